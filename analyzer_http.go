@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+const (
+	analyzerHTTP = "http"
+	// trace references kept per flow and reporting interval.
+	maxFlowTraces = 10
+)
+
+var (
+	httpMethods = [][]byte{
+		[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+		[]byte("HEAD "), []byte("PATCH "), []byte("OPTIONS "),
+	}
+	headerTraceparent = []byte("\r\ntraceparent:")
+	headersEnd        = []byte("\r\n\r\n")
+)
+
+// TraceRef links a flow's RTT at some point in time to a W3C trace context,
+// as found in a plaintext HTTP request.
+type TraceRef struct {
+	TraceID string
+	SpanID  string
+	TS      int64  // capture timestamp
+	RTT     uint64 // flow RTT at the time, if sampled yet
+}
+
+// parseTraceparent extracts the trace and parent (span) ids off the
+// traceparent header of an HTTP request starting in payload, eg.
+// traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(payload []byte) (traceID, spanID string, ok bool) {
+	isRequest := false
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, m) {
+			isRequest = true
+			break
+		}
+	}
+	if !isRequest {
+		return "", "", false
+	}
+
+	if end := bytes.Index(payload, headersEnd); end >= 0 {
+		payload = payload[:end+2]
+	}
+	// header names are case insensitive.
+	idx := bytes.Index(bytes.ToLower(payload), headerTraceparent)
+	if idx < 0 {
+		return "", "", false
+	}
+	value := payload[idx+len(headerTraceparent):]
+	if eol := bytes.IndexByte(value, '\r'); eol >= 0 {
+		value = value[:eol]
+	}
+	parts := bytes.Split(bytes.TrimSpace(value), []byte("-"))
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	for _, p := range parts[1:3] {
+		if _, err := hex.DecodeString(string(p)); err != nil {
+			return "", "", false
+		}
+	}
+	// all zeroes is invalid.
+	if bytes.Count(parts[1], []byte("0")) == len(parts[1]) {
+		return "", "", false
+	}
+	return string(bytes.ToLower(parts[1])), string(bytes.ToLower(parts[2])), true
+}
+
+// AddTrace records a trace reference - call holding the flow's lock.
+func (t *TCPAccounting) AddTrace(traceID, spanID string, ts int64) {
+	if len(t.Traces) >= maxFlowTraces {
+		return
+	}
+	t.Traces = append(t.Traces, TraceRef{TraceID: traceID, SpanID: spanID, TS: ts, RTT: t.Last})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		payload string
+		trace   string
+		span    string
+		ok      bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: foo\r\nTraceparent: 00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01\r\n\r\n",
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"POST /api HTTP/1.1\r\ntraceparent:00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n\r\n{}",
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		// responses, bodies, bad ids.
+		{"HTTP/1.1 200 OK\r\ntraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n", "", "", false},
+		{"GET / HTTP/1.1\r\nHost: foo\r\n\r\ntraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n", "", "", false},
+		{"GET / HTTP/1.1\r\ntraceparent: 00-00000000000000000000000000000000-00f067aa0ba902b7-01\r\n\r\n", "", "", false},
+		{"GET / HTTP/1.1\r\ntraceparent: 00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01\r\n\r\n", "", "", false},
+	}
+
+	for _, test := range tests {
+		trace, span, ok := parseTraceparent([]byte(test.payload))
+		if ok != test.ok || trace != test.trace || span != test.span {
+			t.Fatalf("Expected (%q, %q, %v) parsing %q, got (%q, %q, %v)", test.trace, test.span, test.ok, test.payload, trace, span, ok)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnnotationConfig attaches tags, eg. incident:INC-1234 or canary:true, to
+// the flows to some destinations (IPs, CIDRs, hostnames or peer group names)
+// or to single flows (src:port-dst:port, as logged), until end (RFC3339) if
+// set, to correlate their metrics with experiments and incidents.
+type AnnotationConfig struct {
+	Destinations []string `json:"destinations,omitempty"`
+	Flows        []string `json:"flows,omitempty"`
+	Tags         []string `json:"tags"`
+	End          string   `json:"end,omitempty"`
+}
+
+type annotation struct {
+	ID    int
+	cfg   AnnotationConfig
+	end   time.Time // zero if open-ended
+	nets  []*net.IPNet
+	names map[string]bool
+	flows map[string]bool
+}
+
+// annotationStore holds the annotations set through the control API, shared
+// by all reporters.
+type annotationStore struct {
+	sync.RWMutex
+	annotations []*annotation
+	next        int
+}
+
+// annotations is the process-wide store, populated from the control API.
+var annotations = newAnnotationStore()
+
+func newAnnotationStore() *annotationStore {
+	return &annotationStore{next: 1}
+}
+
+func newAnnotation(cfg AnnotationConfig) (*annotation, error) {
+	if len(cfg.Destinations) == 0 && len(cfg.Flows) == 0 {
+		return nil, errors.New("No destinations or flows to annotate.")
+	}
+	if len(cfg.Tags) == 0 {
+		return nil, errors.New("No tags in annotation.")
+	}
+	for _, tag := range cfg.Tags {
+		if i := strings.Index(tag, ":"); i <= 0 || i == len(tag)-1 {
+			return nil, fmt.Errorf("Bad annotation tag %q, expected key:value.", tag)
+		}
+	}
+	a := &annotation{cfg: cfg, names: make(map[string]bool), flows: make(map[string]bool)}
+	if cfg.End != "" {
+		var err error
+		if a.end, err = time.Parse(time.RFC3339, cfg.End); err != nil {
+			return nil, fmt.Errorf("Bad annotation end %q.", cfg.End)
+		}
+	}
+	for _, d := range cfg.Destinations {
+		if ipnet, err := parseIPNet(d); err == nil {
+			a.nets = append(a.nets, ipnet)
+		} else {
+			a.names[d] = true
+		}
+	}
+	for _, f := range cfg.Flows {
+		key, err := parseFlowKey(f)
+		if err != nil {
+			return nil, err
+		}
+		a.flows[key] = true
+	}
+	return a, nil
+}
+
+// parseFlowKey normalizes a flow, src:port-dst:port with IPv6 addresses in
+// brackets, the way flows are keyed.
+func parseFlowKey(s string) (string, error) {
+	if ends := strings.Split(s, "-"); len(ends) == 2 {
+		src, srcOK := flowEndpoint(ends[0])
+		dst, dstOK := flowEndpoint(ends[1])
+		if srcOK && dstOK {
+			return src + "-" + dst, nil
+		}
+	}
+	return "", fmt.Errorf("Bad flow %q, expected src:port-dst:port.", s)
+}
+
+func flowEndpoint(s string) (string, bool) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil || ip == nil {
+		return "", false
+	}
+	return net.JoinHostPort(ip.String(), port), true
+}
+
+// flowKey returns a flow's key, less any tunnel.
+func flowKey(flow *TCPAccounting) string {
+	return net.JoinHostPort(flow.Src.String(), strconv.Itoa(int(flow.Sport))) + "-" +
+		net.JoinHostPort(flow.Dst.String(), strconv.Itoa(int(flow.Dport)))
+}
+
+// matches returns whether the annotation covers a flow, by its key, or its
+// remote end's (Dst) address or any of the names it is reported under.
+func (a *annotation) matches(key string, ip net.IP, names ...string) bool {
+	if a.flows[key] {
+		return true
+	}
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range names {
+		if a.names[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// Add sets an annotation, returning its ID.
+func (s *annotationStore) Add(cfg AnnotationConfig) (int, error) {
+	a, err := newAnnotation(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	a.ID = s.next
+	s.next++
+	s.annotations = append(s.annotations, a)
+	return a.ID, nil
+}
+
+// Remove drops an annotation, returns false if there was no such annotation.
+func (s *annotationStore) Remove(id int) bool {
+	s.Lock()
+	defer s.Unlock()
+	for i, a := range s.annotations {
+		if a.ID == id {
+			s.annotations = append(s.annotations[:i], s.annotations[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the annotations that have not ended yet, forgetting the rest.
+func (s *annotationStore) List(now time.Time) []AnnotationStatus {
+	s.Lock()
+	defer s.Unlock()
+	current := s.annotations[:0]
+	for _, a := range s.annotations {
+		if a.end.IsZero() || a.end.After(now) {
+			current = append(current, a)
+		}
+	}
+	s.annotations = current
+
+	status := make([]AnnotationStatus, 0, len(current))
+	for _, a := range current {
+		status = append(status, AnnotationStatus{ID: a.ID, AnnotationConfig: a.cfg})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+// Tags returns the tags of the annotations covering a flow at the time, its
+// remote end (Dst) reported under names.
+func (s *annotationStore) Tags(now time.Time, flow *TCPAccounting, names ...string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	var tags []string
+	var key string
+	for _, a := range s.annotations {
+		if !a.end.IsZero() && !now.Before(a.end) {
+			continue
+		}
+		if key == "" && len(a.flows) > 0 {
+			key = flowKey(flow)
+		}
+		if a.matches(key, flow.Dst, names...) {
+			tags = append(tags, a.cfg.Tags...)
+		}
+	}
+	return tags
+}
+
+// annotationTags returns the tags a flow is annotated with, by flow, address,
+// hostname or peer group. Call holding the flow lock.
+func (r *Client) annotationTags(flow *TCPAccounting) []string {
+	if r.notes == nil {
+		return nil
+	}
+	names := []string{r.hostname(flow.Dst)}
+	if group, ok := r.peerGroup(flow); ok {
+		names = append(names, group)
+	}
+	return r.notes.Tags(time.Now(), flow, names...)
+}
+
+// AnnotationStatus is an annotation as reported by the control API.
+type AnnotationStatus struct {
+	ID int `json:"id"`
+	AnnotationConfig
+}
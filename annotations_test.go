@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnnotations(t *testing.T) {
+	s := newAnnotationStore()
+	r := &Client{notes: s, enrich: &EnrichmentPipeline{}}
+	flow := &TCPAccounting{Src: net.ParseIP("10.0.0.1"), Sport: 40000, Dst: net.ParseIP("10.1.4.1"), Dport: 443}
+	other := &TCPAccounting{Src: net.ParseIP("10.0.0.1"), Sport: 40001, Dst: net.ParseIP("10.1.4.1"), Dport: 443}
+
+	if _, err := s.Add(AnnotationConfig{Destinations: []string{"10.1.4.0/24"}, Tags: []string{"incident:INC-1234"}}); err != nil {
+		t.Fatalf("Unexpected error adding annotation: %v", err)
+	}
+	if _, err := s.Add(AnnotationConfig{Flows: []string{"10.0.0.1:40000-10.1.4.1:443"}, Tags: []string{"canary:true"}}); err != nil {
+		t.Fatalf("Unexpected error adding annotation: %v", err)
+	}
+	ended := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if _, err := s.Add(AnnotationConfig{Destinations: []string{"10.1.4.1"}, Tags: []string{"experiment:old"}, End: ended}); err != nil {
+		t.Fatalf("Unexpected error adding annotation: %v", err)
+	}
+
+	if tags := r.annotationTags(flow); !reflect.DeepEqual(tags, []string{"incident:INC-1234", "canary:true"}) {
+		t.Fatalf("Unexpected flow annotations: %v", tags)
+	}
+	if tags := r.annotationTags(other); !reflect.DeepEqual(tags, []string{"incident:INC-1234"}) {
+		t.Fatalf("Unexpected destination annotations: %v", tags)
+	}
+	if status := s.List(time.Now()); len(status) != 2 {
+		t.Fatalf("Expected ended annotations to be forgotten, got %+v", status)
+	}
+
+	for _, cfg := range []AnnotationConfig{
+		{Tags: []string{"canary:true"}},
+		{Destinations: []string{"10.1.4.1"}},
+		{Destinations: []string{"10.1.4.1"}, Tags: []string{"canary"}},
+		{Flows: []string{"10.0.0.1-10.1.4.1"}, Tags: []string{"canary:true"}},
+	} {
+		if _, err := s.Add(cfg); err == nil {
+			t.Fatalf("Expected bad annotation to be rejected: %+v", cfg)
+		}
+	}
+}
+
+func TestControlAnnotations(t *testing.T) {
+	c := NewControlServer("127.0.0.1:0", newMaintenanceSchedule(), nil)
+	c.notes = newAnnotationStore()
+	srv := httptest.NewServer(c.srv.Handler)
+	defer srv.Close()
+
+	body, _ := json.Marshal(AnnotationConfig{Flows: []string{"[2001:db8::1]:40000-[2001:db8::2]:443"}, Tags: []string{"canary:true"}})
+	resp, err := http.Post(srv.URL+"/annotations", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unexpected error annotating: %v", err)
+	}
+	var created map[string]int
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created["id"] != 1 {
+		t.Fatalf("Unexpected response annotating: %d %v", resp.StatusCode, created)
+	}
+
+	resp, err = http.Get(srv.URL + "/annotations")
+	if err != nil {
+		t.Fatalf("Unexpected error listing annotations: %v", err)
+	}
+	var status []AnnotationStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if len(status) != 1 || status[0].Tags[0] != "canary:true" {
+		t.Fatalf("Unexpected annotations: %+v", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/annotations/1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error removing annotation: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(c.notes.List(time.Now())) != 0 {
+		t.Fatalf("Expected annotation to be removed, got %d", resp.StatusCode)
+	}
+}
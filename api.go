@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	defaultAPIURL      = "https://api.datadoghq.com"
+	apiSeriesPath      = "/api/v1/series"
+	apiTimeout         = 10
+	apiMaxPending      = 100000
+	reporterStatsd     = "statsd"
+	reporterDatadogAPI = "api"
+)
+
+type apiSeries struct {
+	Metric string       `json:"metric"`
+	Points [][2]float64 `json:"points"`
+	Type   string       `json:"type"`
+	Tags   []string     `json:"tags,omitempty"`
+}
+
+type apiPayload struct {
+	Series []apiSeries `json:"series"`
+}
+
+// APIClient submits metrics straight to the Datadog API. Unlike dogstatsd the
+// API accepts the timestamp of each point, so samples submitted late (offline
+// pcaps, retries after an outage) land at the time they were observed.
+type APIClient struct {
+	sync.Mutex
+	url     string
+	key     string
+	client  *http.Client
+	pending []apiSeries
+	spool   *diskSpool // failed submissions go here rather than pending, if set
+}
+
+func NewAPIClient(url, key string) *APIClient {
+	if url == "" {
+		url = defaultAPIURL
+	}
+	a := &APIClient{
+		url:    url + apiSeriesPath,
+		key:    key,
+		client: &http.Client{Timeout: apiTimeout * time.Second},
+	}
+	return a
+}
+
+// Gauge queues a point, ts in seconds since the epoch.
+func (a *APIClient) Gauge(metric string, value float64, tags []string, ts int64) {
+	a.add(metric, "gauge", value, tags, ts)
+}
+
+func (a *APIClient) Count(metric string, value float64, tags []string, ts int64) {
+	a.add(metric, "count", value, tags, ts)
+}
+
+func (a *APIClient) add(metric, mtype string, value float64, tags []string, ts int64) {
+	a.Lock()
+	a.pending = append(a.pending, apiSeries{
+		Metric: metric,
+		Points: [][2]float64{{float64(ts), value}},
+		Type:   mtype,
+		Tags:   tags,
+	})
+	if len(a.pending) > apiMaxPending {
+		log.Warnf("Too many metrics pending submission, dropping %d oldest.", len(a.pending)-apiMaxPending)
+		a.pending = a.pending[len(a.pending)-apiMaxPending:]
+	}
+	a.Unlock()
+}
+
+// Flush posts all pending points. On failure the points are kept so they are
+// retried - with their original timestamps - on the next flush, spooled to
+// disk if configured. Spooled points are replayed once submissions succeed.
+func (a *APIClient) Flush() error {
+	a.Lock()
+	series := a.pending
+	a.pending = nil
+	a.Unlock()
+
+	if len(series) == 0 {
+		return a.replay()
+	}
+
+	body, err := json.Marshal(apiPayload{Series: series})
+	if err != nil {
+		return err
+	}
+	err = a.post(body)
+	if err != nil {
+		if a.spool != nil {
+			serr := a.spool.push(body)
+			if serr == nil {
+				return err
+			}
+			log.Errorf("Unable to spool %d series, keeping them in memory: %v", len(series), serr)
+		}
+		a.Lock()
+		a.pending = append(series, a.pending...)
+		a.Unlock()
+		return err
+	}
+	log.Debugf("Submitted %d series to the API.", len(series))
+	return a.replay()
+}
+
+// replay submits what was spooled while the API was unreachable.
+func (a *APIClient) replay() error {
+	if a.spool == nil {
+		return nil
+	}
+	return a.spool.replay(a.post)
+}
+
+func (a *APIClient) post(body []byte) error {
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", a.key)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{"API submission", resp.StatusCode, resp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// BGPConfig enables tagging external destinations with the route they're
+// reached by, looked up in a RIB dump. The dump is reloaded when it changes,
+// so it may be refreshed periodically off a route server, eg. with
+// `gobgp global rib -a ipv4` or `bgpdump -m` of its MRT table dumps.
+type BGPConfig struct {
+	RIB string `yaml:"rib"`
+}
+
+func (c *BGPConfig) validate() error {
+	if c.RIB == "" {
+		return errors.New("Error parsing configuration - bgp rib is required.")
+	}
+	return nil
+}
+
+// bgpRoute is the best route to a prefix.
+type bgpRoute struct {
+	prefix   string
+	origin   uint32 // last AS on the path
+	upstream uint32 // first AS on the path, our neighbor
+}
+
+// ribTable is a longest-prefix-match table of routes, by prefix length.
+type ribTable struct {
+	sync.RWMutex
+	path    string
+	routes  map[int]map[string]bgpRoute
+	lengths []int // present prefix lengths, longest first
+	loaded  time.Time
+	loading bool
+}
+
+func newRIBTable(cfg *BGPConfig) (*ribTable, error) {
+	t := &ribTable{path: cfg.RIB}
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.load(fi.ModTime()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// refresh reloads the RIB dump in the background if it changed since it was
+// last loaded.
+func (t *ribTable) refresh() {
+	if t == nil {
+		return
+	}
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		log.Warnf("Unable to check RIB dump %q: %v", t.path, err)
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.loading || !fi.ModTime().After(t.loaded) {
+		return
+	}
+	t.loading = true
+	go func() {
+		if err := t.load(fi.ModTime()); err != nil {
+			log.Errorf("Unable to reload RIB dump %q: %v", t.path, err)
+		}
+		t.Lock()
+		t.loading = false
+		t.Unlock()
+	}()
+}
+
+func (t *ribTable) load(mtime time.Time) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	routes, err := parseRIB(f)
+	if err != nil {
+		return err
+	}
+	byLength := make(map[int]map[string]bgpRoute)
+	for n, route := range routes {
+		bits, _ := n.Mask.Size()
+		if len(n.IP) == net.IPv4len {
+			// looked up as 16 byte addresses.
+			bits += 96
+		}
+		if byLength[bits] == nil {
+			byLength[bits] = make(map[string]bgpRoute)
+		}
+		byLength[bits][string(n.IP.To16())] = route
+	}
+	var lengths []int
+	for bits := 8 * net.IPv6len; bits >= 0; bits-- {
+		if _, ok := byLength[bits]; ok {
+			lengths = append(lengths, bits)
+		}
+	}
+
+	t.Lock()
+	t.routes, t.lengths, t.loaded = byLength, lengths, mtime
+	t.Unlock()
+	log.Infof("Loaded %d routes from RIB dump %q", len(routes), t.path)
+	return nil
+}
+
+// lookup returns the most specific route to ip.
+func (t *ribTable) lookup(ip net.IP) (bgpRoute, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return bgpRoute{}, false
+	}
+	v4 := ip.To4() != nil
+	t.RLock()
+	defer t.RUnlock()
+	for _, bits := range t.lengths {
+		if v4 && bits < 8*(net.IPv6len-net.IPv4len) {
+			break
+		}
+		key := string(ip.Mask(net.CIDRMask(bits, 8*net.IPv6len)))
+		if route, ok := t.routes[bits][key]; ok {
+			return route, true
+		}
+	}
+	return bgpRoute{}, false
+}
+
+// tags returns the route tags for a flow's remote end (Dst), if external.
+func (t *ribTable) tags(flow *TCPAccounting) []string {
+	if t == nil || !flow.External {
+		return nil
+	}
+	route, ok := t.lookup(flow.Dst)
+	if !ok {
+		return nil
+	}
+	return []string{
+		"bgp_prefix:" + route.prefix,
+		"bgp_origin_as:" + strconv.FormatUint(uint64(route.origin), 10),
+		"bgp_upstream_as:" + strconv.FormatUint(uint64(route.upstream), 10),
+	}
+}
+
+// parseRIB reads a RIB dump, either `bgpdump -m` output:
+//
+//	TABLE_DUMP2|1700000000|B|192.0.2.1|64500|203.0.113.0/24|64500 64501|IGP|...
+//
+// or lines holding a prefix followed by its AS path, which covers
+// `gobgp global rib` output:
+//
+//	*> 203.0.113.0/24       192.0.2.1       64500 64501     00:10:00   [{Origin: i}]
+//
+// The first route seen for a prefix wins. Lines without one are skipped.
+func parseRIB(r io.Reader) (map[*net.IPNet]bgpRoute, error) {
+	routes := make(map[*net.IPNet]bgpRoute)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var prefix string
+		var path []string
+		if fields := strings.Split(scanner.Text(), "|"); len(fields) >= 7 {
+			prefix, path = fields[5], strings.Fields(fields[6])
+		} else {
+			prefix, path = ribLine(strings.Fields(scanner.Text()))
+		}
+		_, n, err := net.ParseCIDR(prefix)
+		if err != nil || seen[n.String()] {
+			continue
+		}
+		asns := asPath(path)
+		if len(asns) == 0 {
+			continue
+		}
+		seen[n.String()] = true
+		routes[n] = bgpRoute{prefix: n.String(), origin: asns[len(asns)-1], upstream: asns[0]}
+	}
+	return routes, scanner.Err()
+}
+
+// ribLine picks the prefix and AS path out of a whitespace separated line:
+// the first CIDR, then the run of AS numbers after it, skipping next hops.
+func ribLine(fields []string) (string, []string) {
+	for i, f := range fields {
+		if _, _, err := net.ParseCIDR(f); err != nil {
+			continue
+		}
+		rest := fields[i+1:]
+		for len(rest) > 0 && net.ParseIP(rest[0]) != nil {
+			rest = rest[1:]
+		}
+		end := 0
+		for end < len(rest) && len(asPath(rest[end:end+1])) == 1 {
+			end++
+		}
+		return f, rest[:end]
+	}
+	return "", nil
+}
+
+// asPath parses AS numbers, flattening AS sets ({64500,64501}) to their
+// first member.
+func asPath(path []string) []uint32 {
+	var asns []uint32
+	for _, as := range path {
+		as = strings.TrimPrefix(strings.TrimPrefix(as, "{"), "AS")
+		if i := strings.IndexAny(as, ",}"); i >= 0 {
+			as = as[:i]
+		}
+		n, err := strconv.ParseUint(as, 10, 32)
+		if err != nil {
+			return asns
+		}
+		asns = append(asns, uint32(n))
+	}
+	return asns
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRIBTable(t *testing.T) {
+	f, err := ioutil.TempFile("", "metro-rib")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`TABLE_DUMP2|1700000000|B|192.0.2.1|64500|203.0.113.0/24|64500 64510 64520|IGP|192.0.2.1|0|0||NAG||
+TABLE_DUMP2|1700000000|B|192.0.2.2|64501|203.0.113.0/24|64501 64520|IGP|192.0.2.2|0|0||NAG||
+   Network              Next Hop             AS_PATH              Age        Attrs
+*> 203.0.0.0/16         192.0.2.1            64500 {64530,64531}  00:10:00   [{Origin: i}]
+*> 2001:db8::/32        2001:db8:ffff::1     64502 64540          00:10:00   [{Origin: i}]
+*> ::/0                 2001:db8:ffff::1     64502                00:10:00   [{Origin: i}]
+`)
+	f.Close()
+
+	if err := (&BGPConfig{}).validate(); err == nil {
+		t.Fatalf("Expected bgp without a rib to be rejected")
+	}
+	rib, err := newRIBTable(&BGPConfig{RIB: f.Name()})
+	if err != nil {
+		t.Fatalf("Unexpected error loading RIB: %v", err)
+	}
+
+	cases := map[string]bgpRoute{
+		"203.0.113.7": {prefix: "203.0.113.0/24", origin: 64520, upstream: 64500},
+		"203.0.1.1":   {prefix: "203.0.0.0/16", origin: 64530, upstream: 64500},
+		"2001:db8::1": {prefix: "2001:db8::/32", origin: 64540, upstream: 64502},
+		"2001:db9::1": {prefix: "::/0", origin: 64502, upstream: 64502},
+	}
+	for ip, expected := range cases {
+		if route, ok := rib.lookup(net.ParseIP(ip)); !ok || route != expected {
+			t.Fatalf("Unexpected route to %s: %+v", ip, route)
+		}
+	}
+	if route, ok := rib.lookup(net.ParseIP("198.51.100.1")); ok {
+		t.Fatalf("Unexpected route to an IPv4 address off the IPv6 default: %+v", route)
+	}
+
+	flow := &TCPAccounting{Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("203.0.113.7")}
+	if tags := rib.tags(flow); tags != nil {
+		t.Fatalf("Expected internal flows to be left alone, got %v", tags)
+	}
+	flow.External = true
+	expected := []string{"bgp_prefix:203.0.113.0/24", "bgp_origin_as:64520", "bgp_upstream_as:64500"}
+	if tags := rib.tags(flow); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Unexpected route tags: %v", tags)
+	}
+	if tags := (*ribTable)(nil).tags(flow); tags != nil {
+		t.Fatalf("Expected no route tags when off, got %v", tags)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	clockCalibrationReport = "report"
+	clockCalibrationApply  = "apply"
+
+	calibrationInterval = 30 * time.Second
+	// probes not captured within this long are given up on.
+	calibrationTimeout = time.Second
+	// drift is only computed over at least this long.
+	calibrationMinSpan = 5 * time.Minute
+	// the probe datagram: a harmless statsd counter of the probes sent.
+	calibrationProbe = "go_metro.capture.calibration_probes:1|c"
+)
+
+var errCalibrationLoopback = errors.New("Statsd is on a loopback address, its traffic can't be captured for clock calibration.")
+
+// clockCalibration checks the timestamps of the capture (libpcap, NIC
+// hardware clocks...) against the kernel's clock: it sends probe datagrams to
+// statsd through the sniffed interface, and compares the capture timestamps
+// of the probes with when they were sent. It reports the offset of the
+// capture clock and its drift relative to CLOCK_MONOTONIC and, if set to
+// apply, corrects capture timestamps by the offset.
+type clockCalibration struct {
+	sync.Mutex
+	conn    net.Conn
+	local   *net.UDPAddr
+	apply   bool
+	sent    time.Time // outstanding probe, zero if none
+	first   time.Time // first probe captured, as sent...
+	firstTS time.Time // ...and captured
+	offset  time.Duration
+	drift   float64 // ppm
+	samples int
+	next    time.Time     // next probe
+	applied time.Duration // offset subtracted from the packet being handled
+}
+
+func newClockCalibration(mode string, statsd string) (*clockCalibration, error) {
+	conn, err := net.Dial("udp", statsd)
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if local.IP.IsLoopback() {
+		conn.Close()
+		return nil, errCalibrationLoopback
+	}
+	return &clockCalibration{conn: conn, local: local, apply: mode == clockCalibrationApply}, nil
+}
+
+// filter matches the probes, for the capture filter.
+func (c *clockCalibration) filter() string {
+	return fmt.Sprintf("udp and src host %s and src port %d", c.local.IP, c.local.Port)
+}
+
+// probe sends a probe if it's time to.
+func (c *clockCalibration) probe(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if now.Before(c.next) || (!c.sent.IsZero() && now.Sub(c.sent) < calibrationTimeout) {
+		return
+	}
+	c.next = now.Add(jittered(calibrationInterval))
+	c.sent = time.Now()
+	if _, err := c.conn.Write([]byte(calibrationProbe)); err != nil {
+		log.Debugf("Unable to send clock calibration probe: %v", err)
+		c.sent = time.Time{}
+	}
+}
+
+// correct applies the capture clock offset to a packet timestamp, if set to.
+func (c *clockCalibration) correct(ts time.Time) time.Time {
+	if c == nil {
+		return ts
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.applied = 0
+	if c.apply && c.samples > 0 {
+		c.applied = c.offset
+	}
+	return ts.Add(-c.applied)
+}
+
+// captured tells whether a datagram is our outstanding probe, accounting for
+// its capture timestamp if so.
+func (c *clockCalibration) captured(src net.IP, sport layers.UDPPort, ts time.Time) bool {
+	if c == nil || int(sport) != c.local.Port || !src.Equal(c.local.IP) {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.sent.IsZero() {
+		return true
+	}
+	raw := ts.Add(c.applied)
+	offset := raw.Sub(c.sent)
+	if c.samples == 0 {
+		c.offset = offset
+		c.first, c.firstTS = c.sent, raw
+	} else {
+		c.offset -= c.offset / 8
+		c.offset += offset / 8
+	}
+	// capture vs monotonic clock elapsed time since the first probe.
+	if span := c.sent.Sub(c.first); span >= calibrationMinSpan {
+		c.drift = float64(raw.Sub(c.firstTS)-span) / float64(span) * 1e6
+	}
+	c.samples++
+	c.sent = time.Time{}
+	return true
+}
+
+// report submits the capture clock offset (ms) and drift (ppm).
+func (c *clockCalibration) report(r *Client) {
+	if c == nil || r == nil {
+		return
+	}
+	c.Lock()
+	samples, offset, drift := c.samples, c.offset, c.drift
+	c.Unlock()
+	if samples == 0 {
+		return
+	}
+	ts := time.Now().Unix()
+	r.submit("calibration", "go_metro.capture.clock_offset", float64(offset)/float64(time.Millisecond), r.tags, false, ts)
+	if drift != 0 {
+		// only once measured over calibrationMinSpan.
+		r.submit("calibration", "go_metro.capture.clock_drift", drift, r.tags, false, ts)
+	}
+}
+
+func (c *clockCalibration) Close() {
+	if c != nil {
+		c.conn.Close()
+	}
+}
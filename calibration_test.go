@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClockCalibration(t *testing.T) {
+	local := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	c := &clockCalibration{local: local, apply: true}
+
+	// the capture clock runs 2ms ahead.
+	sent := time.Now()
+	c.sent = sent
+	if c.captured(net.ParseIP("10.0.0.2"), 40000, sent) {
+		t.Fatalf("Expected a datagram from another host not to be a probe")
+	}
+	ts := c.correct(sent.Add(2 * time.Millisecond))
+	if !c.captured(local.IP, 40000, ts) {
+		t.Fatalf("Expected our probe to be recognised")
+	}
+	if c.samples != 1 || c.offset != 2*time.Millisecond {
+		t.Fatalf("Unexpected calibration: %d samples, offset %v", c.samples, c.offset)
+	}
+
+	// subsequent timestamps are corrected, the offset still measured off the
+	// raw ones.
+	sent = sent.Add(calibrationMinSpan)
+	c.sent = sent
+	ts = c.correct(sent.Add(2*time.Millisecond + 60*time.Microsecond))
+	if !ts.Equal(sent.Add(60 * time.Microsecond)) {
+		t.Fatalf("Expected timestamp corrected by the offset, got %v off", ts.Sub(sent))
+	}
+	c.captured(local.IP, 40000, ts)
+	if c.offset <= 2*time.Millisecond || c.drift <= 0 {
+		t.Fatalf("Expected offset and drift to grow, got %v and %.2f ppm", c.offset, c.drift)
+	}
+}
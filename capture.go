@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// autoInterface picks the interface carrying the default route, or with
+// "auto:<cidr>" the one holding an address within cidr.
+const autoInterface = "auto"
+
+// errBPFUnsupported is returned by capture handles unable to compile BPF
+// expressions (ie. no libpcap) - the sniffer falls back to userspace filtering.
+var errBPFUnsupported = errors.New("BPF filter expressions unsupported by capture handle")
+
+var errNoPcapFiles = errors.New("No pcap files found.")
+
+// errReadTimeout is returned by handles reading packets off a goroutine when
+// none came in for readPollTimeout, so the sniffer gets to check for shutdown.
+var errReadTimeout = errors.New("Timeout reading packets.")
+
+const readPollTimeout = time.Second
+
+// CaptureSource is what the sniffer needs from a packet source. Live sources
+// are opened by the capture backend the instance selects (libpcap, or pcapgo's
+// AF_PACKET on Linux when built with the nopcap tag - no cgo required - and
+// DPDK), offline ones off pcap/pcapng files. Tests can hand the sniffer their
+// own with SetPcapHandle.
+type CaptureSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	SetBPFFilter(expr string) error
+	Stats() (CaptureStats, error)
+	Close()
+}
+
+// CaptureStats are a source's packet counters since it was opened.
+type CaptureStats struct {
+	Received uint64
+	Dropped  uint64 // by the kernel or the backend, for lack of buffer space
+}
+
+// captureBackends open live capture sources, by name. Each build registers
+// those it supports.
+var captureBackends = make(map[string]func(d *MetroSniffer) (CaptureSource, error))
+
+// defaultCaptureBackend is used by instances not selecting one.
+var defaultCaptureBackend string
+
+func registerCaptureBackend(name string, open func(d *MetroSniffer) (CaptureSource, error)) {
+	captureBackends[name] = open
+}
+
+func captureBackendNames() []string {
+	names := make([]string, 0, len(captureBackends))
+	for name := range captureBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openCapture opens a live capture source with the instance's backend -
+// DPDK for DPDK ports.
+func (d *MetroSniffer) openCapture() (CaptureSource, error) {
+	name := d.config.Capture
+	if name == "" && isDPDKInterface(d.Iface) {
+		name = dpdkInterface
+	} else if name == "" {
+		name = defaultCaptureBackend
+	}
+	open, ok := captureBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("Capture backend %q unavailable in this build, try one of: %s", name, strings.Join(captureBackendNames(), ", "))
+	}
+	d.backend = name
+	return open(d)
+}
+
+type captureInterface struct {
+	Name        string
+	Description string
+	Addresses   []net.IP
+}
+
+// Matches tells whether name designates the interface, by device name or - as
+// Npcap device names are unwieldy GUIDs on Windows - by description.
+func (i *captureInterface) Matches(name string) bool {
+	return i.Name == name || (i.Description != "" && strings.EqualFold(i.Description, name))
+}
+
+func isAutoInterface(name string) bool {
+	return name == autoInterface || strings.HasPrefix(name, autoInterface+":")
+}
+
+// resolveAutoInterface finds the interface an "auto" interface spec stands for.
+func resolveAutoInterface(spec string, ifaces []captureInterface) (string, error) {
+	var match func(net.IP) bool
+	if cidr := strings.TrimPrefix(spec, autoInterface+":"); cidr != spec {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", err
+		}
+		match = ipnet.Contains
+	} else {
+		// no packets are sent, this just has the kernel pick the route.
+		conn, err := net.Dial("udp", "8.8.8.8:53")
+		if err != nil {
+			return "", err
+		}
+		local := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		match = local.Equal
+	}
+
+	for i := range ifaces {
+		for _, addr := range ifaces[i].Addresses {
+			if match(addr) {
+				return ifaces[i].Name, nil
+			}
+		}
+	}
+	return "", errors.New("No interface found for " + spec)
+}
+
+// openOffline opens a pcap or pcapng capture file.
+func openOffline(path string) (CaptureSource, error) {
+	ng, err := isPcapng(path)
+	if err != nil {
+		return nil, err
+	}
+	if ng {
+		return openPcapng(path)
+	}
+	return openPcap(path)
+}
+
+// pcapFiles expands the pcap setting of an offline instance: a file, a
+// directory (all files within, sorted) or a glob.
+func pcapFiles(pattern string) ([]string, error) {
+	info, err := os.Stat(pattern)
+	if err == nil && info.IsDir() {
+		entries, err := ioutil.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, e := range entries {
+			if e.Mode().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(pattern, e.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, errNoPcapFiles
+		}
+		return files, nil
+	} else if err == nil {
+		return []string{pattern}, nil
+	}
+
+	files, gerr := filepath.Glob(pattern)
+	if gerr != nil {
+		return nil, gerr
+	}
+	if len(files) == 0 {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
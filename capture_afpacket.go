@@ -0,0 +1,160 @@
+//go:build nopcap && linux
+// +build nopcap,linux
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/sys/unix"
+)
+
+type afpacketPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+// afpacketHandle wraps pcapgo's (pure-Go) AF_PACKET socket. Reads on it block
+// so they're done from a goroutine, letting the sniffer time out and check
+// for shutdown/refreshes as it does with libpcap. The goroutine polls the
+// socket before reading, so it notices the handle closing and exits before
+// the socket is.
+type afpacketHandle struct {
+	*pcapgo.EthernetHandle
+	fd      int
+	packets chan afpacketPacket
+	done    chan struct{}
+	exited  chan struct{}
+	stats   CaptureStats
+}
+
+func (h *afpacketHandle) read() {
+	defer close(h.exited)
+	fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-h.done:
+			return
+		default:
+		}
+		n, err := unix.Poll(fds, int(readPollTimeout/time.Millisecond))
+		if n == 0 || err == unix.EINTR {
+			continue
+		}
+		var data []byte
+		var ci gopacket.CaptureInfo
+		if err == nil {
+			data, ci, err = h.EthernetHandle.ReadPacketData()
+		}
+		select {
+		case h.packets <- afpacketPacket{data, ci, err}:
+		case <-h.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (h *afpacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case p := <-h.packets:
+		return p.data, p.ci, p.err
+	case <-time.After(readPollTimeout):
+		return nil, gopacket.CaptureInfo{}, errReadTimeout
+	}
+}
+
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// Stats accumulates the socket's counters, which the kernel resets on read.
+func (h *afpacketHandle) Stats() (CaptureStats, error) {
+	s, err := h.EthernetHandle.Stats()
+	if err != nil {
+		return h.stats, err
+	}
+	h.stats.Received += uint64(s.Packets)
+	h.stats.Dropped += uint64(s.Drops)
+	return h.stats, nil
+}
+
+func (h *afpacketHandle) SetBPFFilter(expr string) error {
+	return errBPFUnsupported
+}
+
+// Close waits for the reader to be done with the socket, at most a poll
+// timeout, before closing it: it'd otherwise read off a closed, maybe reused
+// descriptor.
+func (h *afpacketHandle) Close() {
+	close(h.done)
+	<-h.exited
+	h.EthernetHandle.Close()
+}
+
+// socketFD digs the socket out of pcapgo's handle, which doesn't expose it.
+func socketFD(eth *pcapgo.EthernetHandle) (int, error) {
+	fd := reflect.ValueOf(eth).Elem().FieldByName("fd")
+	if fd.Kind() != reflect.Int {
+		return -1, errors.New("Unable to find the socket of pcapgo's handle.")
+	}
+	return int(fd.Int()), nil
+}
+
+func init() {
+	registerCaptureBackend("afpacket", (*MetroSniffer).openLive)
+	defaultCaptureBackend = "afpacket"
+}
+
+func isTimeout(err error) bool {
+	return err == errReadTimeout
+}
+
+func (d *MetroSniffer) openLive() (CaptureSource, error) {
+	if d.TSSource != "" {
+		log.Warnf("Timestamp source selection unsupported by afpacket capture on %q, using default.", d.Iface)
+	}
+
+	eth, err := pcapgo.NewEthernetHandle(d.Iface)
+	if err != nil {
+		log.Errorf("Unable to open afpacket socket for %q", d.Iface)
+		return nil, err
+	}
+	if d.config.Promisc || d.config.Mirror {
+		if err := eth.SetPromiscuous(true); err != nil {
+			log.Warnf("Unable to set promiscuous mode on %q: %v", d.Iface, err)
+		}
+	}
+	snaplen := d.Snaplen
+	if snaplen <= 0 {
+		snaplen = maxSnaplen
+	}
+	if err := eth.SetCaptureLength(snaplen); err != nil {
+		log.Warnf("Unable to set capture length on %q: %v", d.Iface, err)
+	}
+	fd, err := socketFD(eth)
+	if err != nil {
+		log.Errorf("Unable to poll the afpacket socket for %q", d.Iface)
+		eth.Close()
+		return nil, err
+	}
+
+	h := &afpacketHandle{
+		EthernetHandle: eth,
+		fd:             fd,
+		packets:        make(chan afpacketPacket),
+		done:           make(chan struct{}),
+		exited:         make(chan struct{}),
+	}
+	go h.read()
+	return h, nil
+}
@@ -0,0 +1,22 @@
+//go:build nopcap && !linux
+// +build nopcap,!linux
+
+package main
+
+import (
+	"errors"
+)
+
+func init() {
+	// fails, explaining why.
+	registerCaptureBackend("pcap", (*MetroSniffer).openLive)
+	defaultCaptureBackend = "pcap"
+}
+
+func (d *MetroSniffer) openLive() (CaptureSource, error) {
+	return nil, errors.New("Live capture requires libpcap on this platform - rebuild without the nopcap tag")
+}
+
+func isTimeout(err error) bool {
+	return err == errReadTimeout
+}
@@ -0,0 +1,118 @@
+//go:build !nopcap
+// +build !nopcap
+
+package main
+
+import (
+	"runtime"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func init() {
+	registerCaptureBackend("pcap", (*MetroSniffer).openLive)
+	defaultCaptureBackend = "pcap"
+}
+
+// pcapSource is a libpcap handle, live or offline.
+type pcapSource struct {
+	*pcap.Handle
+}
+
+func (h pcapSource) Stats() (CaptureStats, error) {
+	s, err := h.Handle.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{Received: uint64(s.PacketsReceived), Dropped: uint64(s.PacketsDropped + s.PacketsIfDropped)}, nil
+}
+
+func listInterfaces() ([]captureInterface, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := make([]captureInterface, len(devs))
+	for i := range devs {
+		ifaces[i].Name = devs[i].Name
+		ifaces[i].Description = devs[i].Description
+		for j := range devs[i].Addresses {
+			ifaces[i].Addresses = append(ifaces[i].Addresses, devs[i].Addresses[j].IP)
+		}
+	}
+	return ifaces, nil
+}
+
+func (d *MetroSniffer) openLive() (CaptureSource, error) {
+	inactive, err := pcap.NewInactiveHandle(d.Iface)
+	if err != nil {
+		log.Errorf("Unable to create inactive handle for %q", d.Iface)
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	inactive.SetSnapLen(d.Snaplen)
+	inactive.SetPromisc(d.config.Promisc || d.config.Mirror)
+	inactive.SetTimeout(time.Second)
+	switch runtime.GOOS {
+	case "darwin", "dragonfly", "freebsd", "netbsd", "openbsd":
+		// BPF devices buffer packets until the buffer fills up or the timeout
+		// expires - and on some systems the timeout never fires on an idle
+		// interface, so we'd never get to check whether we should stop.
+		inactive.SetImmediateMode(true)
+	}
+
+	if d.TSSource != "" {
+		d.setTimestampSource(inactive)
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		log.Errorf("Unable to activate %q", d.Iface)
+		return nil, err
+	}
+	return pcapSource{handle}, nil
+}
+
+func isTimeout(err error) bool {
+	return err == pcap.NextErrorTimeoutExpired || err == errReadTimeout
+}
+
+func openPcap(path string) (CaptureSource, error) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, err
+	}
+	return pcapSource{handle}, nil
+}
+
+func compileBPF(link layers.LinkType, snaplen int, expr string) (bpfMatcher, error) {
+	return pcap.NewBPF(link, snaplen, expr)
+}
+
+// Not all OS/NICs will allow selecting the timestamp source - if the configured
+// source isn't available we just log it and stick to the default.
+func (d *MetroSniffer) setTimestampSource(inactive *pcap.InactiveHandle) {
+	source, err := pcap.TimestampSourceFromString(d.TSSource)
+	if err != nil {
+		log.Warnf("Unknown timestamp source %q for %q, using default.", d.TSSource, d.Iface)
+		return
+	}
+
+	supported := inactive.SupportedTimestamps()
+	for i := range supported {
+		if supported[i] == source {
+			if err := inactive.SetTimestampSource(source); err != nil {
+				log.Warnf("Unable to set timestamp source %q for %q: %v", d.TSSource, d.Iface, err)
+			} else {
+				log.Infof("Using timestamp source %q for %q", d.TSSource, d.Iface)
+			}
+			return
+		}
+	}
+	log.Warnf("Timestamp source %q unsupported by %q (available: %v), using default.", d.TSSource, d.Iface, supported)
+}
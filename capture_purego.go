@@ -0,0 +1,72 @@
+//go:build nopcap
+// +build nopcap
+
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Pure-Go capture support, build with -tags nopcap to drop the libpcap (and
+// cgo) dependency. BPF expressions can't be compiled without libpcap, so
+// filtering falls back to userspace whitelisting.
+
+func listInterfaces() ([]captureInterface, error) {
+	nifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := make([]captureInterface, len(nifaces))
+	for i := range nifaces {
+		ifaces[i].Name = nifaces[i].Name
+		addrs, err := nifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for j := range addrs {
+			if ipnet, ok := addrs[j].(*net.IPNet); ok {
+				ifaces[i].Addresses = append(ifaces[i].Addresses, ipnet.IP)
+			}
+		}
+	}
+	return ifaces, nil
+}
+
+type offlineHandle struct {
+	*pcapgo.Reader
+	f *os.File
+}
+
+func (h *offlineHandle) SetBPFFilter(expr string) error {
+	return errBPFUnsupported
+}
+
+func (h *offlineHandle) Stats() (CaptureStats, error) {
+	return CaptureStats{}, nil
+}
+
+func (h *offlineHandle) Close() {
+	h.f.Close()
+}
+
+func openPcap(path string) (CaptureSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &offlineHandle{Reader: r, f: f}, nil
+}
+
+func compileBPF(link layers.LinkType, snaplen int, expr string) (bpfMatcher, error) {
+	return nil, errBPFUnsupported
+}
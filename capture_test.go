@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"gopkg.in/tomb.v2"
+)
+
+func TestPcapFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-metro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"b.pcap", "a.pcap", "c.pcapng", ".hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	all := []string{filepath.Join(dir, "a.pcap"), filepath.Join(dir, "b.pcap"), filepath.Join(dir, "c.pcapng")}
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{dir, all},
+		{filepath.Join(dir, "*.pcap"), all[:2]},
+		{filepath.Join(dir, "b.pcap"), all[1:2]},
+	}
+	for _, test := range tests {
+		files, err := pcapFiles(test.pattern)
+		if err != nil {
+			t.Fatalf("Unexpected error expanding %q: %v", test.pattern, err)
+		}
+		if !reflect.DeepEqual(files, test.expected) {
+			t.Fatalf("Expected %q to expand to %v, got %v", test.pattern, test.expected, files)
+		}
+	}
+
+	if _, err := pcapFiles(filepath.Join(dir, "missing.pcap")); err == nil {
+		t.Fatalf("Expected error for missing file")
+	}
+	if _, err := pcapFiles(filepath.Join(dir, "sub")); err != errNoPcapFiles {
+		t.Fatalf("Expected error for empty directory, got %v", err)
+	}
+}
+
+// sliceSource is an in-memory capture source.
+type sliceSource struct {
+	packets [][]byte
+	ts      time.Time
+	stats   CaptureStats
+	closed  bool
+}
+
+func (s *sliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := s.packets[0]
+	s.packets = s.packets[1:]
+	s.stats.Received++
+	s.ts = s.ts.Add(time.Millisecond)
+	return data, gopacket.CaptureInfo{Timestamp: s.ts, CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func (s *sliceSource) LinkType() layers.LinkType      { return layers.LinkTypeEthernet }
+func (s *sliceSource) SetBPFFilter(expr string) error { return errBPFUnsupported }
+func (s *sliceSource) Stats() (CaptureStats, error)   { return s.stats, nil }
+func (s *sliceSource) Close()                         { s.closed = true }
+
+func TestSniffFilesMerged(t *testing.T) {
+	// a flow spanning two rotated files, an RTT sample in each.
+	dir := t.TempDir()
+	start := time.Now().Truncate(time.Microsecond)
+	var paths []string
+	for i, seq := range []uint32{1000, 1100} {
+		path := filepath.Join(dir, fmt.Sprintf("capture.pcap%d", i))
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := pcapgo.NewWriter(f)
+		w.WriteFileHeader(maxSnaplen, layers.LinkTypeEthernet)
+		tsval := uint32(100 + i)
+		for j, pkt := range [][]byte{
+			ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, seq, 1, tsval, 50, make([]byte, 100)),
+			ipv6Segment(t, "2001:db8::2", "2001:db8::1", 5432, 40000, 1, seq, 51, tsval, nil),
+		} {
+			ts := start.Add(time.Duration(i)*time.Second + time.Duration(j)*time.Duration(10+10*i)*time.Millisecond)
+			w.WritePacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(pkt), Length: len(pkt)}, pkt)
+		}
+		f.Close()
+		paths = append(paths, path)
+	}
+
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		Iface:      fileInterface,
+		IdleTTL:    300,
+		config:     Config{PcapWorkers: 2},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  map[string]bool{"2001:db8::2": true},
+		userFilter: true,
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+		pcaps:      paths,
+	}
+	handle, err := openOffline(paths[0])
+	if err != nil {
+		t.Fatalf("Unexpected error opening %s: %v", paths[0], err)
+	}
+	d.handle = handle
+	d.sniffFiles()
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+	if !ok {
+		t.Fatalf("Expected the flow merged, got %v", d.flows.Map)
+	}
+	if flow.Segments != 2 || flow.Sampled != 2 || flow.Bytes != 200 || flow.Retransmits != 0 {
+		t.Fatalf("Unexpected merged flow: %d segments, %d samples, %d bytes, %d retransmits", flow.Segments, flow.Sampled, flow.Bytes, flow.Retransmits)
+	}
+	if flow.Min != uint64(10*time.Millisecond) || flow.Max != uint64(20*time.Millisecond) || flow.SRTT != uint64(15*time.Millisecond) {
+		t.Fatalf("Unexpected merged RTTs: min %v, max %v, srtt %v", time.Duration(flow.Min), time.Duration(flow.Max), time.Duration(flow.SRTT))
+	}
+	if flow.FirstSeen != start.UnixNano() {
+		t.Fatalf("Expected the flow first seen in the first file")
+	}
+}
+
+func TestCaptureBackend(t *testing.T) {
+	src := &sliceSource{ts: time.Now()}
+	for _, seq := range []uint32{1000, 1100} {
+		src.packets = append(src.packets, ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, seq, 1, 100, 50, make([]byte, 100)))
+	}
+	src.packets = append(src.packets, ipv6Segment(t, "2001:db8::2", "2001:db8::1", 5432, 40000, 1, 1100, 51, 100, nil))
+
+	registerCaptureBackend("test", func(d *MetroSniffer) (CaptureSource, error) { return src, nil })
+	defer delete(captureBackends, "test")
+
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{Capture: "test"},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	handle, err := d.openCapture()
+	if err != nil || handle != src {
+		t.Fatalf("Expected the test capture source, got %v, %v", handle, err)
+	}
+	d.SetPcapHandle(handle)
+	d.decoder = d.decoderFor(handle.LinkType())
+	d.SniffOffline()
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+	if !ok || flow.Sampled != 1 {
+		t.Fatalf("Expected a sampled flow off the test source, got %v", d.flows.Map)
+	}
+	if stats, _ := handle.Stats(); stats.Received != 3 {
+		t.Fatalf("Expected 3 packets received, got %d", stats.Received)
+	}
+
+	d.config.Capture = "nope"
+	if _, err := d.openCapture(); err == nil {
+		t.Fatalf("Expected unknown capture backend to fail")
+	}
+}
+
+func TestCaptureStartupRetry(t *testing.T) {
+	src := &sliceSource{ts: time.Now()}
+	attempts := 0
+	registerCaptureBackend("test", func(d *MetroSniffer) (CaptureSource, error) {
+		if attempts++; attempts == 1 {
+			return nil, errors.New("eth0: That device is not up")
+		}
+		return src, nil
+	})
+	defer delete(captureBackends, "test")
+
+	d := &MetroSniffer{Iface: "eth0", config: Config{Capture: "test"}, reporter: &Client{metrics: make(map[string]bool)}}
+	if _, err := d.openStartup(); err == nil {
+		t.Fatalf("Expected failing right away without a startup timeout")
+	}
+
+	attempts = 0
+	d.startupTimeout = 5 * time.Second
+	if handle, err := d.openStartup(); err != nil || handle != src || attempts != 2 {
+		t.Fatalf("Expected the capture open on retry, got %v, %v after %d attempts", handle, err, attempts)
+	}
+
+	// stopped while waiting.
+	attempts = 0
+	d.t.Kill(nil)
+	if _, err := d.openStartup(); err != tomb.ErrDying {
+		t.Fatalf("Expected giving up once stopped, got %v", err)
+	}
+}
+
+func TestCaptureInterfaceDown(t *testing.T) {
+	send := func(seq uint32) []byte {
+		return ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, seq, 1, 100, 50, make([]byte, 100))
+	}
+	// reads fail once the packets run out, as off an interface gone down.
+	first := &sliceSource{ts: time.Now(), packets: [][]byte{send(1000)}}
+	second := &sliceSource{ts: time.Now(), packets: [][]byte{send(1100)}}
+	opened := []*sliceSource{first, second}
+	registerCaptureBackend("test", func(d *MetroSniffer) (CaptureSource, error) {
+		if len(opened) == 0 {
+			return nil, errors.New("eth0: That device is not up")
+		}
+		src := opened[0]
+		opened = opened[1:]
+		return src, nil
+	})
+	defer delete(captureBackends, "test")
+
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		Iface:       "eth0",
+		IdleTTL:     300,
+		config:      Config{Capture: "test"},
+		decoders:    make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:     map[string]bool{"2001:db8::1": true},
+		whitelist:   make(map[string]bool),
+		nameLookup:  NewLookupTable(),
+		flows:       NewFlowMap(),
+		policies:    policies,
+		captureCtl:  make(chan captureRequest),
+		nextRefresh: time.Now().Add(time.Hour),
+		reporter:    &Client{metrics: make(map[string]bool), ifstate: &interfaceState{}},
+	}
+	d.handle, _ = d.openCapture()
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	done := make(chan bool)
+	go func() {
+		d.SniffLive()
+		close(done)
+	}()
+
+	flowKey := "[2001:db8::1]:40000-[2001:db8::2]:5432"
+	segments := func() uint64 {
+		flow, ok := d.flows.Get(flowKey)
+		if !ok {
+			return 0
+		}
+		flow.RLock()
+		defer flow.RUnlock()
+		return flow.Segments
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for segments() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := segments(); n != 2 {
+		t.Fatalf("Expected the flow retained across the capture reopened, got %d segments", n)
+	}
+	// second ran out too, the interface is down again: retrying, not dying.
+	time.Sleep(50 * time.Millisecond)
+	if !d.reporter.ifstate.isDown() {
+		t.Errorf("Expected the capture degraded")
+	}
+
+	d.t.Kill(nil)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the capture loop to stop while degraded")
+	}
+	if !first.closed || d.downBackoff < 2*time.Second {
+		t.Errorf("Expected the failed handle closed and backing off further, got backoff %v", d.downBackoff)
+	}
+}
+
+func TestCapturePause(t *testing.T) {
+	first, second := &sliceSource{ts: time.Now()}, &sliceSource{ts: time.Now()}
+	opened := []*sliceSource{first, second}
+	registerCaptureBackend("test", func(d *MetroSniffer) (CaptureSource, error) {
+		src := opened[0]
+		opened = opened[1:]
+		return src, nil
+	})
+	defer delete(captureBackends, "test")
+
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		Iface:      "eth0",
+		IdleTTL:    300,
+		config:     Config{Capture: "test"},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+		captureCtl: make(chan captureRequest),
+	}
+	d.handle, _ = d.openCapture()
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+	send := func(seq uint32) {
+		data := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, seq, 1, 100, 50, make([]byte, 100))
+		d.handlePacket(data, &gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)})
+	}
+	send(1000)
+
+	// serve requests the way the capture loop does, until resumed.
+	resumed := make(chan bool)
+	go func() {
+		for d.handleCaptureRequest(<-d.captureCtl) {
+			if d.handle == second {
+				break
+			}
+		}
+		resumed <- d.handle == second
+	}()
+	if err := d.ResumeCapture(); err != errCaptureRunning {
+		t.Fatalf("Expected capture to be running, got %v", err)
+	}
+	if err := d.PauseCapture(); err != nil || !first.closed || !d.CapturePaused() {
+		t.Fatalf("Expected capture to be paused, got %v", err)
+	}
+	if err := d.PauseCapture(); err != errCapturePaused {
+		t.Fatalf("Expected capture to be paused already, got %v", err)
+	}
+	if err := d.ResumeCapture(); err != nil || !<-resumed || d.CapturePaused() {
+		t.Fatalf("Expected capture resumed on a new handle, got %v", err)
+	}
+	send(1100)
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+	if !ok || flow.Segments != 2 {
+		t.Fatalf("Expected flow state kept across the pause, got %v", d.flows.Map)
+	}
+
+	d.Iface = fileInterface
+	if err := d.PauseCapture(); err != errCaptureOffline {
+		t.Fatalf("Expected file capture not to pause, got %v", err)
+	}
+}
+
+func TestMergeFlowsExpired(t *testing.T) {
+	f, o := NewFlowMap(), NewFlowMap()
+	// more than the channel holds, nobody reading it.
+	n := CHAN_DEPTH + 5
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("10.0.0.1:%d-10.0.0.2:443", 40000+i)
+		flow := NewTCPAccounting(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), layers.TCPPort(40000+i), 443, time.Minute, &o.Expire)
+		flow.SetExpiration(time.Millisecond, k)
+		o.Add(k, flow)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan []string)
+	go func() { done <- f.mergeFlows(o) }()
+	select {
+	case expired := <-done:
+		if len(expired) != n {
+			t.Fatalf("Expected %d flows expired, got %d", n, len(expired))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Merging flows deadlocked")
+	}
+	if len(f.Map) != n {
+		t.Fatalf("Expected %d flows merged, got %d", n, len(f.Map))
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// defaultChaosTolerance is the fraction of the expected latency the added
+// latency observed may be off by, unless configured.
+const defaultChaosTolerance = 0.2
+
+// ExperimentConfig declares a chaos experiment injecting latency towards some
+// destinations (IPs, CIDRs, hostnames or peer group names) between start and
+// end (RFC3339), to verify off the wire that it materialized. The RTT
+// baseline is measured from when the experiment is declared until it starts,
+// unless given.
+type ExperimentConfig struct {
+	Name         string   `yaml:"name" json:"name"`
+	Destinations []string `yaml:"destinations" json:"destinations"`
+	Latency      float64  `yaml:"latency" json:"latency"`               // ms, expected to be added
+	Tolerance    float64  `yaml:"tolerance" json:"tolerance,omitempty"` // ms, 20% of latency by default
+	Baseline     float64  `yaml:"baseline" json:"baseline,omitempty"`   // ms, measured by default
+	Start        string   `yaml:"start" json:"start,omitempty"`         // defaults to now
+	End          string   `yaml:"end" json:"end"`
+}
+
+type chaosExperiment struct {
+	ID  int
+	cfg ExperimentConfig
+	*maintenanceWindow
+	verdict *ExperimentVerdict // latest, nil until verified
+}
+
+// ExperimentVerdict is the outcome of an experiment over a reporting interval.
+type ExperimentVerdict struct {
+	Time      time.Time `json:"time"`
+	Baseline  float64   `json:"baseline"` // ms
+	RTT       float64   `json:"rtt"`      // ms, mean of the flows' smoothed RTTs
+	Added     float64   `json:"added"`    // ms
+	Compliant bool      `json:"compliant"`
+}
+
+// ExperimentStatus is an experiment as reported by the control API.
+type ExperimentStatus struct {
+	ID int `json:"id"`
+	ExperimentConfig
+	Active  bool               `json:"active"`
+	Verdict *ExperimentVerdict `json:"verdict,omitempty"`
+}
+
+// chaosExperiments holds the declared experiments, shared by all reporters.
+type chaosExperiments struct {
+	sync.RWMutex
+	experiments []*chaosExperiment
+	next        int
+}
+
+// experiments is the process-wide set - populated from the configuration and
+// the control API.
+var experiments = newChaosExperiments()
+
+func newChaosExperiments() *chaosExperiments {
+	return &chaosExperiments{next: 1}
+}
+
+func newChaosExperiment(cfg ExperimentConfig, now time.Time) (*chaosExperiment, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("Chaos experiments require a name.")
+	}
+	if cfg.Latency <= 0 {
+		return nil, errors.New("Chaos experiments require the latency they add.")
+	}
+	if cfg.Tolerance < 0 || cfg.Baseline < 0 {
+		return nil, errors.New("Chaos experiment tolerance and baseline must be positive.")
+	}
+	if cfg.Tolerance == 0 {
+		cfg.Tolerance = math.Max(defaultChaosTolerance*cfg.Latency, 1)
+	}
+	w, err := newMaintenanceWindow(MaintenanceConfig{
+		Destinations: cfg.Destinations,
+		Start:        cfg.Start,
+		End:          cfg.End,
+		Reason:       cfg.Name,
+	}, now)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Start, cfg.End = w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339)
+	return &chaosExperiment{cfg: cfg, maintenanceWindow: w}, nil
+}
+
+// Add declares an experiment, returning its ID.
+func (c *chaosExperiments) Add(cfg ExperimentConfig) (int, error) {
+	now := time.Now()
+	e, err := newChaosExperiment(cfg, now)
+	if err != nil {
+		return 0, err
+	}
+	if e.cfg.Baseline == 0 && !e.Start.After(now) {
+		log.Warnf("Chaos experiment %q starts right away with no baseline, it can't be verified.", cfg.Name)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	e.ID = c.next
+	c.next++
+	c.experiments = append(c.experiments, e)
+	return e.ID, nil
+}
+
+// Remove drops an experiment, returns false if there was no such experiment.
+func (c *chaosExperiments) Remove(id int) bool {
+	c.Lock()
+	defer c.Unlock()
+	for i, e := range c.experiments {
+		if e.ID == id {
+			c.experiments = append(c.experiments[:i], c.experiments[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the experiments that have not ended yet, forgetting the rest.
+func (c *chaosExperiments) List(now time.Time) []ExperimentStatus {
+	c.Lock()
+	defer c.Unlock()
+	current := c.experiments[:0]
+	for _, e := range c.experiments {
+		if e.End.After(now) {
+			current = append(current, e)
+		}
+	}
+	c.experiments = current
+
+	status := make([]ExperimentStatus, 0, len(current))
+	for _, e := range current {
+		status = append(status, ExperimentStatus{
+			ID:               e.ID,
+			ExperimentConfig: e.cfg,
+			Active:           !now.Before(e.Start),
+			Verdict:          e.verdict,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+// matching returns the experiments, pending or active at the time, covering
+// a destination by address or any of the names it is reported under.
+func (c *chaosExperiments) matching(now time.Time, ip net.IP, names ...string) []*chaosExperiment {
+	c.RLock()
+	defer c.RUnlock()
+	var matched []*chaosExperiment
+	for _, e := range c.experiments {
+		if !now.Before(e.End) {
+			continue
+		}
+		if e.matches(ip, names...) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+func (c *chaosExperiments) record(e *chaosExperiment, v ExperimentVerdict) {
+	c.Lock()
+	e.verdict = &v
+	c.Unlock()
+}
+
+// chaosCheck follows an experiment for a reporter: the RTTs of the flows it
+// covers over the interval, and before it started.
+type chaosCheck struct {
+	exp       *chaosExperiment
+	sum       float64 // ms
+	n         int
+	baseline  float64 // ms, mean of the intervals before the start
+	intervals int
+}
+
+// observeChaos adds a flow's smoothed RTT to the experiments covering its
+// remote end (Dst). Call holding the flow lock.
+func (r *Client) observeChaos(flow *TCPAccounting, now time.Time) {
+	if r.experiments == nil || flow.Sampled == flow.RepSampled {
+		return
+	}
+	names := []string{r.hostname(flow.Dst)}
+	if group, ok := r.peerGroup(flow); ok {
+		names = append(names, group)
+	}
+	for _, e := range r.experiments.matching(now, flow.Dst, names...) {
+		ck, ok := r.chaos[e.ID]
+		if !ok {
+			ck = &chaosCheck{exp: e}
+			r.chaos[e.ID] = ck
+		}
+		ck.sum += nsToMs(flow.SRTT)
+		ck.n++
+	}
+}
+
+// reportChaos verifies the experiments under way against their baseline: the
+// latency added to the flows they cover is expected within tolerance. Before
+// they start, it measures the baseline.
+func (r *Client) reportChaos(now time.Time) {
+	for id, ck := range r.chaos {
+		e := ck.exp
+		if !now.Before(e.End) {
+			delete(r.chaos, id)
+			continue
+		}
+		if ck.n == 0 {
+			continue
+		}
+		rtt := ck.sum / float64(ck.n)
+		ck.sum, ck.n = 0, 0
+		if now.Before(e.Start) {
+			ck.intervals++
+			ck.baseline += (rtt - ck.baseline) / float64(ck.intervals)
+			continue
+		}
+
+		baseline := e.cfg.Baseline
+		if baseline == 0 && ck.intervals == 0 {
+			log.Debugf("No baseline for chaos experiment %q, not verifying.", e.cfg.Name)
+			continue
+		} else if baseline == 0 {
+			baseline = ck.baseline
+		}
+		added := rtt - baseline
+		compliant := math.Abs(added-e.cfg.Latency) <= e.cfg.Tolerance
+		r.experiments.record(e, ExperimentVerdict{
+			Time:      now,
+			Baseline:  baseline,
+			RTT:       rtt,
+			Added:     added,
+			Compliant: compliant,
+		})
+		if !compliant {
+			log.Warnf("Chaos experiment %q not materializing: %.3f ms added, %.3f ms expected.", e.cfg.Name, added, e.cfg.Latency)
+		}
+
+		ts := now.Unix()
+		tags := append([]string{"experiment:" + e.cfg.Name}, r.tags...)
+		key := "experiment:" + e.cfg.Name
+		r.submit(key, "go_metro.chaos.added_latency", added, tags, false, ts)
+		r.submit(key, "go_metro.chaos.expected_latency", e.cfg.Latency, tags, false, ts)
+		v := 0.0
+		if compliant {
+			v = 1
+		}
+		r.submit(key, "go_metro.chaos.compliant", v, tags, false, ts)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChaosExperiments(t *testing.T) {
+	c := newChaosExperiments()
+	now := time.Now()
+	id, err := c.Add(ExperimentConfig{
+		Name:         "db-latency",
+		Destinations: []string{"10.1.4.0/24"},
+		Latency:      100,
+		Start:        now.Add(time.Hour).Format(time.RFC3339),
+		End:          now.Add(2 * time.Hour).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error declaring experiment: %v", err)
+	}
+	r := &Client{experiments: c, chaos: make(map[int]*chaosCheck), enrich: &EnrichmentPipeline{}}
+	flow := &TCPAccounting{Dst: net.ParseIP("10.1.4.1"), Sampled: 1, SRTT: uint64(10 * time.Millisecond)}
+	other := &TCPAccounting{Dst: net.ParseIP("10.2.4.1"), Sampled: 1, SRTT: uint64(500 * time.Millisecond)}
+
+	// baseline, before the experiment.
+	r.observeChaos(flow, now)
+	r.observeChaos(other, now)
+	r.reportChaos(now)
+	if ck := r.chaos[id]; ck == nil || ck.baseline != 10 || ck.intervals != 1 {
+		t.Fatalf("Unexpected baseline: %+v", ck)
+	}
+
+	// 95ms added, within the default 20ms tolerance.
+	during := now.Add(90 * time.Minute)
+	flow.SRTT = uint64(105 * time.Millisecond)
+	r.observeChaos(flow, during)
+	r.reportChaos(during)
+	status := c.List(during)
+	if len(status) != 1 || !status[0].Active || status[0].Verdict == nil {
+		t.Fatalf("Expected the experiment to be verified: %+v", status)
+	}
+	if v := status[0].Verdict; v.Added != 95 || !v.Compliant || status[0].Tolerance != 20 {
+		t.Fatalf("Unexpected verdict: %+v (tolerance %v)", v, status[0].Tolerance)
+	}
+
+	// no latency injected.
+	flow.SRTT = uint64(12 * time.Millisecond)
+	r.observeChaos(flow, during)
+	r.reportChaos(during)
+	if v := c.List(during)[0].Verdict; v.Compliant {
+		t.Fatalf("Expected the experiment not to comply: %+v", v)
+	}
+
+	for _, cfg := range []ExperimentConfig{
+		{Destinations: []string{"10.1.4.1"}, Latency: 100, End: now.Add(time.Hour).Format(time.RFC3339)},
+		{Name: "x", Destinations: []string{"10.1.4.1"}, End: now.Add(time.Hour).Format(time.RFC3339)},
+		{Name: "x", Destinations: []string{"10.1.4.1"}, Latency: 100},
+	} {
+		if _, err := c.Add(cfg); err == nil {
+			t.Fatalf("Expected bad experiment to be rejected: %+v", cfg)
+		}
+	}
+}
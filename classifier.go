@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Traffic classes, by where the remote end is relative to us.
+const (
+	trafficIntraAZ     = "intra-az"
+	trafficInterAZ     = "inter-az"
+	trafficIntraRegion = "intra-region" // same region, zones unknown
+	trafficInterRegion = "inter-region"
+	trafficInternet    = "internet"
+	trafficUnknown     = "unknown"
+)
+
+type ClassifierConfig struct {
+	// Published provider range files (AWS ip-ranges.json, GCP cloud.json).
+	Ranges []string `yaml:"ranges"`
+	// User overrides: CIDR (or any lookup key) -> "region/zone" or "region".
+	Zones map[string]string `yaml:"zones"`
+	// Our own "region/zone", looked up by local IP if unset.
+	Local string `yaml:"local"`
+}
+
+// providerRanges covers both the AWS and GCP published range formats.
+type providerRanges struct {
+	Prefixes []struct {
+		AWSPrefix string `json:"ip_prefix"`
+		AWSRegion string `json:"region"`
+		GCPPrefix string `json:"ipv4Prefix"`
+		GCPScope  string `json:"scope"`
+	} `json:"prefixes"`
+}
+
+// TrafficClassifier maps endpoint IPs to cloud regions/zones and tells flows
+// apart by the boundaries they cross.
+type TrafficClassifier struct {
+	locations *LookupTable
+	local     string
+}
+
+func NewTrafficClassifier(cfg *ClassifierConfig) (*TrafficClassifier, error) {
+	c := &TrafficClassifier{
+		locations: NewLookupTable(),
+		local:     cfg.Local,
+	}
+
+	for _, path := range cfg.Ranges {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var ranges providerRanges
+		if err := json.Unmarshal(data, &ranges); err != nil {
+			return nil, err
+		}
+		for _, p := range ranges.Prefixes {
+			prefix, region := p.AWSPrefix, p.AWSRegion
+			if prefix == "" {
+				prefix, region = p.GCPPrefix, p.GCPScope
+			}
+			if prefix == "" || region == "" || region == "GLOBAL" || region == "global" {
+				continue
+			}
+			if err := c.locations.Add(prefix, region); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for k, v := range cfg.Zones {
+		if err := c.locations.Add(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func splitLocation(loc string) (string, string) {
+	if i := strings.Index(loc, "/"); i >= 0 {
+		return loc[:i], loc[i+1:]
+	}
+	return loc, ""
+}
+
+func isInternal(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// Classify returns the traffic class for a flow between our local IP and a
+// remote one.
+func (c *TrafficClassifier) Classify(local, remote net.IP) string {
+	localLoc := c.local
+	if localLoc == "" {
+		localLoc, _ = c.locations.Get(local.String())
+	}
+	remoteLoc, ok := c.locations.Get(remote.String())
+	if !ok {
+		if isInternal(remote) {
+			return trafficUnknown
+		}
+		return trafficInternet
+	}
+	if localLoc == "" {
+		return trafficUnknown
+	}
+
+	localRegion, localZone := splitLocation(localLoc)
+	remoteRegion, remoteZone := splitLocation(remoteLoc)
+	switch {
+	case localRegion != remoteRegion:
+		return trafficInterRegion
+	case localZone == "" || remoteZone == "":
+		return trafficIntraRegion
+	case localZone != remoteZone:
+		return trafficInterAZ
+	default:
+		return trafficIntraAZ
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrafficClassifier(t *testing.T) {
+	c, err := NewTrafficClassifier(&ClassifierConfig{
+		Zones: map[string]string{
+			"10.0.0.0/20":  "us-east-1/us-east-1a",
+			"10.0.16.0/20": "us-east-1/us-east-1b",
+			"10.1.0.0/16":  "us-west-2",
+			"52.0.0.0/8":   "us-east-1",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewTrafficClassifier expected == nil, got %v", err)
+	}
+
+	local := net.ParseIP("10.0.1.1")
+	expected := map[string]string{
+		"10.0.2.2":    trafficIntraAZ,
+		"10.0.17.1":   trafficInterAZ,
+		"10.1.1.1":    trafficInterRegion,
+		"52.1.1.1":    trafficIntraRegion,
+		"8.8.8.8":     trafficInternet,
+		"192.168.1.1": trafficUnknown,
+	}
+	for remote, class := range expected {
+		if got := c.Classify(local, net.ParseIP(remote)); got != class {
+			t.Fatalf("Classify(%v, %v) expected %q, got %q", local, remote, class, got)
+		}
+	}
+}
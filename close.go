@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Ways connections end.
+const (
+	closeFIN   = "fin"
+	closeReset = "reset"
+)
+
+// FINs seen, by direction.
+const (
+	finSrc uint8 = 1 << iota
+	finDst
+)
+
+// trackClose notes how a flow's connection ends: orderly once both ends sent
+// their FIN, reset by whichever end sends a RST before. Resets refusing a
+// connection attempt are counted as such instead. Call holding the flow lock.
+func (t *TCPAccounting) trackClose(fromSrc bool, tcp *layers.TCP) {
+	if t.Close != "" || t.Refused {
+		return
+	}
+	switch {
+	case tcp.RST:
+		t.Close, t.ResetLocal = closeReset, fromSrc
+	case tcp.FIN && fromSrc:
+		t.FINs |= finSrc
+	case tcp.FIN:
+		t.FINs |= finDst
+	}
+	if t.FINs == finSrc|finDst {
+		t.Close = closeFIN
+	}
+}
+
+// closed tallies a flow's connection if it ended - half-closed ones too, if
+// the flow is expiring. Call holding the flow lock.
+func (r *Client) closed(flow *TCPAccounting, now time.Time, expiring bool) {
+	if flow.CloseCounted || !r.policies.reported(flow.External) {
+		return
+	}
+	how := flow.Close
+	if how == "" && expiring && flow.FINs != 0 {
+		how = closeFIN
+	}
+	if how == "" {
+		return
+	}
+	flow.CloseCounted = true
+	r.connectionEnded(flow, how, now)
+	if r.suppressed(flow, now) || r.cloudLBs.dropped(flow) {
+		return
+	}
+
+	tags := append(r.flowTags(flow), "close:"+how)
+	if how == closeReset && flow.ResetLocal {
+		tags = append(tags, "reset_by:local")
+	} else if how == closeReset {
+		tags = append(tags, "reset_by:remote")
+	}
+	key := strings.Join(tags, ",")
+	c, ok := r.closes[key]
+	if !ok {
+		c = &flowTally{tags: append(tags, r.tags...)}
+		r.closes[key] = c
+	}
+	c.n++
+}
+
+// reportCloses submits the connections closed over the interval, orderly or
+// reset.
+func (r *Client) reportCloses(ts int64) {
+	for k, c := range r.closes {
+		r.submit(k, metricPrefix+"closed", float64(c.n), c.tags, false, ts)
+	}
+	r.closes = make(map[string]*flowTally)
+}
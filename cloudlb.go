@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	cloudLBActionTag  = "tag"
+	cloudLBActionDrop = "drop"
+	cloudLBActionOff  = "off"
+)
+
+// cloudLBRanges are the documented source ranges of cloud load balancers,
+// proxies and health checkers, by provider. AWS NLB/ALB health checks come
+// from the load balancer's own addresses within the VPC, those have to be
+// configured (health_checks sources).
+var cloudLBRanges = map[string][]string{
+	// load balancer proxies (GFEs) and health checks, and legacy network LB
+	// health checks.
+	"gcp": {"35.191.0.0/16", "130.211.0.0/22", "209.85.152.0/22", "209.85.204.0/22"},
+	// load balancer health probes, from the platform virtual IP.
+	"azure": {"168.63.129.16/32"},
+	// Route 53 health checkers.
+	"aws": {
+		"15.177.0.0/18", "54.183.255.128/26", "54.228.16.0/26", "54.232.40.64/26",
+		"54.241.32.64/26", "54.243.31.192/26", "54.244.52.192/26", "54.245.168.0/26",
+		"54.248.220.0/26", "54.250.253.192/26", "54.251.31.128/26", "54.252.79.128/26",
+		"54.252.254.192/26", "54.255.254.192/26", "107.23.255.0/26", "176.34.159.192/26",
+		"177.71.207.128/26",
+	},
+}
+
+// CloudLBConfig configures the recognition of flows from well-known cloud
+// load balancer and health checker ranges. They're tagged cloud_lb:<provider>
+// unless configured otherwise.
+type CloudLBConfig struct {
+	Action    string   `yaml:"action"`    // tag (default), drop or off
+	Providers []string `yaml:"providers"` // gcp, azure, aws - all by default
+}
+
+func (c *CloudLBConfig) validate() error {
+	switch c.Action {
+	case "":
+		c.Action = cloudLBActionTag
+	case cloudLBActionTag, cloudLBActionDrop, cloudLBActionOff:
+	default:
+		return fmt.Errorf("Error parsing configuration - unknown cloud_lbs action %q.", c.Action)
+	}
+	for _, p := range c.Providers {
+		if _, ok := cloudLBRanges[p]; !ok {
+			return fmt.Errorf("Error parsing configuration - unknown cloud_lbs provider %q.", p)
+		}
+	}
+	return nil
+}
+
+type cloudLBNet struct {
+	net      *net.IPNet
+	provider string
+}
+
+// cloudLBs matches flows against the ranges of the configured providers.
+type cloudLBs struct {
+	drop bool
+	nets []cloudLBNet
+}
+
+// newCloudLBs returns the recognizer for a configuration, nil if off.
+func newCloudLBs(cfg CloudLBConfig) (*cloudLBs, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Action == cloudLBActionOff {
+		return nil, nil
+	}
+	providers := cfg.Providers
+	if len(providers) == 0 {
+		for p := range cloudLBRanges {
+			providers = append(providers, p)
+		}
+		sort.Strings(providers)
+	}
+
+	c := &cloudLBs{drop: cfg.Action == cloudLBActionDrop}
+	for _, p := range providers {
+		for _, r := range cloudLBRanges[p] {
+			_, n, err := net.ParseCIDR(r)
+			if err != nil {
+				return nil, err
+			}
+			c.nets = append(c.nets, cloudLBNet{n, p})
+		}
+	}
+	return c, nil
+}
+
+// provider returns the provider whose load balancers either end of the flow
+// belongs to, if any.
+func (c *cloudLBs) provider(flow *TCPAccounting) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	for _, n := range c.nets {
+		if n.net.Contains(flow.Dst) || n.net.Contains(flow.Src) {
+			return n.provider, true
+		}
+	}
+	return "", false
+}
+
+// dropped tells whether a flow isn't to be reported.
+func (c *cloudLBs) dropped(flow *TCPAccounting) bool {
+	if c == nil || !c.drop {
+		return false
+	}
+	_, ok := c.provider(flow)
+	return ok
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCloudLBs(t *testing.T) {
+	us := net.ParseIP("10.0.0.1")
+	gfe := &TCPAccounting{Src: us, Dst: net.ParseIP("35.191.12.3")}
+	probe := &TCPAccounting{Src: us, Dst: net.ParseIP("168.63.129.16")}
+	user := &TCPAccounting{Src: us, Dst: net.ParseIP("198.51.100.7")}
+
+	c, err := newCloudLBs(CloudLBConfig{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p, ok := c.provider(gfe); !ok || p != "gcp" {
+		t.Fatalf("Expected GCP load balancer, got %q", p)
+	}
+	if p, ok := c.provider(probe); !ok || p != "azure" {
+		t.Fatalf("Expected Azure probe, got %q", p)
+	}
+	if _, ok := c.provider(user); ok {
+		t.Fatalf("User traffic recognised as load balancer")
+	}
+	if c.dropped(gfe) {
+		t.Fatalf("Load balancer flows should only be tagged by default")
+	}
+
+	c, err = newCloudLBs(CloudLBConfig{Action: cloudLBActionDrop, Providers: []string{"azure"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !c.dropped(probe) || c.dropped(gfe) {
+		t.Fatalf("Expected only Azure probes dropped")
+	}
+
+	c, err = newCloudLBs(CloudLBConfig{Action: cloudLBActionOff})
+	if err != nil || c != nil {
+		t.Fatalf("Expected no recognizer when off, got %v, %v", c, err)
+	}
+	if _, ok := c.provider(gfe); ok {
+		t.Fatalf("Disabled recognizer matched")
+	}
+
+	if _, err := newCloudLBs(CloudLBConfig{Providers: []string{"nope"}}); err == nil {
+		t.Fatalf("Expected unknown provider to be rejected")
+	}
+}
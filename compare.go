@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+// compareIdleTTL keeps flows around for the whole analysis, there's no
+// reporter expiring them.
+const compareIdleTTL = 24 * 3600
+
+// flowStats are the statistics of the flows between two hosts to a service
+// port, RTTs in ms.
+type flowStats struct {
+	Flows          int     `json:"flows"`
+	Samples        uint64  `json:"samples"`
+	SRTT           float64 `json:"srtt"`
+	Jitter         float64 `json:"jitter"`
+	Min            float64 `json:"min"`
+	Max            float64 `json:"max"`
+	Segments       uint64  `json:"segments"`
+	Retransmits    uint64  `json:"retransmits"`
+	RetransmitRate float64 `json:"retransmit_rate"`
+	Resets         uint64  `json:"resets"`
+}
+
+// add accounts a flow in, RTTs weighted by samples. Call holding the flow lock.
+func (s *flowStats) add(flow *TCPAccounting) {
+	s.Flows++
+	s.Segments += flow.Segments
+	s.Retransmits += flow.Retransmits
+	s.Resets += flow.Resets
+	if s.Segments > 0 {
+		s.RetransmitRate = float64(s.Retransmits) / float64(s.Segments)
+	}
+	if flow.Sampled == 0 {
+		return
+	}
+	n := float64(s.Samples + flow.Sampled)
+	s.SRTT = (s.SRTT*float64(s.Samples) + nsToMs(flow.SRTT)*float64(flow.Sampled)) / n
+	s.Jitter = (s.Jitter*float64(s.Samples) + nsToMs(flow.Jitter)*float64(flow.Sampled)) / n
+	if min := nsToMs(flow.Min); s.Samples == 0 || min < s.Min {
+		s.Min = min
+	}
+	s.Max = math.Max(s.Max, nsToMs(flow.Max))
+	s.Samples += flow.Sampled
+}
+
+// flowDiff compares a flow (or the aggregate of all flows) across captures,
+// deltas are after - before.
+type flowDiff struct {
+	Flow                string     `json:"flow"`
+	Before              *flowStats `json:"before,omitempty"`
+	After               *flowStats `json:"after,omitempty"`
+	SRTTDelta           float64    `json:"srtt_delta"`
+	JitterDelta         float64    `json:"jitter_delta"`
+	RetransmitRateDelta float64    `json:"retransmit_rate_delta"`
+	ResetsDelta         int64      `json:"resets_delta"`
+}
+
+type comparison struct {
+	Aggregate flowDiff   `json:"aggregate"`
+	Flows     []flowDiff `json:"flows"`
+}
+
+// compareKey identifies a flow across captures - client ports are ephemeral so
+// flows are keyed by hosts and service port.
+func compareKey(flow *TCPAccounting) string {
+	port := flow.Sport
+	if flow.Client {
+		port = flow.Dport
+	}
+	return fmt.Sprintf("%s-%s:%d", flow.Src, flow.Dst, port)
+}
+
+func newFlowDiff(key string, before, after *flowStats) flowDiff {
+	diff := flowDiff{Flow: key, Before: before, After: after}
+	if before != nil && after != nil {
+		diff.SRTTDelta = after.SRTT - before.SRTT
+		diff.JitterDelta = after.Jitter - before.Jitter
+		diff.RetransmitRateDelta = after.RetransmitRate - before.RetransmitRate
+		diff.ResetsDelta = int64(after.Resets) - int64(before.Resets)
+	}
+	return diff
+}
+
+// analysePcap runs pcap files through the flow accounting, without reporting,
+// and returns the statistics per compareKey along with the aggregate. Our end
+// of flows are the local addresses or, if none, the clients.
+func analysePcap(pattern string, local []string, filter string) (map[string]*flowStats, *flowStats, error) {
+	files, err := pcapFiles(pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policies, err := newTrafficPolicies(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &MetroSniffer{
+		Iface:      fileInterface,
+		Filter:     filter,
+		IdleTTL:    compareIdleTTL,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    make(map[string]bool),
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+		config:     Config{Interface: fileInterface, Pcap: pattern, Mirror: len(local) == 0},
+	}
+	for _, ip := range local {
+		d.hostIPs[ip] = true
+	}
+
+	for _, path := range files {
+		handle, err := openOffline(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open pcap file %q: %v", path, err)
+		}
+		if err := handle.SetBPFFilter(filter); err != nil && err != errBPFUnsupported {
+			handle.Close()
+			return nil, nil, fmt.Errorf("Error setting BPF filter %q: %v", filter, err)
+		}
+		d.handle = handle
+		d.decoder = d.decoderFor(handle.LinkType())
+		d.SniffOffline()
+		handle.Close()
+	}
+
+	stats := make(map[string]*flowStats)
+	total := &flowStats{}
+	d.flows.Lock()
+	for _, flow := range d.flows.Map {
+		flow.Lock()
+		if flow.Alive != nil {
+			flow.Alive.Stop()
+		}
+		k := compareKey(flow)
+		s, ok := stats[k]
+		if !ok {
+			s = &flowStats{}
+			stats[k] = s
+		}
+		s.add(flow)
+		total.add(flow)
+		flow.Unlock()
+	}
+	d.flows.Unlock()
+	return stats, total, nil
+}
+
+func compareStats(before, after map[string]*flowStats, totalBefore, totalAfter *flowStats) *comparison {
+	c := &comparison{Aggregate: newFlowDiff("all", totalBefore, totalAfter)}
+	for k, b := range before {
+		c.Flows = append(c.Flows, newFlowDiff(k, b, after[k]))
+	}
+	for k, a := range after {
+		if _, ok := before[k]; !ok {
+			c.Flows = append(c.Flows, newFlowDiff(k, nil, a))
+		}
+	}
+	sort.Slice(c.Flows, func(i, j int) bool { return c.Flows[i].Flow < c.Flows[j].Flow })
+	return c
+}
+
+func (c *comparison) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLOW\tSAMPLES\tSRTT (ms)\tJITTER (ms)\tRETRANSMITS\tRESETS")
+	row := func(d flowDiff) {
+		switch {
+		case d.Before == nil:
+			fmt.Fprintf(tw, "%s\t-/%d\tnew: %.3f\tnew: %.3f\tnew: %.2f%%\tnew: %d\n", d.Flow, d.After.Samples, d.After.SRTT, d.After.Jitter, 100*d.After.RetransmitRate, d.After.Resets)
+		case d.After == nil:
+			fmt.Fprintf(tw, "%s\t%d/-\tgone: %.3f\tgone: %.3f\tgone: %.2f%%\tgone: %d\n", d.Flow, d.Before.Samples, d.Before.SRTT, d.Before.Jitter, 100*d.Before.RetransmitRate, d.Before.Resets)
+		default:
+			fmt.Fprintf(tw, "%s\t%d/%d\t%.3f -> %.3f (%+.3f)\t%.3f -> %.3f (%+.3f)\t%.2f%% -> %.2f%%\t%d -> %d\n", d.Flow,
+				d.Before.Samples, d.After.Samples,
+				d.Before.SRTT, d.After.SRTT, d.SRTTDelta,
+				d.Before.Jitter, d.After.Jitter, d.JitterDelta,
+				100*d.Before.RetransmitRate, 100*d.After.RetransmitRate,
+				d.Before.Resets, d.After.Resets)
+		}
+	}
+	for _, d := range c.Flows {
+		row(d)
+	}
+	row(c.Aggregate)
+	return tw.Flush()
+}
+
+// runCompare implements the compare subcommand:
+//
+//	go-metro compare [-local ips] [-f filter] [-json] before.pcap after.pcap
+func runCompare(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	local := fs.String("local", "", "Comma separated local addresses, our end of flows (defaults to the clients).")
+	bpf := fs.String("f", defaultBPFFilter, "BPF filter for pcap")
+	asJSON := fs.Bool("json", false, "Output the comparison as JSON.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [options] <before pcap> <after pcap>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var ips []string
+	if *local != "" {
+		ips = strings.Split(*local, ",")
+	}
+
+	start := time.Now()
+	before, totalBefore, err := analysePcap(fs.Arg(0), ips, *bpf)
+	if err != nil {
+		log.Criticalf("Error analysing %q: %v", fs.Arg(0), err)
+		return 1
+	}
+	after, totalAfter, err := analysePcap(fs.Arg(1), ips, *bpf)
+	if err != nil {
+		log.Criticalf("Error analysing %q: %v", fs.Arg(1), err)
+		return 1
+	}
+	log.Infof("Compared %q and %q in %v", fs.Arg(0), fs.Arg(1), time.Since(start))
+
+	c := compareStats(before, after, totalBefore, totalAfter)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(c)
+	} else {
+		err = c.writeText(os.Stdout)
+	}
+	if err != nil {
+		log.Errorf("Error writing comparison: %v", err)
+		return 1
+	}
+	return 0
+}
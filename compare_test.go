@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestComparePcaps(t *testing.T) {
+	before, totalBefore, err := analysePcap("fixtures/test_scp.pcap", []string{"10.42.31.222"}, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error analysing pcap: %v", err)
+	}
+	if len(before) == 0 || totalBefore.Samples == 0 {
+		t.Fatalf("Expected RTT samples from the pcap, got %+v", totalBefore)
+	}
+
+	// a capture compared with itself shows no difference.
+	after, totalAfter, err := analysePcap("fixtures/test_scp.pcap", []string{"10.42.31.222"}, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error analysing pcap: %v", err)
+	}
+	c := compareStats(before, after, totalBefore, totalAfter)
+	if len(c.Flows) != len(before) {
+		t.Fatalf("Expected %d flows in the comparison, got %d", len(before), len(c.Flows))
+	}
+	for _, d := range append(c.Flows, c.Aggregate) {
+		if d.Before == nil || d.After == nil || d.SRTTDelta != 0 || d.JitterDelta != 0 || d.RetransmitRateDelta != 0 || d.ResetsDelta != 0 {
+			t.Fatalf("Unexpected difference for %s: %+v", d.Flow, d)
+		}
+	}
+
+	// flows only found on either side.
+	c = compareStats(before, map[string]*flowStats{"10.0.0.1-10.0.0.2:443": {Flows: 1}}, totalBefore, totalAfter)
+	var buf bytes.Buffer
+	if err := c.writeText(&buf); err != nil {
+		t.Fatalf("Unexpected error writing comparison: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "gone:") || !strings.Contains(out, "new:") {
+		t.Fatalf("Expected new and gone flows in the comparison:\n%s", out)
+	}
+}
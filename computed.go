@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	computedMetricPrefix = metricPrefix + "custom."
+	// allowed in the names of metrics defined in the configuration.
+	metricNameChars = "abcdefghijklmnopqrstuvwxyz0123456789_."
+)
+
+// exprFunc evaluates an expression over a flow, reported secs after the
+// last interval.
+type exprFunc func(flow *TCPAccounting, secs float64) float64
+
+// flowVars are the per-flow fields computed metrics may refer to. Counters
+// are over the interval being reported, times in milliseconds.
+var flowVars = map[string]exprFunc{
+	"rtt":                  func(f *TCPAccounting, _ float64) float64 { return nsToMs(f.Last) },
+	"rtt_avg":              func(f *TCPAccounting, _ float64) float64 { return nsToMs(f.SRTT) },
+	"rtt_min":              func(f *TCPAccounting, _ float64) float64 { return nsToMs(f.Min) },
+	"rtt_max":              func(f *TCPAccounting, _ float64) float64 { return nsToMs(f.Max) },
+	"jitter":               func(f *TCPAccounting, _ float64) float64 { return nsToMs(f.Jitter) },
+	"samples":              func(f *TCPAccounting, _ float64) float64 { return float64(f.Sampled - f.RepSampled) },
+	"packets_sent":         func(f *TCPAccounting, _ float64) float64 { return float64(f.Segments - f.RepSegments) },
+	"packets_received":     func(f *TCPAccounting, _ float64) float64 { return float64(f.Rcvd.Segments - f.RepRcvd.Segments) },
+	"retransmits":          func(f *TCPAccounting, _ float64) float64 { return float64(f.Retransmits - f.RepRetransmits) },
+	"retransmit_bytes":     func(f *TCPAccounting, _ float64) float64 { return float64(f.RetxBytes - f.RepRetxBytes) },
+	"bytes_sent":           func(f *TCPAccounting, _ float64) float64 { return float64(f.SentBytes - f.RepSentBytes) },
+	"retransmits_received": func(f *TCPAccounting, _ float64) float64 { return float64(f.Rcvd.Retransmits - f.RepRcvd.Retransmits) },
+	"out_of_order":         func(f *TCPAccounting, _ float64) float64 { return float64(f.Rcvd.OutOfOrder - f.RepRcvd.OutOfOrder) },
+	"dup_acks":             func(f *TCPAccounting, _ float64) float64 { return float64(f.DupAcks.Count - f.RepDupAcks.Count) },
+	"resets":               func(f *TCPAccounting, _ float64) float64 { return float64(f.Resets - f.RepResets) },
+	"interval":             func(_ *TCPAccounting, secs float64) float64 { return secs },
+}
+
+// computedMetric is a metric derived from the flow fields by an arithmetic
+// expression, eg. "retransmits / packets_sent".
+type computedMetric struct {
+	name string
+	eval exprFunc
+}
+
+// newComputedMetrics compiles the configured expressions by metric name,
+// reported as system.net.tcp.custom.<name>.
+func newComputedMetrics(exprs map[string]string) ([]computedMetric, error) {
+	names := make([]string, 0, len(exprs))
+	for name := range exprs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]computedMetric, 0, len(names))
+	for _, name := range names {
+		if name == "" || strings.Trim(name, metricNameChars) != "" {
+			return nil, fmt.Errorf("Error parsing configuration - bad computed metric name %q, expected lowercase letters, digits, _ and dots.", name)
+		}
+		eval, err := compileExpr(exprs[name])
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing configuration - computed metric %q: %v", name, err)
+		}
+		metrics = append(metrics, computedMetric{name: computedMetricPrefix + name, eval: eval})
+	}
+	return metrics, nil
+}
+
+// reportComputed submits the computed metrics of a flow. Those undefined over
+// the interval, eg. dividing by no packets sent, are skipped.
+func (r *Client) reportComputed(k string, flow *TCPAccounting, tags []string, ts int64, secs float64) {
+	for _, m := range r.computed {
+		v := m.eval(flow, secs)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		r.submit(k, m.name, v, tags, false, ts)
+	}
+}
+
+// exprIndex evaluates an indexed field, eg. payload[0], NaN out of range.
+type exprIndex func(flow *TCPAccounting, i int) float64
+
+// exprParser is a recursive descent parser of + - * / expressions over
+// numbers, fields and parentheses. Comparisons and the ! && || logical
+// operators evaluate to 1 or 0, NaN comparing false.
+type exprParser struct {
+	src     string
+	pos     int
+	vars    map[string]exprFunc
+	indexed map[string]exprIndex
+}
+
+func compileExpr(src string) (exprFunc, error) {
+	return compileExprWith(src, flowVars, nil)
+}
+
+// compileExprWith compiles an expression over the given fields.
+func compileExprWith(src string, vars map[string]exprFunc, indexed map[string]exprIndex) (exprFunc, error) {
+	p := &exprParser{src: src, vars: vars, indexed: indexed}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at %d.", p.src[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skip() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// accept consumes op if it's next.
+func (p *exprParser) accept(op byte) bool {
+	p.skip()
+	if p.pos < len(p.src) && p.src[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptOp consumes the (multi-character) op if it's next.
+func (p *exprParser) acceptOp(op string) bool {
+	p.skip()
+	if strings.HasPrefix(p.src[p.pos:], op) {
+		p.pos += len(op)
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) or() (exprFunc, error) {
+	l, err := p.and()
+	for err == nil {
+		var r exprFunc
+		if !p.acceptOp("||") {
+			return l, nil
+		}
+		if r, err = p.and(); err == nil {
+			l = exprOr(l, r)
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) and() (exprFunc, error) {
+	l, err := p.comparison()
+	for err == nil {
+		var r exprFunc
+		if !p.acceptOp("&&") {
+			return l, nil
+		}
+		if r, err = p.comparison(); err == nil {
+			l = exprAnd(l, r)
+		}
+	}
+	return nil, err
+}
+
+// comparisons don't chain: a < b < c is an error.
+func (p *exprParser) comparison() (exprFunc, error) {
+	l, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if !p.acceptOp(op) {
+			continue
+		}
+		r, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return exprCompare(op, l, r), nil
+	}
+	return l, nil
+}
+
+func (p *exprParser) sum() (exprFunc, error) {
+	l, err := p.product()
+	for err == nil {
+		var r exprFunc
+		switch {
+		case p.accept('+'):
+			if r, err = p.product(); err == nil {
+				l = exprAdd(l, r)
+			}
+		case p.accept('-'):
+			if r, err = p.product(); err == nil {
+				l = exprSub(l, r)
+			}
+		default:
+			return l, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) product() (exprFunc, error) {
+	l, err := p.unary()
+	for err == nil {
+		var r exprFunc
+		switch {
+		case p.accept('*'):
+			if r, err = p.unary(); err == nil {
+				l = exprMul(l, r)
+			}
+		case p.accept('/'):
+			if r, err = p.unary(); err == nil {
+				l = exprDiv(l, r)
+			}
+		default:
+			return l, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) unary() (exprFunc, error) {
+	if p.accept('-') {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *TCPAccounting, secs float64) float64 { return -e(f, secs) }, nil
+	}
+	if p.accept('!') {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *TCPAccounting, secs float64) float64 { return exprBool(!exprTrue(e(f, secs))) }, nil
+	}
+	if p.accept('(') {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ) at %d.", p.pos)
+		}
+		return e, nil
+	}
+	return p.operand()
+}
+
+func (p *exprParser) operand() (exprFunc, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) && strings.IndexByte(metricNameChars, p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	tok := p.src[start:p.pos]
+	switch {
+	case tok == "" && p.pos < len(p.src):
+		return nil, fmt.Errorf("unexpected %q at %d.", p.src[p.pos], p.pos)
+	case tok == "":
+		return nil, errors.New("unexpected end of expression.")
+	case tok[0] >= '0' && tok[0] <= '9' || tok[0] == '.':
+		n, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d.", tok, start)
+		}
+		return func(*TCPAccounting, float64) float64 { return n }, nil
+	}
+	if ix, ok := p.indexed[tok]; ok {
+		if !p.accept('[') {
+			return nil, fmt.Errorf("missing [ after %q at %d.", tok, p.pos)
+		}
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(']') {
+			return nil, fmt.Errorf("missing ] at %d.", p.pos)
+		}
+		return func(f *TCPAccounting, secs float64) float64 {
+			i := e(f, secs)
+			if i < 0 || i > math.MaxInt32 || math.IsNaN(i) {
+				return math.NaN()
+			}
+			return ix(f, int(i))
+		}, nil
+	}
+	v, ok := p.vars[tok]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at %d.", tok, start)
+	}
+	return v, nil
+}
+
+// exprTrue tells whether a value holds as a condition: non-zero, and not NaN.
+func exprTrue(v float64) bool {
+	return v != 0 && !math.IsNaN(v)
+}
+
+func exprBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func exprOr(l, r exprFunc) exprFunc {
+	return func(f *TCPAccounting, secs float64) float64 {
+		return exprBool(exprTrue(l(f, secs)) || exprTrue(r(f, secs)))
+	}
+}
+
+func exprAnd(l, r exprFunc) exprFunc {
+	return func(f *TCPAccounting, secs float64) float64 {
+		return exprBool(exprTrue(l(f, secs)) && exprTrue(r(f, secs)))
+	}
+}
+
+func exprCompare(op string, l, r exprFunc) exprFunc {
+	var cmp func(a, b float64) bool
+	switch op {
+	case "==":
+		cmp = func(a, b float64) bool { return a == b }
+	case "!=":
+		// NaN compares false either way.
+		cmp = func(a, b float64) bool { return a != b && !math.IsNaN(a) && !math.IsNaN(b) }
+	case "<=":
+		cmp = func(a, b float64) bool { return a <= b }
+	case ">=":
+		cmp = func(a, b float64) bool { return a >= b }
+	case "<":
+		cmp = func(a, b float64) bool { return a < b }
+	default:
+		cmp = func(a, b float64) bool { return a > b }
+	}
+	return func(f *TCPAccounting, secs float64) float64 { return exprBool(cmp(l(f, secs), r(f, secs))) }
+}
+
+func exprAdd(l, r exprFunc) exprFunc {
+	return func(f *TCPAccounting, secs float64) float64 { return l(f, secs) + r(f, secs) }
+}
+
+func exprSub(l, r exprFunc) exprFunc {
+	return func(f *TCPAccounting, secs float64) float64 { return l(f, secs) - r(f, secs) }
+}
+
+func exprMul(l, r exprFunc) exprFunc {
+	return func(f *TCPAccounting, secs float64) float64 { return l(f, secs) * r(f, secs) }
+}
+
+func exprDiv(l, r exprFunc) exprFunc {
+	return func(f *TCPAccounting, secs float64) float64 { return l(f, secs) / r(f, secs) }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputedMetrics(t *testing.T) {
+	metrics, err := newComputedMetrics(map[string]string{
+		"retransmit_ratio": "retransmits / packets_sent",
+		"rtt_spread":       "rtt_max - rtt_min",
+		"retx_per_sec":     "(retransmits + retransmits_received) / interval",
+		"weighted":         "-2 * (rtt_avg - 1.5) + jitter",
+		"degraded":         "rtt_avg > 5 && !(retransmits == 2) || jitter < 0",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error compiling metrics: %v", err)
+	}
+
+	flow := &TCPAccounting{
+		SRTT:           uint64(10 * time.Millisecond),
+		Jitter:         uint64(time.Millisecond),
+		Min:            uint64(5 * time.Millisecond),
+		Max:            uint64(25 * time.Millisecond),
+		Segments:       120,
+		RepSegments:    20,
+		Retransmits:    7,
+		RepRetransmits: 2,
+		Rcvd:           seqSpace{Retransmits: 5},
+	}
+	expected := map[string]float64{
+		computedMetricPrefix + "retransmit_ratio": 0.05,
+		computedMetricPrefix + "rtt_spread":       20,
+		computedMetricPrefix + "retx_per_sec":     0.5,
+		computedMetricPrefix + "weighted":         -16,
+		computedMetricPrefix + "degraded":         1,
+	}
+	for _, m := range metrics {
+		if v := m.eval(flow, 20); v != expected[m.name] {
+			t.Errorf("Expected %s = %v, got %v", m.name, expected[m.name], v)
+		}
+	}
+
+	for expr, ok := range map[string]bool{
+		"retransmits/packets_sent": true,
+		"((rtt))":                  true,
+		"rtt +":                    false,
+		"(rtt":                     false,
+		"rtt rtt":                  false,
+		"bytes_in_flight":          false,
+		"1..2":                     false,
+		"rtt % 2":                  false,
+		"rtt >= 1 || !jitter":      true,
+		"rtt != 0 == 1":            false,
+		"payload[0] == 1":          false,
+		"rtt &&":                   false,
+	} {
+		if _, err := compileExpr(expr); (err == nil) != ok {
+			t.Errorf("Unexpected result compiling %q: %v", expr, err)
+		}
+	}
+	if _, err := newComputedMetrics(map[string]string{"Bad Name": "rtt"}); err == nil {
+		t.Errorf("Expected bad metric name to be rejected")
+	}
+}
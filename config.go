@@ -2,44 +2,217 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
 	"gopkg.in/yaml.v2"
 )
 
-const fileInterface = "file"
+const (
+	fileInterface = "file"
+
+	// configVersion is the current configuration schema version. Files with no
+	// explicit version are considered version 1.
+	configVersion = 2
+
+	// Flow endpoint tagging modes.
+	tagModeSrcDst       = "src_dst"       // src:local, dst:remote (default)
+	tagModeLocalRemote  = "local_remote"  // local:, remote:
+	tagModeClientServer = "client_server" // client:, server: - by handshake direction
+)
 
 type InitConfig struct {
-	Snaplen    int    `yaml:"snaplen"`
-	IdleTTL    int    `yaml:"idle_ttl"`
-	ExpTTL     int    `yaml:"expired_ttl"`
-	StatsdIP   string `yaml:"statsd_ip"`
-	StatsdPort int    `yaml:"statsd_port"`
-	LogToFile  bool   `yaml:"log_to_file"`
-	LogLevel   string `yaml:"log_level"`
+	Snaplen         int                 `yaml:"snaplen"`
+	IdleTTL         int                 `yaml:"idle_ttl"`
+	ExpTTL          int                 `yaml:"expired_ttl"`
+	StatsdIP        string              `yaml:"statsd_ip"`
+	StatsdPort      int                 `yaml:"statsd_port"`
+	LogToFile       bool                `yaml:"log_to_file"`
+	LogLevel        string              `yaml:"log_level"`
+	TimestampSource string              `yaml:"timestamp_source"`
+	HeadersOnly     bool                `yaml:"headers_only"`
+	Reporter        string              `yaml:"reporter"`
+	APIKey          string              `yaml:"api_key"`
+	APIURL          string              `yaml:"api_url"`
+	OTLPEndpoint    string              `yaml:"otlp_endpoint"`
+	OTLPHeaders     map[string]string   `yaml:"otlp_headers"`
+	DedupKeys       bool                `yaml:"dedup_keys"`
+	Jitter          float64             `yaml:"jitter"`
+	Soften          *bool               `yaml:"soften"`
+	StartupTimeout  int                 `yaml:"startup_timeout"`
+	ControlAPI      string              `yaml:"control_api"`
+	Maintenance     []MaintenanceConfig `yaml:"maintenance"`
+	Experiments     []ExperimentConfig  `yaml:"chaos_experiments"`
+	Election        *ElectionConfig     `yaml:"election"`
+	Spool           *SpoolConfig        `yaml:"spool"`
+	Sidecar         *SidecarConfig      `yaml:"analyzer_sidecar"`
+
+	// Deprecated - kept around so migrations can pick them up.
+	LegacyExpTTL int `yaml:"exp_ttl"`
 }
 
 type Config struct {
-	Interface      string   `yaml:"interface"`
-	Pcap           string   `yaml:"pcap"`
-	Sample         bool     `yaml:"sample"`
-	SampleDuration int      `yaml:"sample_duration"`
-	SampleInterval int      `yaml:"sample_interval"`
-	Ips            []string `yaml:"ips"`
-	Hosts          []string `yaml:"hosts"`
-	Tags           []string `yaml:"tags"`
+	Interface      string               `yaml:"interface"`
+	Pcap           string               `yaml:"pcap"`
+	PcapWorkers    int                  `yaml:"pcap_workers"`
+	ReplaySpeed    float64              `yaml:"replay_speed"`
+	OfflineFilter  *OfflineFilterConfig `yaml:"offline_filter"`
+	Summary        *SummaryConfig       `yaml:"summary"`
+	Promisc        bool                 `yaml:"promiscuous"`
+	Mirror         bool                 `yaml:"mirror"`
+	Capture        string               `yaml:"capture"`
+	IgnoreOffloads bool                 `yaml:"ignore_offloads"`
+	Calibration    string               `yaml:"clock_calibration"`
+	VLANTags       bool                 `yaml:"vlan_tags"`
+	VLANStats      bool                 `yaml:"vlan_stats"`
+	MACTags        bool                 `yaml:"mac_tags"`
+	DSCPTags       bool                 `yaml:"dscp_tags"`
+	SYNTags        bool                 `yaml:"syn_tags"`
+	Tunnels        bool                 `yaml:"tunnels"`
+	UDP            *UDPConfig           `yaml:"udp"`
+	ICMP           bool                 `yaml:"icmp"`
+	DNS            bool                 `yaml:"dns"`
+	Sample         bool                 `yaml:"sample"`
+	SampleDuration int                  `yaml:"sample_duration"`
+	SampleInterval int                  `yaml:"sample_interval"`
+	Ips            []string             `yaml:"ips"`
+	Hosts          []string             `yaml:"hosts"`
+	Lookup         map[string]string    `yaml:"lookup"`
+	Tags           []string             `yaml:"tags"`
+	Metrics        []string             `yaml:"metrics"`
+	TagMode        string               `yaml:"tag_mode"`
+	MinLifetime    int                  `yaml:"min_flow_lifetime"` // ms
+	Enrichment     []ResolverConfig     `yaml:"enrichment"`
+	Aggregation    *AggregationConfig   `yaml:"aggregation"`
+	TrafficClass   *ClassifierConfig    `yaml:"traffic_class"`
+	Policies       *PolicyConfig        `yaml:"policies"`
+	Tee            *TeeConfig           `yaml:"tee"`
+	Matrix         *MatrixConfig        `yaml:"matrix"`
+	Narrowing      *NarrowingConfig     `yaml:"adaptive_filter"`
+	BGP            *BGPConfig           `yaml:"bgp"`
+	SwitchPorts    *SwitchPortConfig    `yaml:"switch_ports"`
+	Tracing        *TracingConfig       `yaml:"pipeline_tracing"`
+	DPDK           *DPDKConfig          `yaml:"dpdk"`
+	Health         *HealthConfig        `yaml:"health"`
+	HealthChecks   *HealthCheckConfig   `yaml:"health_checks"`
+	CloudLBs       *CloudLBConfig       `yaml:"cloud_lbs"`
+	Analyzers      []string             `yaml:"analyzers"`
+	SocketStats    bool                 `yaml:"socket_stats"`
+	LinkStats      bool                 `yaml:"link_stats"`
+	PeerGroups     map[string][]string  `yaml:"peer_groups"`
+	Computed       map[string]string    `yaml:"computed_metrics"`
+	Smoothing      *SmoothingConfig     `yaml:"smoothing"`
+	Soften         *bool                `yaml:"soften"` // overrides init_config's
+	Percentiles    bool                 `yaml:"rtt_percentiles"`
+	Scripts        []ScriptConfig       `yaml:"script_analyzers"`
+	Hooks          []HookConfig         `yaml:"hooks"`
+	Filters        map[string]string    `yaml:"filters"`
+}
+
+// AggregationConfig defines an extra dimension (eg. availability zone) flows
+// are tagged and rolled up by, derived from the endpoint IPs.
+type AggregationConfig struct {
+	Tag    string            `yaml:"tag"`
+	Ranges map[string]string `yaml:"ranges"`
 }
 
 type MetroConfig struct {
+	Version  int        `yaml:"version"`
 	InitConf InitConfig `yaml:"init_config"`
 	Configs  []Config   `yaml:"instances"`
 }
 
+// configMigrations[i] upgrades a configuration from schema version i+1 to i+2.
+// New options should be added with a migration whenever they replace or change
+// the meaning of an existing one, so older YAML files keep working.
+var configMigrations = []func(*MetroConfig){
+	migrateV1,
+}
+
+// v1 -> v2: "exp_ttl" (as documented in the sample config) was never actually
+// read, the parser expected "expired_ttl".
+func migrateV1(c *MetroConfig) {
+	if c.InitConf.LegacyExpTTL != 0 {
+		log.Warnf("Configuration option \"exp_ttl\" is deprecated, please use \"expired_ttl\" instead.")
+		if c.InitConf.ExpTTL == 0 {
+			c.InitConf.ExpTTL = c.InitConf.LegacyExpTTL
+		}
+		c.InitConf.LegacyExpTTL = 0
+	}
+}
+
+func (c *MetroConfig) migrate() error {
+	if c.Version == 0 {
+		c.Version = 1
+	}
+	if c.Version > configVersion {
+		return fmt.Errorf("Unsupported configuration version %d (latest supported: %d).", c.Version, configVersion)
+	}
+	if c.Version < configVersion {
+		log.Warnf("Configuration version %d is deprecated, migrating to version %d - please update your configuration file.", c.Version, configVersion)
+	}
+	for ; c.Version < configVersion; c.Version++ {
+		configMigrations[c.Version-1](c)
+	}
+	return nil
+}
+
 func (c *MetroConfig) Parse(data []byte) error {
 	if err := yaml.Unmarshal(data, c); err != nil {
 		return err
 	}
+	if err := c.migrate(); err != nil {
+		return err
+	}
 	if len(c.Configs) == 0 {
 		return errors.New("No sniffing interfaces specified.")
 	}
+	switch c.InitConf.Reporter {
+	case "", reporterStatsd, reporterOTLP:
+	case reporterDatadogAPI:
+		if c.InitConf.APIKey == "" {
+			return errors.New("Error parsing configuration - api_key required by the api reporter.")
+		}
+	default:
+		return fmt.Errorf("Error parsing configuration - unknown reporter %q.", c.InitConf.Reporter)
+	}
+	if c.InitConf.DedupKeys && c.InitConf.Reporter != "" && c.InitConf.Reporter != reporterStatsd {
+		return errors.New("Error parsing configuration - dedup_keys require the statsd reporter.")
+	}
+	if c.InitConf.Jitter < 0 || c.InitConf.Jitter >= 1 {
+		return errors.New("Error parsing configuration - jitter must be between 0 and 1.")
+	}
+	if c.InitConf.StartupTimeout < 0 {
+		return errors.New("Error parsing configuration - startup_timeout must be positive.")
+	}
+	if c.InitConf.Election != nil {
+		if err := c.InitConf.Election.validate(); err != nil {
+			return err
+		}
+	}
+	if c.InitConf.Spool != nil {
+		if err := c.InitConf.Spool.validate(); err != nil {
+			return err
+		}
+	}
+	if c.InitConf.Sidecar != nil {
+		if err := c.InitConf.Sidecar.validate(); err != nil {
+			return err
+		}
+	}
+	for i := range c.InitConf.Maintenance {
+		if _, err := newMaintenanceWindow(c.InitConf.Maintenance[i], time.Now()); err != nil {
+			return fmt.Errorf("Error parsing configuration - bad maintenance window: %v", err)
+		}
+	}
+	for i := range c.InitConf.Experiments {
+		if _, err := newChaosExperiment(c.InitConf.Experiments[i], time.Now()); err != nil {
+			return fmt.Errorf("Error parsing configuration - bad chaos experiment: %v", err)
+		}
+	}
 
 	for i := range c.Configs {
 		if c.Configs[i].Interface == "" {
@@ -47,6 +220,111 @@ func (c *MetroConfig) Parse(data []byte) error {
 		} else if c.Configs[i].Interface == fileInterface && c.Configs[i].Pcap == "" {
 			return errors.New("Error parsing configuration - empty pcap field for file interface.")
 		}
+		if cidr := strings.TrimPrefix(c.Configs[i].Interface, autoInterface+":"); cidr != c.Configs[i].Interface {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("Error parsing configuration - bad auto interface CIDR %q.", cidr)
+			}
+		}
+		if backend := c.Configs[i].Capture; backend != "" {
+			if _, ok := captureBackends[backend]; !ok {
+				return fmt.Errorf("Error parsing configuration - capture backend %q unavailable, try one of: %s.", backend, strings.Join(captureBackendNames(), ", "))
+			}
+		}
+		switch c.Configs[i].TagMode {
+		case "", tagModeSrcDst, tagModeLocalRemote, tagModeClientServer:
+		default:
+			return fmt.Errorf("Error parsing configuration - unknown tag_mode %q.", c.Configs[i].TagMode)
+		}
+		for _, a := range c.Configs[i].Analyzers {
+			if a != analyzerHTTP {
+				return fmt.Errorf("Error parsing configuration - unknown analyzer %q.", a)
+			}
+		}
+		if c.Configs[i].OfflineFilter != nil {
+			if _, err := newOfflineFilter(c.Configs[i].OfflineFilter); err != nil {
+				return fmt.Errorf("Error parsing configuration - bad offline_filter: %v", err)
+			}
+		}
+		if c.Configs[i].Summary != nil {
+			if err := c.Configs[i].Summary.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].MinLifetime < 0 {
+			return errors.New("Error parsing configuration - min_flow_lifetime must be positive.")
+		}
+		if c.Configs[i].ReplaySpeed < 0 {
+			return errors.New("Error parsing configuration - replay_speed must be positive.")
+		}
+		switch c.Configs[i].Calibration {
+		case "", clockCalibrationReport, clockCalibrationApply:
+		default:
+			return fmt.Errorf("Error parsing configuration - unknown clock_calibration %q.", c.Configs[i].Calibration)
+		}
+		if c.Configs[i].Health != nil {
+			if err := c.Configs[i].Health.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].HealthChecks != nil {
+			if err := c.Configs[i].HealthChecks.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].CloudLBs != nil {
+			if err := c.Configs[i].CloudLBs.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].UDP != nil {
+			if err := c.Configs[i].UDP.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].Matrix != nil {
+			if err := c.Configs[i].Matrix.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].Narrowing != nil {
+			if err := c.Configs[i].Narrowing.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].BGP != nil {
+			if err := c.Configs[i].BGP.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].SwitchPorts != nil {
+			if err := c.Configs[i].SwitchPorts.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].Tracing != nil {
+			if err := c.Configs[i].Tracing.validate(); err != nil {
+				return err
+			}
+		}
+		if c.Configs[i].Smoothing != nil {
+			if err := c.Configs[i].Smoothing.validate(); err != nil {
+				return err
+			}
+		}
+		if err := validateFilters(c.Configs[i].Filters); err != nil {
+			return err
+		}
+		for j := range c.Configs[i].Scripts {
+			if err := c.Configs[i].Scripts[j].validate(); err != nil {
+				return err
+			}
+		}
+		if _, err := newComputedMetrics(c.Configs[i].Computed); err != nil {
+			return err
+		}
+		if _, err := newAnalyzerHooks(c.Configs[i].Hooks); err != nil {
+			return err
+		}
 	}
 
 	return nil
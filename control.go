@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// ControlServer serves the HTTP control API, used to adjust a running
+// go-metro, eg.:
+//
+//	GET    /maintenance            list pending and active maintenance windows
+//	POST   /maintenance            schedule a window (MaintenanceConfig as JSON)
+//	DELETE /maintenance/<id>       cancel a window
+//	GET    /instances              list sniffer instances
+//	POST   /instances              add an instance (InstanceRequest as JSON)
+//	DELETE /instances/<id>         remove an instance
+//	POST   /instances/<id>/pause   stop sniffing, keeping the instance around
+//	POST   /instances/<id>/resume  resume sniffing
+//	POST   /instances/<id>/pause_capture   release the capture handle, keeping flows
+//	POST   /instances/<id>/resume_capture  reopen the capture handle
+//	GET    /features               list feature flags overridden at runtime
+//	PUT    /features               override flags (JSON object, null resets one)
+//	DELETE /features/<flag>        reset a flag to its configuration
+//	GET    /features/audit         list the latest flag changes
+//	GET    /annotations            list flow annotations
+//	POST   /annotations            annotate flows (AnnotationConfig as JSON)
+//	DELETE /annotations/<id>       remove an annotation
+//	GET    /experiments            list chaos experiments and their verdicts
+//	POST   /experiments            declare an experiment (ExperimentConfig as JSON)
+//	DELETE /experiments/<id>       drop an experiment
+//	GET    /destinations           list destinations by RTT, lowest first (?port=, ?limit=,
+//	                               ?format=srv for SRV record data: priority weight port target)
+type ControlServer struct {
+	srv       *http.Server
+	listener  net.Listener
+	maint     *maintenanceSchedule
+	instances *instanceManager
+	features  *featureFlags
+	notes     *annotationStore
+	exps      *chaosExperiments
+	board     *latencyBoard
+}
+
+func NewControlServer(addr string, maint *maintenanceSchedule, instances *instanceManager) *ControlServer {
+	c := &ControlServer{maint: maint, instances: instances, features: features, notes: annotations, exps: experiments, board: destinations}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/maintenance", c.handleMaintenance)
+	mux.HandleFunc("/maintenance/", c.handleMaintenance)
+	mux.HandleFunc("/features", c.handleFeatures)
+	mux.HandleFunc("/features/", c.handleFeatures)
+	mux.HandleFunc("/annotations", c.handleAnnotations)
+	mux.HandleFunc("/annotations/", c.handleAnnotations)
+	mux.HandleFunc("/experiments", c.handleExperiments)
+	mux.HandleFunc("/experiments/", c.handleExperiments)
+	mux.HandleFunc("/destinations", c.handleDestinations)
+	if instances != nil {
+		mux.HandleFunc("/instances", c.handleInstances)
+		mux.HandleFunc("/instances/", c.handleInstances)
+	}
+	c.srv = &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return c
+}
+
+// Start listens on the configured address and serves requests in the
+// background.
+func (c *ControlServer) Start() error {
+	l, err := net.Listen("tcp", c.srv.Addr)
+	if err != nil {
+		return err
+	}
+	c.listener = l
+	go func() {
+		if err := c.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Control API stopped: %v", err)
+		}
+	}()
+	log.Infof("Control API listening on %s", l.Addr())
+	return nil
+}
+
+func (c *ControlServer) Stop() error {
+	return c.srv.Close()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (c *ControlServer) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/maintenance"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, c.maint.List(time.Now()))
+	case req.Method == http.MethodPost && id == "":
+		var cfg MaintenanceConfig
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := c.maint.Add(cfg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Infof("Maintenance window %d scheduled via control API: %v until %s (%s)", n, cfg.Destinations, cfg.End, cfg.Reason)
+		writeJSON(w, http.StatusCreated, map[string]int{"id": n})
+	case req.Method == http.MethodDelete && id != "":
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !c.maint.Remove(n) {
+			http.NotFound(w, req)
+			return
+		}
+		log.Infof("Maintenance window %d cancelled via control API", n)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *ControlServer) handleAnnotations(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/annotations"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, c.notes.List(time.Now()))
+	case req.Method == http.MethodPost && id == "":
+		var cfg AnnotationConfig
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := c.notes.Add(cfg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Infof("Annotation %d set via control API: %v on %v %v", n, cfg.Tags, cfg.Destinations, cfg.Flows)
+		writeJSON(w, http.StatusCreated, map[string]int{"id": n})
+	case req.Method == http.MethodDelete && id != "":
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !c.notes.Remove(n) {
+			http.NotFound(w, req)
+			return
+		}
+		log.Infof("Annotation %d removed via control API", n)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *ControlServer) handleDestinations(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	var port uint64
+	var limit int
+	var err error
+	if p := q.Get("port"); p != "" {
+		if port, err = strconv.ParseUint(p, 10, 16); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("Bad limit."))
+			return
+		}
+	}
+
+	list := c.board.List(time.Now(), uint16(port))
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	switch q.Get("format") {
+	case "":
+		writeJSON(w, http.StatusOK, list)
+	case "srv":
+		// ranked by priority, lowest RTT first.
+		w.Header().Set("Content-Type", "text/plain")
+		for i, d := range list {
+			target := d.Name
+			if target == "" {
+				target = d.IP
+			}
+			fmt.Fprintf(w, "%d 0 %d %s.\n", i, d.Port, strings.TrimSuffix(target, "."))
+		}
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("Unknown format, expected srv."))
+	}
+}
+
+func (c *ControlServer) handleExperiments(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/experiments"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, c.exps.List(time.Now()))
+	case req.Method == http.MethodPost && id == "":
+		var cfg ExperimentConfig
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := c.exps.Add(cfg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Infof("Chaos experiment %d (%s) declared via control API: %.3f ms added to %v until %s", n, cfg.Name, cfg.Latency, cfg.Destinations, cfg.End)
+		writeJSON(w, http.StatusCreated, map[string]int{"id": n})
+	case req.Method == http.MethodDelete && id != "":
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !c.exps.Remove(n) {
+			http.NotFound(w, req)
+			return
+		}
+		log.Infof("Chaos experiment %d dropped via control API", n)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *ControlServer) handleInstances(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/instances"), "/")
+	if path == "" {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, c.instances.List())
+		case http.MethodPost:
+			var ireq InstanceRequest
+			if err := json.NewDecoder(req.Body).Decode(&ireq); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			cfg := Config{Interface: ireq.Interface, Ips: ireq.Ips, Hosts: ireq.Hosts, Tags: ireq.Tags}
+			ids, err := c.instances.Add(cfg, ireq.Filter)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			log.Infof("Instances %v added via control API on %q", ids, ireq.Interface)
+			writeJSON(w, http.StatusCreated, map[string][]int{"ids": ids})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		http.NotFound(w, req)
+		return
+	}
+	var action string
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch {
+	case req.Method == http.MethodDelete && action == "":
+		err = c.instances.Remove(id)
+	case req.Method == http.MethodPost && action == "pause":
+		err = c.instances.Pause(id)
+	case req.Method == http.MethodPost && action == "resume":
+		err = c.instances.Resume(id)
+	case req.Method == http.MethodPost && action == "pause_capture":
+		err = c.instances.PauseCapture(id)
+	case req.Method == http.MethodPost && action == "resume_capture":
+		err = c.instances.ResumeCapture(id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch err {
+	case nil:
+		if action == "" {
+			action = "remove"
+		}
+		log.Infof("Instance %d: %s via control API", id, action)
+		w.WriteHeader(http.StatusNoContent)
+	case errNoSuchInstance:
+		writeError(w, http.StatusNotFound, err)
+	case errInstancePaused, errInstanceRunning, errCapturePaused, errCaptureRunning, errSnifferStopped:
+		writeError(w, http.StatusConflict, err)
+	case errCaptureOffline:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (c *ControlServer) handleFeatures(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/features"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && name == "":
+		writeJSON(w, http.StatusOK, c.features.List())
+	case req.Method == http.MethodGet && name == "audit":
+		writeJSON(w, http.StatusOK, c.features.Audit())
+	case (req.Method == http.MethodPut || req.Method == http.MethodPost) && name == "":
+		var changes map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&changes); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := c.features.Set(changes, "control API ("+req.RemoteAddr+")"); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.features.List())
+	case req.Method == http.MethodDelete && name != "" && name != "audit":
+		err := c.features.Set(map[string]interface{}{name: nil}, "control API ("+req.RemoteAddr+")")
+		if err == errNoSuchFeature {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -27,22 +27,104 @@ type TCPAccounting struct {
 	Dport, Sport layers.TCPPort
 
 	sync.RWMutex
-	SRTT      uint64
-	Jitter    uint64
-	Max       uint64
-	Min       uint64
-	Last      uint64
-	TS, TSecr uint32
-	Seen      map[uint32]struct{}
-	Timed     map[TCPKey]int64
-	Done      bool
-	Sampled   uint64
-	Seq       uint32
-	NextSeq   uint32
-	LastSz    uint32
-	Expire    *chan string
-	Alive     *time.Timer
-	LastFlush int64
+	SRTT           uint64
+	Jitter         uint64
+	Max            uint64
+	Min            uint64
+	Last           uint64
+	LastTS         int64 // capture timestamp of the last sample
+	Reported       bool
+	RepSRTT        uint64 // SRTT at the last report
+	Segments       uint64 // data segments sent by Src
+	Retransmits    uint64
+	RetxBytes      uint64 // payload sent again by Src
+	SentBytes      uint64 // payload sent by Src, retransmissions included
+	Resets         uint64 // RSTs seen, either direction
+	Bytes          uint64 // TCP payload, either direction
+	FirstSeen      int64  // capture timestamp of the first packet
+	LastSeen       int64  // capture timestamp of the last packet
+	RepSampled     uint64 // counters at the last report
+	RepSegments    uint64
+	RepRetransmits uint64
+	RepRetxBytes   uint64
+	RepSentBytes   uint64
+	RepRcvd        seqSpace
+	RepDupAcks     dupAcks
+	RepRcvdDupAcks dupAcks
+	RepWnd         rwnd
+	RepRcvdWnd     rwnd
+	RepECN         ecnMarks
+	RepRcvdECN     ecnMarks
+	RepSACK        sackLoss
+	RepRcvdSACK    sackLoss
+	RepResets      uint64
+	RepPathChanges uint64
+	RepLabels      uint64
+	RTTs           *ExpHistogram // samples since the last report (ms), OTLP only
+	Traces         []TraceRef    // since the last report, http analyzer only
+	HookTallies    []hookTally   // packet hooks' since the last report, by hook
+	hooked         *hookSegment  // segment being evaluated by packet hooks
+	TS, TSecr      uint32
+	Seen           map[uint32]struct{}
+	Timed          map[TCPKey]int64
+	Done           bool
+	Client         bool     // true if Src initiated the connection
+	External       bool     // remote end outside our internal ranges
+	VLANs          []uint16 // outermost first, if tagging flows by VLAN
+	Tunnel         string   // tag of the encapsulating tunnel (vni:, gre_key:), if any
+	Iface          string   // capturing interface, if not the instance's (pcapng files)
+	Filters        []string // named filters the packet opening the flow matched
+	LocalMAC       string   // of Src, if tagging by MAC OUI
+	RemoteMAC      string   // of Dst, or the next hop to it, if tagging by switch port or OUI
+	QoS            string   // DSCP class of our segments, if tagging flows by DSCP
+	RcvdQoS        string   // likewise of Dst's, as delivered
+	RcvdHopLimit   uint8    // of Dst's last packet
+	FlowLabel      uint32   // of our last packet, IPv6 only
+	RcvdFlowLabel  uint32   // likewise of Dst's
+	Rcvd           seqSpace // sequence space of Dst's data segments
+	DupAcks        dupAcks  // Dst's duplicate ACKs, of Src's data
+	RcvdDupAcks    dupAcks  // likewise Src's, of Dst's data
+	Wnd            rwnd     // Dst's receive window, Src's data fills
+	RcvdWnd        rwnd     // likewise Src's
+	ECN            ecnMarks // ECN signals of Src's packets
+	RcvdECN        ecnMarks // likewise Dst's
+	SACK           sackLoss // holes in Src's data, as Dst SACKs it
+	RcvdSACK       sackLoss // likewise in Dst's
+	OWD            owdSplit // one-way legs of the RTT samples
+	NoTS           bool     // segments without timestamps, RTTs matched by seq/ACK
+	NoTSCounted    bool     // timestamp-less flow counted
+	TSHigh         uint32   // newest TSval sent, modulo wraparound
+	TimedSweep     int64    // capture timestamp Timed was last swept
+	seenOrder      []uint32 // Seen's keys, oldest first
+	timedOrder     []TCPKey // Timed's keys, oldest first (some since deleted)
+	Evicted        uint64   // entries evicted from Seen and Timed, since reported
+	PathChanges    uint64   // received hop limit changes
+	LabelChanges   uint64   // flow label changes, either direction
+	TLSClient      bool     // Src sent the ClientHello
+	TLSHello       int64    // capture timestamps of the ClientHello...
+	TLSServerHello int64    // ...and ServerHello
+	TLSHandshake   uint64   // ClientHello to client Finished (ns), 0 until done
+	TLSReported    bool     // handshake times submitted
+	MSS            uint16   // announced by Dst, 0 if the handshake wasn't seen
+	SrcMSS         uint16   // likewise announced by Src
+	SYN            int64    // capture timestamps of the first SYN...
+	SYNACK         int64    // ...and SYN-ACK
+	SYNACKTime     uint64   // SYN to SYN-ACK (ns), 0 until the handshake completes
+	ACKTime        uint64   // SYN-ACK to the client's ACK (ns)
+	ConnReported   bool     // connect times submitted
+	Refused        bool     // the SYN was answered with a RST
+	ConnFailed     bool     // failed connection attempt counted
+	FINs           uint8    // FINs seen, finSrc and finDst
+	Close          string   // how the connection ended, fin or reset
+	ResetLocal     bool     // Src sent the RST
+	CloseCounted   bool     // connection close counted
+	Sampled        uint64
+	Seq            uint32
+	NextSeq        uint32
+	LastSz         uint32
+	Expire         *chan string
+	Alive          *time.Timer
+	LastFlush      int64
 }
 
 // New creates a new stream.  It's called whenever the assembler sees a stream
@@ -63,6 +145,7 @@ func NewTCPAccounting(src net.IP, dst net.IP, sport layers.TCPPort, dport layers
 		TSecr:     0,
 		Seq:       0,
 		Done:      false,
+		Client:    sport > dport,
 		Seen:      make(map[uint32]struct{}),
 		Timed:     make(map[TCPKey]int64),
 		Expire:    expire,
@@ -79,8 +162,10 @@ func (t *TCPAccounting) SetExpiration(ttl time.Duration, expkey string) {
 	t.Alive = time.AfterFunc(ttl, func() {
 		t.Lock()
 		t.Done = true
+		// the flow may be merged into another map meanwhile.
+		expire := *t.Expire
 		t.Unlock()
-		*t.Expire <- expkey
+		expire <- expkey
 	})
 }
 
@@ -89,6 +174,7 @@ func (t *TCPAccounting) Flush() {
 	//Current maps will be GC'd
 	t.Seen = make(map[uint32]struct{})
 	t.Timed = make(map[TCPKey]int64)
+	t.seenOrder, t.timedOrder = nil, nil
 
 	t.LastFlush = time.Now().Unix()
 }
@@ -134,12 +220,18 @@ func (tb *TimedMap) Delete(key string) {
 type FlowMap struct {
 	sync.RWMutex
 	Map    map[string]*TCPAccounting
+	UDP    map[string]*UDPAccounting  // expired when reported, hold the lock
+	ICMP   map[string]*ICMPAccounting // likewise
+	DNS    map[string]*DNSAccounting  // likewise, by resolver
 	Expire chan string
 }
 
 func NewFlowMap() *FlowMap {
 	m := &FlowMap{
 		Map:    make(map[string]*TCPAccounting),
+		UDP:    make(map[string]*UDPAccounting),
+		ICMP:   make(map[string]*ICMPAccounting),
+		DNS:    make(map[string]*DNSAccounting),
 		Expire: make(chan string, CHAN_DEPTH),
 	}
 	return m
@@ -176,19 +268,32 @@ func (f *FlowMap) Delete(key string) {
 	f.Unlock()
 }
 
+// Keys returns a snapshot of the TCP flow keys.
+func (f *FlowMap) Keys() []string {
+	f.RLock()
+	defer f.RUnlock()
+	keys := make([]string, 0, len(f.Map))
+	for k := range f.Map {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 // NOTE: Never call break on a loop that uses this FlowMapKeyIterator, or else you
 //       end up with uncollectable garabage becase the go routine this will be
 //       running in will continue to do so because we'll never read from the other
 //       end of the channel pipe. Sooooo... ONLY USE THIS IF YOU WISH TO ITERATE
 //       OVER THE ENTIRE KEYSET.
+//
+// Keys are sent off a snapshot: the map isn't locked meanwhile, so the loop
+// may Get, Add or Delete.
 func (f *FlowMap) FlowMapKeyIterator() <-chan string {
 	ch := make(chan string)
+	keys := f.Keys()
 	go func() {
-		f.RLock()
-		for k, _ := range f.Map {
+		for _, k := range keys {
 			ch <- k
 		}
-		f.RUnlock()
 		close(ch) // Remember to close or the loop never ends!
 	}()
 	return ch
@@ -227,6 +332,16 @@ func (t *TCPAccounting) CalcJitter(rtt uint64, soften bool) {
 	}
 }
 
+// TrackSeq accounts for a data segment sent by Src, detecting retransmissions
+// as segments not extending past the highest sequence number sent so far.
+// Returns whether the segment covers anything sent before.
+func (t *TCPAccounting) TrackSeq(seq uint32, sz uint32) bool {
+	s := seqSpace{Next: t.NextSeq, Segments: t.Segments, Bytes: t.SentBytes, Retransmits: t.Retransmits, RetxBytes: t.RetxBytes}
+	resent := s.track(seq, sz)
+	t.NextSeq, t.Segments, t.SentBytes, t.Retransmits, t.RetxBytes = s.Next, s.Segments, s.Bytes, s.Retransmits, s.RetxBytes
+	return resent
+}
+
 func (t *TCPAccounting) MaxRTT(sample uint64) {
 
 	if sample > t.Max {
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// dedupTag carries the flow-epoch key of a submission, for the dedup
+	// proxy to drop those already forwarded by another probe. The proxy strips
+	// it so it never makes it past it.
+	dedupTag = "metro_dedup"
+
+	defaultDedupListen = "127.0.0.1:8125"
+	defaultDedupWindow = 5 * time.Minute
+)
+
+// dedupKey is a deterministic key for a submission: probes watching the same
+// traffic report the same flow, metric and reporting epoch under the same key.
+func dedupKey(metric, flow string, ts int64, interval int32) string {
+	h := fnv.New64a()
+	h.Write([]byte(metric))
+	h.Write([]byte{0})
+	h.Write([]byte(flow))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(ts/int64(interval), 10)))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// dedupProxy forwards statsd datagrams, dropping metrics whose dedup key was
+// already seen within the window.
+type dedupProxy struct {
+	sync.Mutex
+	window  time.Duration
+	seen    map[string]time.Time
+	remarks *remarks
+	next    time.Time // next expiry sweep
+}
+
+func newDedupProxy(window time.Duration) *dedupProxy {
+	return &dedupProxy{
+		window:  window,
+		seen:    make(map[string]time.Time),
+		remarks: newRemarks(window),
+		next:    time.Now().Add(window),
+	}
+}
+
+// filter returns the datagram minus duplicate metrics, and with the dedup
+// tags stripped off the rest. DSCP observations are consumed, turned into
+// events when traffic was re-marked on its way.
+func (p *dedupProxy) filter(datagram []byte, now time.Time) []byte {
+	p.Lock()
+	defer p.Unlock()
+	if now.After(p.next) {
+		for k, ts := range p.seen {
+			if now.Sub(ts) > p.window {
+				delete(p.seen, k)
+			}
+		}
+		p.remarks.expire(now)
+		p.next = now.Add(p.window)
+	}
+
+	var out bytes.Buffer
+	for _, line := range bytes.Split(datagram, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte(dscpObservation+":")) {
+			if line = p.remarks.observe(line, now); line == nil {
+				continue
+			}
+		}
+		line, key := stripDedupTag(line)
+		if key != "" {
+			if ts, ok := p.seen[key]; ok && now.Sub(ts) <= p.window {
+				continue
+			}
+			p.seen[key] = now
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// stripDedupTag removes the dedup tag from a statsd line
+// (name:value|type[|@rate][|#tag,...]), returning the key it held.
+func stripDedupTag(line []byte) ([]byte, string) {
+	prefix := []byte(dedupTag + ":")
+	i := bytes.Index(line, []byte("|#"))
+	if i < 0 {
+		return line, ""
+	}
+	tags := bytes.Split(line[i+2:], []byte(","))
+	kept := tags[:0]
+	key := ""
+	for _, t := range tags {
+		if bytes.HasPrefix(t, prefix) {
+			key = string(t[len(prefix):])
+			continue
+		}
+		kept = append(kept, t)
+	}
+	if key == "" {
+		return line, ""
+	}
+
+	out := append([]byte{}, line[:i]...)
+	if len(kept) > 0 {
+		out = append(out, "|#"...)
+		out = append(out, bytes.Join(kept, []byte(","))...)
+	}
+	return out, key
+}
+
+// runDedup implements the dedup subcommand, a statsd proxy between
+// active-active probes and the agent:
+//
+//	go-metro dedup [-listen addr] [-window d] -forward addr
+func runDedup(args []string) int {
+	fs := flag.NewFlagSet("dedup", flag.ContinueOnError)
+	listen := fs.String("listen", defaultDedupListen, "Address to receive statsd metrics on.")
+	forward := fs.String("forward", "", "Address of the statsd server to forward metrics to.")
+	window := fs.Duration("window", defaultDedupWindow, "How long submission keys are remembered.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s dedup [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *forward == "" {
+		fs.Usage()
+		return 2
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", *listen)
+	if err != nil {
+		log.Criticalf("Bad listen address %q: %v", *listen, err)
+		return 1
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Criticalf("Unable to listen on %q: %v", *listen, err)
+		return 1
+	}
+	defer conn.Close()
+	out, err := net.Dial("udp", *forward)
+	if err != nil {
+		log.Criticalf("Unable to forward to %q: %v", *forward, err)
+		return 1
+	}
+	defer out.Close()
+
+	log.Infof("Deduplicating statsd metrics from %s to %s", *listen, *forward)
+	p := newDedupProxy(*window)
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Errorf("Error receiving metrics: %v", err)
+			return 1
+		}
+		if data := p.filter(buf[:n], time.Now()); len(data) > 0 {
+			if _, err := out.Write(data); err != nil {
+				log.Warnf("Error forwarding metrics: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupKey(t *testing.T) {
+	k := dedupKey("system.net.tcp.rtt.avg", "10.0.0.1:40000-10.0.0.2:443", 1000, 30)
+	if k != dedupKey("system.net.tcp.rtt.avg", "10.0.0.1:40000-10.0.0.2:443", 1019, 30) {
+		t.Fatalf("Expected the same key within a reporting epoch")
+	}
+	if k == dedupKey("system.net.tcp.rtt.avg", "10.0.0.1:40000-10.0.0.2:443", 1020, 30) {
+		t.Fatalf("Expected a different key in the next reporting epoch")
+	}
+	if k == dedupKey("system.net.tcp.rtt.jitter", "10.0.0.1:40000-10.0.0.2:443", 1000, 30) {
+		t.Fatalf("Expected a different key for a different metric")
+	}
+}
+
+func TestDedupProxy(t *testing.T) {
+	p := newDedupProxy(time.Minute)
+	now := time.Now()
+
+	a := []byte("system.net.tcp.rtt.avg:2.5|g|#src:a,metro_dedup:abc,dst:b\ngo_metro.capture.restarts:1|c|#iface:eth0")
+	out := string(p.filter(a, now))
+	expected := "system.net.tcp.rtt.avg:2.5|g|#src:a,dst:b\ngo_metro.capture.restarts:1|c|#iface:eth0"
+	if out != expected {
+		t.Fatalf("Expected %q, got %q", expected, out)
+	}
+
+	// the other probe's submission.
+	b := []byte("system.net.tcp.rtt.avg:2.6|g|#src:a,dst:b,metro_dedup:abc")
+	if out := p.filter(b, now.Add(time.Second)); len(out) != 0 {
+		t.Fatalf("Expected duplicate to be dropped, got %q", out)
+	}
+	if out := string(p.filter(b, now.Add(2*time.Minute))); out != "system.net.tcp.rtt.avg:2.6|g|#src:a,dst:b" {
+		t.Fatalf("Expected key to be forgotten past the window, got %q", out)
+	}
+
+	if out := string(p.filter([]byte("m:1|g|#metro_dedup:xyz"), now)); out != "m:1|g" {
+		t.Fatalf("Expected the tag section to go along with the key, got %q", out)
+	}
+}
+
+func TestDedupProxyRemarks(t *testing.T) {
+	p := newDedupProxy(time.Minute)
+	now := time.Now()
+
+	path := dscpPath(net.ParseIP("10.0.0.1"), 40000, net.ParseIP("10.0.0.2"), 5432)
+	sent := []byte(dscpObservation + ":1|g|#metro_path:" + path + ",metro_observed:sent,metro_dscp:ef")
+	if out := p.filter(sent, now); len(out) != 0 {
+		t.Fatalf("Expected the observation to be consumed, got %q", out)
+	}
+
+	// the other end, unchanged.
+	received := []byte(dscpObservation + ":1|g|#metro_path:" + path + ",metro_observed:received,metro_dscp:ef")
+	if out := p.filter(received, now); len(out) != 0 {
+		t.Fatalf("Expected no event for unchanged marking, got %q", out)
+	}
+
+	remarked := []byte(dscpObservation + ":1|g|#metro_path:" + path + ",metro_observed:received,metro_dscp:cs0")
+	out := string(p.filter(remarked, now))
+	if !strings.HasPrefix(out, "_e{") || !strings.Contains(out, "dscp_sent:ef,dscp_received:cs0") {
+		t.Fatalf("Expected a re-marking event, got %q", out)
+	}
+	if out := p.filter(remarked, now.Add(time.Second)); len(out) != 0 {
+		t.Fatalf("Expected a single event per re-marking, got %q", out)
+	}
+}
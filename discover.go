@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	defaultDiscoverDuration = 5 * time.Minute
+	defaultDiscoverTop      = 20
+)
+
+// peerStats is the traffic to and from a peer, across the service ports
+// (bytes by port) flows to it used.
+type peerStats struct {
+	IP      string            `json:"ip"`
+	Name    string            `json:"name,omitempty"`
+	Flows   int               `json:"flows"`
+	Bytes   uint64            `json:"bytes"`
+	Ports   map[uint16]uint64 `json:"ports"`
+	SRTT    float64           `json:"srtt"` // ms
+	Samples uint64            `json:"samples"`
+}
+
+// ports returns the service ports, busiest first.
+func (p *peerStats) ports() []uint16 {
+	ports := make([]uint16, 0, len(p.Ports))
+	for port := range p.Ports {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if p.Ports[ports[i]] != p.Ports[ports[j]] {
+			return p.Ports[ports[i]] > p.Ports[ports[j]]
+		}
+		return ports[i] < ports[j]
+	})
+	return ports
+}
+
+// discoverPeers ranks the remote ends (Dst) of flows by traffic, up to top.
+func discoverPeers(flows *FlowMap, top int) []*peerStats {
+	peers := make(map[string]*peerStats)
+	flows.Lock()
+	for _, flow := range flows.Map {
+		flow.Lock()
+		if flow.Alive != nil {
+			flow.Alive.Stop()
+		}
+		ip := flow.Dst.String()
+		p, ok := peers[ip]
+		if !ok {
+			p = &peerStats{IP: ip, Ports: make(map[uint16]uint64)}
+			peers[ip] = p
+		}
+		port := flow.Sport
+		if flow.Client {
+			port = flow.Dport
+		}
+		p.Flows++
+		p.Bytes += flow.Bytes
+		p.Ports[uint16(port)] += flow.Bytes
+		if flow.Sampled > 0 {
+			n := float64(p.Samples + flow.Sampled)
+			p.SRTT = (p.SRTT*float64(p.Samples) + nsToMs(flow.SRTT)*float64(flow.Sampled)) / n
+			p.Samples += flow.Sampled
+		}
+		flow.Unlock()
+	}
+	flows.Unlock()
+
+	ranked := make([]*peerStats, 0, len(peers))
+	for _, p := range peers {
+		ranked = append(ranked, p)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Bytes != ranked[j].Bytes {
+			return ranked[i].Bytes > ranked[j].Bytes
+		}
+		return ranked[i].IP < ranked[j].IP
+	})
+	if top > 0 && len(ranked) > top {
+		ranked = ranked[:top]
+	}
+	return ranked
+}
+
+// resolvePeers names the peers by reverse DNS, where they have names.
+func resolvePeers(peers []*peerStats) {
+	for _, p := range peers {
+		if names, err := net.LookupAddr(p.IP); err == nil && len(names) > 0 {
+			p.Name = strings.TrimSuffix(names[0], ".")
+		}
+	}
+}
+
+// writeDiscovery writes the ranked peers, followed by a configuration stanza
+// whitelisting them, and the filter matching their service ports.
+func writeDiscovery(w io.Writer, iface string, peers []*peerStats) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tNAME\tPORTS\tFLOWS\tBYTES\tSRTT (ms)")
+	ports := make(map[uint16]uint64)
+	for _, p := range peers {
+		var pp []string
+		for _, port := range p.ports() {
+			pp = append(pp, fmt.Sprint(port))
+			ports[port] += p.Ports[port]
+		}
+		srtt := "-"
+		if p.Samples > 0 {
+			srtt = fmt.Sprintf("%.3f", p.SRTT)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", p.IP, p.Name, strings.Join(pp, ","), p.Flows, p.Bytes, srtt)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\n# Suggested configuration, the %d busiest peers:\ninstances:\n  - interface: %s\n    ips:\n", len(peers), iface)
+	for _, p := range peers {
+		fmt.Fprintf(w, "      - %s\n", p.IP)
+	}
+	var named []*peerStats
+	for _, p := range peers {
+		if p.Name != "" {
+			named = append(named, p)
+		}
+	}
+	if len(named) > 0 {
+		fmt.Fprintln(w, "    lookup:")
+		for _, p := range named {
+			fmt.Fprintf(w, "      %s: %s\n", p.IP, p.Name)
+		}
+	}
+
+	all := make([]uint16, 0, len(ports))
+	for port := range ports {
+		all = append(all, port)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	terms := make([]string, 0, len(all))
+	for _, port := range all {
+		terms = append(terms, fmt.Sprintf("port %d", port))
+	}
+	_, err := fmt.Fprintf(w, "# to the service ports seen, run with: -f 'tcp and (%s)'\n", strings.Join(terms, " or "))
+	return err
+}
+
+// runDiscover implements the discover subcommand, sniffing for a while (or
+// reading pcap files) to bootstrap configuration on unfamiliar hosts:
+//
+//	go-metro discover [-i interface | -pcap file] [-d duration] [-top n] [-f filter] [-json]
+func runDiscover(args []string) int {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	iface := fs.String("i", "", "Interface to sniff.")
+	pcap := fs.String("pcap", "", "Pcap files to read instead (glob pattern).")
+	duration := fs.Duration("d", defaultDiscoverDuration, "How long to sniff for.")
+	top := fs.Int("top", defaultDiscoverTop, "Peers to list.")
+	bpf := fs.String("f", defaultBPFFilter, "BPF filter for pcap")
+	resolve := fs.Bool("resolve", true, "Name peers by reverse DNS, suggesting lookup entries.")
+	asJSON := fs.Bool("json", false, "Output the peers as JSON.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s discover [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*iface == "") == (*pcap == "") || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	policies, err := newTrafficPolicies(nil)
+	if err != nil {
+		log.Criticalf("Error setting up: %v", err)
+		return 1
+	}
+	d := &MetroSniffer{
+		Iface:      *iface,
+		Filter:     *bpf,
+		IdleTTL:    compareIdleTTL,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    make(map[string]bool),
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+		config:     Config{Interface: *iface},
+	}
+	if *pcap != "" {
+		d.Iface = fileInterface
+		d.config = Config{Interface: fileInterface, Pcap: *pcap, Mirror: true}
+		err = d.discoverOffline(*pcap)
+	} else {
+		err = d.discoverLive(*duration)
+	}
+	if err != nil {
+		log.Criticalf("Error discovering peers: %v", err)
+		return 1
+	}
+
+	peers := discoverPeers(d.flows, *top)
+	if *resolve {
+		resolvePeers(peers)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(peers)
+	} else {
+		err = writeDiscovery(os.Stdout, *iface, peers)
+	}
+	if err != nil {
+		log.Errorf("Error writing peers: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func (d *MetroSniffer) discoverOffline(pattern string) error {
+	files, err := pcapFiles(pattern)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		handle, err := openOffline(path)
+		if err != nil {
+			return fmt.Errorf("Unable to open pcap file %q: %v", path, err)
+		}
+		if err := handle.SetBPFFilter(d.Filter); err != nil && err != errBPFUnsupported {
+			handle.Close()
+			return fmt.Errorf("Error setting BPF filter %q: %v", d.Filter, err)
+		}
+		d.handle = handle
+		d.decoder = d.decoderFor(handle.LinkType())
+		d.SniffOffline()
+		handle.Close()
+	}
+	return nil
+}
+
+func (d *MetroSniffer) discoverLive(duration time.Duration) error {
+	hostIPs, found, err := d.localAddresses()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNoInterface
+	}
+	d.hostIPs = hostIPs
+
+	handle, err := d.openCapture()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(d.bpfFilter(nil)); err != nil && err != errBPFUnsupported {
+		return err
+	}
+	d.handle = handle
+	d.decoder = d.decoderFor(handle.LinkType())
+
+	log.Infof("Discovering peers on %q for %v", d.Iface, duration)
+	for deadline := time.Now().Add(duration); time.Now().Before(deadline); {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil && isTimeout(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		d.handlePacket(data, &ci)
+	}
+	return nil
+}
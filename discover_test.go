@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoverPeers(t *testing.T) {
+	flows := NewFlowMap()
+	local := net.ParseIP("10.0.0.1")
+	flows.Add("a", &TCPAccounting{Src: local, Dst: net.ParseIP("10.0.4.2"), Sport: 40000, Dport: 5432, Client: true, Bytes: 1000, SRTT: uint64(2 * time.Millisecond), Sampled: 1})
+	flows.Add("b", &TCPAccounting{Src: local, Dst: net.ParseIP("10.0.4.2"), Sport: 40001, Dport: 443, Client: true, Bytes: 3000, SRTT: uint64(4 * time.Millisecond), Sampled: 3})
+	// we're the server.
+	flows.Add("c", &TCPAccounting{Src: local, Dst: net.ParseIP("10.0.5.7"), Sport: 8080, Dport: 51000, Bytes: 2000})
+	flows.Add("d", &TCPAccounting{Src: local, Dst: net.ParseIP("10.0.6.1"), Sport: 40002, Dport: 443, Client: true, Bytes: 10})
+
+	peers := discoverPeers(flows, 2)
+	if len(peers) != 2 || peers[0].IP != "10.0.4.2" || peers[1].IP != "10.0.5.7" {
+		t.Fatalf("Unexpected peers: %+v", peers)
+	}
+	if p := peers[0]; p.Flows != 2 || p.Bytes != 4000 || p.SRTT != 3.5 || p.ports()[0] != 443 {
+		t.Fatalf("Unexpected peer stats: %+v", p)
+	}
+	if peers[1].ports()[0] != 8080 || peers[1].Samples != 0 {
+		t.Fatalf("Expected our service port for flows we serve, got %+v", peers[1])
+	}
+
+	peers[0].Name = "db-primary.example.com"
+	var out bytes.Buffer
+	if err := writeDiscovery(&out, "eth0", peers); err != nil {
+		t.Fatalf("Unexpected error writing peers: %v", err)
+	}
+	for _, want := range []string{
+		"  - interface: eth0\n    ips:\n      - 10.0.4.2\n      - 10.0.5.7\n",
+		"    lookup:\n      10.0.4.2: db-primary.example.com\n",
+		"-f 'tcp and (port 443 or port 5432 or port 8080)'",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("Expected %q in:\n%s", want, out.String())
+		}
+	}
+}
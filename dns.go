@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dnsMetricPrefix = "system.net.dns."
+	dnsPort         = 53
+
+	// queries unanswered for this long are given up on.
+	dnsQueryTimeout = 10 * time.Second
+	// most queries pending per resolver.
+	dnsMaxPending = 4096
+)
+
+type dnsQueryKey struct {
+	client string // address and port
+	id     uint16
+}
+
+type dnsQuery struct {
+	ts    int64
+	qtype string
+}
+
+// dnsTimes aggregates response times (ns) over a reporting interval.
+type dnsTimes struct {
+	sum, max uint64
+	n        uint64
+	ts       int64
+}
+
+// DNSAccounting pairs the queries to a resolver with its responses.
+type DNSAccounting struct {
+	Resolver net.IP
+	External bool
+	Pending  map[dnsQueryKey]dnsQuery
+	Times    map[string]*dnsTimes // by query type, since the last report
+	LastSeen int64
+}
+
+// parseDNS returns the transaction ID of a DNS message, whether it's a
+// response and the type of its (first) question.
+func parseDNS(msg []byte) (uint16, bool, string, bool) {
+	if len(msg) < 12 {
+		return 0, false, "", false
+	}
+	id := binary.BigEndian.Uint16(msg[0:2])
+	response := msg[2]&0x80 != 0
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return id, response, "", true
+	}
+	// skip the name.
+	off := 12
+	for off < len(msg) {
+		l := int(msg[off])
+		if l == 0 {
+			off++
+			break
+		} else if l&0xc0 == 0xc0 {
+			off += 2
+			break
+		}
+		off += l + 1
+	}
+	if off+2 > len(msg) {
+		return id, response, "", true
+	}
+	qtype := layers.DNSType(binary.BigEndian.Uint16(msg[off : off+2]))
+	name := qtype.String()
+	if name == "Unknown" {
+		name = strconv.Itoa(int(qtype))
+	}
+	return id, response, name, true
+}
+
+// handleDNS pairs DNS queries and responses, msg being the DNS message of a
+// datagram or segment to or from port 53.
+func (d *MetroSniffer) handleDNS(srcIP, dstIP net.IP, sport, dport uint16, msg []byte, meta *packetMeta) {
+	id, response, qtype, ok := parseDNS(msg)
+	if !ok || response != (sport == dnsPort) {
+		return
+	}
+	client, resolver := net.JoinHostPort(srcIP.String(), strconv.Itoa(int(sport))), dstIP
+	if response {
+		client, resolver = net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dport))), srcIP
+	}
+	key := resolver.String()
+	if meta.Tunnel != "" {
+		key = meta.Tunnel + "/" + key
+	}
+	ts := meta.ci.Timestamp.UnixNano()
+
+	d.flows.Lock()
+	defer d.flows.Unlock()
+	r, ok := d.flows.DNS[key]
+	if !ok {
+		if response {
+			return
+		}
+		r = &DNSAccounting{
+			Resolver: resolver,
+			External: d.policies.external(resolver),
+			Pending:  make(map[dnsQueryKey]dnsQuery),
+			Times:    make(map[string]*dnsTimes),
+		}
+		d.flows.DNS[key] = r
+	}
+	r.LastSeen = ts
+
+	q := dnsQueryKey{client, id}
+	if !response {
+		if len(r.Pending) < dnsMaxPending {
+			r.Pending[q] = dnsQuery{ts, qtype}
+		}
+		return
+	}
+	sent, ok := r.Pending[q]
+	if !ok || ts < sent.ts {
+		return
+	}
+	delete(r.Pending, q)
+	t, ok := r.Times[sent.qtype]
+	if !ok {
+		t = &dnsTimes{}
+		r.Times[sent.qtype] = t
+	}
+	rt := uint64(ts - sent.ts)
+	t.sum += rt
+	t.n++
+	if rt > t.max {
+		t.max = rt
+	}
+	t.ts = ts
+}
+
+// reportDNS submits the average response time of each resolver over the
+// interval, by query type, then forgets unanswered queries and idle
+// resolvers.
+func (r *Client) reportDNS(now int64) {
+	r.flows.Lock()
+	defer r.flows.Unlock()
+	for k, res := range r.flows.DNS {
+		if r.policies.reported(res.External) {
+			for qtype, t := range res.Times {
+				tags := append([]string{"resolver:" + r.hostname(res.Resolver), "query_type:" + qtype}, r.tags...)
+				r.submit(k+"/"+qtype, dnsMetricPrefix+"response_time", nsToMs(t.sum/t.n), tags, false, t.ts/int64(time.Second))
+				r.submit(k+"/"+qtype, dnsMetricPrefix+"response_time.max", nsToMs(t.max), tags, false, t.ts/int64(time.Second))
+			}
+		}
+		res.Times = make(map[string]*dnsTimes)
+
+		for q, sent := range res.Pending {
+			if res.LastSeen-sent.ts > int64(dnsQueryTimeout) {
+				delete(res.Pending, q)
+			}
+		}
+		if time.Duration(now*int64(time.Second)-res.LastSeen) > r.idleTTL {
+			delete(r.flows.DNS, k)
+			log.Infof("DNS resolver expired: [%s]", k)
+		}
+	}
+}
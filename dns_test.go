@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// dnsMessage serializes a DNS query or response with a single question.
+func dnsMessage(t *testing.T, id uint16, response bool, qtype layers.DNSType) []byte {
+	dns := &layers.DNS{
+		ID:        id,
+		QR:        response,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: qtype, Class: layers.DNSClassIN}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatalf("Unable to build DNS message: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseDNS(t *testing.T) {
+	id, response, qtype, ok := parseDNS(dnsMessage(t, 42, true, layers.DNSTypeAAAA))
+	if !ok || id != 42 || !response || qtype != "AAAA" {
+		t.Fatalf("Unexpected DNS message: id %d, response %v, type %q", id, response, qtype)
+	}
+	if _, _, qtype, _ := parseDNS(dnsMessage(t, 42, false, layers.DNSType(999))); qtype != "999" {
+		t.Fatalf("Expected unknown query types by number, got %q", qtype)
+	}
+	if _, _, _, ok := parseDNS([]byte{0, 1, 2}); ok {
+		t.Fatalf("Expected truncated message to be rejected")
+	}
+}
+
+func TestSnifferDNS(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{DNS: true},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"10.0.0.1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	start := time.Now()
+	for _, q := range []struct {
+		id    uint16
+		qtype layers.DNSType
+		rt    time.Duration
+	}{{1, layers.DNSTypeA, 2 * time.Millisecond}, {2, layers.DNSTypeA, 4 * time.Millisecond}, {3, layers.DNSTypeMX, 10 * time.Millisecond}} {
+		query := udpDatagram(t, "10.0.0.1", "10.0.0.53", 40000, 53, dnsMessage(t, q.id, false, q.qtype))
+		d.handlePacket(query, &gopacket.CaptureInfo{Timestamp: start})
+		response := udpDatagram(t, "10.0.0.53", "10.0.0.1", 53, 40000, dnsMessage(t, q.id, true, q.qtype))
+		if err := d.handlePacket(response, &gopacket.CaptureInfo{Timestamp: start.Add(q.rt)}); err != nil {
+			t.Fatalf("Unexpected error handling DNS response: %v", err)
+		}
+	}
+
+	r, ok := d.flows.DNS["10.0.0.53"]
+	if !ok {
+		t.Fatalf("Expected a resolver, got %v", d.flows.DNS)
+	}
+	a, mx := r.Times["A"], r.Times["MX"]
+	if a == nil || a.n != 2 || a.sum/a.n != uint64(3*time.Millisecond) || a.max != uint64(4*time.Millisecond) {
+		t.Fatalf("Unexpected A response times: %+v", a)
+	}
+	if mx == nil || mx.n != 1 || len(r.Pending) != 0 {
+		t.Fatalf("Unexpected MX response times: %+v, %d pending", mx, len(r.Pending))
+	}
+}
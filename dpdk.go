@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	// dpdkInterface prefixes instances capturing off a DPDK port, eg. "dpdk:0".
+	dpdkInterface = "dpdk"
+
+	defaultDPDKPdump = "dpdk-pdump"
+	dpdkOpenTimeout  = 30 * time.Second
+)
+
+var errDPDKOpenTimeout = errors.New("Timeout waiting for dpdk-pdump to start writing packets.")
+
+// DPDKConfig configures capture off a DPDK-bound port. The kernel can't see
+// those, so packets are mirrored by the DPDK primary process (the pdump
+// framework must be enabled in the application) to a dpdk-pdump secondary
+// process, which writes them to a FIFO we read them from.
+type DPDKConfig struct {
+	Pdump    string   `yaml:"pdump"`     // dpdk-pdump binary
+	EALArgs  []string `yaml:"eal_args"`  // eg. --file-prefix of the primary process
+	Queue    string   `yaml:"queue"`     // queue(s) to capture, all by default
+	FIFO     string   `yaml:"fifo"`      // path of the FIFO
+	External bool     `yaml:"external"`  // dpdk-pdump is run by someone else, writing to fifo
+	LocalIPs []string `yaml:"local_ips"` // addresses of the DPDK application, our end of flows
+}
+
+func isDPDKInterface(name string) bool {
+	return strings.HasPrefix(name, dpdkInterface+":")
+}
+
+type dpdkPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+// dpdkHandle reads the pcap stream dpdk-pdump writes to the FIFO. As with
+// AF_PACKET reads block, so they're done from a goroutine.
+type dpdkHandle struct {
+	*pcapgo.Reader
+	f       *os.File
+	fifo    string
+	cmd     *exec.Cmd
+	packets chan dpdkPacket
+	done    chan struct{}
+	filter  bpfMatcher
+}
+
+func init() {
+	registerCaptureBackend(dpdkInterface, (*MetroSniffer).openDPDK)
+}
+
+func (d *MetroSniffer) dpdkConfig() DPDKConfig {
+	var cfg DPDKConfig
+	if d.config.DPDK != nil {
+		cfg = *d.config.DPDK
+	}
+	if cfg.Pdump == "" {
+		cfg.Pdump = defaultDPDKPdump
+	}
+	if cfg.Queue == "" {
+		cfg.Queue = "*"
+	}
+	if cfg.FIFO == "" {
+		port := strings.TrimPrefix(d.Iface, dpdkInterface+":")
+		cfg.FIFO = filepath.Join(os.TempDir(), "go-metro-dpdk-"+port+".pcap")
+	}
+	return cfg
+}
+
+func (d *MetroSniffer) openDPDK() (CaptureSource, error) {
+	cfg := d.dpdkConfig()
+	port := strings.TrimPrefix(d.Iface, dpdkInterface+":")
+
+	h := &dpdkHandle{
+		packets: make(chan dpdkPacket),
+		done:    make(chan struct{}),
+	}
+	if !cfg.External {
+		os.Remove(cfg.FIFO)
+		if err := mkfifo(cfg.FIFO); err != nil {
+			return nil, fmt.Errorf("Unable to create FIFO %q: %v", cfg.FIFO, err)
+		}
+		h.fifo = cfg.FIFO
+
+		// rx-dev and tx-dev may be the same, both directions are then
+		// written to the one stream.
+		dev := "port=" + port + ",queue=" + cfg.Queue + ",rx-dev=" + cfg.FIFO + ",tx-dev=" + cfg.FIFO
+		args := append(append([]string{}, cfg.EALArgs...), "--", "--pdump", dev)
+		h.cmd = exec.Command(cfg.Pdump, args...)
+		if err := h.cmd.Start(); err != nil {
+			os.Remove(h.fifo)
+			return nil, fmt.Errorf("Unable to run %s: %v", cfg.Pdump, err)
+		}
+		log.Infof("Started %s %s", cfg.Pdump, strings.Join(args, " "))
+	}
+
+	// opening a FIFO blocks until the writer opens it too.
+	type opened struct {
+		f   *os.File
+		r   *pcapgo.Reader
+		err error
+	}
+	ch := make(chan opened, 1)
+	go func() {
+		f, err := os.Open(cfg.FIFO)
+		if err != nil {
+			ch <- opened{err: err}
+			return
+		}
+		r, err := pcapgo.NewReader(f)
+		if err != nil {
+			f.Close()
+		}
+		ch <- opened{f, r, err}
+	}()
+
+	select {
+	case o := <-ch:
+		if o.err != nil {
+			h.Close()
+			return nil, o.err
+		}
+		h.f, h.Reader = o.f, o.r
+	case <-time.After(dpdkOpenTimeout):
+		h.Close()
+		return nil, errDPDKOpenTimeout
+	}
+
+	go h.read()
+	return h, nil
+}
+
+func (h *dpdkHandle) read() {
+	for {
+		data, ci, err := h.Reader.ReadPacketData()
+		select {
+		case h.packets <- dpdkPacket{data, ci, err}:
+		case <-h.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (h *dpdkHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		select {
+		case p := <-h.packets:
+			if p.err != nil || h.filter == nil || h.filter.Matches(p.ci, p.data) {
+				return p.data, p.ci, p.err
+			}
+		case <-time.After(readPollTimeout):
+			return nil, gopacket.CaptureInfo{}, errReadTimeout
+		}
+	}
+}
+
+// Stats aren't available, dpdk-pdump doesn't tell.
+func (h *dpdkHandle) Stats() (CaptureStats, error) {
+	return CaptureStats{}, nil
+}
+
+func (h *dpdkHandle) LinkType() layers.LinkType {
+	return h.Reader.LinkType()
+}
+
+// SetBPFFilter filters packets in userspace, requires libpcap to compile expr.
+func (h *dpdkHandle) SetBPFFilter(expr string) error {
+	m, err := compileBPF(h.LinkType(), maxSnaplen, expr)
+	if err != nil {
+		return err
+	}
+	h.filter = m
+	return nil
+}
+
+func (h *dpdkHandle) Close() {
+	close(h.done)
+	if h.cmd != nil {
+		h.cmd.Process.Kill()
+		h.cmd.Wait()
+	}
+	if h.f != nil {
+		h.f.Close()
+	}
+	if h.fifo != "" {
+		os.Remove(h.fifo)
+	}
+}
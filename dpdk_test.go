@@ -0,0 +1,83 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestDPDKCapture(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "pdump.pcap")
+	if err := mkfifo(fifo); err != nil {
+		t.Fatalf("Unexpected error creating FIFO: %v", err)
+	}
+
+	// stand in for dpdk-pdump, replaying a capture into the FIFO.
+	go func() {
+		in, err := os.Open("fixtures/test_scp.pcap")
+		if err != nil {
+			return
+		}
+		defer in.Close()
+		out, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer out.Close()
+		io.Copy(out, in)
+	}()
+
+	d := &MetroSniffer{
+		Iface:  "dpdk:0",
+		config: Config{DPDK: &DPDKConfig{FIFO: fifo, External: true, LocalIPs: []string{"10.42.31.222"}}},
+	}
+	handle, err := d.openCapture()
+	if err != nil {
+		t.Fatalf("Unexpected error opening DPDK capture: %v", err)
+	}
+	defer handle.Close()
+
+	if handle.LinkType() != layers.LinkTypeEthernet {
+		t.Fatalf("Unexpected link type: %v", handle.LinkType())
+	}
+
+	f, _ := os.Open("fixtures/test_scp.pcap")
+	defer f.Close()
+	r, _ := pcapgo.NewReader(f)
+	expected := 0
+	for {
+		if _, _, err := r.ReadPacketData(); err != nil {
+			break
+		}
+		expected++
+	}
+
+	n := 0
+	for {
+		_, _, err := handle.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Unexpected error reading packets: %v", err)
+		}
+		n++
+	}
+	if n != expected {
+		t.Fatalf("Expected %d packets, got %d", expected, n)
+	}
+
+	hostIPs, found, err := d.localAddresses()
+	if err != nil || !found || !hostIPs["10.42.31.222"] {
+		t.Fatalf("Expected configured DPDK addresses, got %v (%v)", hostIPs, err)
+	}
+	if names, err := matchInterfaces("dpdk:0"); err != nil || len(names) != 1 || names[0] != "dpdk:0" {
+		t.Fatalf("Expected DPDK interface as is, got %v (%v)", names, err)
+	}
+}
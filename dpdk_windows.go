@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func mkfifo(path string) error {
+	return errors.New("FIFOs unsupported on Windows, run dpdk-pdump externally.")
+}
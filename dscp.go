@@ -0,0 +1,22 @@
+package main
+
+import "strconv"
+
+// dscpClasses name the standard DSCP code points (RFC 2474, 2597, 3246, 5865,
+// 8622), others are tagged by value.
+var dscpClasses = map[uint8]string{
+	0: "cs0", 8: "cs1", 16: "cs2", 24: "cs3", 32: "cs4", 40: "cs5", 48: "cs6", 56: "cs7",
+	10: "af11", 12: "af12", 14: "af13",
+	18: "af21", 20: "af22", 22: "af23",
+	26: "af31", 28: "af32", 30: "af33",
+	34: "af41", 36: "af42", 38: "af43",
+	44: "va", 46: "ef", 1: "le",
+}
+
+// dscpClass names the traffic class of a DSCP value.
+func dscpClass(dscp uint8) string {
+	if name, ok := dscpClasses[dscp]; ok {
+		return name
+	}
+	return strconv.Itoa(int(dscp))
+}
@@ -0,0 +1,69 @@
+package main
+
+import "github.com/google/gopacket/layers"
+
+// ECN codepoints, the low two bits of the IPv4 TOS and IPv6 traffic class
+// (RFC 3168).
+const (
+	ecnNotECT = 0
+	ecnECT1   = 1
+	ecnECT0   = 2
+	ecnCE     = 3
+)
+
+// ecnMarks counts the ECN signals of one end's packets: the codepoints on its
+// IP headers - CE marks being the fabric's congestion signal - and the TCP
+// flags it answers them with.
+type ecnMarks struct {
+	ECT uint64 // ECN-capable packets, CE marked ones included
+	CE  uint64 // congestion experienced on the way
+	ECE uint64 // ECN-echo, CE marks received
+	CWR uint64 // congestion window reduced, in response to ECE
+}
+
+func (m *ecnMarks) track(ecn uint8, tcp *layers.TCP) {
+	if ecn != ecnNotECT {
+		m.ECT++
+	}
+	if ecn == ecnCE {
+		m.CE++
+	}
+	if tcp.ECE && !tcp.SYN {
+		// on SYNs it negotiates ECN instead.
+		m.ECE++
+	}
+	if tcp.CWR && !tcp.SYN {
+		m.CWR++
+	}
+}
+
+// reportECN submits the ECN signals of the interval, tagged direction:sent
+// for Src's packets and direction:received for Dst's: CE marks, their ratio
+// to ECN-capable packets, and ECE and CWR flags. Only flows signalling
+// congestion are reported. Call holding the flow lock.
+func (r *Client) reportECN(k string, flow *TCPAccounting, tags []string, ts int64) {
+	for _, dir := range []struct {
+		tag      string
+		cur, rep ecnMarks
+	}{
+		{"direction:sent", flow.ECN, flow.RepECN},
+		{"direction:received", flow.RcvdECN, flow.RepRcvdECN},
+	} {
+		m := ecnMarks{
+			ECT: dir.cur.ECT - dir.rep.ECT,
+			CE:  dir.cur.CE - dir.rep.CE,
+			ECE: dir.cur.ECE - dir.rep.ECE,
+			CWR: dir.cur.CWR - dir.rep.CWR,
+		}
+		if m.CE == 0 && m.ECE == 0 && m.CWR == 0 {
+			continue
+		}
+		dtags := append(append([]string(nil), tags...), dir.tag)
+		r.submit(k, metricPrefix+"ecn.ce", float64(m.CE), dtags, false, ts)
+		if m.ECT > 0 {
+			r.submit(k, metricPrefix+"ecn.ce_rate", float64(m.CE)/float64(m.ECT), dtags, false, ts)
+		}
+		r.submit(k, metricPrefix+"ecn.ece", float64(m.ECE), dtags, false, ts)
+		r.submit(k, metricPrefix+"ecn.cwr", float64(m.CWR), dtags, false, ts)
+	}
+}
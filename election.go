@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"gopkg.in/tomb.v2"
+)
+
+const (
+	electionLock = "lock" // whoever holds a lock on a shared file leads
+	electionPeer = "peer" // heartbeats between the pair, lowest priority leads
+
+	defaultElectionInterval = 1
+	defaultElectionTimeout  = 5
+)
+
+// ElectionConfig sets up active/standby operation of redundant go-metro
+// instances watching the same traffic: both keep tracking flows, only the
+// leader submits metrics so nothing is reported twice.
+type ElectionConfig struct {
+	Mode     string `yaml:"mode"`
+	LockFile string `yaml:"lock_file"` // lock mode
+	Listen   string `yaml:"listen"`    // peer mode: our heartbeat address, eg. 0.0.0.0:8128
+	Peer     string `yaml:"peer"`      // peer mode: the other instance's heartbeat address
+	ID       string `yaml:"id"`        // peer mode: defaults to the hostname
+	Priority int    `yaml:"priority"`  // peer mode: lowest leads, ties broken by ID
+	Interval int    `yaml:"interval"`  // seconds between lock attempts/heartbeats
+	Timeout  int    `yaml:"timeout"`   // peer mode: seconds without heartbeats before taking over
+}
+
+func (c *ElectionConfig) validate() error {
+	switch c.Mode {
+	case electionLock:
+		if c.LockFile == "" {
+			return errors.New("Error parsing configuration - lock_file required by lock election.")
+		}
+	case electionPeer:
+		if c.Listen == "" || c.Peer == "" {
+			return errors.New("Error parsing configuration - listen and peer required by peer election.")
+		}
+	default:
+		return fmt.Errorf("Error parsing configuration - unknown election mode %q.", c.Mode)
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultElectionInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultElectionTimeout
+	}
+	if c.ID == "" {
+		c.ID, _ = os.Hostname()
+	}
+	return nil
+}
+
+// heartbeat is what peers tell each other every interval.
+type heartbeat struct {
+	ID       string `json:"id"`
+	Priority int    `json:"priority"`
+	Leader   bool   `json:"leader"`
+}
+
+// outranks tells whether h should lead rather than o.
+func (h heartbeat) outranks(o heartbeat) bool {
+	if h.Priority != o.Priority {
+		return h.Priority < o.Priority
+	}
+	return h.ID < o.ID
+}
+
+// elect decides whether we (self) lead given the last heartbeat from our peer,
+// nil if it has gone quiet. Leadership is sticky, priorities only settle
+// elections when both or neither instance claims to lead.
+func elect(self heartbeat, peer *heartbeat) bool {
+	switch {
+	case peer == nil:
+		return true
+	case peer.Leader && self.Leader:
+		return self.outranks(*peer)
+	case peer.Leader:
+		return false
+	case self.Leader:
+		return true
+	default:
+		return self.outranks(*peer)
+	}
+}
+
+// leaderElection tracks whether we lead. A nil election always leads.
+type leaderElection struct {
+	sync.RWMutex
+	cfg      ElectionConfig
+	leader   bool
+	peer     *heartbeat
+	lastSeen time.Time
+	t        tomb.Tomb
+}
+
+// election is the process-wide election, nil unless configured.
+var election *leaderElection
+
+func newLeaderElection(cfg ElectionConfig) (*leaderElection, error) {
+	e := &leaderElection{cfg: cfg}
+	switch cfg.Mode {
+	case electionLock:
+		e.t.Go(e.runLock)
+	case electionPeer:
+		laddr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+		if err != nil {
+			return nil, err
+		}
+		raddr, err := net.ResolveUDPAddr("udp", cfg.Peer)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		e.t.Go(func() error { return e.runPeer(conn, raddr) })
+	}
+	return e, nil
+}
+
+func (e *leaderElection) Leader() bool {
+	if e == nil {
+		return true
+	}
+	e.RLock()
+	defer e.RUnlock()
+	return e.leader
+}
+
+func (e *leaderElection) setLeader(leader bool) {
+	e.Lock()
+	changed := leader != e.leader
+	e.leader = leader
+	e.Unlock()
+	if changed && leader {
+		log.Warnf("Elected leader (%s election), submitting metrics.", e.cfg.Mode)
+	} else if changed {
+		log.Warnf("Standing by (%s election), not submitting metrics.", e.cfg.Mode)
+	}
+}
+
+func (e *leaderElection) Stop() error {
+	e.t.Kill(nil)
+	return e.t.Wait()
+}
+
+// runLock keeps trying to lock the shared file, once we have it we lead until
+// the process exits.
+func (e *leaderElection) runLock() error {
+	interval := time.Duration(e.cfg.Interval) * time.Second
+	for {
+		f, err := lockFile(e.cfg.LockFile)
+		if err == nil {
+			e.setLeader(true)
+			<-e.t.Dying()
+			f.Close()
+			return nil
+		} else if err != errLocked {
+			log.Warnf("Unable to lock %q: %v", e.cfg.LockFile, err)
+		}
+
+		select {
+		case <-e.t.Dying():
+			return nil
+		case <-time.After(jittered(interval)):
+		}
+	}
+}
+
+func (e *leaderElection) runPeer(conn *net.UDPConn, peer *net.UDPAddr) error {
+	defer conn.Close()
+	interval := time.Duration(e.cfg.Interval) * time.Second
+	timeout := time.Duration(e.cfg.Timeout) * time.Second
+	buf := make([]byte, 512)
+
+	// don't grab leadership before hearing from our peer.
+	started := time.Now()
+	next := started
+	for {
+		select {
+		case <-e.t.Dying():
+			return nil
+		default:
+		}
+
+		conn.SetReadDeadline(next)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err == nil {
+			var hb heartbeat
+			if err := json.Unmarshal(buf[:n], &hb); err != nil {
+				log.Debugf("Bad heartbeat from %v: %v", addr, err)
+				continue
+			}
+			e.Lock()
+			e.peer = &hb
+			e.lastSeen = time.Now()
+			e.Unlock()
+			continue
+		} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			log.Warnf("Error reading heartbeats: %v", err)
+		}
+
+		now := time.Now()
+		if now.Before(next) {
+			continue
+		}
+		next = now.Add(interval)
+
+		self := heartbeat{ID: e.cfg.ID, Priority: e.cfg.Priority, Leader: e.Leader()}
+		e.RLock()
+		peerHB := e.peer
+		if now.Sub(e.lastSeen) > timeout {
+			peerHB = nil
+		}
+		e.RUnlock()
+		if peerHB != nil || now.Sub(started) > timeout {
+			self.Leader = elect(self, peerHB)
+			e.setLeader(self.Leader)
+		}
+
+		data, _ := json.Marshal(self)
+		if _, err := conn.WriteToUDP(data, peer); err != nil {
+			log.Debugf("Error sending heartbeat to %v: %v", peer, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestElect(t *testing.T) {
+	a := heartbeat{ID: "a", Priority: 1}
+	b := heartbeat{ID: "b", Priority: 2}
+	aLeading, bLeading := a, b
+	aLeading.Leader, bLeading.Leader = true, true
+
+	tests := []struct {
+		self     heartbeat
+		peer     *heartbeat
+		expected bool
+	}{
+		{b, nil, true},               // peer gone quiet
+		{b, &a, false},               // neither leads, priority decides
+		{a, &b, true},                // likewise
+		{bLeading, &a, true},         // sticky
+		{a, &bLeading, false},        // likewise
+		{aLeading, &bLeading, true},  // both lead, priority decides
+		{bLeading, &aLeading, false}, // likewise
+		{heartbeat{ID: "a"}, &heartbeat{ID: "b"}, true}, // ties broken by ID
+	}
+	for i, tt := range tests {
+		if elect(tt.self, tt.peer) != tt.expected {
+			t.Fatalf("Test %d: expected %+v leading against %+v: %v", i, tt.self, tt.peer, tt.expected)
+		}
+	}
+}
+
+func waitLeader(e *leaderElection, leader bool, d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if e.Leader() == leader {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestLockElection(t *testing.T) {
+	cfg := ElectionConfig{Mode: electionLock, LockFile: filepath.Join(t.TempDir(), "metro.lock")}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Unexpected error validating election: %v", err)
+	}
+
+	a, err := newLeaderElection(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up election: %v", err)
+	}
+	if !waitLeader(a, true, time.Second) {
+		t.Fatalf("Expected first instance to lead")
+	}
+	b, err := newLeaderElection(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up election: %v", err)
+	}
+	defer b.Stop()
+	if waitLeader(b, true, 500*time.Millisecond) {
+		t.Fatalf("Expected second instance to stand by")
+	}
+
+	a.Stop()
+	if !waitLeader(b, true, 3*time.Second) {
+		t.Fatalf("Expected second instance to take over")
+	}
+
+	var none *leaderElection
+	if !none.Leader() {
+		t.Fatalf("Expected instances not running redundantly to lead")
+	}
+	if err := (&ElectionConfig{Mode: electionPeer, Listen: ":8128"}).validate(); err == nil {
+		t.Fatalf("Expected peer election with no peer to be rejected")
+	}
+}
+
+func TestPeerElection(t *testing.T) {
+	a, err := newLeaderElection(ElectionConfig{Mode: electionPeer, Listen: "127.0.0.1:18128", Peer: "127.0.0.1:18129", ID: "a", Priority: 1, Interval: 1, Timeout: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error setting up election: %v", err)
+	}
+	b, err := newLeaderElection(ElectionConfig{Mode: electionPeer, Listen: "127.0.0.1:18129", Peer: "127.0.0.1:18128", ID: "b", Priority: 2, Interval: 1, Timeout: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error setting up election: %v", err)
+	}
+	defer b.Stop()
+
+	if !waitLeader(a, true, 3*time.Second) || b.Leader() {
+		t.Fatalf("Expected the instance with the lowest priority to lead")
+	}
+	a.Stop()
+	if !waitLeader(b, true, 5*time.Second) {
+		t.Fatalf("Expected standby instance to take over")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errLocked = errors.New("File locked by another process.")
+
+// lockFile opens path for exclusive access - Windows denies sharing the file
+// while we have it open.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		if rerr := os.Remove(path); rerr == nil {
+			// stale, its owner is gone.
+			f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		} else {
+			return nil, errLocked
+		}
+	}
+	return f, err
+}
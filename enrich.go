@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	defaultResolverTTL     = 300
+	defaultResolverTimeout = 500
+
+	resolverNegativeTTL = 30 * time.Second
+	resolverCacheSize   = 10000
+)
+
+// Resolver maps an IP to a readable name used to tag metrics. Resolvers are
+// chained in an EnrichmentPipeline - new tagging integrations (k8s, cloud
+// metadata, ...) should implement this rather than patching the reporter.
+type Resolver interface {
+	Name() string
+	Resolve(ip string) (string, bool)
+}
+
+type ResolverConfig struct {
+	Type    string `yaml:"type"`
+	TTL     int    `yaml:"ttl"`     // seconds
+	Timeout int    `yaml:"timeout"` // milliseconds
+}
+
+// staticResolver resolves off the configured/startup lookup table.
+type staticResolver struct {
+	table *LookupTable
+}
+
+func (s *staticResolver) Name() string {
+	return "static"
+}
+
+func (s *staticResolver) Resolve(ip string) (string, bool) {
+	return s.table.Get(ip)
+}
+
+// dnsResolver performs reverse lookups.
+type dnsResolver struct {
+	timeout time.Duration
+}
+
+func (s *dnsResolver) Name() string {
+	return "dns"
+}
+
+func (s *dnsResolver) Resolve(ip string) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return "", false
+	}
+	return strings.TrimSuffix(names[0], "."), true
+}
+
+type cacheEntry struct {
+	name    string
+	found   bool
+	pending bool
+	expires time.Time
+}
+
+// cachedResolver caches results of the resolver it wraps for ttl, misses and
+// lookups taking longer than timeout for a shorter while. Lookups happen in
+// the background: Resolve never blocks, it answers from the cache (a miss
+// until the first lookup completes) so it can be called holding the flow
+// locks. The cache is bounded to size entries.
+type cachedResolver struct {
+	sync.Mutex
+	resolver Resolver
+	ttl      time.Duration
+	negTTL   time.Duration
+	timeout  time.Duration
+	size     int
+	cache    map[string]cacheEntry
+}
+
+func newCachedResolver(r Resolver, ttl, timeout time.Duration) *cachedResolver {
+	c := &cachedResolver{
+		resolver: r,
+		ttl:      ttl,
+		negTTL:   resolverNegativeTTL,
+		timeout:  timeout,
+		size:     resolverCacheSize,
+		cache:    make(map[string]cacheEntry),
+	}
+	if c.negTTL > ttl {
+		c.negTTL = ttl
+	}
+	return c
+}
+
+func (c *cachedResolver) Name() string {
+	return c.resolver.Name()
+}
+
+func (c *cachedResolver) Resolve(ip string) (string, bool) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.cache[ip]
+	if ok && (e.pending || now.Before(e.expires)) {
+		return e.name, e.found
+	}
+	if !ok && len(c.cache) >= c.size {
+		c.evict(now)
+		if len(c.cache) >= c.size {
+			return "", false
+		}
+	}
+
+	// stale entries keep answering until refreshed.
+	e.pending = true
+	c.cache[ip] = e
+	go c.lookup(ip)
+	return e.name, e.found
+}
+
+func (c *cachedResolver) lookup(ip string) {
+	// buffered so the lookup can finish (and be dropped) after a timeout.
+	res := make(chan cacheEntry, 1)
+	go func() {
+		name, found := c.resolver.Resolve(ip)
+		res <- cacheEntry{name: name, found: found}
+	}()
+
+	var e cacheEntry
+	select {
+	case e = <-res:
+	case <-time.After(c.timeout):
+		log.Debugf("Resolver %s timed out for %s", c.Name(), ip)
+	}
+	ttl := c.ttl
+	if !e.found {
+		ttl = c.negTTL
+	}
+	e.expires = time.Now().Add(jittered(ttl))
+
+	c.Lock()
+	c.cache[ip] = e
+	c.Unlock()
+}
+
+// evict drops expired entries. Call holding the lock.
+func (c *cachedResolver) evict(now time.Time) {
+	for ip, e := range c.cache {
+		if !e.pending && !now.Before(e.expires) {
+			delete(c.cache, ip)
+		}
+	}
+}
+
+// EnrichmentPipeline chains resolvers, the first one to resolve an IP wins.
+type EnrichmentPipeline struct {
+	resolvers []Resolver
+}
+
+// NewEnrichmentPipeline builds the resolver chain from config. With no
+// configuration just the static lookup table is used.
+func NewEnrichmentPipeline(cfgs []ResolverConfig, table *LookupTable) (*EnrichmentPipeline, error) {
+	p := &EnrichmentPipeline{}
+	if len(cfgs) == 0 {
+		cfgs = []ResolverConfig{{Type: "static"}}
+	}
+
+	for _, cfg := range cfgs {
+		var r Resolver
+		ttl := time.Duration(cfg.TTL) * time.Second
+		if cfg.TTL == 0 {
+			ttl = defaultResolverTTL * time.Second
+		}
+		timeout := time.Duration(cfg.Timeout) * time.Millisecond
+		if cfg.Timeout == 0 {
+			timeout = defaultResolverTimeout * time.Millisecond
+		}
+
+		switch cfg.Type {
+		case "static":
+			// in-memory, no point caching.
+			p.resolvers = append(p.resolvers, &staticResolver{table: table})
+			continue
+		case "dns":
+			r = &dnsResolver{timeout: timeout}
+		default:
+			return nil, fmt.Errorf("Unknown resolver type %q", cfg.Type)
+		}
+		p.resolvers = append(p.resolvers, newCachedResolver(r, ttl, timeout))
+	}
+	return p, nil
+}
+
+func (p *EnrichmentPipeline) Resolve(ip string) (string, bool) {
+	for _, r := range p.resolvers {
+		if name, ok := r.Resolve(ip); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
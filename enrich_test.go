@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingResolver answers once released, or never.
+type blockingResolver struct {
+	release chan string
+	calls   int32
+}
+
+func (b *blockingResolver) Name() string {
+	return "blocking"
+}
+
+func (b *blockingResolver) Resolve(ip string) (string, bool) {
+	atomic.AddInt32(&b.calls, 1)
+	name := <-b.release
+	return name, name != ""
+}
+
+// settled waits for the lookup of ip to complete.
+func settled(c *cachedResolver, ip string) cacheEntry {
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.Lock()
+		e := c.cache[ip]
+		c.Unlock()
+		if !e.pending || time.Now().After(deadline) {
+			return e
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCachedResolver(t *testing.T) {
+	b := &blockingResolver{release: make(chan string)}
+	c := newCachedResolver(b, time.Hour, 50*time.Millisecond)
+
+	// lookups don't hold up the caller.
+	start := time.Now()
+	if _, ok := c.Resolve("10.0.0.1"); ok {
+		t.Fatalf("Expected a miss before the lookup completes")
+	}
+	if d := time.Since(start); d > 10*time.Millisecond {
+		t.Fatalf("Expected Resolve not to block, took %v", d)
+	}
+	c.Resolve("10.0.0.1")
+	b.release <- "db1.local"
+	if e := settled(c, "10.0.0.1"); !e.found || e.name != "db1.local" {
+		t.Fatalf("Expected the lookup to be cached, got %+v", e)
+	}
+	if name, _ := c.Resolve("10.0.0.1"); name != "db1.local" || atomic.LoadInt32(&b.calls) != 1 {
+		t.Fatalf("Expected a single lookup in flight, got %d", atomic.LoadInt32(&b.calls))
+	}
+
+	// timeouts are cached for a short while only.
+	c.Resolve("10.0.0.2")
+	if e := settled(c, "10.0.0.2"); e.found || time.Until(e.expires) > 2*resolverNegativeTTL {
+		t.Fatalf("Expected a timeout to be cached as a short lived miss, got %+v", e)
+	}
+	go func() { b.release <- "" }()
+
+	// bounded: expired entries make room, live ones don't.
+	c.size = 2
+	if _, ok := c.Resolve("10.0.0.3"); ok || len(c.cache) != 2 {
+		t.Fatalf("Expected a full cache to skip lookups, got %d entries", len(c.cache))
+	}
+	c.Lock()
+	c.cache["10.0.0.2"] = cacheEntry{expires: time.Now()}
+	c.Unlock()
+	c.Resolve("10.0.0.3")
+	c.Lock()
+	_, ok := c.cache["10.0.0.3"]
+	_, old := c.cache["10.0.0.2"]
+	c.Unlock()
+	if !ok || old {
+		t.Fatalf("Expected the expired entry to be evicted")
+	}
+	go func() { b.release <- "" }()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// Feature flags adjustable at runtime, overriding the configuration of every
+// instance until reset.
+const (
+	featureLogLevel     = "log_level"                    // trace, debug, info, warning, error or critical
+	featureHTTPAnalyzer = "analyzer.http"                // look for trace context in HTTP requests
+	featureTracing      = "pipeline_tracing"             // trace a sample of packets through our pipeline
+	featureTracingRate  = "pipeline_tracing.sample_rate" // fraction of packets traced
+)
+
+const maxFeatureAudit = 100
+
+var errNoSuchFeature = errors.New("No such feature flag.")
+
+var logLevels = []string{"trace", "debug", "info", "warning", "warn", "error", "err", "critical", "crit"}
+
+// parseFeature checks a flag's value, as decoded from JSON.
+func parseFeature(name string, value interface{}) (interface{}, error) {
+	switch name {
+	case featureHTTPAnalyzer, featureTracing:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("Feature flag %s takes true or false.", name)
+	case featureTracingRate:
+		if f, ok := value.(float64); ok && f > 0 && f <= 1 {
+			return f, nil
+		}
+		return nil, fmt.Errorf("Feature flag %s takes a rate between 0 and 1.", name)
+	case featureLogLevel:
+		if s, ok := value.(string); ok {
+			for _, l := range logLevels {
+				if strings.EqualFold(s, l) {
+					return strings.ToLower(s), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("Feature flag %s takes one of %s.", name, strings.Join(logLevels, ", "))
+	}
+	return nil, errNoSuchFeature
+}
+
+// FeatureChange is an audit log entry.
+type FeatureChange struct {
+	Time   time.Time   `json:"time"`
+	Flag   string      `json:"flag"`
+	Old    interface{} `json:"old"` // null when configured
+	New    interface{} `json:"new"` // null when reset
+	Source string      `json:"source"`
+}
+
+// featureFlags holds the runtime overrides, read on the packet path without
+// locking: changes swap in a new map.
+type featureFlags struct {
+	sync.Mutex
+	values atomic.Value // map[string]interface{}
+	audit  []FeatureChange
+	// applies a log level change, set up along with logging.
+	setLogLevel func(level string)
+}
+
+// features are the process-wide flags, adjusted through the control API.
+var features = newFeatureFlags()
+
+func newFeatureFlags() *featureFlags {
+	f := &featureFlags{}
+	f.values.Store(make(map[string]interface{}))
+	return f
+}
+
+func (f *featureFlags) get(name string) (interface{}, bool) {
+	v, ok := f.values.Load().(map[string]interface{})[name]
+	return v, ok
+}
+
+// enabled returns a boolean flag, def unless overridden.
+func (f *featureFlags) enabled(name string, def bool) bool {
+	if v, ok := f.get(name); ok {
+		return v.(bool)
+	}
+	return def
+}
+
+// rate returns a rate flag, def unless overridden.
+func (f *featureFlags) rate(name string, def float64) float64 {
+	if v, ok := f.get(name); ok {
+		return v.(float64)
+	}
+	return def
+}
+
+// List returns the overridden flags.
+func (f *featureFlags) List() map[string]interface{} {
+	return f.values.Load().(map[string]interface{})
+}
+
+// Audit returns the latest changes, oldest first.
+func (f *featureFlags) Audit() []FeatureChange {
+	f.Lock()
+	defer f.Unlock()
+	return append([]FeatureChange(nil), f.audit...)
+}
+
+// Set overrides flags, all or none of them, on behalf of source. A nil value
+// resets a flag to its configuration.
+func (f *featureFlags) Set(changes map[string]interface{}, source string) error {
+	parsed := make(map[string]interface{}, len(changes))
+	for name, value := range changes {
+		if value == nil {
+			if _, err := parseFeature(name, false); err == errNoSuchFeature {
+				return err
+			}
+			parsed[name] = nil
+			continue
+		}
+		v, err := parseFeature(name, value)
+		if err != nil {
+			return err
+		}
+		parsed[name] = v
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	cur := f.values.Load().(map[string]interface{})
+	values := make(map[string]interface{}, len(cur)+len(parsed))
+	for name, v := range cur {
+		values[name] = v
+	}
+	names := make([]string, 0, len(parsed))
+	for name := range parsed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		v := parsed[name]
+		old := values[name]
+		if v == nil {
+			delete(values, name)
+		} else {
+			values[name] = v
+		}
+		f.audit = append(f.audit, FeatureChange{Time: now, Flag: name, Old: old, New: v, Source: source})
+		log.Infof("Feature flag %s changed from %v to %v by %s", name, old, v, source)
+	}
+	if len(f.audit) > maxFeatureAudit {
+		f.audit = f.audit[len(f.audit)-maxFeatureAudit:]
+	}
+	f.values.Store(values)
+
+	if level, ok := parsed[featureLogLevel]; ok && f.setLogLevel != nil {
+		if level == nil {
+			level = ""
+		}
+		f.setLogLevel(level.(string))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	f := newFeatureFlags()
+	var level string
+	f.setLogLevel = func(l string) { level = l }
+
+	if !f.enabled(featureHTTPAnalyzer, true) || f.rate(featureTracingRate, 0.5) != 0.5 {
+		t.Fatalf("Expected configured values unless overridden")
+	}
+	if err := f.Set(map[string]interface{}{featureHTTPAnalyzer: false, featureLogLevel: "DEBUG"}, "test"); err != nil {
+		t.Fatalf("Unexpected error setting flags: %v", err)
+	}
+	if f.enabled(featureHTTPAnalyzer, true) || level != "debug" {
+		t.Fatalf("Expected flags to be overridden, log level %q", level)
+	}
+
+	// all or nothing.
+	if err := f.Set(map[string]interface{}{featureTracing: true, featureTracingRate: 2.0}, "test"); err == nil {
+		t.Fatalf("Expected bad sample rate to be rejected")
+	}
+	if f.enabled(featureTracing, false) {
+		t.Fatalf("Expected no flag set when one is invalid")
+	}
+	if err := f.Set(map[string]interface{}{"bogus": true}, "test"); err != errNoSuchFeature {
+		t.Fatalf("Expected unknown flag to be rejected, got %v", err)
+	}
+
+	if err := f.Set(map[string]interface{}{featureHTTPAnalyzer: nil, featureLogLevel: nil}, "test"); err != nil {
+		t.Fatalf("Unexpected error resetting flags: %v", err)
+	}
+	if !f.enabled(featureHTTPAnalyzer, true) || level != "" || len(f.List()) != 0 {
+		t.Fatalf("Expected flags to be reset, got %v", f.List())
+	}
+
+	audit := f.Audit()
+	if len(audit) != 4 || audit[0].Flag != featureHTTPAnalyzer || audit[0].New != false || audit[2].Old != false || audit[2].New != nil {
+		t.Fatalf("Unexpected audit log: %+v", audit)
+	}
+}
+
+func TestControlFeatures(t *testing.T) {
+	c := NewControlServer("127.0.0.1:0", newMaintenanceSchedule(), nil)
+	c.features = newFeatureFlags()
+	srv := httptest.NewServer(c.srv.Handler)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/features", bytes.NewReader([]byte(`{"pipeline_tracing": true}`)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error setting flags: %v", err)
+	}
+	var flags map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&flags)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || flags[featureTracing] != true {
+		t.Fatalf("Unexpected response setting flags: %d %v", resp.StatusCode, flags)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, srv.URL+"/features", bytes.NewReader([]byte(`{"log_level": 3}`)))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error setting flags: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for invalid log level, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, srv.URL+"/features/pipeline_tracing", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error resetting flag: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || c.features.enabled(featureTracing, false) {
+		t.Fatalf("Expected flag to be reset, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/features/audit")
+	if err != nil {
+		t.Fatalf("Unexpected error listing flag changes: %v", err)
+	}
+	var audit []FeatureChange
+	json.NewDecoder(resp.Body).Decode(&audit)
+	resp.Body.Close()
+	if len(audit) != 2 || audit[1].Flag != featureTracing || audit[1].New != nil {
+		t.Fatalf("Unexpected audit log: %+v", audit)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// namedFilters classifies the flows of an instance by the named BPF filters
+// (eg. db: port 5432) the packet opening them matches, the capture filtering
+// on their union: one instance rather than one per filter capturing the same
+// interface. Flows are tagged filter:<name>, for each match.
+type namedFilters struct {
+	sync.Mutex
+	names    []string
+	exprs    map[string]string
+	matchers map[layers.LinkType][]bpfMatcher // by name, nil if unable to compile
+}
+
+func validateFilters(filters map[string]string) error {
+	for name, expr := range filters {
+		if name == "" || strings.TrimSpace(expr) == "" {
+			return errors.New("Error parsing configuration - filters require a name and an expression.")
+		}
+		if strings.ContainsAny(name, ", ") {
+			return fmt.Errorf("Error parsing configuration - bad filter name %q, may not hold commas or spaces.", name)
+		}
+	}
+	return nil
+}
+
+// newNamedFilters returns nil if there are none.
+func newNamedFilters(filters map[string]string) *namedFilters {
+	if len(filters) == 0 {
+		return nil
+	}
+	f := &namedFilters{exprs: filters, matchers: make(map[layers.LinkType][]bpfMatcher)}
+	for name := range filters {
+		f.names = append(f.names, name)
+	}
+	sort.Strings(f.names)
+	return f
+}
+
+// union is the capture filter matching any of them.
+func (f *namedFilters) union() string {
+	if f == nil {
+		return ""
+	}
+	terms := make([]string, len(f.names))
+	for i, name := range f.names {
+		terms[i] = "(" + f.exprs[name] + ")"
+	}
+	return strings.Join(terms, " or ")
+}
+
+// match returns the names of the filters a packet matches, matched in
+// userspace - which needs libpcap to compile them.
+func (f *namedFilters) match(link layers.LinkType, ci gopacket.CaptureInfo, data []byte) []string {
+	if f == nil {
+		return nil
+	}
+	f.Lock()
+	matchers, ok := f.matchers[link]
+	if !ok {
+		matchers = make([]bpfMatcher, len(f.names))
+		for i, name := range f.names {
+			m, err := compileBPF(link, maxSnaplen, f.exprs[name])
+			if err != nil {
+				log.Warnf("Unable to compile filter %q (%s), flows won't be tagged by it: %v", name, f.exprs[name], err)
+				continue
+			}
+			matchers[i] = m
+		}
+		f.matchers[link] = matchers
+	}
+	f.Unlock()
+
+	var names []string
+	for i, m := range matchers {
+		if m != nil && m.Matches(ci, data) {
+			names = append(names, f.names[i])
+		}
+	}
+	return names
+}
+
+// filterTags tags a flow by the named filters it matched.
+func filterTags(flow *TCPAccounting) []string {
+	tags := make([]string, len(flow.Filters))
+	for i, name := range flow.Filters {
+		tags[i] = "filter:" + name
+	}
+	return tags
+}
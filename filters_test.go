@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// portMatcher matches IPv6 TCP segments by destination port, standing in for
+// compiled filters.
+type portMatcher uint16
+
+func (p portMatcher) Matches(ci gopacket.CaptureInfo, data []byte) bool {
+	return len(data) > 14+40+4 && uint16(data[14+40+2])<<8|uint16(data[14+40+3]) == uint16(p)
+}
+
+func TestNamedFilters(t *testing.T) {
+	if err := validateFilters(map[string]string{"db": "port 5432", "web": "port 443"}); err != nil {
+		t.Fatalf("Unexpected error validating filters: %v", err)
+	}
+	for _, bad := range []map[string]string{{"db": ""}, {"": "port 443"}, {"db,web": "port 443"}} {
+		if err := validateFilters(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+
+	f := newNamedFilters(map[string]string{"web": "port 443", "db": "port 5432", "tls": "tcp port 443"})
+	if union := f.union(); union != "(port 5432) or (tcp port 443) or (port 443)" {
+		t.Fatalf("Unexpected union of filters: %q", union)
+	}
+	f.matchers[layers.LinkTypeEthernet] = []bpfMatcher{portMatcher(5432), portMatcher(443), portMatcher(443)}
+
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		Filter:     "tcp",
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+		filters:    f,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+	if filter := d.bpfFilter(nil); filter != "(tcp) and ((port 5432) or (tcp port 443) or (port 443)) and not host 127.0.0.1 and not host ::1" {
+		t.Errorf("Unexpected capture filter: %q", filter)
+	}
+
+	for _, dport := range []layers.TCPPort{443, 5432, 8080} {
+		pkt := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, dport, 1, 1, 50, 0, nil)
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+	for key, expected := range map[string][]string{
+		"[2001:db8::1]:40000-[2001:db8::2]:443":  {"tls", "web"},
+		"[2001:db8::1]:40000-[2001:db8::2]:5432": {"db"},
+		"[2001:db8::1]:40000-[2001:db8::2]:8080": nil,
+	} {
+		flow, ok := d.flows.Get(key)
+		if !ok {
+			t.Fatalf("Expected flow %s", key)
+		}
+		if !reflect.DeepEqual(flow.Filters, expected) {
+			t.Errorf("Expected %s to match %v, got %v", key, expected, flow.Filters)
+		}
+	}
+	if tags := filterTags(&TCPAccounting{Filters: []string{"tls", "web"}}); !reflect.DeepEqual(tags, []string{"filter:tls", "filter:web"}) {
+		t.Errorf("Unexpected filter tags: %v", tags)
+	}
+}
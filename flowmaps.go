@@ -0,0 +1,61 @@
+package main
+
+const (
+	// maxSeenEntries caps the ACK numbers sampled a flow remembers.
+	maxSeenEntries = 16384
+	// maxTimedEntries caps the segments a flow keeps waiting for their ACKs,
+	// a window's worth of segments at 10 Gbps and 20 ms.
+	maxTimedEntries = 16384
+)
+
+// markSeen records an ACK number as sampled, evicting the oldest beyond the
+// cap. Call holding the flow lock.
+func (t *TCPAccounting) markSeen(ack uint32) {
+	if _, ok := t.Seen[ack]; ok {
+		return
+	}
+	t.Seen[ack] = struct{}{}
+	t.seenOrder = append(t.seenOrder, ack)
+	for len(t.Seen) > maxSeenEntries {
+		delete(t.Seen, t.seenOrder[0])
+		t.seenOrder = t.seenOrder[1:]
+		t.Evicted++
+	}
+}
+
+// markSent records when a segment was sent, evicting the oldest segments
+// still waiting for their ACKs beyond the cap. Call holding the flow lock.
+func (t *TCPAccounting) markSent(k TCPKey, at int64) {
+	if _, ok := t.Timed[k]; !ok {
+		t.timedOrder = append(t.timedOrder, k)
+	}
+	t.Timed[k] = at
+	for len(t.Timed) > maxTimedEntries {
+		old := t.timedOrder[0]
+		t.timedOrder = t.timedOrder[1:]
+		if _, ok := t.Timed[old]; ok {
+			delete(t.Timed, old)
+			t.Evicted++
+		}
+	}
+	if len(t.timedOrder) > 2*maxTimedEntries {
+		// forget the segments since acknowledged.
+		order := make([]TCPKey, 0, len(t.Timed))
+		for _, k := range t.timedOrder {
+			if _, ok := t.Timed[k]; ok {
+				order = append(order, k)
+			}
+		}
+		t.timedOrder = order
+	}
+}
+
+// reportFlowMaps submits the entries the flows' Seen and Timed maps hold, and
+// those evicted over the interval.
+func (r *Client) reportFlowMaps(seen, timed int, evicted uint64, ts int64) {
+	r.submit("flowmaps", "go_metro.flows.seen_entries", float64(seen), r.tags, false, ts)
+	r.submit("flowmaps", "go_metro.flows.timed_entries", float64(timed), r.tags, false, ts)
+	if evicted > 0 {
+		r.count("go_metro.flows.evicted_entries", int64(evicted))
+	}
+}
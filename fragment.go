@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// fragmentTimeout is how long incomplete IPv4 datagrams are kept around.
+const fragmentTimeout = 30 * time.Second
+
+// fragmented tells whether decoding stopped at an IP fragment.
+func fragmented(err error) bool {
+	u, ok := err.(gopacket.UnsupportedLayerType)
+	return ok && gopacket.LayerType(u) == gopacket.LayerTypeFragment
+}
+
+// reassemble hands the IPv4 fragment just decoded to the defragmenter. Once
+// a datagram is complete its TCP segment is decoded, as if received whole, and
+// true returned.
+func (d *MetroSniffer) reassemble(ts time.Time) bool {
+	d.fragments++
+	if d.defrag == nil {
+		d.defrag = ip4defrag.NewIPv4Defragmenter()
+	}
+	if ts.Sub(d.fragSweep) > fragmentTimeout {
+		d.defrag.DiscardOlderThan(ts.Add(-fragmentTimeout))
+		d.fragSweep = ts
+	}
+
+	// the defragmenter keeps fragments around, and the decoder's layer is
+	// reused.
+	frag := d.decoder.ip4
+	frag.Payload = append([]byte(nil), frag.Payload...)
+	ip, err := d.defrag.DefragIPv4WithTimestamp(&frag, ts)
+	if err != nil {
+		log.Debugf("Dropping IPv4 fragment: %v", err)
+		return false
+	} else if ip == nil || ip.Protocol != layers.IPProtocolTCP {
+		return false
+	}
+
+	// the reassembled length only covers the payload.
+	ip.Length += uint16(ip.IHL) * 4
+	d.decoder.ip4 = *ip
+	err = d.decoder.fragParser.DecodeLayers(ip.Payload, &d.decoder.fragDecoded)
+	if err != nil && !unneededPayload(err, d.decoder.fragDecoded) {
+		log.Debugf("Error decoding reassembled datagram: %v", err)
+		return false
+	}
+	d.decoder.decoded = append(d.decoder.decoded, d.decoder.fragDecoded...)
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// connectTimeout is how long a SYN may go unanswered before the connection
+// attempt is considered failed - past the first few SYN retransmissions.
+const connectTimeout = 10 * time.Second
+
+// Reasons connection attempts fail for.
+const (
+	connectTimedOut = "timeout"
+	connectRefused  = "refused"
+)
+
+// trackHandshake times a flow's three-way handshake, from the first SYN (so
+// retransmissions, eg. off a full SYN backlog, count) to the SYN-ACK, then
+// to the client's ACK. fromSrc tells whether the segment comes from Src.
+// Call holding the flow lock.
+func (t *TCPAccounting) trackHandshake(fromSrc bool, tcp *layers.TCP, ts int64) {
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if t.SYN == 0 {
+			t.SYN = ts
+		}
+	case tcp.SYN:
+		if t.SYN != 0 && t.SYNACK == 0 && fromSrc != t.Client {
+			t.SYNACK = ts
+		}
+	case tcp.RST:
+		if t.SYN != 0 && t.SYNACK == 0 && fromSrc != t.Client {
+			t.Refused = true
+		}
+	case tcp.ACK && !tcp.RST:
+		if t.SYNACK != 0 && t.ACKTime == 0 && fromSrc == t.Client {
+			t.SYNACKTime = uint64(t.SYNACK - t.SYN)
+			t.ACKTime = uint64(ts - t.SYNACK)
+		}
+	}
+}
+
+// reportHandshake submits the connection setup times of a flow, once. Call
+// holding the flow lock.
+func (r *Client) reportHandshake(k string, flow *TCPAccounting, tags []string, ts int64) {
+	if flow.ACKTime == 0 || flow.ConnReported {
+		return
+	}
+	r.submit(k, metricPrefix+"connect_time", nsToMs(flow.SYNACKTime+flow.ACKTime), tags, false, ts)
+	r.submit(k, metricPrefix+"connect_time.syn_ack", nsToMs(flow.SYNACKTime), tags, false, ts)
+	r.submit(k, metricPrefix+"connect_time.ack", nsToMs(flow.ACKTime), tags, false, ts)
+	flow.ConnReported = true
+}
+
+// flowTally counts events, eg. failed connection attempts, of the flows to a
+// destination, ie. tag set, over a reporting interval.
+type flowTally struct {
+	tags []string
+	n    int
+}
+
+// connectFailed tallies a flow's connection attempt if it was refused, or
+// timed out as of now - or for good, if the flow is expiring. Call holding
+// the flow lock.
+func (r *Client) connectFailed(flow *TCPAccounting, now time.Time, expiring bool) {
+	if flow.SYN == 0 || flow.SYNACK != 0 || flow.ConnFailed || !r.policies.reported(flow.External) {
+		return
+	}
+	reason := connectRefused
+	if !flow.Refused {
+		if !expiring && now.Sub(time.Unix(0, flow.SYN)) < connectTimeout {
+			return
+		}
+		reason = connectTimedOut
+	}
+	flow.ConnFailed = true
+	if r.suppressed(flow, now) || r.cloudLBs.dropped(flow) {
+		return
+	}
+
+	tags := append(r.flowTags(flow), "reason:"+reason)
+	key := strings.Join(tags, ",")
+	f, ok := r.failures[key]
+	if !ok {
+		f = &flowTally{tags: append(tags, r.tags...)}
+		r.failures[key] = f
+	}
+	f.n++
+}
+
+// reportConnectFailures submits the failed connection attempts of the
+// interval.
+func (r *Client) reportConnectFailures(ts int64) {
+	for k, f := range r.failures {
+		r.submit(k, metricPrefix+"connect_failures", float64(f.n), f.tags, false, ts)
+	}
+	r.failures = make(map[string]*flowTally)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+)
+
+const (
+	// retransmit and reset rates at (or above) which their component of the
+	// health score drops to 0.
+	healthMaxRetransmitRate = 0.05
+	healthMaxResetRate      = 0.2
+)
+
+// HealthConfig enables the composite health score (0-100) per destination,
+// combining RTT against its baseline (minimum RTT seen), retransmit rate and
+// reset rate with the given weights.
+type HealthConfig struct {
+	RTTWeight        float64 `yaml:"rtt_weight"`
+	RetransmitWeight float64 `yaml:"retransmit_weight"`
+	ResetWeight      float64 `yaml:"reset_weight"`
+}
+
+func (c *HealthConfig) validate() error {
+	if c.RTTWeight < 0 || c.RetransmitWeight < 0 || c.ResetWeight < 0 {
+		return errors.New("Error parsing configuration - health weights must be positive.")
+	}
+	if c.RTTWeight == 0 && c.RetransmitWeight == 0 && c.ResetWeight == 0 {
+		c.RTTWeight = 0.5
+		c.RetransmitWeight = 0.3
+		c.ResetWeight = 0.2
+	}
+	return nil
+}
+
+// health accumulates a destination's flows over a reporting interval.
+type health struct {
+	tags        []string
+	baseline    uint64 // lowest RTT seen to the destination
+	srtt        float64
+	samples     uint64
+	segments    uint64
+	retransmits uint64
+	flows       int
+	resets      int
+	ts          int64
+}
+
+// add accounts for flow activity since the last report - call holding the
+// flow's lock.
+func (h *health) add(flow *TCPAccounting, ts int64) {
+	if h.baseline == 0 || flow.Min < h.baseline {
+		h.baseline = flow.Min
+	}
+	h.srtt += float64(flow.SRTT) * float64(flow.Sampled)
+	h.samples += flow.Sampled
+	h.segments += flow.Segments - flow.RepSegments
+	h.retransmits += flow.Retransmits - flow.RepRetransmits
+	h.flows++
+	if flow.Resets > flow.RepResets {
+		h.resets++
+	}
+	if ts > h.ts {
+		h.ts = ts
+	}
+}
+
+func (h *health) score(cfg *HealthConfig) float64 {
+	rtt := 1.0
+	if h.samples > 0 && h.baseline > 0 {
+		// 1 at baseline, 0.5 when doubled, etc.
+		srtt := h.srtt / float64(h.samples)
+		if srtt > float64(h.baseline) {
+			rtt = float64(h.baseline) / srtt
+		}
+	}
+
+	retransmit := 1.0
+	if h.segments > 0 {
+		retransmit = 1 - float64(h.retransmits)/float64(h.segments)/healthMaxRetransmitRate
+	}
+
+	reset := 1.0
+	if h.flows > 0 {
+		reset = 1 - float64(h.resets)/float64(h.flows)/healthMaxResetRate
+	}
+
+	total := cfg.RTTWeight + cfg.RetransmitWeight + cfg.ResetWeight
+	score := (cfg.RTTWeight*clamp01(rtt) +
+		cfg.RetransmitWeight*clamp01(retransmit) +
+		cfg.ResetWeight*clamp01(reset)) / total
+	return 100 * score
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHealthScore(t *testing.T) {
+	cfg := &HealthConfig{}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Unexpected error validating default weights: %v", err)
+	}
+
+	flow := &TCPAccounting{SRTT: 10000000, Min: 10000000, Sampled: 10, Segments: 100}
+	h := &health{}
+	h.add(flow, 0)
+	if s := h.score(cfg); s != 100 {
+		t.Fatalf("Expected healthy flow to score 100, got %v", s)
+	}
+
+	// RTT doubled over baseline, half the retransmit budget used, one of two
+	// flows reset.
+	flow = &TCPAccounting{SRTT: 20000000, Min: 10000000, Sampled: 10, Segments: 200, Retransmits: 5}
+	reset := &TCPAccounting{SRTT: 20000000, Min: 10000000, Sampled: 10, Resets: 1}
+	h = &health{}
+	h.add(flow, 0)
+	h.add(reset, 0)
+	expected := 100 * (0.5*0.5 + 0.3*0.5 + 0.2*0)
+	if s := h.score(cfg); math.Abs(s-expected) > 1e-9 {
+		t.Fatalf("Expected score %v, got %v", expected, s)
+	}
+
+	// only interval activity counts.
+	flow.RepSegments, flow.RepRetransmits = flow.Segments, flow.Retransmits
+	reset.RepResets = reset.Resets
+	h = &health{}
+	h.add(flow, 0)
+	h.add(reset, 0)
+	expected = 100 * (0.5*0.5 + 0.3 + 0.2)
+	if s := h.score(cfg); math.Abs(s-expected) > 1e-9 {
+		t.Fatalf("Expected score %v, got %v", expected, s)
+	}
+
+	if err := (&HealthConfig{RTTWeight: -1}).validate(); err == nil {
+		t.Fatalf("Expected negative weights to be rejected")
+	}
+}
+
+func TestTrackSeq(t *testing.T) {
+	flow := &TCPAccounting{}
+	flow.TrackSeq(math.MaxUint32-99, 100)
+	flow.TrackSeq(0, 100) // wraps
+	flow.TrackSeq(0, 100) // retransmitted
+	flow.TrackSeq(50, 50) // partial retransmit
+	flow.TrackSeq(100, 100)
+	if flow.Segments != 5 || flow.Retransmits != 2 {
+		t.Fatalf("Expected 5 segments and 2 retransmits, got %d and %d", flow.Segments, flow.Retransmits)
+	}
+}
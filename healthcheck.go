@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	healthCheckTag        = "traffic:health_check"
+	healthCheckActionTag  = "tag"
+	healthCheckActionDrop = "drop"
+
+	defaultHealthCheckConnections = 5
+	defaultHealthCheckBytes       = 2048
+
+	// connection intervals within this coefficient of variation are periodic.
+	healthCheckTolerance = 0.2
+	// connection starts remembered per client and server port.
+	healthCheckHistory = 16
+	// clients that haven't connected for this long are forgotten.
+	healthCheckTTL = 10 * time.Minute
+)
+
+// HealthCheckConfig recognises load-balancer health checks - tiny connections
+// opened periodically from the same client to the same port - so they don't
+// pollute the latency of real traffic: they're tagged traffic:health_check,
+// or not reported at all.
+type HealthCheckConfig struct {
+	Action      string   `yaml:"action"`          // tag (default) or drop
+	Sources     []string `yaml:"sources"`         // known checkers (IPs, CIDRs), no periodicity required
+	Connections int      `yaml:"min_connections"` // periodic connections before a client is recognised
+	MaxBytes    uint64   `yaml:"max_bytes"`       // larger flows are never health checks
+}
+
+func (c *HealthCheckConfig) validate() error {
+	switch c.Action {
+	case "":
+		c.Action = healthCheckActionTag
+	case healthCheckActionTag, healthCheckActionDrop:
+	default:
+		return fmt.Errorf("Error parsing configuration - unknown health check action %q.", c.Action)
+	}
+	for _, s := range c.Sources {
+		if _, err := parseIPNet(s); err != nil {
+			return fmt.Errorf("Error parsing configuration - bad health check source %q.", s)
+		}
+	}
+	if c.Connections < 0 {
+		return errors.New("Error parsing configuration - health check min_connections must be positive.")
+	}
+	if c.Connections == 0 {
+		c.Connections = defaultHealthCheckConnections
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = defaultHealthCheckBytes
+	}
+	return nil
+}
+
+// healthChecks tracks connection starts per client and server port. Only used
+// from the reporting goroutine.
+type healthChecks struct {
+	cfg     HealthCheckConfig
+	sources []*net.IPNet
+	starts  map[string][]int64 // capture timestamps, sorted
+	latest  int64
+}
+
+func newHealthChecks(cfg HealthCheckConfig) (*healthChecks, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	h := &healthChecks{cfg: cfg, starts: make(map[string][]int64)}
+	for _, s := range cfg.Sources {
+		n, err := parseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		h.sources = append(h.sources, n)
+	}
+	return h, nil
+}
+
+// endpoints returns a flow's client address, and its key: client and server
+// port.
+func (h *healthChecks) endpoints(flow *TCPAccounting) (net.IP, string) {
+	if flow.Client {
+		return flow.Src, flow.Src.String() + "-" + strconv.Itoa(int(flow.Dport))
+	}
+	return flow.Dst, flow.Dst.String() + "-" + strconv.Itoa(int(flow.Sport))
+}
+
+// observe records the start of a flow's connection, if not already known.
+// Call holding the flow's lock.
+func (h *healthChecks) observe(flow *TCPAccounting) {
+	if flow.FirstSeen == 0 {
+		return
+	}
+	_, key := h.endpoints(flow)
+	starts := h.starts[key]
+	i := sort.Search(len(starts), func(i int) bool { return starts[i] >= flow.FirstSeen })
+	if i < len(starts) && starts[i] == flow.FirstSeen {
+		return
+	}
+	starts = append(starts, 0)
+	copy(starts[i+1:], starts[i:])
+	starts[i] = flow.FirstSeen
+	if len(starts) > healthCheckHistory {
+		starts = starts[len(starts)-healthCheckHistory:]
+	}
+	h.starts[key] = starts
+	if flow.FirstSeen > h.latest {
+		h.latest = flow.FirstSeen
+	}
+}
+
+// prune forgets clients that stopped connecting.
+func (h *healthChecks) prune() {
+	for k, starts := range h.starts {
+		if h.latest-starts[len(starts)-1] > int64(healthCheckTTL) {
+			delete(h.starts, k)
+		}
+	}
+}
+
+// matches tells whether a flow looks like a health check. Call holding the
+// flow's lock.
+func (h *healthChecks) matches(flow *TCPAccounting) bool {
+	if h == nil || flow.Bytes > h.cfg.MaxBytes {
+		return false
+	}
+	client, key := h.endpoints(flow)
+	for _, n := range h.sources {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return periodic(h.starts[key], h.cfg.Connections)
+}
+
+func (h *healthChecks) drop() bool {
+	return h != nil && h.cfg.Action == healthCheckActionDrop
+}
+
+// periodic tells whether there are at least n regularly spaced timestamps.
+func periodic(ts []int64, n int) bool {
+	if len(ts) < n || len(ts) < 3 {
+		return false
+	}
+	var sum, sumsq float64
+	for i := 1; i < len(ts); i++ {
+		d := float64(ts[i] - ts[i-1])
+		sum += d
+		sumsq += d * d
+	}
+	count := float64(len(ts) - 1)
+	mean := sum / count
+	if mean <= 0 {
+		return false
+	}
+	stddev := math.Sqrt(math.Max(sumsq/count-mean*mean, 0))
+	return stddev/mean <= healthCheckTolerance
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(t *testing.T) {
+	h, err := newHealthChecks(HealthCheckConfig{Sources: []string{"10.0.1.0/24"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	lb := net.ParseIP("10.0.0.5")
+	us := net.ParseIP("10.0.0.1")
+	flow := func(start time.Duration, bytes uint64) *TCPAccounting {
+		// our end (Src) is the server.
+		return &TCPAccounting{Src: us, Dst: lb, Sport: 80, Dport: 40000, FirstSeen: int64(time.Minute + start), Bytes: bytes}
+	}
+
+	// every 5s, give or take.
+	var last *TCPAccounting
+	for i, jitter := range []time.Duration{0, 100, -200, 50, 0} {
+		last = flow(time.Duration(i)*5*time.Second+jitter*time.Millisecond, 300)
+		if h.matches(last) {
+			t.Fatalf("Health check recognised after %d connections", i)
+		}
+		h.observe(last)
+		h.observe(last) // reported again, same connection.
+	}
+	if !h.matches(last) {
+		t.Fatalf("Expected periodic connections to be recognised, got %v", h.starts)
+	}
+	if h.matches(flow(30*time.Second, 100000)) {
+		t.Fatalf("Large flows should never be health checks")
+	}
+
+	// irregular connections from another client.
+	other := net.ParseIP("10.0.0.6")
+	for _, s := range []time.Duration{0, 1, 7, 8, 20, 21} {
+		f := &TCPAccounting{Src: us, Dst: other, Sport: 80, Dport: 40000, FirstSeen: int64(time.Minute + s*time.Second)}
+		h.observe(f)
+		last = f
+	}
+	if h.matches(last) {
+		t.Fatalf("Irregular connections recognised as health checks")
+	}
+
+	// known checker.
+	known := &TCPAccounting{Src: us, Dst: net.ParseIP("10.0.1.7"), Sport: 80, Dport: 40000}
+	if !h.matches(known) {
+		t.Fatalf("Expected known checker to be matched")
+	}
+
+	// forgotten once quiet.
+	h.observe(flow(time.Hour, 300))
+	h.prune()
+	if len(h.starts) != 1 {
+		t.Fatalf("Expected quiet clients to be pruned, got %v", h.starts)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// intervalSummary tallies a reporting interval, logged as a single line at
+// its end: a greppable heartbeat of the probe's health.
+type intervalSummary struct {
+	sync.Mutex
+	reported  int    // flows
+	samples   uint64 // RTT samples of the flows reported
+	submitted int    // metrics
+	errors    int    // metrics failing to submit
+	dropped   uint64 // packets dropped by the capture
+	top       string // flow with the highest rtt.avg
+	topRTT    float64
+}
+
+func (s *intervalSummary) submission(err error) {
+	s.Lock()
+	s.submitted++
+	if err != nil {
+		s.errors++
+	}
+	s.Unlock()
+}
+
+func (s *intervalSummary) drop(n uint64) {
+	s.Lock()
+	s.dropped += n
+	s.Unlock()
+}
+
+// flow tallies a flow reported. Call holding the flow lock.
+func (s *intervalSummary) flow(k string, flow *TCPAccounting) {
+	s.Lock()
+	s.reported++
+	s.samples += flow.Sampled - flow.RepSampled
+	if rtt := nsToMs(flow.SRTT); rtt > s.topRTT {
+		s.top, s.topRTT = k, rtt
+	}
+	s.Unlock()
+}
+
+// end returns the summary line, given the flows tracked and those under
+// maintenance, and starts the next interval.
+func (s *intervalSummary) end(flows, muted int) string {
+	s.Lock()
+	defer s.Unlock()
+	line := fmt.Sprintf("Interval summary: flows=%d reported=%d muted=%d samples=%d submitted=%d errors=%d dropped=%d top=%q top_rtt_ms=%.3f",
+		flows, s.reported, muted, s.samples, s.submitted, s.errors, s.dropped, s.top, s.topRTT)
+	s.reported, s.samples, s.submitted, s.errors, s.dropped = 0, 0, 0, 0, 0
+	s.top, s.topRTT = "", 0
+	return line
+}
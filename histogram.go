@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// scale RTT histograms start at - ~2% relative error - and the number of
+	// buckets they're downscaled to fit in on export.
+	expHistogramScale      = 5
+	expHistogramMaxBuckets = 160
+)
+
+// ExpHistogram is an exponential bucket histogram as defined by OpenTelemetry:
+// at scale s, bucket i holds values in (base^i, base^(i+1)] with
+// base = 2^(2^-s). Buckets are kept sparse and only downscaled on export.
+type ExpHistogram struct {
+	Scale   int32
+	Count   uint64
+	Sum     float64
+	Min     float64
+	Max     float64
+	Buckets map[int32]uint64
+}
+
+func NewExpHistogram() *ExpHistogram {
+	return &ExpHistogram{
+		Scale:   expHistogramScale,
+		Buckets: make(map[int32]uint64),
+	}
+}
+
+func (h *ExpHistogram) index(v float64) int32 {
+	return int32(math.Ceil(math.Log2(v)*math.Ldexp(1, int(h.Scale)))) - 1
+}
+
+// Record adds a (positive) value to the histogram.
+func (h *ExpHistogram) Record(v float64) {
+	if v <= 0 {
+		return
+	}
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if v > h.Max {
+		h.Max = v
+	}
+	h.Count++
+	h.Sum += v
+	h.Buckets[h.index(v)]++
+}
+
+// Merge adds o's values to h, at the coarsest of both scales.
+func (h *ExpHistogram) Merge(o *ExpHistogram) {
+	if o.Count == 0 {
+		return
+	}
+	if o.Scale < h.Scale {
+		h.downscale(h.Scale - o.Scale)
+	}
+	shift := uint(o.Scale - h.Scale)
+	for i, c := range o.Buckets {
+		h.Buckets[i>>shift] += c
+	}
+	if h.Count == 0 || o.Min < h.Min {
+		h.Min = o.Min
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+}
+
+func (h *ExpHistogram) downscale(by int32) {
+	if by <= 0 {
+		return
+	}
+	buckets := make(map[int32]uint64, len(h.Buckets))
+	for i, c := range h.Buckets {
+		buckets[i>>uint(by)] += c
+	}
+	h.Buckets = buckets
+	h.Scale -= by
+}
+
+// Quantile estimates the q-quantile (0 to 1) of the values recorded, to the
+// relative error of the buckets. 0 if empty.
+func (h *ExpHistogram) Quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	indices := make([]int32, 0, len(h.Buckets))
+	for i := range h.Buckets {
+		indices = append(indices, i)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	// nearest rank.
+	rank := math.Max(1, math.Ceil(q*float64(h.Count)))
+	base := math.Exp2(math.Ldexp(1, -int(h.Scale)))
+	var seen uint64
+	for _, i := range indices {
+		if seen += h.Buckets[i]; float64(seen) >= rank {
+			// of (base^i, base^(i+1)], the value closest to both ends relatively.
+			v := 2 * math.Pow(base, float64(i+1)) / (base + 1)
+			return math.Max(h.Min, math.Min(h.Max, v))
+		}
+	}
+	return h.Max
+}
+
+// Dense returns the bucket counts as a contiguous slice starting at offset,
+// downscaling as needed to fit in expHistogramMaxBuckets.
+func (h *ExpHistogram) Dense() (offset int32, counts []uint64) {
+	if len(h.Buckets) == 0 {
+		return 0, nil
+	}
+	for {
+		first, last := int32(math.MaxInt32), int32(math.MinInt32)
+		for i := range h.Buckets {
+			if i < first {
+				first = i
+			}
+			if i > last {
+				last = i
+			}
+		}
+		if last-first < expHistogramMaxBuckets {
+			counts = make([]uint64, last-first+1)
+			for i, c := range h.Buckets {
+				counts[i-first] = c
+			}
+			return first, counts
+		}
+		h.downscale(1)
+	}
+}
+
+// rttPercentiles are reported of each flow's RTT samples over the interval.
+var rttPercentiles = []struct {
+	metric string
+	q      float64
+}{
+	{metricPrefix + "rtt.p50", 0.5},
+	{metricPrefix + "rtt.p95", 0.95},
+	{metricPrefix + "rtt.p99", 0.99},
+}
+
+// reportPercentiles submits the tail of a flow's RTTs, averages hide it.
+// Call holding the flow lock.
+func (r *Client) reportPercentiles(k string, flow *TCPAccounting, tags []string, ts int64) {
+	if !r.percentiles || flow.RTTs == nil {
+		return
+	}
+	for _, p := range rttPercentiles {
+		r.submit(k, p.metric, flow.RTTs.Quantile(p.q), tags, false, ts)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExpHistogram(t *testing.T) {
+	h := NewExpHistogram()
+	h.Scale = 0 // buckets: (0.5, 1], (1, 2], (2, 4]...
+	for _, v := range []float64{1, 1.5, 2, 3, 4, 5} {
+		h.Record(v)
+	}
+	offset, counts := h.Dense()
+	if offset != -1 || len(counts) != 4 || counts[0] != 1 || counts[1] != 2 || counts[2] != 2 || counts[3] != 1 {
+		t.Fatalf("Unexpected buckets at offset %d: %v", offset, counts)
+	}
+	if h.Count != 6 || h.Sum != 16.5 || h.Min != 1 || h.Max != 5 {
+		t.Fatalf("Unexpected count/sum/min/max: %d %v %v %v", h.Count, h.Sum, h.Min, h.Max)
+	}
+
+	// merging a finer histogram downscales it.
+	o := NewExpHistogram()
+	o.Scale = 1
+	o.Record(1.2) // bucket 0 at scale 1, 0 at scale 0
+	h.Merge(o)
+	if h.Scale != 0 || h.Buckets[0] != 3 || h.Count != 7 {
+		t.Fatalf("Unexpected merge result at scale %d: %v", h.Scale, h.Buckets)
+	}
+}
+
+func TestExpHistogramDownscale(t *testing.T) {
+	h := NewExpHistogram()
+	for v := 0.01; v < 1e6; v *= 1.01 {
+		h.Record(v)
+	}
+	offset, counts := h.Dense()
+	if len(counts) > expHistogramMaxBuckets {
+		t.Fatalf("Expected at most %d buckets, got %d", expHistogramMaxBuckets, len(counts))
+	}
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total != h.Count {
+		t.Fatalf("Expected %d values in buckets, got %d", h.Count, total)
+	}
+
+	// lowest bucket holds the smallest value.
+	base := math.Pow(2, math.Ldexp(1, -int(h.Scale)))
+	if lower, upper := math.Pow(base, float64(offset)), math.Pow(base, float64(offset+1)); h.Min <= lower || h.Min > upper {
+		t.Fatalf("Expected %v in (%v, %v]", h.Min, lower, upper)
+	}
+}
+
+func TestExpHistogramQuantile(t *testing.T) {
+	h := NewExpHistogram()
+	if h.Quantile(0.5) != 0 {
+		t.Fatalf("Expected empty histogram quantiles to be 0")
+	}
+	// 1..1000 ms, a long tail.
+	for v := 1; v <= 1000; v++ {
+		h.Record(float64(v))
+	}
+	for _, tc := range []struct{ q, expected float64 }{{0, 1}, {0.5, 500}, {0.95, 950}, {0.99, 990}, {1, 1000}} {
+		if v := h.Quantile(tc.q); math.Abs(v-tc.expected)/tc.expected > 0.02 {
+			t.Errorf("Expected p%v ~ %v, got %v", tc.q*100, tc.expected, v)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	hookMetricPrefix = metricPrefix + "hook."
+
+	hookEventPacket = "packet"
+	hookEventFlow   = "flow"
+)
+
+// HookConfig is an analyzer hook embedded in the sniffer: expressions
+// evaluated over every TCP segment of the flows, or over every flow reported,
+// emitting a metric whenever the condition matches. Packet hooks may look
+// into payloads, enough to recognise site-specific protocols - eg. counting
+// PostgreSQL simple queries:
+//
+//	event: packet
+//	match: "remote_port == 5432 && outbound && payload[0] == 81"
+//	metric: pg.queries
+type HookConfig struct {
+	Event  string   `yaml:"event"`  // packet (default) or flow
+	Match  string   `yaml:"match"`  // condition, always if empty
+	Metric string   `yaml:"metric"` // reported as system.net.tcp.hook.<metric>
+	Value  string   `yaml:"value"`  // expression, 1 if empty
+	Tags   []string `yaml:"tags"`   // added to the flow's
+}
+
+// hookSegment is the TCP segment packet hooks are evaluated over.
+type hookSegment struct {
+	tcp      *layers.TCP
+	outbound bool
+	size     uint32 // of the payload, as per the IP headers
+}
+
+// hookTally sums the values of a packet hook over the interval.
+type hookTally struct {
+	hits uint64
+	sum  float64
+}
+
+// hookFlowVars are the fields flow hooks may refer to: those of computed
+// metrics and the flow's ends.
+var hookFlowVars = mergeExprVars(flowVars, map[string]exprFunc{
+	"local_port":  func(f *TCPAccounting, _ float64) float64 { return float64(f.Sport) },
+	"remote_port": func(f *TCPAccounting, _ float64) float64 { return float64(f.Dport) },
+	"client":      func(f *TCPAccounting, _ float64) float64 { return exprBool(f.Client) },
+})
+
+// hookPacketVars are the fields packet hooks may refer to: the flow's, as of
+// the segment, and the segment's.
+var hookPacketVars = mergeExprVars(hookFlowVars, map[string]exprFunc{
+	"outbound":    func(f *TCPAccounting, _ float64) float64 { return exprBool(f.hooked.outbound) },
+	"payload_len": func(f *TCPAccounting, _ float64) float64 { return float64(f.hooked.size) },
+	"syn":         func(f *TCPAccounting, _ float64) float64 { return exprBool(f.hooked.tcp.SYN) },
+	"ack":         func(f *TCPAccounting, _ float64) float64 { return exprBool(f.hooked.tcp.ACK) },
+	"fin":         func(f *TCPAccounting, _ float64) float64 { return exprBool(f.hooked.tcp.FIN) },
+	"rst":         func(f *TCPAccounting, _ float64) float64 { return exprBool(f.hooked.tcp.RST) },
+	"psh":         func(f *TCPAccounting, _ float64) float64 { return exprBool(f.hooked.tcp.PSH) },
+	"window":      func(f *TCPAccounting, _ float64) float64 { return float64(f.hooked.tcp.Window) },
+})
+
+// hookPacketIndexed are the captured payload bytes, NaN past the snaplen.
+var hookPacketIndexed = map[string]exprIndex{
+	"payload": func(f *TCPAccounting, i int) float64 {
+		if i >= len(f.hooked.tcp.Payload) {
+			return math.NaN()
+		}
+		return float64(f.hooked.tcp.Payload[i])
+	},
+}
+
+func mergeExprVars(maps ...map[string]exprFunc) map[string]exprFunc {
+	vars := make(map[string]exprFunc)
+	for _, m := range maps {
+		for k, v := range m {
+			vars[k] = v
+		}
+	}
+	return vars
+}
+
+type analyzerHook struct {
+	metric string
+	packet bool
+	match  exprFunc // nil, always
+	value  exprFunc
+	tags   []string
+}
+
+// newAnalyzerHooks compiles the configured hooks.
+func newAnalyzerHooks(cfgs []HookConfig) ([]*analyzerHook, error) {
+	var hooks []*analyzerHook
+	for _, cfg := range cfgs {
+		if cfg.Metric == "" || strings.Trim(cfg.Metric, metricNameChars) != "" {
+			return nil, fmt.Errorf("Error parsing configuration - bad hook metric %q, expected lowercase letters, digits, _ and dots.", cfg.Metric)
+		}
+		h := &analyzerHook{metric: hookMetricPrefix + cfg.Metric, tags: cfg.Tags}
+
+		vars, indexed := hookFlowVars, map[string]exprIndex(nil)
+		switch cfg.Event {
+		case "", hookEventPacket:
+			h.packet = true
+			vars, indexed = hookPacketVars, hookPacketIndexed
+		case hookEventFlow:
+		default:
+			return nil, fmt.Errorf("Error parsing configuration - hook %q: unknown event %q, expected packet or flow.", cfg.Metric, cfg.Event)
+		}
+
+		var err error
+		if cfg.Match != "" {
+			if h.match, err = compileExprWith(cfg.Match, vars, indexed); err != nil {
+				return nil, fmt.Errorf("Error parsing configuration - hook %q match: %v", cfg.Metric, err)
+			}
+		}
+		value := cfg.Value
+		if value == "" {
+			value = "1"
+		}
+		if h.value, err = compileExprWith(value, vars, indexed); err != nil {
+			return nil, fmt.Errorf("Error parsing configuration - hook %q value: %v", cfg.Metric, err)
+		}
+		for _, tag := range cfg.Tags {
+			if tag == "" {
+				return nil, errors.New("Error parsing configuration - hook tags can't be empty.")
+			}
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// runPacketHooks evaluates the packet hooks over a segment of the flow,
+// tallying their values for the next report. Call holding the flow lock.
+func runPacketHooks(hooks []*analyzerHook, flow *TCPAccounting, tcp *layers.TCP, outbound bool, size uint32) {
+	flow.hooked = &hookSegment{tcp: tcp, outbound: outbound, size: size}
+	defer func() { flow.hooked = nil }()
+
+	for i, h := range hooks {
+		if !h.packet || h.match != nil && !exprTrue(h.match(flow, 0)) {
+			continue
+		}
+		v := h.value(flow, 0)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		if flow.HookTallies == nil {
+			flow.HookTallies = make([]hookTally, len(hooks))
+		}
+		flow.HookTallies[i].hits++
+		flow.HookTallies[i].sum += v
+	}
+}
+
+// reportHooks submits what the hooks made of a flow: packet hooks' values
+// summed over the segments matched in the interval, flow hooks' if matching.
+func (r *Client) reportHooks(k string, flow *TCPAccounting, tags []string, ts int64, secs float64) {
+	for i, h := range r.hooks {
+		var v float64
+		if h.packet {
+			if i >= len(flow.HookTallies) || flow.HookTallies[i].hits == 0 {
+				continue
+			}
+			v = flow.HookTallies[i].sum
+			flow.HookTallies[i] = hookTally{}
+		} else {
+			if h.match != nil && !exprTrue(h.match(flow, secs)) {
+				continue
+			}
+			if v = h.value(flow, secs); math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+		}
+		r.submit(k, h.metric, v, append(tags[:len(tags):len(tags)], h.tags...), false, ts)
+	}
+}
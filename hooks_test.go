@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestAnalyzerHooks(t *testing.T) {
+	hooks, err := newAnalyzerHooks([]HookConfig{
+		{Match: "remote_port == 5432 && outbound && payload[0] == 81", Metric: "pg.queries", Tags: []string{"db:postgres"}},
+		{Match: "payload[100] >= 0", Metric: "long_payloads"},
+		{Value: "payload_len", Metric: "payload_bytes"},
+		{Event: hookEventFlow, Match: "retransmits > 1", Value: "retransmits", Metric: "lossy"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error compiling hooks: %v", err)
+	}
+
+	flow := NewTCPAccounting(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 40000, 5432, time.Minute, nil)
+	flow.Retransmits = 3
+	query := &layers.TCP{SrcPort: 40000, DstPort: 5432, ACK: true}
+	query.Payload = []byte("Q\x00\x00\x00\x0dselect 1")
+	reply := &layers.TCP{SrcPort: 5432, DstPort: 40000, ACK: true}
+	reply.Payload = []byte("T\x00\x00\x00\x21")
+	runPacketHooks(hooks, flow, query, true, uint32(len(query.Payload)))
+	runPacketHooks(hooks, flow, query, true, uint32(len(query.Payload)))
+	runPacketHooks(hooks, flow, reply, false, uint32(len(reply.Payload)))
+	if flow.hooked != nil {
+		t.Fatalf("Expected the segment to be forgotten once evaluated")
+	}
+
+	r := &Client{api: NewAPIClient("http://127.0.0.1:0", "key"), metrics: enabledMetrics(nil), hooks: hooks}
+	for _, h := range hooks {
+		r.metrics[h.metric] = true
+	}
+	r.reportHooks("k", flow, []string{"dst:db"}, 1700000000, 10)
+	reported := make(map[string]apiSeries)
+	for _, s := range r.api.pending {
+		reported[s.Metric] = s
+	}
+	if s, ok := reported[hookMetricPrefix+"pg.queries"]; !ok || s.Points[0][1] != 2 || len(s.Tags) != 2 || s.Tags[1] != "db:postgres" {
+		t.Errorf("Expected 2 queries, tagged like the flow and by the hook, got %+v", s)
+	}
+	if s, ok := reported[hookMetricPrefix+"payload_bytes"]; !ok || s.Points[0][1] != float64(2*len(query.Payload)+len(reply.Payload)) {
+		t.Errorf("Expected payload bytes summed, got %+v", s)
+	}
+	if s, ok := reported[hookMetricPrefix+"lossy"]; !ok || s.Points[0][1] != 3 {
+		t.Errorf("Expected the flow hook to match, got %+v", s)
+	}
+	if _, ok := reported[hookMetricPrefix+"long_payloads"]; ok {
+		t.Errorf("Expected bytes past the payload not to match")
+	}
+
+	// tallies start over every interval.
+	r.api.pending = nil
+	r.reportHooks("k", flow, []string{"dst:db"}, 1700000010, 10)
+	if len(r.api.pending) != 1 || r.api.pending[0].Metric != hookMetricPrefix+"lossy" {
+		t.Errorf("Expected only the flow hook reported, got %+v", r.api.pending)
+	}
+
+	for _, cfg := range []HookConfig{
+		{Metric: "Bad Name"},
+		{Metric: "x", Event: "connection"},
+		{Metric: "x", Event: hookEventFlow, Match: "payload[0] == 1"},
+		{Metric: "x", Match: "payload == 1"},
+		{Metric: "x", Value: "rtt +"},
+	} {
+		if _, err := newAnalyzerHooks([]HookConfig{cfg}); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	icmpMetricPrefix = "system.net.icmp."
+
+	// echo requests unanswered for this long are given up on.
+	icmpEchoTimeout = 10 * time.Second
+	// most echo requests pending per flow, pingers flooding unreachable hosts
+	// won't get us to hold more.
+	icmpMaxPending = 1024
+)
+
+// ICMPAccounting follows the echo requests (pings) from a requester (Src) to
+// a responder (Dst), passing through or sent by us.
+type ICMPAccounting struct {
+	Src, Dst   net.IP
+	External   bool
+	Pending    map[uint32]int64 // request capture timestamps, by id and sequence
+	SRTT       uint64           // ns
+	Last       uint64
+	Sampled    uint64
+	RepSampled uint64
+	LastSeen   int64
+}
+
+// handleEcho matches ICMP echo requests and replies, holding the sniffer's
+// flow map.
+func (d *MetroSniffer) handleEcho(srcIP, dstIP net.IP, request bool, id, seq uint16, meta *packetMeta) {
+	requester, responder := srcIP, dstIP
+	if !request {
+		requester, responder = dstIP, srcIP
+	}
+	flowkey := requester.String() + "-" + responder.String()
+	if meta.Tunnel != "" {
+		flowkey = meta.Tunnel + "/" + flowkey
+	}
+	ts := meta.ci.Timestamp.UnixNano()
+
+	d.flows.Lock()
+	defer d.flows.Unlock()
+	flow, ok := d.flows.ICMP[flowkey]
+	if !ok {
+		if !request {
+			return
+		}
+		external := d.policies.external(responder)
+		if !d.policies.sampled(flowkey, external) {
+			return
+		}
+		flow = &ICMPAccounting{Src: requester, Dst: responder, External: external, Pending: make(map[uint32]int64)}
+		d.flows.ICMP[flowkey] = flow
+	}
+	flow.LastSeen = ts
+
+	key := uint32(id)<<16 | uint32(seq)
+	if request {
+		if len(flow.Pending) < icmpMaxPending {
+			flow.Pending[key] = ts
+		}
+		return
+	}
+	sent, ok := flow.Pending[key]
+	if !ok || ts < sent {
+		return
+	}
+	delete(flow.Pending, key)
+	rtt := uint64(ts - sent)
+	if flow.SRTT == 0 {
+		flow.SRTT = rtt
+	} else if d.Soften {
+		flow.SRTT -= flow.SRTT >> 3
+		flow.SRTT += rtt >> 3
+	} else {
+		flow.SRTT = uint64(float64(flow.Sampled*flow.SRTT)/float64(flow.Sampled+1) + float64(rtt)/float64(flow.Sampled+1))
+	}
+	flow.Last = rtt
+	flow.Sampled++
+}
+
+// echo tells whether the decoded ICMP layer is an echo request or reply,
+// returning which and its id and sequence.
+func (m *MetroDecoder) echo(v6 bool) (bool, bool, uint16, uint16) {
+	if v6 {
+		switch m.icmp6.TypeCode.Type() {
+		case layers.ICMPv6TypeEchoRequest:
+			return true, true, m.icmp6echo.Identifier, m.icmp6echo.SeqNumber
+		case layers.ICMPv6TypeEchoReply:
+			return true, false, m.icmp6echo.Identifier, m.icmp6echo.SeqNumber
+		}
+		return false, false, 0, 0
+	}
+	switch m.icmp4.TypeCode.Type() {
+	case layers.ICMPv4TypeEchoRequest:
+		return true, true, m.icmp4.Id, m.icmp4.Seq
+	case layers.ICMPv4TypeEchoReply:
+		return true, false, m.icmp4.Id, m.icmp4.Seq
+	}
+	return false, false, 0, 0
+}
+
+// reportICMP submits the echo RTTs sampled over the interval, then forgets
+// requests left unanswered and idle flows.
+func (r *Client) reportICMP(now int64) {
+	r.flows.Lock()
+	defer r.flows.Unlock()
+	for k, flow := range r.flows.ICMP {
+		if flow.Sampled > flow.RepSampled && r.policies.reported(flow.External) {
+			ts := flow.LastSeen / int64(time.Second)
+			tags := append([]string{"src:" + r.hostname(flow.Src), "dst:" + r.hostname(flow.Dst)}, r.tags...)
+			r.submit(k, icmpMetricPrefix+"rtt.avg", nsToMs(flow.SRTT), tags, false, ts)
+			r.submit(k, icmpMetricPrefix+"rtt", nsToMs(flow.Last), tags, false, ts)
+		}
+		flow.RepSampled = flow.Sampled
+
+		for key, sent := range flow.Pending {
+			if flow.LastSeen-sent > int64(icmpEchoTimeout) {
+				delete(flow.Pending, key)
+			}
+		}
+		if time.Duration(now*int64(time.Second)-flow.LastSeen) > r.idleTTL {
+			delete(r.flows.ICMP, k)
+			log.Infof("ICMP flow expired: [%s]", k)
+		}
+	}
+}
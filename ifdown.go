@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// interfaceState tells whether a live capture is degraded: reading off it
+// failed (eg. EIO, ENETDOWN) and the handle is being reopened until the
+// interface is back, flows retained meanwhile.
+type interfaceState struct {
+	down int32
+}
+
+func (s *interfaceState) set(down bool) {
+	if s == nil {
+		return
+	}
+	var v int32
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&s.down, v)
+}
+
+func (s *interfaceState) isDown() bool {
+	return s != nil && atomic.LoadInt32(&s.down) != 0
+}
+
+// reportInterface submits whether the capture interface was down as of the
+// end of the interval, live captures only.
+func (r *Client) reportInterface(ts int64) {
+	if r.ifstate == nil {
+		return
+	}
+	var down float64
+	if r.ifstate.isDown() {
+		down = 1
+	}
+	r.submit("interface", "go_metro.capture.interface_down", down, r.tags, false, ts)
+}
+
+// interfaceDown enters the degraded state, on the capture failing.
+func (d *MetroSniffer) interfaceDown(err error) {
+	if d.downSince.IsZero() {
+		log.Errorf("Error reading packets off %q, interface down? Retaining flows while reopening: %v", d.Iface, err)
+		d.downSince = time.Now()
+		d.downBackoff = time.Second
+		if d.reporter != nil {
+			d.reporter.ifstate.set(true)
+		}
+		return
+	}
+	log.Debugf("Error reading packets off %q, still down: %v", d.Iface, err)
+}
+
+// interfaceUp leaves the degraded state, once the reopened capture reads
+// fine.
+func (d *MetroSniffer) interfaceUp() {
+	if d.downSince.IsZero() {
+		return
+	}
+	log.Infof("Interface %q back up after %v.", d.Iface, time.Since(d.downSince).Round(time.Second))
+	d.downSince, d.downBackoff = time.Time{}, 0
+	if d.reporter != nil {
+		d.reporter.ifstate.set(false)
+	}
+}
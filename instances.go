@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	instanceRunning = "running"
+	instancePaused  = "paused"
+	instanceStopped = "stopped" // sniffer died, or done reading a pcap file
+	// capture handle released, flows still reported and expired.
+	instanceCapturePaused = "capture_paused"
+)
+
+var (
+	errNoWhitelist     = errors.New("Whitelists must be enabled for go-metro to run (you may whitelist by IP or hostname).")
+	errNoInterface     = errors.New("No such interface.")
+	errNoSuchInstance  = errors.New("No such instance.")
+	errInstancePaused  = errors.New("Instance already paused.")
+	errInstanceRunning = errors.New("Instance not paused.")
+)
+
+// InstanceRequest describes a sniffer instance added through the control API.
+type InstanceRequest struct {
+	Interface string   `json:"interface"`
+	Filter    string   `json:"filter"`
+	Ips       []string `json:"ips"`
+	Hosts     []string `json:"hosts"`
+	Tags      []string `json:"tags"`
+}
+
+// InstanceStatus is a sniffer instance as reported by the control API.
+type InstanceStatus struct {
+	ID        int      `json:"id"`
+	Interface string   `json:"interface"`
+	Filter    string   `json:"filter"`
+	Tags      []string `json:"tags"`
+	State     string   `json:"state"`
+}
+
+type instance struct {
+	id      int
+	config  Config
+	filter  string
+	sniffer *MetroSniffer // nil while paused
+}
+
+// instanceManager owns the sniffer instances, so they can be managed at
+// runtime: paused instances keep their configuration and get a new sniffer
+// when resumed.
+type instanceManager struct {
+	sync.Mutex
+	initConf  InitConfig
+	filter    string
+	instances map[int]*instance
+	next      int
+}
+
+func newInstanceManager(initConf InitConfig, filter string) *instanceManager {
+	return &instanceManager{
+		initConf:  initConf,
+		filter:    filter,
+		instances: make(map[int]*instance),
+		next:      1,
+	}
+}
+
+// Add starts sniffing as configured, on every interface matching the
+// configuration, and returns the new instances' IDs.
+func (m *instanceManager) Add(cfg Config, filter string) ([]int, error) {
+	if len(cfg.Ips) == 0 && len(cfg.Hosts) == 0 {
+		return nil, errNoWhitelist
+	}
+	if filter == "" {
+		filter = m.filter
+	} else if _, err := compileBPF(layers.LinkTypeEthernet, maxSnaplen, filter); err != nil && err != errBPFUnsupported {
+		// it'd fail sniffing, unbeknownst to the caller.
+		return nil, fmt.Errorf("Bad BPF filter %q: %v", filter, err)
+	}
+
+	names, err := matchInterfaces(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 && m.initConf.StartupTimeout > 0 && !isAutoInterface(cfg.Interface) {
+		// may not be up yet at boot, the sniffer waits for it.
+		log.Warnf("Interface %q not found, will wait for it up to %ds", cfg.Interface, m.initConf.StartupTimeout)
+		names = []string{cfg.Interface}
+	}
+
+	// sniffers append to the tags, keep them from sharing our backing array.
+	cfg.Tags = cfg.Tags[:len(cfg.Tags):len(cfg.Tags)]
+
+	m.Lock()
+	defer m.Unlock()
+	var ids []int
+	for _, name := range names {
+		icfg := cfg
+		icfg.Interface = name
+		log.Infof("Will attempt sniffing off interface %q", icfg.Interface)
+		metrosniffer, err := NewMetroSniffer(m.initConf, icfg, filter)
+		if err != nil {
+			log.Errorf("Unable to instantiate sniffer for interface %q", icfg.Interface)
+			continue
+		}
+		metrosniffer.Start()
+
+		inst := &instance{id: m.next, config: icfg, filter: filter, sniffer: metrosniffer}
+		m.instances[inst.id] = inst
+		ids = append(ids, inst.id)
+		m.next++
+	}
+	if len(ids) == 0 {
+		return nil, errNoInterface
+	}
+	return ids, nil
+}
+
+// matchInterfaces returns the names of the interfaces an instance's interface
+// setting designates.
+func matchInterfaces(iface string) ([]string, error) {
+	if isDPDKInterface(iface) {
+		// not known to the kernel.
+		return []string{iface}, nil
+	}
+
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting interface details: %s", err)
+	}
+	if isAutoInterface(iface) {
+		name, err := resolveAutoInterface(iface, ifaces)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to pick interface for %q: %v", iface, err)
+		}
+		log.Infof("Interface %q resolved to %q", iface, name)
+		iface = name
+	}
+
+	var names []string
+	for j := range ifaces {
+		// Npcap device names are GUIDs, they may be configured by description instead.
+		if ifaces[j].Matches(iface) {
+			names = append(names, ifaces[j].Name)
+		}
+	}
+	return names, nil
+}
+
+// Remove stops an instance for good.
+func (m *instanceManager) Remove(id int) error {
+	m.Lock()
+	inst, ok := m.instances[id]
+	delete(m.instances, id)
+	m.Unlock()
+	if !ok {
+		return errNoSuchInstance
+	}
+	if inst.sniffer != nil {
+		return inst.sniffer.Stop()
+	}
+	return nil
+}
+
+// Pause stops an instance's sniffer, keeping its configuration around.
+func (m *instanceManager) Pause(id int) error {
+	m.Lock()
+	defer m.Unlock()
+	inst, ok := m.instances[id]
+	if !ok {
+		return errNoSuchInstance
+	}
+	if inst.sniffer == nil {
+		return errInstancePaused
+	}
+	err := inst.sniffer.Stop()
+	inst.sniffer = nil
+	return err
+}
+
+// Resume starts a new sniffer for a paused instance.
+func (m *instanceManager) Resume(id int) error {
+	m.Lock()
+	defer m.Unlock()
+	inst, ok := m.instances[id]
+	if !ok {
+		return errNoSuchInstance
+	}
+	if inst.sniffer != nil {
+		return errInstanceRunning
+	}
+	metrosniffer, err := NewMetroSniffer(m.initConf, inst.config, inst.filter)
+	if err != nil {
+		return err
+	}
+	metrosniffer.Start()
+	inst.sniffer = metrosniffer
+	return nil
+}
+
+// PauseCapture releases an instance's capture handle, keeping its sniffer
+// and flow state around.
+func (m *instanceManager) PauseCapture(id int) error {
+	s, err := m.sniffer(id)
+	if err != nil {
+		return err
+	}
+	return s.PauseCapture()
+}
+
+// ResumeCapture reopens an instance's capture handle.
+func (m *instanceManager) ResumeCapture(id int) error {
+	s, err := m.sniffer(id)
+	if err != nil {
+		return err
+	}
+	return s.ResumeCapture()
+}
+
+// sniffer returns an instance's sniffer, which must not be paused.
+func (m *instanceManager) sniffer(id int) (*MetroSniffer, error) {
+	m.Lock()
+	defer m.Unlock()
+	inst, ok := m.instances[id]
+	if !ok {
+		return nil, errNoSuchInstance
+	}
+	if inst.sniffer == nil {
+		return nil, errInstancePaused
+	}
+	return inst.sniffer, nil
+}
+
+// Sniffers returns the sniffers of the instances that are not paused.
+func (m *instanceManager) Sniffers() []*MetroSniffer {
+	m.Lock()
+	defer m.Unlock()
+	sniffers := make([]*MetroSniffer, 0, len(m.instances))
+	for _, inst := range m.instances {
+		if inst.sniffer != nil {
+			sniffers = append(sniffers, inst.sniffer)
+		}
+	}
+	return sniffers
+}
+
+func (m *instanceManager) List() []InstanceStatus {
+	m.Lock()
+	defer m.Unlock()
+	status := make([]InstanceStatus, 0, len(m.instances))
+	for _, inst := range m.instances {
+		state := instancePaused
+		if inst.sniffer != nil && inst.sniffer.Running() && inst.sniffer.CapturePaused() {
+			state = instanceCapturePaused
+		} else if inst.sniffer != nil && inst.sniffer.Running() {
+			state = instanceRunning
+		} else if inst.sniffer != nil {
+			state = instanceStopped
+		}
+		status = append(status, InstanceStatus{
+			ID:        inst.id,
+			Interface: inst.config.Interface,
+			Filter:    inst.filter,
+			Tags:      inst.config.Tags,
+			State:     state,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+// StopAll stops every sniffer, eg. when shutting down.
+func (m *instanceManager) StopAll() {
+	for _, s := range m.Sniffers() {
+		if err := s.Stop(); err != nil {
+			log.Infof("Error shutting down %s sniffer: %v.", s.Iface, err)
+		}
+	}
+}
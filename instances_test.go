@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestInstanceManager(t *testing.T) {
+	m := newInstanceManager(InitConfig{StatsdIP: "127.0.0.1", StatsdPort: 8125, IdleTTL: 300, ExpTTL: 60}, "tcp")
+	if _, err := m.Add(Config{Interface: "eth0"}, ""); err != errNoWhitelist {
+		t.Fatalf("Expected instance with no whitelist to be rejected, got %v", err)
+	}
+	if _, err := m.Add(Config{Interface: "no-such-interface", Ips: []string{"10.0.0.1"}}, ""); err != errNoInterface {
+		t.Fatalf("Expected instance on unknown interface to be rejected, got %v", err)
+	}
+
+	cfg := Config{Interface: fileInterface, Pcap: "fixtures/test_scp.pcap", Ips: []string{"162.243.251.92"}}
+	s, err := NewMetroSniffer(m.initConf, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error creating sniffer: %v", err)
+	}
+	s.Start()
+	m.instances[1] = &instance{id: 1, config: cfg, filter: "tcp", sniffer: s}
+
+	if err := m.Pause(1); err != nil {
+		t.Fatalf("Unexpected error pausing instance: %v", err)
+	}
+	if err := m.Pause(1); err != errInstancePaused {
+		t.Fatalf("Expected instance to be paused already, got %v", err)
+	}
+	if status := m.List(); len(status) != 1 || status[0].State != instancePaused || len(m.Sniffers()) != 0 {
+		t.Fatalf("Unexpected instances: %+v", status)
+	}
+	if err := m.Resume(1); err != nil {
+		t.Fatalf("Unexpected error resuming instance: %v", err)
+	}
+	if err := m.Resume(1); err != errInstanceRunning {
+		t.Fatalf("Expected instance to be running already, got %v", err)
+	}
+	if len(m.Sniffers()) != 1 {
+		t.Fatalf("Expected a new sniffer for the resumed instance")
+	}
+	if err := m.Remove(1); err != nil {
+		t.Fatalf("Unexpected error removing instance: %v", err)
+	}
+	if err := m.Remove(1); err != errNoSuchInstance {
+		t.Fatalf("Expected instance to be gone, got %v", err)
+	}
+}
+
+func TestControlInstances(t *testing.T) {
+	m := newInstanceManager(InitConfig{StatsdIP: "127.0.0.1", StatsdPort: 8125}, "tcp")
+	c := NewControlServer("127.0.0.1:0", newMaintenanceSchedule(), m)
+	srv := httptest.NewServer(c.srv.Handler)
+	defer srv.Close()
+
+	body, _ := json.Marshal(InstanceRequest{Interface: "eth0", Tags: []string{"env:test"}})
+	resp, err := http.Post(srv.URL+"/instances", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unexpected error adding instance: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for instance with no whitelist, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/instances/7/pause", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error pausing instance: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected not found pausing unknown instance, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/instances")
+	if err != nil {
+		t.Fatalf("Unexpected error listing instances: %v", err)
+	}
+	var status []InstanceStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(status) != 0 {
+		t.Fatalf("Unexpected instances: %d %+v", resp.StatusCode, status)
+	}
+}
+
+// badFilterSource rejects any filter, as libpcap does those it can't compile.
+type badFilterSource struct {
+	sliceSource
+}
+
+func (s *badFilterSource) SetBPFFilter(expr string) error {
+	return errors.New("syntax error in filter expression")
+}
+
+func TestInstanceBadFilter(t *testing.T) {
+	m := newInstanceManager(InitConfig{StatsdIP: "127.0.0.1", StatsdPort: 8125, IdleTTL: 300, ExpTTL: 60}, "tcp")
+	if _, err := compileBPF(layers.LinkTypeEthernet, maxSnaplen, "tcp"); err != errBPFUnsupported {
+		cfg := Config{Interface: fileInterface, Pcap: "fixtures/test_scp.pcap", Ips: []string{"162.243.251.92"}}
+		if _, err := m.Add(cfg, "tcp and ("); err == nil {
+			t.Fatalf("Expected instance with a bad filter to be rejected")
+		}
+	}
+
+	// failing to set the filter stops the sniffer, not the process.
+	registerCaptureBackend("test", func(d *MetroSniffer) (CaptureSource, error) {
+		return &badFilterSource{sliceSource{ts: time.Now()}}, nil
+	})
+	defer delete(captureBackends, "test")
+	ifaces, err := listInterfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skipf("No interface to sniff off: %v", err)
+	}
+	cfg := Config{Interface: ifaces[0].Name, Capture: "test", Ips: []string{"10.0.0.1"}}
+	s, err := NewMetroSniffer(m.initConf, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error creating sniffer: %v", err)
+	}
+	s.Start()
+	select {
+	case <-s.t.Dead():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the sniffer to stop failing to set its filter")
+	}
+	if s.t.Err() == nil {
+		t.Fatalf("Expected the sniffer to stop with an error")
+	}
+}
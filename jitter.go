@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// scheduleJitter spreads periodic work (reporting, refreshes, reconnects) by
+// up to this fraction of its period, so fleets of probes don't hit dogstatsd
+// or APIs in lockstep. 0 disables it.
+var scheduleJitter float64
+
+// jittered returns d randomly shortened or lengthened by up to the jitter
+// fraction.
+func jittered(d time.Duration) time.Duration {
+	if scheduleJitter <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*scheduleJitter*float64(d))
+}
+
+// splayed returns the delay before the first run of work repeating every d:
+// a random part of d when jittering, so probes started together drift apart
+// from the start.
+func splayed(d time.Duration) time.Duration {
+	if scheduleJitter <= 0 || d <= 0 {
+		return d
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
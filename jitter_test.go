@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	defer func(j float64) { scheduleJitter = j }(scheduleJitter)
+
+	scheduleJitter = 0
+	if d := jittered(time.Minute); d != time.Minute {
+		t.Fatalf("Expected no jitter by default, got %v", d)
+	}
+	if d := splayed(time.Minute); d != time.Minute {
+		t.Fatalf("Expected no splay by default, got %v", d)
+	}
+
+	scheduleJitter = 0.1
+	for i := 0; i < 1000; i++ {
+		if d := jittered(time.Minute); d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("Jittered interval out of bounds: %v", d)
+		}
+		if d := splayed(time.Minute); d <= 0 || d > time.Minute {
+			t.Fatalf("Splayed delay out of bounds: %v", d)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDestinationAge is how long the destinations a reporter published are
+// listed for without an update, eg. once its instance stopped.
+const maxDestinationAge = 10 * time.Minute
+
+// Destination is a service we connect to, as ranked by the control API for
+// sidecars and load balancers to prefer low-latency backends.
+type Destination struct {
+	IP    string  `json:"ip"`
+	Name  string  `json:"name,omitempty"`
+	Port  uint16  `json:"port"`
+	RTT   float64 `json:"rtt"` // ms, the flows' smoothed RTTs weighted by samples
+	Min   float64 `json:"min"` // ms
+	Flows int     `json:"flows"`
+	// samples the RTT is averaged over, to merge instances.
+	samples uint64
+}
+
+func (d *Destination) add(flow *TCPAccounting) {
+	n := float64(d.samples + flow.Sampled)
+	d.RTT = (d.RTT*float64(d.samples) + nsToMs(flow.SRTT)*float64(flow.Sampled)) / n
+	if min := nsToMs(flow.Min); d.Flows == 0 || min < d.Min {
+		d.Min = min
+	}
+	d.samples += flow.Sampled
+	d.Flows++
+}
+
+func (d *Destination) merge(o *Destination) {
+	n := float64(d.samples + o.samples)
+	d.RTT = (d.RTT*float64(d.samples) + o.RTT*float64(o.samples)) / n
+	if o.Min < d.Min {
+		d.Min = o.Min
+	}
+	d.samples += o.samples
+	d.Flows += o.Flows
+}
+
+type latencySnapshot struct {
+	at    time.Time
+	dests map[string]*Destination
+}
+
+// latencyBoard holds the destinations each reporter measured over its last
+// interval, shared by all of them.
+type latencyBoard struct {
+	sync.RWMutex
+	published map[*Client]latencySnapshot
+}
+
+// destinations is the process-wide board, read through the control API.
+var destinations = newLatencyBoard()
+
+func newLatencyBoard() *latencyBoard {
+	return &latencyBoard{published: make(map[*Client]latencySnapshot)}
+}
+
+// Publish replaces a reporter's destinations.
+func (b *latencyBoard) Publish(r *Client, dests map[string]*Destination, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.published[r] = latencySnapshot{at: now, dests: dests}
+	b.Unlock()
+}
+
+// Withdraw drops a reporter's destinations, eg. as it stops.
+func (b *latencyBoard) Withdraw(r *Client) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	delete(b.published, r)
+	b.Unlock()
+}
+
+// List returns the destinations on port (any if 0), lowest RTT first. Those
+// measured by several instances are merged.
+func (b *latencyBoard) List(now time.Time, port uint16) []Destination {
+	b.RLock()
+	merged := make(map[string]*Destination)
+	for _, snap := range b.published {
+		if now.Sub(snap.at) > maxDestinationAge {
+			continue
+		}
+		for k, d := range snap.dests {
+			if port != 0 && d.Port != port {
+				continue
+			}
+			if m, ok := merged[k]; ok {
+				m.merge(d)
+			} else {
+				dup := *d
+				merged[k] = &dup
+			}
+		}
+	}
+	b.RUnlock()
+
+	list := make([]Destination, 0, len(merged))
+	for _, d := range merged {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].RTT != list[j].RTT {
+			return list[i].RTT < list[j].RTT
+		}
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
+
+// observeDestination accounts a flow we initiated to the destination (Dst
+// and port) it connects to. Call holding the flow lock.
+func (r *Client) observeDestination(dests map[string]*Destination, flow *TCPAccounting) {
+	if r.board == nil || !flow.Client || flow.Sampled == 0 {
+		return
+	}
+	k := net.JoinHostPort(flow.Dst.String(), strconv.Itoa(int(flow.Dport)))
+	d, ok := dests[k]
+	if !ok {
+		d = &Destination{IP: flow.Dst.String(), Port: uint16(flow.Dport)}
+		if name := r.hostname(flow.Dst); name != d.IP {
+			d.Name = name
+		}
+		dests[k] = d
+	}
+	d.add(flow)
+}
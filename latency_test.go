@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyBoard(t *testing.T) {
+	b := newLatencyBoard()
+	now := time.Now()
+	a, c := &Client{}, &Client{}
+
+	b.Publish(a, map[string]*Destination{
+		"[2001:db8::2]:443": {IP: "2001:db8::2", Port: 443, RTT: 20, Min: 10, Flows: 1, samples: 10},
+		"[2001:db8::3]:443": {IP: "2001:db8::3", Port: 443, RTT: 5, Min: 4, Flows: 1, samples: 10},
+	}, now)
+	b.Publish(c, map[string]*Destination{
+		"[2001:db8::2]:443": {IP: "2001:db8::2", Port: 443, RTT: 10, Min: 8, Flows: 1, samples: 30},
+		"[2001:db8::4]:80":  {IP: "2001:db8::4", Port: 80, RTT: 1, Min: 1, Flows: 1, samples: 1},
+	}, now)
+
+	list := b.List(now, 443)
+	if len(list) != 2 || list[0].IP != "2001:db8::3" || list[1].IP != "2001:db8::2" {
+		t.Fatalf("Unexpected destinations: %+v", list)
+	}
+	if list[1].RTT != 12.5 || list[1].Min != 8 || list[1].Flows != 2 {
+		t.Errorf("Expected merged destination, got %+v", list[1])
+	}
+	if list = b.List(now, 0); len(list) != 3 || list[0].Port != 80 {
+		t.Errorf("Unexpected destinations on any port: %+v", list)
+	}
+
+	b.Withdraw(c)
+	if list = b.List(now, 0); len(list) != 2 || list[1].RTT != 20 {
+		t.Errorf("Expected withdrawn destinations to be dropped, got %+v", list)
+	}
+	if list = b.List(now.Add(maxDestinationAge+time.Second), 0); len(list) != 0 {
+		t.Errorf("Expected stale destinations to be dropped, got %+v", list)
+	}
+}
+
+func TestControlDestinations(t *testing.T) {
+	c := NewControlServer("127.0.0.1:0", newMaintenanceSchedule(), nil)
+	c.board = newLatencyBoard()
+	c.board.Publish(&Client{}, map[string]*Destination{
+		"[2001:db8::2]:443": {IP: "2001:db8::2", Name: "b.example.com", Port: 443, RTT: 20, Flows: 1, samples: 1},
+		"[2001:db8::3]:443": {IP: "2001:db8::3", Port: 443, RTT: 5, Flows: 1, samples: 1},
+	}, time.Now())
+	srv := httptest.NewServer(c.srv.Handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/destinations?port=443&limit=1")
+	if err != nil {
+		t.Fatalf("Unexpected error listing destinations: %v", err)
+	}
+	var list []Destination
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].IP != "2001:db8::3" {
+		t.Fatalf("Unexpected destinations: %+v", list)
+	}
+
+	resp, err = http.Get(srv.URL + "/destinations?format=srv")
+	if err != nil {
+		t.Fatalf("Unexpected error listing SRV records: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if expected := "0 0 443 2001:db8::3.\n1 0 443 b.example.com.\n"; string(body) != expected {
+		t.Errorf("Expected SRV records %q, got %q", expected, body)
+	}
+
+	resp, err = http.Get(srv.URL + "/destinations?format=txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected unknown format to be rejected, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// connections expiring without a FIN or RST end idle.
+const closeIdle = "idle"
+
+// connectionEnded submits how long a connection lasted, from its SYN - or
+// first packet, if the handshake wasn't seen - to its last packet, tagged by
+// how it ended. Call holding the flow lock, once per flow.
+func (r *Client) connectionEnded(flow *TCPAccounting, how string, now time.Time) {
+	if flow.Refused || flow.ConnFailed || !r.policies.reported(flow.External) {
+		return
+	}
+	if r.suppressed(flow, now) || r.cloudLBs.dropped(flow) {
+		return
+	}
+	start := flow.FirstSeen
+	if flow.SYN != 0 {
+		start = flow.SYN
+	}
+	if start == 0 || flow.LastSeen < start {
+		return
+	}
+
+	tags := append(r.flowTags(flow), "close:"+how)
+	secs := float64(flow.LastSeen-start) / float64(time.Second)
+	r.submit(strings.Join(tags, ","), metricPrefix+"connection.duration", secs, append(tags, r.tags...), true, now.Unix())
+}
+
+// observeOpen tallies a flow's connection if it's still open, by host pair.
+// Call holding the flow lock.
+func (r *Client) observeOpen(opens map[string]*flowTally, flow *TCPAccounting, now time.Time) {
+	if flow.Close != "" || flow.Refused || flow.ConnFailed || !r.policies.reported(flow.External) {
+		return
+	}
+	if r.suppressed(flow, now) || r.cloudLBs.dropped(flow) {
+		return
+	}
+	tags := r.flowTags(flow)
+	key := strings.Join(tags, ",")
+	o, ok := opens[key]
+	if !ok {
+		o = &flowTally{tags: append(tags, r.tags...)}
+		opens[key] = o
+	}
+	o.n++
+}
+
+// reportOpen submits the connections open as of the end of the interval.
+func (r *Client) reportOpen(opens map[string]*flowTally, ts int64) {
+	for k, o := range opens {
+		r.submit(k, metricPrefix+"connections.open", float64(o.n), o.tags, false, ts)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+var errLinkStatsUnsupported = errors.New("Link statistics unsupported on this platform.")
+
+// LinkStat holds an interface's byte counters and link speed.
+type LinkStat struct {
+	RxBytes uint64
+	TxBytes uint64
+	Speed   uint64 // Mbps, 0 if unknown (eg. virtual interfaces, link down)
+}
+
+// linkStats turns the capture interface's counters into per-interval deltas,
+// so RTTs can be read knowing how loaded the link was.
+type linkStats struct {
+	iface string
+	prev  LinkStat
+	ts    time.Time
+}
+
+func newLinkStats(iface string) *linkStats {
+	return &linkStats{iface: iface}
+}
+
+// collect returns the counter deltas since the previous call, along with the
+// current link speed, and the interval they cover - zero the first time or
+// if the counters were reset.
+func (l *linkStats) collect() (LinkStat, time.Duration, error) {
+	current, err := readLinkStat(l.iface)
+	if err != nil {
+		return LinkStat{}, 0, err
+	}
+	delta, interval := l.delta(current, time.Now())
+	return delta, interval, nil
+}
+
+func (l *linkStats) delta(current LinkStat, now time.Time) (LinkStat, time.Duration) {
+	prev, ts := l.prev, l.ts
+	l.prev, l.ts = current, now
+	if ts.IsZero() || current.RxBytes < prev.RxBytes || current.TxBytes < prev.TxBytes {
+		return LinkStat{}, 0
+	}
+	return LinkStat{
+		RxBytes: current.RxBytes - prev.RxBytes,
+		TxBytes: current.TxBytes - prev.TxBytes,
+		Speed:   current.Speed,
+	}, now.Sub(ts)
+}
+
+// reportLink submits the capture interface's throughput (bytes per second)
+// and, its speed being known, utilization (percent of the link speed), tagged
+// direction:sent and direction:received.
+func (r *Client) reportLink() {
+	delta, interval, err := r.link.collect()
+	if err != nil {
+		log.Warnf("Error collecting link statistics of %q: %v", r.link.iface, err)
+		return
+	}
+	secs := interval.Seconds()
+	if secs <= 0 {
+		return
+	}
+
+	ts := time.Now().Unix()
+	k := "link:" + r.link.iface
+	if delta.Speed > 0 {
+		r.submit(k, metricPrefix+"link.speed", float64(delta.Speed), r.tags, false, ts)
+	}
+	for _, dir := range []struct {
+		tag   string
+		bytes uint64
+	}{
+		{"direction:sent", delta.TxBytes},
+		{"direction:received", delta.RxBytes},
+	} {
+		tags := append(append([]string(nil), r.tags...), dir.tag)
+		rate := float64(dir.bytes) / secs
+		r.submit(k, metricPrefix+"link.bytes", rate, tags, false, ts)
+		if delta.Speed > 0 {
+			r.submit(k, metricPrefix+"link.utilization", 100*rate*8/(float64(delta.Speed)*1e6), tags, false, ts)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysClassNet is where the kernel exposes interface counters and the link
+// speed ethtool reports.
+var sysClassNet = "/sys/class/net"
+
+func readSysUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// readLinkStat reads an interface's byte counters and link speed off sysfs.
+func readLinkStat(iface string) (LinkStat, error) {
+	var s LinkStat
+	var err error
+	dir := filepath.Join(sysClassNet, iface)
+	if s.RxBytes, err = readSysUint(filepath.Join(dir, "statistics", "rx_bytes")); err != nil {
+		return s, err
+	}
+	if s.TxBytes, err = readSysUint(filepath.Join(dir, "statistics", "tx_bytes")); err != nil {
+		return s, err
+	}
+	// unreadable, or -1, with the link down or no notion of speed.
+	s.Speed, _ = readSysUint(filepath.Join(dir, "speed"))
+	return s, nil
+}
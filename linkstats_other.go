@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func readLinkStat(iface string) (LinkStat, error) {
+	return LinkStat{}, errLinkStatsUnsupported
+}
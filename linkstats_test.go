@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkStatsDeltas(t *testing.T) {
+	l := newLinkStats("eth0")
+	now := time.Now()
+	if _, interval := l.delta(LinkStat{RxBytes: 1000, TxBytes: 500, Speed: 10000}, now); interval != 0 {
+		t.Fatalf("Expected no interval off the first collection, got %v", interval)
+	}
+
+	delta, interval := l.delta(LinkStat{RxBytes: 3000, TxBytes: 600, Speed: 10000}, now.Add(10*time.Second))
+	if interval != 10*time.Second || delta.RxBytes != 2000 || delta.TxBytes != 100 || delta.Speed != 10000 {
+		t.Fatalf("Unexpected deltas: %+v over %v", delta, interval)
+	}
+
+	// counters reset, eg. the driver reloaded.
+	if _, interval := l.delta(LinkStat{RxBytes: 10, TxBytes: 10}, now.Add(20*time.Second)); interval != 0 {
+		t.Fatalf("Expected no interval across a counter reset, got %v", interval)
+	}
+}
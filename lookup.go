@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Lookup keys starting with this prefix are treated as regular expressions.
+const regexKeyPrefix = "~"
+
+type cidrEntry struct {
+	net  *net.IPNet
+	bits int
+	name string
+}
+
+type regexEntry struct {
+	re   *regexp.Regexp
+	name string
+}
+
+// LookupTable maps IPs to readable names. Keys may be plain IPs, CIDRs
+// (eg. 10.1.0.0/16) or regular expressions prefixed by "~" matched against
+// the textual IP. The most specific match wins: exact IPs, then the longest
+// CIDR prefix, then regular expressions in key order.
+type LookupTable struct {
+	sync.RWMutex
+	exact  map[string]string
+	cidrs  []cidrEntry
+	regexs []regexEntry
+}
+
+func NewLookupTable() *LookupTable {
+	l := &LookupTable{
+		exact: make(map[string]string),
+	}
+	return l
+}
+
+// Add inserts a lookup entry, parsing CIDR and regex keys.
+func (l *LookupTable) Add(key, name string) error {
+	switch {
+	case strings.HasPrefix(key, regexKeyPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(key, regexKeyPrefix))
+		if err != nil {
+			return err
+		}
+		l.Lock()
+		l.regexs = append(l.regexs, regexEntry{re: re, name: name})
+		sort.Slice(l.regexs, func(i, j int) bool {
+			return l.regexs[i].re.String() < l.regexs[j].re.String()
+		})
+		l.Unlock()
+	case strings.Contains(key, "/"):
+		_, ipnet, err := net.ParseCIDR(key)
+		if err != nil {
+			return err
+		}
+		bits, _ := ipnet.Mask.Size()
+		l.Lock()
+		l.cidrs = append(l.cidrs, cidrEntry{net: ipnet, bits: bits, name: name})
+		sort.SliceStable(l.cidrs, func(i, j int) bool {
+			return l.cidrs[i].bits > l.cidrs[j].bits
+		})
+		l.Unlock()
+	default:
+		if net.ParseIP(key) == nil {
+			return errors.New("Invalid lookup key: " + key)
+		}
+		l.Set(key, name)
+	}
+	return nil
+}
+
+// Set adds an exact IP entry.
+func (l *LookupTable) Set(ip, name string) {
+	l.Lock()
+	l.exact[ip] = name
+	l.Unlock()
+}
+
+// Get returns the most specific name for ip.
+func (l *LookupTable) Get(ip string) (string, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if name, ok := l.exact[ip]; ok {
+		return name, true
+	}
+
+	if len(l.cidrs) > 0 {
+		if addr := net.ParseIP(ip); addr != nil {
+			for i := range l.cidrs {
+				if l.cidrs[i].net.Contains(addr) {
+					return l.cidrs[i].name, true
+				}
+			}
+		}
+	}
+
+	for i := range l.regexs {
+		if l.regexs[i].re.MatchString(ip) {
+			return l.regexs[i].name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLookupTable(t *testing.T) {
+	l := NewLookupTable()
+	entries := map[string]string{
+		"10.1.0.0/16":        "payments-vpc",
+		"10.1.2.0/24":        "payments-db",
+		"10.1.2.3":           "payments-db-master",
+		"~^192\\.168\\.1\\.": "office",
+	}
+	for k, v := range entries {
+		if err := l.Add(k, v); err != nil {
+			t.Fatalf("LookupTable.Add(%q) expected == nil, got %v", k, err)
+		}
+	}
+
+	expected := map[string]string{
+		"10.1.2.3":     "payments-db-master",
+		"10.1.2.4":     "payments-db",
+		"10.1.200.1":   "payments-vpc",
+		"192.168.1.20": "office",
+	}
+	for ip, name := range expected {
+		if got, ok := l.Get(ip); !ok || got != name {
+			t.Fatalf("LookupTable.Get(%q) expected %q, got %q", ip, name, got)
+		}
+	}
+
+	if _, ok := l.Get("172.16.0.1"); ok {
+		t.Fatalf("LookupTable.Get should not match unknown IPs")
+	}
+	if err := l.Add("not-an-ip", "foo"); err == nil {
+		t.Fatalf("LookupTable.Add expected error for invalid key")
+	}
+}
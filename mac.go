@@ -0,0 +1,29 @@
+package main
+
+import "strings"
+
+// macOUI returns the OUI (vendor prefix) of a MAC address, eg. 00:50:56.
+func macOUI(mac string) string {
+	if len(mac) < 8 {
+		return ""
+	}
+	return strings.ToLower(mac[:8])
+}
+
+// ouiTags returns the OUI tags of a flow's endpoints, by the tag names they
+// go by, eg. src_oui:00:50:56, dst_oui:3c:fd:fe. Call holding the flow lock.
+func (r *Client) ouiTags(flow *TCPAccounting) []string {
+	a, _, aKey, bKey := r.endpoints(flow)
+	aMAC, bMAC := flow.LocalMAC, flow.RemoteMAC
+	if !a.Equal(flow.Src) {
+		aMAC, bMAC = bMAC, aMAC
+	}
+	var tags []string
+	if oui := macOUI(aMAC); oui != "" {
+		tags = append(tags, aKey+"_oui:"+oui)
+	}
+	if oui := macOUI(bMAC); oui != "" {
+		tags = append(tags, bKey+"_oui:"+oui)
+	}
+	return tags
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaintenanceConfig describes a maintenance window: metrics for flows to the
+// destinations (IPs, CIDRs, hostnames or peer group names) are not emitted
+// between start and end (RFC3339), flows are still being tracked though.
+type MaintenanceConfig struct {
+	Destinations []string `yaml:"destinations" json:"destinations"`
+	Start        string   `yaml:"start" json:"start"`
+	End          string   `yaml:"end" json:"end"`
+	Reason       string   `yaml:"reason" json:"reason,omitempty"`
+}
+
+type maintenanceWindow struct {
+	ID     int
+	Start  time.Time
+	End    time.Time
+	Reason string
+	dests  []string
+	nets   []*net.IPNet
+	names  map[string]bool
+}
+
+// maintenanceSchedule holds the configured and API-defined maintenance
+// windows, shared by all reporters.
+type maintenanceSchedule struct {
+	sync.RWMutex
+	windows []*maintenanceWindow
+	next    int
+}
+
+// maintenance is the process-wide schedule - populated from the configuration
+// and the control API.
+var maintenance = newMaintenanceSchedule()
+
+func newMaintenanceSchedule() *maintenanceSchedule {
+	return &maintenanceSchedule{next: 1}
+}
+
+func newMaintenanceWindow(cfg MaintenanceConfig, now time.Time) (*maintenanceWindow, error) {
+	if len(cfg.Destinations) == 0 {
+		return nil, errors.New("No destinations in maintenance window.")
+	}
+	w := &maintenanceWindow{
+		Start:  now,
+		Reason: cfg.Reason,
+		dests:  cfg.Destinations,
+		names:  make(map[string]bool),
+	}
+	var err error
+	if cfg.Start != "" {
+		if w.Start, err = time.Parse(time.RFC3339, cfg.Start); err != nil {
+			return nil, fmt.Errorf("Bad maintenance window start %q.", cfg.Start)
+		}
+	}
+	if cfg.End == "" {
+		return nil, errors.New("Maintenance windows require an end time.")
+	}
+	if w.End, err = time.Parse(time.RFC3339, cfg.End); err != nil {
+		return nil, fmt.Errorf("Bad maintenance window end %q.", cfg.End)
+	}
+	if !w.End.After(w.Start) {
+		return nil, errors.New("Maintenance window ends before it starts.")
+	}
+	for _, d := range cfg.Destinations {
+		if ipnet, err := parseIPNet(d); err == nil {
+			w.nets = append(w.nets, ipnet)
+		} else {
+			w.names[d] = true
+		}
+	}
+	return w, nil
+}
+
+// matches returns whether the window covers a destination, by address or by
+// any of the names it is reported under.
+func (w *maintenanceWindow) matches(ip net.IP, names ...string) bool {
+	for _, n := range w.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range names {
+		if w.names[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// Add schedules a window, returning its ID.
+func (m *maintenanceSchedule) Add(cfg MaintenanceConfig) (int, error) {
+	w, err := newMaintenanceWindow(cfg, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	w.ID = m.next
+	m.next++
+	m.windows = append(m.windows, w)
+	return w.ID, nil
+}
+
+// Remove cancels a window, returns false if there was no such window.
+func (m *maintenanceSchedule) Remove(id int) bool {
+	m.Lock()
+	defer m.Unlock()
+	for i, w := range m.windows {
+		if w.ID == id {
+			m.windows = append(m.windows[:i], m.windows[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the windows that have not ended yet, forgetting the rest.
+func (m *maintenanceSchedule) List(now time.Time) []MaintenanceStatus {
+	m.Lock()
+	defer m.Unlock()
+	windows := m.windows[:0]
+	for _, w := range m.windows {
+		if w.End.After(now) {
+			windows = append(windows, w)
+		}
+	}
+	m.windows = windows
+
+	status := make([]MaintenanceStatus, 0, len(windows))
+	for _, w := range windows {
+		status = append(status, MaintenanceStatus{
+			ID: w.ID,
+			MaintenanceConfig: MaintenanceConfig{
+				Destinations: w.dests,
+				Start:        w.Start.Format(time.RFC3339),
+				End:          w.End.Format(time.RFC3339),
+				Reason:       w.Reason,
+			},
+			Active: !now.Before(w.Start),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+// Suppressed returns whether a destination is under maintenance at the time.
+func (m *maintenanceSchedule) Suppressed(now time.Time, ip net.IP, names ...string) bool {
+	m.RLock()
+	defer m.RUnlock()
+	for _, w := range m.windows {
+		if now.Before(w.Start) || !now.Before(w.End) {
+			continue
+		}
+		if w.matches(ip, names...) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceStatus is a scheduled window as reported by the control API.
+type MaintenanceStatus struct {
+	ID int `json:"id"`
+	MaintenanceConfig
+	Active bool `json:"active"`
+}
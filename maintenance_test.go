@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceSchedule(t *testing.T) {
+	m := newMaintenanceSchedule()
+	end := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	id, err := m.Add(MaintenanceConfig{Destinations: []string{"10.1.4.0/24", "db.example.com"}, End: end})
+	if err != nil {
+		t.Fatalf("Unexpected error adding maintenance window: %v", err)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	if _, err := m.Add(MaintenanceConfig{Destinations: []string{"10.1.5.1"}, Start: later.Format(time.RFC3339), End: later.Add(time.Hour).Format(time.RFC3339)}); err != nil {
+		t.Fatalf("Unexpected error adding maintenance window: %v", err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		ip       string
+		name     string
+		expected bool
+	}{
+		{"10.1.4.200", "", true},
+		{"10.1.3.1", "db.example.com", true},
+		{"10.1.3.1", "web.example.com", false},
+		{"10.1.5.1", "", false}, // not started yet
+	}
+	for _, tt := range tests {
+		if m.Suppressed(now, net.ParseIP(tt.ip), tt.name) != tt.expected {
+			t.Fatalf("Expected %s (%s) suppressed: %v", tt.ip, tt.name, tt.expected)
+		}
+	}
+	if !m.Suppressed(later, net.ParseIP("10.1.5.1")) {
+		t.Fatalf("Expected 10.1.5.1 suppressed once its window starts")
+	}
+
+	if status := m.List(now); len(status) != 2 || !status[0].Active || status[1].Active {
+		t.Fatalf("Unexpected maintenance windows: %+v", status)
+	}
+	if !m.Remove(id) || m.Remove(id) {
+		t.Fatalf("Expected window %d to be removed exactly once", id)
+	}
+	if len(m.List(later.Add(2*time.Hour))) != 0 {
+		t.Fatalf("Expected ended windows to be forgotten")
+	}
+
+	if _, err := m.Add(MaintenanceConfig{Destinations: []string{"10.1.5.1"}}); err == nil {
+		t.Fatalf("Expected window with no end to be rejected")
+	}
+	if _, err := m.Add(MaintenanceConfig{End: end}); err == nil {
+		t.Fatalf("Expected window with no destinations to be rejected")
+	}
+}
+
+func TestControlMaintenance(t *testing.T) {
+	m := newMaintenanceSchedule()
+	c := NewControlServer("127.0.0.1:0", m, nil)
+	srv := httptest.NewServer(c.srv.Handler)
+	defer srv.Close()
+
+	body, _ := json.Marshal(MaintenanceConfig{
+		Destinations: []string{"10.1.4.1"},
+		End:          time.Now().Add(time.Hour).Format(time.RFC3339),
+		Reason:       "failover drill",
+	})
+	resp, err := http.Post(srv.URL+"/maintenance", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unexpected error scheduling maintenance: %v", err)
+	}
+	var created map[string]int
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created["id"] != 1 {
+		t.Fatalf("Unexpected response scheduling maintenance: %d %v", resp.StatusCode, created)
+	}
+	if !m.Suppressed(time.Now(), net.ParseIP("10.1.4.1")) {
+		t.Fatalf("Expected 10.1.4.1 to be under maintenance")
+	}
+
+	resp, err = http.Get(srv.URL + "/maintenance")
+	if err != nil {
+		t.Fatalf("Unexpected error listing maintenance windows: %v", err)
+	}
+	var status []MaintenanceStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if len(status) != 1 || status[0].Reason != "failover drill" || !status[0].Active {
+		t.Fatalf("Unexpected maintenance windows: %+v", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/maintenance/1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error cancelling maintenance: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || m.Suppressed(time.Now(), net.ParseIP("10.1.4.1")) {
+		t.Fatalf("Expected maintenance window to be cancelled, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/maintenance", "application/json", bytes.NewReader([]byte(`{"destinations":["10.1.4.1"]}`)))
+	if err != nil {
+		t.Fatalf("Unexpected error scheduling maintenance: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for window with no end, got %d", resp.StatusCode)
+	}
+}
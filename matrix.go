@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"gopkg.in/tomb.v2"
+)
+
+const defaultMatrixInterval = 300 // seconds
+
+var matrixHeader = []string{"timestamp", "src", "dst", "bytes", "flows", "srtt", "sampled_flows"}
+
+// MatrixConfig enables exporting a host-to-host traffic/RTT matrix, limited
+// to hosts in the configured subnets, for offline capacity planning. Rows
+// are appended to a CSV file every interval, independently of the metrics.
+type MatrixConfig struct {
+	Path     string   `yaml:"path"`
+	Subnets  []string `yaml:"subnets"`
+	Interval int      `yaml:"interval"` // seconds
+}
+
+func (c *MatrixConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("Error parsing configuration - matrix path is required.")
+	}
+	if len(c.Subnets) == 0 {
+		return errors.New("Error parsing configuration - matrix subnets are required.")
+	}
+	for _, s := range c.Subnets {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return fmt.Errorf("Error parsing configuration - bad matrix subnet %q.", s)
+		}
+	}
+	if c.Interval < 0 {
+		return errors.New("Error parsing configuration - matrix interval must be positive.")
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultMatrixInterval
+	}
+	return nil
+}
+
+// matrixCell is the traffic between a pair of hosts over an interval.
+type matrixCell struct {
+	bytes   uint64
+	flows   int
+	srtt    uint64 // sum of the flows' SRTTs, ns
+	samples uint64
+}
+
+type trafficMatrix struct {
+	path     string
+	subnets  []*net.IPNet
+	interval time.Duration
+	flows    *FlowMap
+	// bytes of each flow at the previous export
+	last map[string]uint64
+	t    tomb.Tomb
+}
+
+func newTrafficMatrix(cfg *MatrixConfig, flows *FlowMap) (*trafficMatrix, error) {
+	m := &trafficMatrix{
+		path:     cfg.Path,
+		interval: time.Duration(cfg.Interval) * time.Second,
+		flows:    flows,
+		last:     make(map[string]uint64),
+	}
+	if m.interval <= 0 {
+		m.interval = defaultMatrixInterval * time.Second
+	}
+	for _, s := range cfg.Subnets {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		m.subnets = append(m.subnets, n)
+	}
+	return m, nil
+}
+
+// Start exports the matrix every interval until closed.
+func (m *trafficMatrix) Start() {
+	m.t.Go(m.run)
+}
+
+// Close stops the exports, writing out whatever was seen since the last one.
+func (m *trafficMatrix) Close() error {
+	m.t.Kill(nil)
+	return m.t.Wait()
+}
+
+func (m *trafficMatrix) run() error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.export(now)
+		case <-m.t.Dying():
+			m.export(time.Now())
+			return nil
+		}
+	}
+}
+
+func (m *trafficMatrix) export(now time.Time) {
+	if err := m.write(now, m.collect()); err != nil {
+		log.Errorf("Unable to export traffic matrix to %q: %v", m.path, err)
+	}
+}
+
+func (m *trafficMatrix) covers(ip net.IP) bool {
+	for _, n := range m.subnets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// collect aggregates the traffic of every flow between covered hosts since
+// the previous export.
+func (m *trafficMatrix) collect() map[[2]string]*matrixCell {
+	cells := make(map[[2]string]*matrixCell)
+	seen := make(map[string]uint64)
+
+	m.flows.RLock()
+	for k, flow := range m.flows.Map {
+		flow.RLock()
+		if m.covers(flow.Src) && m.covers(flow.Dst) {
+			seen[k] = flow.Bytes
+			delta := flow.Bytes
+			if prev, ok := m.last[k]; ok && prev <= flow.Bytes {
+				delta -= prev
+			}
+			pair := [2]string{flow.Src.String(), flow.Dst.String()}
+			c, ok := cells[pair]
+			if !ok {
+				c = &matrixCell{}
+				cells[pair] = c
+			}
+			c.bytes += delta
+			c.flows++
+			if flow.Sampled > 0 {
+				c.srtt += flow.SRTT
+				c.samples++
+			}
+		}
+		flow.RUnlock()
+	}
+	m.flows.RUnlock()
+
+	m.last = seen
+	return cells
+}
+
+// write appends the matrix to the export file, with a header if new.
+func (m *trafficMatrix) write(now time.Time, cells map[[2]string]*matrixCell) error {
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	pairs := make([][2]string, 0, len(cells))
+	for pair := range cells {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+
+	cw := csv.NewWriter(f)
+	if fi.Size() == 0 {
+		cw.Write(matrixHeader)
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	for _, pair := range pairs {
+		c := cells[pair]
+		srtt := ""
+		if c.samples > 0 {
+			srtt = strconv.FormatFloat(nsToMs(c.srtt/c.samples), 'f', 3, 64)
+		}
+		cw.Write([]string{
+			ts, pair[0], pair[1], strconv.FormatUint(c.bytes, 10), strconv.Itoa(c.flows),
+			srtt, strconv.FormatUint(c.samples, 10),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrafficMatrix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metro-matrix")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &MatrixConfig{Path: filepath.Join(dir, "matrix.csv"), Subnets: []string{"10.0.0.0/8"}}
+	if err := cfg.validate(); err != nil || cfg.Interval != defaultMatrixInterval {
+		t.Fatalf("Unexpected matrix config validation: %+v (%v)", cfg, err)
+	}
+	if err := (&MatrixConfig{Path: cfg.Path, Subnets: []string{"10.0.0.0"}}).validate(); err == nil {
+		t.Fatalf("Expected bad matrix subnet to be rejected")
+	}
+	if err := (&MatrixConfig{Path: cfg.Path}).validate(); err == nil {
+		t.Fatalf("Expected matrix without subnets to be rejected")
+	}
+
+	flows := NewFlowMap()
+	flows.Add("10.0.0.1:40000-10.0.0.2:443", &TCPAccounting{
+		Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2"),
+		SRTT: uint64(2 * time.Millisecond), Sampled: 10, Bytes: 1000,
+	})
+	flows.Add("10.0.0.1:40001-10.0.0.2:443", &TCPAccounting{
+		Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2"),
+		SRTT: uint64(4 * time.Millisecond), Sampled: 5, Bytes: 500,
+	})
+	flows.Add("10.0.0.1:40002-8.8.8.8:443", &TCPAccounting{
+		Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("8.8.8.8"), Bytes: 500,
+	})
+
+	m, err := newTrafficMatrix(cfg, flows)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up traffic matrix: %v", err)
+	}
+	m.export(time.Unix(100, 0))
+
+	flow, _ := flows.Get("10.0.0.1:40000-10.0.0.2:443")
+	flow.Bytes += 200
+	m.export(time.Unix(400, 0))
+
+	out, err := ioutil.ReadFile(cfg.Path)
+	if err != nil {
+		t.Fatalf("Unable to read traffic matrix: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	expected := []string{
+		"timestamp,src,dst,bytes,flows,srtt,sampled_flows",
+		"100,10.0.0.1,10.0.0.2,1500,2,3.000,2",
+		"400,10.0.0.1,10.0.0.2,200,2,3.000,2",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected traffic matrix: %q", lines)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+func memorySize() (uint64, error) {
+	var name string
+	switch runtime.GOOS {
+	case "darwin":
+		name = "hw.memsize"
+	case "netbsd", "openbsd":
+		name = "hw.physmem64"
+	default:
+		name = "hw.physmem"
+	}
+	return unix.SysctlUint64(name)
+}
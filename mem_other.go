@@ -0,0 +1,12 @@
+//go:build !linux && !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!windows,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+)
+
+func memorySize() (uint64, error) {
+	return 0, errors.New("memory size detection unsupported on this platform")
+}
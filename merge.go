@@ -0,0 +1,221 @@
+package main
+
+// Files read concurrently are each accounted into their own FlowMap, merged
+// into ours once all are read: a flow spanning rotated files is analyzed a
+// file at a time, in order, its pieces combined.
+
+// mergeFlows moves the flows of a file's FlowMap into ours, combining those
+// we have already - from earlier files, merge in order. Expiry timers are
+// stopped, the file read, and the keys of flows expired meanwhile returned
+// for us to expire. Those whose timer fired may be sent on our Expire too,
+// expiring them twice is harmless.
+func (f *FlowMap) mergeFlows(o *FlowMap) (expired []string) {
+	f.Lock()
+	defer f.Unlock()
+	o.Lock()
+	defer o.Unlock()
+
+	for k, flow := range o.Map {
+		flow.Lock()
+		if flow.Alive != nil && !flow.Alive.Stop() {
+			// fired, its key is (to be) sent on o.Expire.
+			expired = append(expired, k)
+		}
+		flow.Alive, flow.Expire = nil, &f.Expire
+		flow.Unlock()
+
+		if t, ok := f.Map[k]; ok {
+			t.Lock()
+			t.merge(flow)
+			t.Unlock()
+		} else {
+			f.Map[k] = flow
+		}
+	}
+	// let the timers that fired be done, nobody reads o's channel.
+	for drained := false; !drained; {
+		select {
+		case <-o.Expire:
+		default:
+			drained = true
+		}
+	}
+	for k, flow := range o.UDP {
+		if t, ok := f.UDP[k]; ok {
+			t.merge(flow)
+		} else {
+			f.UDP[k] = flow
+		}
+	}
+	for k, flow := range o.ICMP {
+		if t, ok := f.ICMP[k]; ok {
+			t.merge(flow)
+		} else {
+			f.ICMP[k] = flow
+		}
+	}
+	for k, r := range o.DNS {
+		if t, ok := f.DNS[k]; ok {
+			t.merge(r)
+		} else {
+			f.DNS[k] = r
+		}
+	}
+	return expired
+}
+
+// weighted averages two means by their sample counts.
+func weighted(a, na, b, nb uint64) uint64 {
+	if na+nb == 0 {
+		return 0
+	}
+	return uint64((float64(a)*float64(na) + float64(b)*float64(nb)) / float64(na+nb))
+}
+
+// merge combines a later piece of the flow into t: counters are summed, RTTs
+// averaged by sample count, and the handshake and endpoint details kept from
+// the earlier piece unless it missed them, the state of the connection taken
+// from the later one. Call holding both flow locks.
+func (t *TCPAccounting) merge(o *TCPAccounting) {
+	t.SRTT = weighted(t.SRTT, t.Sampled, o.SRTT, o.Sampled)
+	t.Jitter = weighted(t.Jitter, t.Sampled, o.Jitter, o.Sampled)
+	if o.Sampled > 0 {
+		t.Last, t.LastTS = o.Last, o.LastTS
+	}
+	if o.Min < t.Min {
+		t.Min = o.Min
+	}
+	if o.Max > t.Max {
+		t.Max = o.Max
+	}
+	t.Sampled += o.Sampled
+	if o.RTTs != nil {
+		if t.RTTs == nil {
+			t.RTTs = NewExpHistogram()
+		}
+		t.RTTs.Merge(o.RTTs)
+	}
+	t.Traces = append(t.Traces, o.Traces...)
+	for i := range o.HookTallies {
+		if t.HookTallies == nil {
+			t.HookTallies = make([]hookTally, len(o.HookTallies))
+		}
+		t.HookTallies[i].hits += o.HookTallies[i].hits
+		t.HookTallies[i].sum += o.HookTallies[i].sum
+	}
+
+	t.Segments += o.Segments
+	t.SentBytes += o.SentBytes
+	t.Retransmits += o.Retransmits
+	t.RetxBytes += o.RetxBytes
+	t.Resets += o.Resets
+	t.Bytes += o.Bytes
+	t.Evicted += o.Evicted
+	t.PathChanges += o.PathChanges
+	t.LabelChanges += o.LabelChanges
+	t.Rcvd.Segments += o.Rcvd.Segments
+	t.Rcvd.Bytes += o.Rcvd.Bytes
+	t.Rcvd.Retransmits += o.Rcvd.Retransmits
+	t.Rcvd.RetxBytes += o.Rcvd.RetxBytes
+	t.Rcvd.OutOfOrder += o.Rcvd.OutOfOrder
+	t.Rcvd.Next, t.Rcvd.holes = o.Rcvd.Next, o.Rcvd.holes
+	t.NextSeq = o.NextSeq
+	for _, p := range []struct{ into, from *dupAcks }{{&t.DupAcks, &o.DupAcks}, {&t.RcvdDupAcks, &o.RcvdDupAcks}} {
+		p.into.Count += p.from.Count
+		p.into.Bursts += p.from.Bursts
+	}
+	for _, p := range []struct{ into, from *rwnd }{{&t.Wnd, &o.Wnd}, {&t.RcvdWnd, &o.RcvdWnd}} {
+		p.into.Zero += p.from.Zero
+		p.into.Full += p.from.Full
+	}
+	for _, p := range []struct{ into, from *ecnMarks }{{&t.ECN, &o.ECN}, {&t.RcvdECN, &o.RcvdECN}} {
+		p.into.ECT += p.from.ECT
+		p.into.CE += p.from.CE
+		p.into.ECE += p.from.ECE
+		p.into.CWR += p.from.CWR
+	}
+	for _, p := range []struct{ into, from *sackLoss }{{&t.SACK, &o.SACK}, {&t.RcvdSACK, &o.RcvdSACK}} {
+		p.into.Acks += p.from.Acks
+		p.into.Holes += p.from.Holes
+		p.into.HoleBytes += p.from.HoleBytes
+	}
+	for _, name := range o.Filters {
+		seen := false
+		for _, n := range t.Filters {
+			seen = seen || n == name
+		}
+		if !seen {
+			t.Filters = append(t.Filters, name)
+		}
+	}
+
+	if o.FirstSeen != 0 && (t.FirstSeen == 0 || o.FirstSeen < t.FirstSeen) {
+		t.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen > t.LastSeen {
+		t.LastSeen = o.LastSeen
+	}
+	if t.SYN == 0 {
+		t.SYN, t.SYNACK, t.SYNACKTime, t.ACKTime = o.SYN, o.SYNACK, o.SYNACKTime, o.ACKTime
+		t.MSS, t.SrcMSS = o.MSS, o.SrcMSS
+		t.Wnd.syn, t.Wnd.shift, t.Wnd.scales = o.Wnd.syn, o.Wnd.shift, o.Wnd.scales
+		t.RcvdWnd.syn, t.RcvdWnd.shift, t.RcvdWnd.scales = o.RcvdWnd.syn, o.RcvdWnd.shift, o.RcvdWnd.scales
+	}
+	if t.TLSHandshake == 0 {
+		t.TLSClient, t.TLSHello, t.TLSServerHello, t.TLSHandshake = o.TLSClient, o.TLSHello, o.TLSServerHello, o.TLSHandshake
+	}
+	t.Refused = t.Refused || o.Refused
+	t.NoTS = t.NoTS || o.NoTS
+	t.FINs |= o.FINs
+	if o.Close != "" {
+		t.Close, t.ResetLocal = o.Close, o.ResetLocal
+	}
+	t.Done = t.Done || o.Done
+}
+
+func (t *UDPAccounting) merge(o *UDPAccounting) {
+	t.Packets += o.Packets
+	t.Bytes += o.Bytes
+	t.Requests += o.Requests
+	t.Responses += o.Responses
+	t.SpinSRTT = weighted(t.SpinSRTT, t.SpinSampled, o.SpinSRTT, o.SpinSampled)
+	if o.SpinSampled > 0 {
+		t.SpinLast = o.SpinLast
+	}
+	t.SpinSampled += o.SpinSampled
+	if o.LastSeen > t.LastSeen {
+		t.LastSeen = o.LastSeen
+	}
+}
+
+func (t *ICMPAccounting) merge(o *ICMPAccounting) {
+	t.SRTT = weighted(t.SRTT, t.Sampled, o.SRTT, o.Sampled)
+	if o.Sampled > 0 {
+		t.Last = o.Last
+	}
+	t.Sampled += o.Sampled
+	if o.LastSeen > t.LastSeen {
+		t.LastSeen = o.LastSeen
+	}
+}
+
+func (t *DNSAccounting) merge(o *DNSAccounting) {
+	for qtype, ot := range o.Times {
+		tt, ok := t.Times[qtype]
+		if !ok {
+			t.Times[qtype] = ot
+			continue
+		}
+		tt.sum += ot.sum
+		tt.n += ot.n
+		if ot.max > tt.max {
+			tt.max = ot.max
+		}
+		if ot.ts > tt.ts {
+			tt.ts = ot.ts
+		}
+	}
+	if o.LastSeen > t.LastSeen {
+		t.LastSeen = o.LastSeen
+	}
+}
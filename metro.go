@@ -17,12 +17,9 @@ import (
 	"time"
 
 	log "github.com/cihub/seelog"
-	"github.com/google/gopacket/pcap"
 )
 
 const (
-	defaultConfigFile = "/etc/dd-agent/checks.d/go-metro.yaml"
-	defaultLogFile    = "/var/log/datadog/go-metro.log"
 	defaultBPFFilter  = "tcp"
 	baseFileLogConfig = `<seelog minlevel="ddloglevel">
 	<outputs formatid="common">
@@ -117,6 +114,21 @@ func main() {
 	defer log.Flush()
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "compare":
+		logger := initLogging(false, "warning")
+		defer logger.Close()
+		panic(Exit{runCompare(flag.Args()[1:])})
+	case "dedup":
+		logger := initLogging(false, "info")
+		defer logger.Close()
+		panic(Exit{runDedup(flag.Args()[1:])})
+	case "discover":
+		logger := initLogging(false, "warning")
+		defer logger.Close()
+		panic(Exit{runDiscover(flag.Args()[1:])})
+	}
+
 	logger := initLogging(true, "warning")
 
 	//Parse config
@@ -143,6 +155,12 @@ func main() {
 		logger = initLogging(false, cfg.InitConf.LogLevel)
 	}
 	defer logger.Close()
+	features.setLogLevel = func(level string) {
+		if level == "" {
+			level = cfg.InitConf.LogLevel
+		}
+		initLogging(cfg.InitConf.LogToFile, level)
+	}
 
 	//Install signal handler
 	signalChan := make(chan os.Signal, 1)
@@ -183,32 +201,49 @@ func main() {
 		}
 	}()
 
-	ifaces, err := pcap.FindAllDevs()
-	if err != nil {
-		log.Criticalf("Error getting interface details: %s", err)
-		panic(Exit{1})
+	scheduleJitter = cfg.InitConf.Jitter
+
+	for i := range cfg.InitConf.Maintenance {
+		if _, err := maintenance.Add(cfg.InitConf.Maintenance[i]); err != nil {
+			log.Errorf("Ignoring maintenance window: %v", err)
+		}
+	}
+	for i := range cfg.InitConf.Experiments {
+		if _, err := experiments.Add(cfg.InitConf.Experiments[i]); err != nil {
+			log.Errorf("Ignoring chaos experiment: %v", err)
+		}
+	}
+
+	if cfg.InitConf.Election != nil {
+		election, err = newLeaderElection(*cfg.InitConf.Election)
+		if err != nil {
+			log.Criticalf("Unable to set up %s election: %v", cfg.InitConf.Election.Mode, err)
+			panic(Exit{1})
+		}
+		defer election.Stop()
 	}
 
-	sniffers := make([]*MetroSniffer, 0)
+	if cfg.InitConf.Sidecar != nil {
+		sidecars, err = newSidecarHub(*cfg.InitConf.Sidecar)
+		if err != nil {
+			log.Criticalf("Unable to open analyzer sidecar socket on %s: %v", cfg.InitConf.Sidecar.Listen, err)
+			panic(Exit{1})
+		}
+		defer sidecars.Stop()
+	}
+
+	instances := newInstanceManager(cfg.InitConf, *filter)
 	for i := range cfg.Configs {
-		if len(cfg.Configs[i].Ips) == 0 && len(cfg.Configs[i].Hosts) == 0 {
+		_, err := instances.Add(cfg.Configs[i], "")
+		if err == errNoWhitelist {
 			log.Errorf("Whitelists must be enabled for go-metro to run (you may whitelist by IP or hostname in config file).")
 			panic(Exit{1})
-		}
-		for j := range ifaces {
-			if ifaces[j].Name == cfg.Configs[i].Interface {
-				log.Infof("Will attempt sniffing off interface %q", cfg.Configs[i].Interface)
-				metrosniffer, err := NewMetroSniffer(cfg.InitConf, cfg.Configs[i], *filter)
-				if err == nil {
-					sniffers = append(sniffers, metrosniffer)
-					metrosniffer.Start()
-				} else {
-					log.Errorf("Unable to instantiate sniffer for interface %q", cfg.Configs[i].Interface)
-				}
-			}
+		} else if err != nil {
+			log.Errorf("Unable to sniff off interface %q: %v", cfg.Configs[i].Interface, err)
 		}
 	}
 
+	sniffers := instances.Sniffers()
 	if len(sniffers) == 0 {
 		log.Criticalf("No sniffers available, baling out (please check your configuration and privileges).")
 		panic(Exit{1})
@@ -225,6 +260,15 @@ func main() {
 		}
 	}
 
+	if cfg.InitConf.ControlAPI != "" {
+		control := NewControlServer(cfg.InitConf.ControlAPI, maintenance, instances)
+		if err := control.Start(); err != nil {
+			log.Errorf("Unable to start control API on %s: %v", cfg.InitConf.ControlAPI, err)
+		} else {
+			defer control.Stop()
+		}
+	}
+
 	quit := false
 	for !quit {
 		msg := <-exitChan
@@ -238,11 +282,6 @@ func main() {
 	}
 
 	//Stop the show
-	for i := range sniffers {
-		err := sniffers[i].Stop()
-		if err != nil {
-			log.Infof("Error shutting down %s sniffer: %v.", sniffers[i].Iface, err)
-		}
-	}
+	instances.StopAll()
 
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	defaultNarrowTopK   = 20
+	defaultNarrowLearn  = 300  // seconds
+	defaultNarrowPeriod = 3600 // seconds
+)
+
+// NarrowingConfig enables narrowing the BPF filter of live captures to the
+// top destinations by traffic, plus critical peers, to reduce probe load.
+// The capture starts broad to learn them, then alternates narrowed periods
+// with broad ones rediscovering peers.
+type NarrowingConfig struct {
+	TopK     int      `yaml:"top_k"`    // destinations kept
+	Learn    int      `yaml:"learn"`    // seconds broad, learning the top destinations
+	Narrow   int      `yaml:"narrow"`   // seconds narrowed, before widening again
+	Critical []string `yaml:"critical"` // IPs always captured
+}
+
+func (c *NarrowingConfig) validate() error {
+	if c.TopK < 0 || c.Learn < 0 || c.Narrow < 0 {
+		return errors.New("Error parsing configuration - adaptive_filter top_k, learn and narrow must be positive.")
+	}
+	if c.TopK == 0 {
+		c.TopK = defaultNarrowTopK
+	}
+	if c.Learn == 0 {
+		c.Learn = defaultNarrowLearn
+	}
+	if c.Narrow == 0 {
+		c.Narrow = defaultNarrowPeriod
+	}
+	for _, ip := range c.Critical {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("Error parsing configuration - bad adaptive_filter critical peer %q, expected an IP.", ip)
+		}
+	}
+	return nil
+}
+
+// bpfNarrowing alternates learning the top destinations, capturing broadly,
+// and narrowing the filter to them. Used from the sniffing goroutine only.
+type bpfNarrowing struct {
+	topK     int
+	learn    time.Duration
+	narrow   time.Duration
+	critical []string
+	flows    *FlowMap
+	narrowed bool
+	until    time.Time // end of the current period
+	top      []string  // destinations narrowed to
+	// bytes of each flow as learning started
+	last map[string]uint64
+}
+
+func newBPFNarrowing(cfg *NarrowingConfig, flows *FlowMap, now time.Time) *bpfNarrowing {
+	n := &bpfNarrowing{
+		topK:     cfg.TopK,
+		learn:    time.Duration(cfg.Learn) * time.Second,
+		narrow:   time.Duration(cfg.Narrow) * time.Second,
+		critical: cfg.Critical,
+		flows:    flows,
+	}
+	n.widen(now)
+	return n
+}
+
+// widen starts learning.
+func (n *bpfNarrowing) widen(now time.Time) {
+	n.narrowed, n.top = false, nil
+	n.until = now.Add(n.learn)
+	n.last = make(map[string]uint64)
+	n.flows.RLock()
+	for k, flow := range n.flows.Map {
+		flow.RLock()
+		n.last[k] = flow.Bytes
+		flow.RUnlock()
+	}
+	n.flows.RUnlock()
+}
+
+// due moves on to the next period when due, telling whether the filter
+// changes. Learning nothing, it keeps learning.
+func (n *bpfNarrowing) due(now time.Time) bool {
+	if n == nil || now.Before(n.until) {
+		return false
+	}
+	if n.narrowed {
+		log.Infof("Widening capture filter to rediscover peers for %v.", n.learn)
+		n.widen(now)
+		return true
+	}
+	top := n.topDestinations()
+	if len(top) == 0 {
+		n.widen(now)
+		return false
+	}
+	log.Infof("Narrowing capture filter to the top %d destinations for %v: %s", len(top), n.narrow, strings.Join(top, ", "))
+	n.narrowed, n.top = true, top
+	n.until = now.Add(n.narrow)
+	return true
+}
+
+// topDestinations returns the destinations (Dst) flows sent the most bytes
+// to while learning, up to top_k.
+func (n *bpfNarrowing) topDestinations() []string {
+	bytes := make(map[string]uint64)
+	n.flows.RLock()
+	for k, flow := range n.flows.Map {
+		flow.RLock()
+		delta := flow.Bytes
+		if prev, ok := n.last[k]; ok && prev <= flow.Bytes {
+			delta -= prev
+		}
+		if delta > 0 {
+			bytes[flow.Dst.String()] += delta
+		}
+		flow.RUnlock()
+	}
+	n.flows.RUnlock()
+
+	top := make([]string, 0, len(bytes))
+	for dst := range bytes {
+		top = append(top, dst)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if bytes[top[i]] != bytes[top[j]] {
+			return bytes[top[i]] > bytes[top[j]]
+		}
+		return top[i] < top[j]
+	})
+	if len(top) > n.topK {
+		top = top[:n.topK]
+	}
+	return top
+}
+
+// hosts returns the hosts the filter is narrowed to, nil while broad.
+func (n *bpfNarrowing) hosts() []string {
+	if n == nil || !n.narrowed {
+		return nil
+	}
+	return append(append([]string(nil), n.critical...), n.top...)
+}
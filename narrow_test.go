@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBPFNarrowing(t *testing.T) {
+	cfg := &NarrowingConfig{TopK: 2, Critical: []string{"10.0.9.9"}}
+	if err := cfg.validate(); err != nil || cfg.Learn != defaultNarrowLearn || cfg.Narrow != defaultNarrowPeriod {
+		t.Fatalf("Unexpected validation: %v %+v", err, cfg)
+	}
+	if err := (&NarrowingConfig{Critical: []string{"db.example.com"}}).validate(); err == nil {
+		t.Fatalf("Expected critical peers to be IPs")
+	}
+
+	flows := NewFlowMap()
+	flows.Add("old", &TCPAccounting{Dst: net.ParseIP("10.0.0.1"), Bytes: 1000000})
+	now := time.Now()
+	n := newBPFNarrowing(cfg, flows, now)
+	if n.hosts() != nil || n.due(now) {
+		t.Fatalf("Expected to start learning")
+	}
+	if n.due(now.Add(time.Duration(cfg.Learn) * time.Second)) {
+		t.Fatalf("Expected to keep learning with no traffic")
+	}
+
+	now = now.Add(time.Duration(cfg.Learn) * time.Second)
+	old, _ := flows.Get("old")
+	old.Bytes += 10
+	flows.Add("a", &TCPAccounting{Dst: net.ParseIP("10.0.0.2"), Bytes: 500})
+	flows.Add("b", &TCPAccounting{Dst: net.ParseIP("10.0.0.3"), Bytes: 300})
+	flows.Add("c", &TCPAccounting{Dst: net.ParseIP("10.0.0.3"), Bytes: 300})
+	if !n.due(now.Add(time.Duration(cfg.Learn) * time.Second)) {
+		t.Fatalf("Expected to narrow after learning")
+	}
+	// bytes sent while learning count, not before.
+	if hosts := n.hosts(); strings.Join(hosts, ",") != "10.0.9.9,10.0.0.3,10.0.0.2" {
+		t.Fatalf("Unexpected narrowed hosts: %v", hosts)
+	}
+
+	d := &MetroSniffer{Filter: "tcp", narrow: n}
+	if f := d.bpfFilter(nil); !strings.HasSuffix(f, " and (host 10.0.9.9 or host 10.0.0.3 or host 10.0.0.2)") {
+		t.Fatalf("Unexpected narrowed filter: %s", f)
+	}
+
+	now = now.Add(time.Duration(cfg.Learn+cfg.Narrow) * time.Second)
+	if !n.due(now) || n.hosts() != nil {
+		t.Fatalf("Expected to widen again")
+	}
+}
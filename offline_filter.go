@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// OfflineFilterConfig restricts offline analysis to a time window (RFC3339
+// timestamps, either end optional) and/or a set of flows.
+type OfflineFilterConfig struct {
+	Start string             `yaml:"start"`
+	End   string             `yaml:"end"`
+	Flows []FlowFilterConfig `yaml:"flows"`
+}
+
+// FlowFilterConfig matches flows between src and dst (IPs or CIDRs, in either
+// direction) on port (either end), each optional.
+type FlowFilterConfig struct {
+	Src  string `yaml:"src"`
+	Dst  string `yaml:"dst"`
+	Port int    `yaml:"port"`
+}
+
+type flowFilter struct {
+	src, dst *net.IPNet
+	port     layers.TCPPort
+}
+
+type offlineFilter struct {
+	start, end time.Time
+	flows      []flowFilter
+}
+
+func parseIPNet(s string) (*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Bad IP address %q.", s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+func newOfflineFilter(cfg *OfflineFilterConfig) (*offlineFilter, error) {
+	f := &offlineFilter{}
+	var err error
+	if cfg.Start != "" {
+		if f.start, err = time.Parse(time.RFC3339, cfg.Start); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.End != "" {
+		if f.end, err = time.Parse(time.RFC3339, cfg.End); err != nil {
+			return nil, err
+		}
+	}
+	if !f.start.IsZero() && !f.end.IsZero() && !f.end.After(f.start) {
+		return nil, errors.New("Offline filter end must be after its start.")
+	}
+
+	for _, ff := range cfg.Flows {
+		var m flowFilter
+		if m.src, err = parseIPNet(ff.Src); err != nil {
+			return nil, err
+		}
+		if m.dst, err = parseIPNet(ff.Dst); err != nil {
+			return nil, err
+		}
+		if ff.Port < 0 || ff.Port > 65535 {
+			return nil, fmt.Errorf("Bad port %d.", ff.Port)
+		}
+		m.port = layers.TCPPort(ff.Port)
+		f.flows = append(f.flows, m)
+	}
+	return f, nil
+}
+
+// before tells whether ts is before the window, after whether it's past it.
+func (f *offlineFilter) before(ts time.Time) bool {
+	return !f.start.IsZero() && ts.Before(f.start)
+}
+
+func (f *offlineFilter) after(ts time.Time) bool {
+	return !f.end.IsZero() && ts.After(f.end)
+}
+
+func (m *flowFilter) matches(a, b net.IP) bool {
+	return (m.src == nil || m.src.Contains(a)) && (m.dst == nil || m.dst.Contains(b))
+}
+
+// matchesFlow tells whether a packet belongs to one of the flows, if any.
+func (f *offlineFilter) matchesFlow(src, dst net.IP, sport, dport layers.TCPPort) bool {
+	if len(f.flows) == 0 {
+		return true
+	}
+	for i := range f.flows {
+		m := &f.flows[i]
+		if m.port != 0 && m.port != sport && m.port != dport {
+			continue
+		}
+		if m.matches(src, dst) || m.matches(dst, src) {
+			return true
+		}
+	}
+	return false
+}
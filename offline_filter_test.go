@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestOfflineFilter(t *testing.T) {
+	f, err := newOfflineFilter(&OfflineFilterConfig{
+		Start: "2017-07-14T02:40:00Z",
+		End:   "2017-07-14T03:10:00Z",
+		Flows: []FlowFilterConfig{
+			{Src: "10.0.0.0/24", Dst: "10.1.2.3", Port: 5432},
+			{Dst: "192.168.1.1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building offline filter: %v", err)
+	}
+
+	start := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	if !f.before(start.Add(-time.Second)) || f.before(start) || f.after(start.Add(30*time.Minute)) || !f.after(start.Add(31*time.Minute)) {
+		t.Fatalf("Unexpected time window handling")
+	}
+
+	tests := []struct {
+		src, dst     string
+		sport, dport layers.TCPPort
+		expected     bool
+	}{
+		{"10.0.0.5", "10.1.2.3", 40000, 5432, true},
+		{"10.1.2.3", "10.0.0.5", 5432, 40000, true}, // reverse direction
+		{"10.0.0.5", "10.1.2.3", 40000, 80, false},
+		{"10.0.1.5", "10.1.2.3", 40000, 5432, false},
+		{"172.16.0.1", "192.168.1.1", 40000, 80, true},
+	}
+	for _, test := range tests {
+		if f.matchesFlow(net.ParseIP(test.src), net.ParseIP(test.dst), test.sport, test.dport) != test.expected {
+			t.Fatalf("Expected %v matching %+v", test.expected, test)
+		}
+	}
+
+	bad := []*OfflineFilterConfig{
+		{Start: "yesterday"},
+		{Start: "2017-07-14T03:10:00Z", End: "2017-07-14T02:40:00Z"},
+		{Flows: []FlowFilterConfig{{Src: "10.0.0.256"}}},
+		{Flows: []FlowFilterConfig{{Port: 70000}}},
+	}
+	for _, cfg := range bad {
+		if _, err := newOfflineFilter(cfg); err == nil {
+			t.Fatalf("Expected error building offline filter from %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// defaultMSS splits super-packets of flows whose handshake we missed: a
+	// 1500 byte MTU minus IPv4, TCP and timestamp option headers.
+	defaultMSS = 1448
+	// maxSegmentSize is the largest payload a single segment can carry when
+	// the MSS is unknown: a 9000 byte jumbo frame minus headers.
+	maxSegmentSize = 8960
+)
+
+// synMSS returns the MSS option of a SYN, 0 if none.
+func synMSS(tcp *layers.TCP) uint16 {
+	return parseTCPOptions(tcp).MSS
+}
+
+// logicalSegments returns how many segments on the wire a captured one stands
+// for, and their size. With GRO/GSO/TSO offloads the capture sees aggregates
+// of up to 64KB, larger than the MSS (or any frame if we don't know it).
+func logicalSegments(size uint32, mss uint16) (uint32, uint32) {
+	limit := uint32(mss)
+	if limit == 0 {
+		limit = maxSegmentSize
+	}
+	if size <= limit {
+		return 1, size
+	}
+	if mss == 0 {
+		mss = defaultMSS
+	}
+	return (size + uint32(mss) - 1) / uint32(mss), uint32(mss)
+}
+
+// superPacket accounts for a GRO/GSO aggregate, warning (once) that offloads
+// should be disabled unless told not to.
+func (d *MetroSniffer) superPacket(size uint32, meta *packetMeta) {
+	d.superPackets++
+	if d.offloadWarned || d.config.IgnoreOffloads {
+		return
+	}
+	d.offloadWarned = true
+	hint := "eg. ethtool -K " + meta.Iface + " gro off gso off tso off"
+	if meta.Capture == dpdkInterface {
+		// the kernel isn't involved, the port aggregates.
+		hint = "disable LRO on the DPDK port"
+	}
+	log.Warnf("Captured a %d byte TCP segment on %q: segmentation offloads (GRO/GSO/TSO/LRO) are enabled, "+
+		"aggregates are split by MSS but timing precision suffers. Consider disabling them, "+
+		"%s (ignore_offloads silences this).", size, meta.Iface, hint)
+}
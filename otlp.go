@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	defaultOTLPEndpoint = "http://localhost:4318"
+	otlpMetricsPath     = "/v1/metrics"
+	reporterOTLP        = "otlp"
+	// AGGREGATION_TEMPORALITY_DELTA
+	otlpDelta = 1
+)
+
+// OTLP/HTTP JSON encoding of the metrics data model - 64 bit integers are
+// encoded as strings as per the protobuf JSON mapping.
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpNumberPoint struct {
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsDouble     float64         `json:"asDouble"`
+}
+
+type otlpBuckets struct {
+	Offset       int32    `json:"offset"`
+	BucketCounts []string `json:"bucketCounts"`
+}
+
+// otlpExemplar links a value to a trace - ids are hex encoded.
+type otlpExemplar struct {
+	TimeUnixNano string  `json:"timeUnixNano"`
+	AsDouble     float64 `json:"asDouble"`
+	TraceID      string  `json:"traceId"`
+	SpanID       string  `json:"spanId"`
+}
+
+type otlpExpHistogramPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	Scale             int32           `json:"scale"`
+	ZeroCount         string          `json:"zeroCount"`
+	Positive          otlpBuckets     `json:"positive"`
+	Min               float64         `json:"min"`
+	Max               float64         `json:"max"`
+	Exemplars         []otlpExemplar  `json:"exemplars,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpExpHistogram struct {
+	DataPoints             []otlpExpHistogramPoint `json:"dataPoints"`
+	AggregationTemporality int                     `json:"aggregationTemporality"`
+}
+
+type otlpMetric struct {
+	Name                 string            `json:"name"`
+	Unit                 string            `json:"unit,omitempty"`
+	Gauge                *otlpGauge        `json:"gauge,omitempty"`
+	Sum                  *otlpSum          `json:"sum,omitempty"`
+	ExponentialHistogram *otlpExpHistogram `json:"exponentialHistogram,omitempty"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpPayload struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// OTLPClient exports metrics to an OpenTelemetry collector (or any OTLP/HTTP
+// capable backend). RTT samples are exported as exponential histograms, so
+// percentiles can be computed accurately downstream.
+type OTLPClient struct {
+	sync.Mutex
+	url     string
+	headers map[string]string
+	client  *http.Client
+	pending []otlpMetric
+	spool   *diskSpool // failed exports go here rather than pending, if set
+}
+
+func NewOTLPClient(endpoint string, headers map[string]string) *OTLPClient {
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+	o := &OTLPClient{
+		url:     strings.TrimSuffix(endpoint, "/") + otlpMetricsPath,
+		headers: headers,
+		client:  &http.Client{Timeout: apiTimeout * time.Second},
+	}
+	return o
+}
+
+// otlpAttributes maps "key:value" tags to attributes.
+func otlpAttributes(tags []string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(tags))
+	for _, t := range tags {
+		kv := strings.SplitN(t, ":", 2)
+		a := otlpAttribute{Key: kv[0]}
+		if len(kv) > 1 {
+			a.Value.StringValue = kv[1]
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+func otlpTime(ts int64) string {
+	return strconv.FormatInt(ts*int64(time.Second), 10)
+}
+
+// Gauge queues a point, ts in seconds since the epoch.
+func (o *OTLPClient) Gauge(metric string, value float64, tags []string, ts int64) {
+	o.add(otlpMetric{
+		Name: metric,
+		Gauge: &otlpGauge{DataPoints: []otlpNumberPoint{{
+			Attributes:   otlpAttributes(tags),
+			TimeUnixNano: otlpTime(ts),
+			AsDouble:     value,
+		}}},
+	})
+}
+
+func (o *OTLPClient) Count(metric string, value float64, tags []string, ts int64) {
+	o.add(otlpMetric{
+		Name: metric,
+		Sum: &otlpSum{
+			DataPoints: []otlpNumberPoint{{
+				Attributes:   otlpAttributes(tags),
+				TimeUnixNano: otlpTime(ts),
+				AsDouble:     value,
+			}},
+			AggregationTemporality: otlpDelta,
+			IsMonotonic:            true,
+		},
+	})
+}
+
+// Histogram queues the values recorded in h over [start, ts].
+func (o *OTLPClient) Histogram(metric, unit string, h *ExpHistogram, tags []string, start, ts int64, exemplars []otlpExemplar) {
+	offset, counts := h.Dense()
+	buckets := make([]string, len(counts))
+	for i := range counts {
+		buckets[i] = strconv.FormatUint(counts[i], 10)
+	}
+
+	p := otlpExpHistogramPoint{
+		Attributes:   otlpAttributes(tags),
+		TimeUnixNano: otlpTime(ts),
+		Count:        strconv.FormatUint(h.Count, 10),
+		Sum:          h.Sum,
+		Scale:        h.Scale,
+		ZeroCount:    "0",
+		Positive:     otlpBuckets{Offset: offset, BucketCounts: buckets},
+		Min:          h.Min,
+		Max:          h.Max,
+		Exemplars:    exemplars,
+	}
+	if start > 0 {
+		p.StartTimeUnixNano = otlpTime(start)
+	}
+	o.add(otlpMetric{
+		Name: metric,
+		Unit: unit,
+		ExponentialHistogram: &otlpExpHistogram{
+			DataPoints:             []otlpExpHistogramPoint{p},
+			AggregationTemporality: otlpDelta,
+		},
+	})
+}
+
+func (o *OTLPClient) add(m otlpMetric) {
+	o.Lock()
+	o.pending = append(o.pending, m)
+	if len(o.pending) > apiMaxPending {
+		log.Warnf("Too many metrics pending export, dropping %d oldest.", len(o.pending)-apiMaxPending)
+		o.pending = o.pending[len(o.pending)-apiMaxPending:]
+	}
+	o.Unlock()
+}
+
+// Flush exports all pending metrics, keeping them for the next flush on failure
+// - spooled to disk if configured, and replayed once exports succeed.
+func (o *OTLPClient) Flush() error {
+	o.Lock()
+	metrics := o.pending
+	o.pending = nil
+	o.Unlock()
+
+	if len(metrics) == 0 {
+		return o.replay()
+	}
+
+	body, err := o.marshal(metrics)
+	if err != nil {
+		return err
+	}
+	err = o.post(body)
+	if err != nil {
+		if o.spool != nil {
+			serr := o.spool.push(body)
+			if serr == nil {
+				return err
+			}
+			log.Errorf("Unable to spool %d metrics, keeping them in memory: %v", len(metrics), serr)
+		}
+		o.Lock()
+		o.pending = append(metrics, o.pending...)
+		o.Unlock()
+		return err
+	}
+	log.Debugf("Exported %d metrics over OTLP.", len(metrics))
+	return o.replay()
+}
+
+// replay exports what was spooled while the collector was unreachable.
+func (o *OTLPClient) replay() error {
+	if o.spool == nil {
+		return nil
+	}
+	return o.spool.replay(o.post)
+}
+
+func (o *OTLPClient) marshal(metrics []otlpMetric) ([]byte, error) {
+	payload := otlpPayload{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: "go-metro"}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "go-metro"},
+			Metrics: metrics,
+		}},
+	}}}
+	return json.Marshal(payload)
+}
+
+func (o *OTLPClient) post(body []byte) error {
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{"OTLP export", resp.StatusCode, resp.Status}
+	}
+	return nil
+}
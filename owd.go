@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// minClockEstimate is how long Dst's timestamp clock is watched before its
+// rate is estimated.
+const minClockEstimate = time.Second
+
+// tsClockRates are the timestamp clock rates (ticks per second) in use.
+var tsClockRates = []float64{10, 100, 250, 1000}
+
+// owdSplit splits a flow's RTT samples into their outbound (Src to Dst) and
+// inbound legs, by the TSval Dst stamps its ACKs with (RFC 7323). Clocks not
+// being synchronized, the legs are only known up to a constant: the lowest
+// ones seen are taken to split the minimum RTT evenly, and the delay on
+// each leg above its lowest is what it adds to that half.
+type owdSplit struct {
+	ts0     uint32  // Dst's first TSval...
+	at0     int64   // ...and when it arrived (ns)
+	hz      float64 // Dst's timestamp clock, 0 until estimated
+	seen    bool    // minimums set
+	minOut  int64   // lowest outbound leg (ns), off by the clocks' offset...
+	minIn   int64   // ...as the inbound one, the other way
+	Out, In float64 // smoothed delay above the lowest, each leg (ns)
+	Samples uint64
+}
+
+// observe follows Dst's timestamp clock off a TSval received at (ns).
+func (o *owdSplit) observe(tsval uint32, at int64) {
+	if o.at0 == 0 {
+		o.ts0, o.at0 = tsval, at
+		return
+	}
+	elapsed := time.Duration(at - o.at0)
+	if o.hz != 0 || elapsed < minClockEstimate {
+		return
+	}
+	ticks := int32(tsval - o.ts0)
+	if ticks <= 0 {
+		// the clock went back, start over.
+		o.ts0, o.at0 = tsval, at
+		return
+	}
+	rate := float64(ticks) / elapsed.Seconds()
+	for _, hz := range tsClockRates {
+		if math.Abs(rate-hz) <= hz/10 {
+			o.hz = hz
+			return
+		}
+	}
+	// not a clock we know, eg. randomized timestamps: keep trying.
+	o.ts0, o.at0 = tsval, at
+}
+
+// sample splits an RTT sample: data sent at sent (ns), acknowledged by an
+// ACK stamped tsval received at acked.
+func (o *owdSplit) sample(sent, acked int64, tsval uint32) {
+	if o.hz == 0 {
+		return
+	}
+	stamped := o.at0 + int64(float64(int32(tsval-o.ts0))/o.hz*float64(time.Second))
+	out, in := stamped-sent, acked-stamped
+	if !o.seen || out < o.minOut {
+		o.minOut = out
+	}
+	if !o.seen || in < o.minIn {
+		o.minIn = in
+	}
+	o.seen = true
+	o.Out += (float64(out-o.minOut) - o.Out) / 8
+	o.In += (float64(in-o.minIn) - o.In) / 8
+	o.Samples++
+}
+
+// reportOneWay submits the RTT split into its legs, tagged direction:sent
+// for Src to Dst and direction:received for the way back, so asymmetric
+// paths tell which way degraded. Call holding the flow lock.
+func (r *Client) reportOneWay(k string, flow *TCPAccounting, tags []string, ts int64) {
+	if flow.OWD.Samples == 0 {
+		return
+	}
+	half := float64(flow.Min) / 2
+	for _, dir := range []struct {
+		tag   string
+		delay float64
+	}{
+		{"direction:sent", flow.OWD.Out},
+		{"direction:received", flow.OWD.In},
+	} {
+		dtags := append(append([]string(nil), tags...), dir.tag)
+		r.submit(k, metricPrefix+"rtt.one_way", nsToMs(uint64(half+dir.delay)), dtags, false, ts)
+	}
+}
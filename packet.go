@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+)
+
+// packetMeta is what we know of a packet besides its bytes: gathered off the
+// capture source, then while decoding, and kept by the flow it opens.
+type packetMeta struct {
+	ci        *gopacket.CaptureInfo
+	Iface     string   // interface it was captured on
+	Capture   string   // capture backend, empty reading files
+	VLANs     []uint16 // outermost first
+	Tunnel    string   // tag of the encapsulating tunnel (vni:, gre_key:), if any
+	DSCP      uint8    // of the innermost IP header
+	ECN       uint8    // likewise
+	HopLimit  uint8    // likewise, the TTL for IPv4
+	FlowLabel uint32   // likewise, IPv6 only
+	SrcMAC    string   // of the innermost Ethernet header
+	DstMAC    string
+}
+
+// interfaceNamer is implemented by capture sources holding packets of several
+// interfaces, eg. pcapng files, to name a CaptureInfo.InterfaceIndex.
+type interfaceNamer interface {
+	InterfaceName(index int) string
+}
+
+// packetMeta starts the metadata of a captured packet.
+func (d *MetroSniffer) packetMeta(ci *gopacket.CaptureInfo) packetMeta {
+	m := packetMeta{ci: ci, Iface: d.Iface, Capture: d.backend}
+	if n, ok := d.handle.(interfaceNamer); ok {
+		if name := n.InterfaceName(ci.InterfaceIndex); name != "" {
+			m.Iface = name
+		}
+	}
+	return m
+}
+
+// annotate records the metadata of the packet opening a flow. The interface
+// is only kept when it isn't the instance's, already tagged.
+func (m *packetMeta) annotate(flow *TCPAccounting, d *MetroSniffer) {
+	flow.Tunnel = m.Tunnel
+	if (d.config.VLANTags || d.config.VLANStats) && len(m.VLANs) > 0 {
+		flow.VLANs = append([]uint16(nil), m.VLANs...)
+	}
+	if m.Iface != d.Iface {
+		flow.Iface = m.Iface
+	}
+}
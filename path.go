@@ -0,0 +1,28 @@
+package main
+
+// trackPath follows what tells a flow's packets apart when they take different
+// paths, as ECMP rehashing does: the hop limit (TTL) of the packets we receive,
+// and the IPv6 flow labels - hashed by routers, and changed by endpoints
+// rehashing after timeouts (eg. Linux's txhash). Call holding the flow lock.
+func (t *TCPAccounting) trackPath(ourIP bool, hopLimit uint8, label uint32) {
+	if ourIP {
+		if label != 0 && t.FlowLabel != 0 && label != t.FlowLabel {
+			t.LabelChanges++
+		}
+		if label != 0 {
+			t.FlowLabel = label
+		}
+		return
+	}
+	if label != 0 && t.RcvdFlowLabel != 0 && label != t.RcvdFlowLabel {
+		t.LabelChanges++
+	}
+	if label != 0 {
+		t.RcvdFlowLabel = label
+	}
+	// as many hops on the way: possibly another path.
+	if t.RcvdHopLimit != 0 && hopLimit != t.RcvdHopLimit {
+		t.PathChanges++
+	}
+	t.RcvdHopLimit = hopLimit
+}
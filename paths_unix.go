@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+const (
+	defaultConfigFile = "/etc/dd-agent/checks.d/go-metro.yaml"
+	defaultLogFile    = "/var/log/datadog/go-metro.log"
+)
@@ -0,0 +1,6 @@
+package main
+
+const (
+	defaultConfigFile = `C:\ProgramData\Datadog\conf.d\go-metro.yaml`
+	defaultLogFile    = `C:\ProgramData\Datadog\logs\go-metro.log`
+)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	errCapturePaused  = errors.New("Capture already paused.")
+	errCaptureRunning = errors.New("Capture not paused.")
+	errCaptureOffline = errors.New("Only live captures may be paused.")
+	errSnifferStopped = errors.New("Sniffer stopped.")
+)
+
+// captureRequest asks the capture loop to release (pause) or reacquire its
+// handle, replying with the outcome.
+type captureRequest struct {
+	pause bool
+	reply chan error
+}
+
+// PauseCapture closes the capture handle, freeing the interface, eg. for
+// maintenance or other tools. Flows are kept meanwhile, reported and expired
+// as usual.
+func (d *MetroSniffer) PauseCapture() error {
+	return d.controlCapture(true)
+}
+
+// ResumeCapture reopens the capture handle of a paused sniffer, accounting
+// into the flows kept.
+func (d *MetroSniffer) ResumeCapture() error {
+	return d.controlCapture(false)
+}
+
+// CapturePaused tells whether the capture handle was released.
+func (d *MetroSniffer) CapturePaused() bool {
+	return atomic.LoadInt32(&d.capturePaused) != 0
+}
+
+func (d *MetroSniffer) controlCapture(pause bool) error {
+	if d.Iface == fileInterface {
+		return errCaptureOffline
+	}
+	req := captureRequest{pause: pause, reply: make(chan error, 1)}
+	select {
+	case d.captureCtl <- req:
+	case <-d.t.Dying():
+		return errSnifferStopped
+	}
+	return <-req.reply
+}
+
+// handleCaptureRequest serves a request off the capture loop. Pausing, it
+// holds the loop until resumed, returning false if told to stop meanwhile.
+func (d *MetroSniffer) handleCaptureRequest(req captureRequest) bool {
+	if !req.pause {
+		req.reply <- errCaptureRunning
+		return true
+	}
+	d.handle.Close()
+	d.handle = nil
+	atomic.StoreInt32(&d.capturePaused, 1)
+	log.Infof("Capture on %q paused, flows kept.", d.Iface)
+	req.reply <- nil
+
+	for {
+		select {
+		case <-d.t.Dying():
+			return false
+		case req := <-d.captureCtl:
+			if req.pause {
+				req.reply <- errCapturePaused
+				continue
+			}
+			handle, err := d.openCapture()
+			if err == nil {
+				if err = handle.SetBPFFilter(d.bpf); err == errBPFUnsupported {
+					err = nil
+				}
+			}
+			if err != nil {
+				if handle != nil {
+					handle.Close()
+				}
+				log.Warnf("Unable to resume capture on %q: %v", d.Iface, err)
+				req.reply <- err
+				continue
+			}
+			d.handle = handle
+			atomic.StoreInt32(&d.capturePaused, 0)
+			log.Infof("Capture on %q resumed.", d.Iface)
+			req.reply <- nil
+			return true
+		}
+	}
+}
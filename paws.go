@@ -0,0 +1,45 @@
+package main
+
+import "time"
+
+const (
+	// timedMaxAge is how long a segment sent waits for its ACK to be sampled,
+	// past which it's presumably lost, or its TSval wrapped around.
+	timedMaxAge = 60 * time.Second
+	// timedSweepInterval is how often segments waiting for ACKs are swept.
+	timedSweepInterval = 10 * time.Second
+)
+
+// tsAfter compares TSvals modulo wraparound (RFC 7323 PAWS).
+func tsAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// sentTS follows the newest TSval sent, at (capture timestamp, ns), every
+// so often expiring the segments waiting for their ACKs that are too old, or
+// stamped ahead of it - from before the TSval wrapped around - so they don't
+// get matched by ACKs echoing the same TSval a wrap later. Call holding the
+// flow lock.
+func (t *TCPAccounting) sentTS(tsval uint32, at int64) {
+	if t.TSHigh == 0 || tsAfter(tsval, t.TSHigh) {
+		t.TSHigh = tsval
+	}
+	if t.TimedSweep == 0 {
+		t.TimedSweep = at
+	}
+	if time.Duration(at-t.TimedSweep) < timedSweepInterval {
+		return
+	}
+	t.TimedSweep = at
+	for k, sent := range t.Timed {
+		if time.Duration(at-sent) > timedMaxAge || tsAfter(k.TS, t.TSHigh) {
+			delete(t.Timed, k)
+		}
+	}
+}
+
+// staleSample tells whether an ACK matched a segment sent too long ago to be
+// an RTT sample, or echoes a TSval we haven't sent yet, modulo wraparound.
+func (t *TCPAccounting) staleSample(hasTS bool, tsecr uint32, rtt time.Duration) bool {
+	return rtt > timedMaxAge || hasTS && tsAfter(tsecr, t.TSHigh)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic is the block type of the section header opening pcapng files.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// bpfMatcher filters packets in userspace, for handles unable to do it in the
+// kernel/libpcap.
+type bpfMatcher interface {
+	Matches(ci gopacket.CaptureInfo, data []byte) bool
+}
+
+// ngHandle reads pcapng files - as saved by Wireshark by default. Files may
+// hold packets from several interfaces with different link types, in which
+// case each packet's link type is in ci.AncillaryData[0]. Timestamps keep the
+// resolution (eg. nanoseconds) of their interface.
+type ngHandle struct {
+	*pcapgo.NgReader
+	f       *os.File
+	link    layers.LinkType // of the first interface
+	expr    string
+	filters map[layers.LinkType]bpfMatcher
+}
+
+func isPcapng(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(pcapngMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		// too short for either format, let the pcap reader complain.
+		return false, nil
+	}
+	return bytes.Equal(magic, pcapngMagic), nil
+}
+
+func openPcapng(path string) (CaptureSource, error) {
+	// mixed link type readers only learn about interfaces as packets are
+	// read, peek at the first one for the handle's link type.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	link := r.LinkType()
+
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err = pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{
+		WantMixedLinkType:  true,
+		SkipUnknownVersion: true,
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ngHandle{NgReader: r, f: f, link: link}, nil
+}
+
+// packetLinkType returns the link type of a packet read off a pcapng file
+// with mixed link types, if known.
+func packetLinkType(ci *gopacket.CaptureInfo) (layers.LinkType, bool) {
+	if len(ci.AncillaryData) == 0 {
+		return 0, false
+	}
+	link, ok := ci.AncillaryData[0].(layers.LinkType)
+	return link, ok
+}
+
+// InterfaceName names the interface of a packet, when the file holds several.
+func (h *ngHandle) InterfaceName(index int) string {
+	if h.NInterfaces() < 2 {
+		return ""
+	}
+	iface, err := h.Interface(index)
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+func (h *ngHandle) Stats() (CaptureStats, error) {
+	return CaptureStats{}, nil
+}
+
+func (h *ngHandle) LinkType() layers.LinkType {
+	return h.link
+}
+
+// SetBPFFilter compiles expr for each link type found in the file, as
+// packets are read. Requires libpcap.
+func (h *ngHandle) SetBPFFilter(expr string) error {
+	m, err := compileBPF(h.link, maxSnaplen, expr)
+	if err != nil {
+		return err
+	}
+	h.expr = expr
+	h.filters = map[layers.LinkType]bpfMatcher{h.link: m}
+	return nil
+}
+
+func (h *ngHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := h.NgReader.ReadPacketData()
+		if err != nil || h.filters == nil {
+			return data, ci, err
+		}
+
+		link, ok := packetLinkType(&ci)
+		if !ok {
+			link = h.link
+		}
+		m, ok := h.filters[link]
+		if !ok {
+			m, err = compileBPF(link, maxSnaplen, h.expr)
+			if err != nil {
+				return nil, ci, err
+			}
+			h.filters[link] = m
+		}
+		if m.Matches(ci, data) {
+			return data, ci, nil
+		}
+	}
+}
+
+func (h *ngHandle) Close() {
+	h.f.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestOpenPcapng(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-metro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mixed.pcapng")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := w.AddInterface(pcapgo.NgInterface{Name: "tun0", LinkType: layers.LinkTypeRaw, TimestampResolution: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Unix(1500000000, 123456789)
+	data := []byte{1, 2, 3, 4}
+	for _, iface := range []int{0, raw} {
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data), InterfaceIndex: iface}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	f.Close()
+
+	handle, err := openOffline(path)
+	if err != nil {
+		t.Fatalf("Unable to open pcapng file: %v", err)
+	}
+	defer handle.Close()
+	if handle.LinkType() != layers.LinkTypeEthernet {
+		t.Fatalf("Expected link type of the first interface, got %v", handle.LinkType())
+	}
+
+	d := &MetroSniffer{Iface: fileInterface, handle: handle}
+	for i, expected := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeRaw} {
+		_, ci, err := handle.ReadPacketData()
+		if err != nil {
+			t.Fatalf("Error reading packet: %v", err)
+		}
+		if !ci.Timestamp.Equal(ts) {
+			t.Fatalf("Expected nanosecond timestamp %v, got %v", ts, ci.Timestamp)
+		}
+		if link, ok := packetLinkType(&ci); !ok || link != expected {
+			t.Fatalf("Expected packet link type %v, got %v", expected, link)
+		}
+		if meta := d.packetMeta(&ci); i == 1 && meta.Iface != "tun0" {
+			t.Fatalf("Expected packet captured on tun0, got %q", meta.Iface)
+		}
+	}
+}
+
+func TestOpenPcap(t *testing.T) {
+	ng, err := isPcapng("fixtures/test_tcp.pcap")
+	if err != nil || ng {
+		t.Fatalf("Expected classic pcap fixture not to be detected as pcapng: %v", err)
+	}
+}
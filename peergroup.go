@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// how often peer group hostnames are re-resolved - members of a load
+// balancer's pool come and go.
+const peerGroupRefresh = 60 * time.Second
+
+// peerGroups maps remote endpoints to the logical service (peer group) they
+// belong to. Members may be IPs (v4 or v6), CIDRs, lookup-style regexes or
+// hostnames/CNAMEs, resolved periodically.
+type peerGroups struct {
+	members map[string][]string
+	table   *LookupTable
+	next    time.Time
+}
+
+func newPeerGroups(groups map[string][]string) (*peerGroups, error) {
+	g := &peerGroups{members: groups}
+	// static members are validated upfront.
+	for name, members := range groups {
+		for _, m := range members {
+			if isPeerName(m) {
+				continue
+			}
+			if err := NewLookupTable().Add(m, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	g.resolve()
+	return g, nil
+}
+
+func isPeerName(member string) bool {
+	return net.ParseIP(member) == nil && !strings.Contains(member, "/") && !strings.HasPrefix(member, regexKeyPrefix)
+}
+
+// resolve (re)builds the lookup table, resolving hostnames.
+func (g *peerGroups) resolve() {
+	table := NewLookupTable()
+	for name, members := range g.members {
+		for _, m := range members {
+			if !isPeerName(m) {
+				table.Add(m, name)
+				continue
+			}
+			ips, err := net.LookupHost(m)
+			if err != nil {
+				log.Warnf("Unable to resolve peer group %q member %q: %v", name, m, err)
+				continue
+			}
+			for _, ip := range ips {
+				table.Add(ip, name)
+			}
+		}
+	}
+	g.table = table
+	g.next = time.Now().Add(peerGroupRefresh)
+}
+
+// group returns the peer group ip belongs to, if any.
+func (g *peerGroups) group(ip net.IP) (string, bool) {
+	if time.Now().After(g.next) {
+		g.resolve()
+	}
+	return g.table.Get(ip.String())
+}
+
+// groupStats aggregates the flows of a peer group, or those a traffic policy
+// collapses into their class, over a reporting interval.
+type groupStats struct {
+	tags     []string
+	srtt     float64 // sample weighted
+	jitter   float64
+	samples  uint64
+	sampled  uint64 // over the interval
+	min, max uint64
+	last     float64 // most recent sample
+	lastTS   int64
+	rtts     *ExpHistogram // members' samples (ms), if keeping distributions
+	sent     seqSpace      // summed over the interval
+	rcvd     seqSpace
+}
+
+func (s *groupStats) add(flow *TCPAccounting) {
+	s.srtt += float64(flow.SRTT) * float64(flow.Sampled)
+	s.jitter += float64(flow.Jitter) * float64(flow.Sampled)
+	if s.samples == 0 || flow.Min < s.min {
+		s.min = flow.Min
+	}
+	if flow.Max > s.max {
+		s.max = flow.Max
+	}
+	s.samples += flow.Sampled
+	s.sampled += flow.Sampled - flow.RepSampled
+	s.sent.Segments += flow.Segments - flow.RepSegments
+	s.sent.Bytes += flow.SentBytes - flow.RepSentBytes
+	s.sent.Retransmits += flow.Retransmits - flow.RepRetransmits
+	s.sent.RetxBytes += flow.RetxBytes - flow.RepRetxBytes
+	s.rcvd.Segments += flow.Rcvd.Segments - flow.RepRcvd.Segments
+	s.rcvd.Bytes += flow.Rcvd.Bytes - flow.RepRcvd.Bytes
+	s.rcvd.Retransmits += flow.Rcvd.Retransmits - flow.RepRcvd.Retransmits
+	s.rcvd.RetxBytes += flow.Rcvd.RetxBytes - flow.RepRcvd.RetxBytes
+	if flow.RTTs != nil {
+		if s.rtts == nil {
+			s.rtts = NewExpHistogram()
+		}
+		s.rtts.Merge(flow.RTTs)
+	}
+	if flow.LastTS >= s.lastTS {
+		s.lastTS = flow.LastTS
+		s.last = float64(flow.Last)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPeerGroups(t *testing.T) {
+	g, err := newPeerGroups(map[string][]string{
+		"payments-lb": {"10.1.2.3", "2001:db8::1", "10.1.4.0/24"},
+		"local":       {"localhost"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building peer groups: %v", err)
+	}
+
+	tests := map[string]string{
+		"10.1.2.3":    "payments-lb",
+		"2001:db8::1": "payments-lb",
+		"10.1.4.200":  "payments-lb",
+		"127.0.0.1":   "local",
+		"10.1.5.1":    "",
+	}
+	for ip, expected := range tests {
+		group, _ := g.group(net.ParseIP(ip))
+		if group != expected {
+			t.Fatalf("Expected %s to belong to group %q, got %q", ip, expected, group)
+		}
+	}
+
+	if _, err := newPeerGroups(map[string][]string{"bad": {"10.1.4.0/33"}}); err == nil {
+		t.Fatalf("Expected invalid CIDR to be rejected")
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	s := &groupStats{}
+	s.add(&TCPAccounting{SRTT: 10, Jitter: 2, Sampled: 3, Last: 11, LastTS: 100})
+	s.add(&TCPAccounting{SRTT: 20, Jitter: 4, Sampled: 1, Last: 22, LastTS: 50})
+	if s.samples != 4 || s.srtt/float64(s.samples) != 12.5 || s.jitter/float64(s.samples) != 2.5 || s.last != 11 {
+		t.Fatalf("Unexpected group stats: %+v", s)
+	}
+}
+
+func TestGroupPercentiles(t *testing.T) {
+	s := &groupStats{}
+	for _, rtts := range [][]float64{{1, 2, 3}, {100}} {
+		flow := &TCPAccounting{SRTT: 1, Sampled: uint64(len(rtts)), RTTs: NewExpHistogram()}
+		for _, v := range rtts {
+			flow.RTTs.Record(v)
+		}
+		s.add(flow)
+	}
+	s.add(&TCPAccounting{SRTT: 1, Sampled: 1})
+	if s.rtts == nil || s.rtts.Count != 4 {
+		t.Fatalf("Expected members' samples to be merged, got %+v", s.rtts)
+	}
+	if p50, p99 := s.rtts.Quantile(0.5), s.rtts.Quantile(0.99); p50 > 2.1 || p99 < 98 {
+		t.Errorf("Unexpected group percentiles: p50 %v p99 %v", p50, p99)
+	}
+}
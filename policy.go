@@ -0,0 +1,102 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+)
+
+// ClassPolicy defines how flows of a traffic class (internal/external) are
+// handled.
+type ClassPolicy struct {
+	// Fraction of flows tracked, 1 (all) by default.
+	SampleRate float64 `yaml:"sample_rate"`
+	// Whether to report the class at all, true by default.
+	Report *bool `yaml:"report"`
+	// Collapse remote endpoints into a single "internal"/"external" tag value
+	// to keep cardinality in check, flows sharing tags reported combined.
+	Aggregate bool `yaml:"aggregate"`
+}
+
+type PolicyConfig struct {
+	// Ranges considered internal on top of RFC1918/ULA/loopback/link-local.
+	InternalRanges []string    `yaml:"internal_ranges"`
+	Internal       ClassPolicy `yaml:"internal"`
+	External       ClassPolicy `yaml:"external"`
+}
+
+type trafficPolicies struct {
+	internal []*net.IPNet
+	policies [2]ClassPolicy // indexed by external
+}
+
+func newTrafficPolicies(cfg *PolicyConfig) (*trafficPolicies, error) {
+	p := &trafficPolicies{}
+	if cfg == nil {
+		cfg = &PolicyConfig{}
+	}
+
+	for _, r := range cfg.InternalRanges {
+		_, ipnet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, err
+		}
+		p.internal = append(p.internal, ipnet)
+	}
+
+	p.policies[0] = cfg.Internal
+	p.policies[1] = cfg.External
+	for i := range p.policies {
+		if p.policies[i].SampleRate <= 0 || p.policies[i].SampleRate > 1 {
+			p.policies[i].SampleRate = 1
+		}
+	}
+	return p, nil
+}
+
+func (p *trafficPolicies) external(ip net.IP) bool {
+	if isInternal(ip) {
+		return false
+	}
+	for _, ipnet := range p.internal {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *trafficPolicies) policy(external bool) *ClassPolicy {
+	if external {
+		return &p.policies[1]
+	}
+	return &p.policies[0]
+}
+
+// sampled deterministically decides whether a flow is tracked, so every
+// packet of a flow gets the same verdict.
+func (p *trafficPolicies) sampled(flowkey string, external bool) bool {
+	rate := p.policy(external).SampleRate
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(flowkey))
+	return float64(h.Sum32())/math.MaxUint32 < rate
+}
+
+func (p *trafficPolicies) reported(external bool) bool {
+	r := p.policy(external).Report
+	return r == nil || *r
+}
+
+func (p *trafficPolicies) aggregated(external bool) bool {
+	return p.policy(external).Aggregate
+}
+
+func trafficClassName(external bool) string {
+	if external {
+		return "external"
+	}
+	return "internal"
+}
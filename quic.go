@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+const quicMetricPrefix = "system.net.quic."
+
+// defaultQUICPorts are the UDP ports QUIC (HTTP/3) is expected on.
+var defaultQUICPorts = []int{443}
+
+const (
+	quicLongHeader = 0x80
+	quicFixedBit   = 0x40
+	quicSpinBit    = 0x20
+)
+
+// quicPort tells whether a UDP flow is QUIC, going by its service port.
+func (d *MetroSniffer) quicPort(sport, dport layers.UDPPort) bool {
+	if d.config.UDP == nil {
+		return false
+	}
+	for _, p := range d.config.UDP.QUICPorts {
+		if int(sport) == p || int(dport) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// spin follows the latency spin bit (RFC 9000 17.4) of the short header QUIC
+// packets we send: it flips once per round trip, so the time between edges is
+// an RTT sample. Endpoints may disable it, leaving it constant - no samples.
+// Long header (handshake) packets carry no spin bit.
+func (u *UDPAccounting) spin(first byte, ts int64, soften bool) {
+	if first&quicLongHeader != 0 || first&quicFixedBit == 0 {
+		return
+	}
+	value := first&quicSpinBit != 0
+	if u.SpinEdge == 0 {
+		// first short header, no edge yet.
+		u.Spin, u.SpinEdge = value, -1
+		return
+	}
+	if value == u.Spin {
+		return
+	}
+	u.Spin = value
+	if u.SpinEdge > 0 && ts > u.SpinEdge {
+		rtt := uint64(ts - u.SpinEdge)
+		if u.SpinSRTT == 0 {
+			u.SpinSRTT = rtt
+		} else if soften {
+			u.SpinSRTT -= u.SpinSRTT >> 3
+			u.SpinSRTT += rtt >> 3
+		} else {
+			u.SpinSRTT = uint64(float64(u.SpinSampled*u.SpinSRTT)/float64(u.SpinSampled+1) + float64(rtt)/float64(u.SpinSampled+1))
+		}
+		u.SpinLast = rtt
+		u.SpinSampled++
+	}
+	u.SpinEdge = ts
+}
+
+func validateQUICPorts(ports []int) error {
+	for _, p := range ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("Error parsing configuration - bad udp quic port %d.", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQUICSpin(t *testing.T) {
+	u := &UDPAccounting{}
+
+	// a handshake packet, then short headers spinning every 20ms - a packet
+	// each 5ms.
+	u.spin(quicLongHeader|quicFixedBit, int64(time.Millisecond), false)
+	for i := 0; i < 20; i++ {
+		first := byte(quicFixedBit)
+		if (i/4)%2 == 1 {
+			first |= quicSpinBit
+		}
+		u.spin(first, int64(time.Duration(i+1)*5*time.Millisecond), false)
+	}
+	// edges at 25, 45, 65, 85ms: the first one only starts the measure.
+	if u.SpinSampled != 3 || u.SpinSRTT != uint64(20*time.Millisecond) || u.SpinLast != uint64(20*time.Millisecond) {
+		t.Fatalf("Unexpected spin bit RTT: %d samples, srtt %v, last %v", u.SpinSampled, time.Duration(u.SpinSRTT), time.Duration(u.SpinLast))
+	}
+
+	// disabled spin bit.
+	u = &UDPAccounting{}
+	for i := 0; i < 20; i++ {
+		u.spin(quicFixedBit, int64(time.Duration(i+1)*5*time.Millisecond), false)
+	}
+	if u.SpinSampled != 0 {
+		t.Fatalf("Expected no samples off a constant spin bit, got %d", u.SpinSampled)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// dscpObservation is the internal metric probes behind the dedup proxy
+	// share the DSCP classes they see with. The proxy consumes it.
+	dscpObservation = "go_metro.dscp.observed"
+
+	remarkPathTag     = "metro_path"     // sender>receiver, addresses and ports
+	remarkObservedTag = "metro_observed" // sent or received
+	remarkDSCPTag     = "metro_dscp"
+)
+
+// dscpPath identifies a direction of a flow, the same at both ends.
+func dscpPath(from net.IP, fport uint16, to net.IP, tport uint16) string {
+	return net.JoinHostPort(from.String(), strconv.Itoa(int(fport))) + ">" + net.JoinHostPort(to.String(), strconv.Itoa(int(tport)))
+}
+
+// observeDSCP shares the DSCP classes of a flow with the dedup proxy: that of
+// the segments we sent, as marked, and of those we received, as delivered.
+// Call holding the flow lock.
+func (r *Client) observeDSCP(flow *TCPAccounting) {
+	if !r.election.Leader() {
+		return
+	}
+	observe := func(path, observed, class string) {
+		if class == "" {
+			return
+		}
+		tags := []string{remarkPathTag + ":" + path, remarkObservedTag + ":" + observed, remarkDSCPTag + ":" + class}
+		r.client.Gauge(dscpObservation, 1, tags, 1)
+	}
+	observe(dscpPath(flow.Src, uint16(flow.Sport), flow.Dst, uint16(flow.Dport)), "sent", flow.QoS)
+	observe(dscpPath(flow.Dst, uint16(flow.Dport), flow.Src, uint16(flow.Sport)), "received", flow.RcvdQoS)
+}
+
+// dscpMarks are the classes a direction of a flow was seen with at either end.
+type dscpMarks struct {
+	sent, received string
+	alerted        string // sent>received pair last reported
+	ts             time.Time
+}
+
+// remarks compares DSCP observations of the probes at both ends of flows,
+// to catch intermediate devices re-marking traffic. Used by the dedup proxy,
+// holding its lock.
+type remarks struct {
+	window time.Duration
+	paths  map[string]*dscpMarks
+}
+
+func newRemarks(window time.Duration) *remarks {
+	return &remarks{window: window, paths: make(map[string]*dscpMarks)}
+}
+
+// observe records an observation line, returning the statsd event to emit if
+// the path turns out re-marked.
+func (r *remarks) observe(line []byte, now time.Time) []byte {
+	i := bytes.Index(line, []byte("|#"))
+	if i < 0 {
+		return nil
+	}
+	var path, observed, class string
+	for _, t := range bytes.Split(line[i+2:], []byte(",")) {
+		if v := bytes.TrimPrefix(t, []byte(remarkPathTag+":")); len(v) < len(t) {
+			path = string(v)
+		} else if v := bytes.TrimPrefix(t, []byte(remarkObservedTag+":")); len(v) < len(t) {
+			observed = string(v)
+		} else if v := bytes.TrimPrefix(t, []byte(remarkDSCPTag+":")); len(v) < len(t) {
+			class = string(v)
+		}
+	}
+	if path == "" || class == "" {
+		return nil
+	}
+
+	m, ok := r.paths[path]
+	if !ok {
+		m = &dscpMarks{}
+		r.paths[path] = m
+	}
+	switch observed {
+	case "sent":
+		m.sent = class
+	case "received":
+		m.received = class
+	default:
+		return nil
+	}
+	m.ts = now
+	if m.sent == "" || m.received == "" || m.sent == m.received {
+		return nil
+	}
+	pair := m.sent + ">" + m.received
+	if pair == m.alerted {
+		return nil
+	}
+	m.alerted = pair
+
+	title := "DSCP re-marked"
+	text := fmt.Sprintf("Traffic %s sent as %s arrived as %s.", path, m.sent, m.received)
+	return []byte(fmt.Sprintf("_e{%d,%d}:%s|%s|t:warning|#dscp_sent:%s,dscp_received:%s",
+		len(title), len(text), title, text, m.sent, m.received))
+}
+
+// expire forgets paths not observed within the window.
+func (r *remarks) expire(now time.Time) {
+	for k, m := range r.paths {
+		if now.Sub(m.ts) > r.window {
+			delete(r.paths, k)
+		}
+	}
+}
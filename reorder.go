@@ -0,0 +1,92 @@
+package main
+
+import "github.com/google/gopacket/layers"
+
+const (
+	// maxSeqHoles bounds the gaps followed per direction.
+	maxSeqHoles = 8
+	// defaultReorderWindow stands for the RTT of flows not sampled yet.
+	defaultReorderWindow = 5000000 // ns
+	// dupAckThreshold duplicate ACKs in a row trigger a fast retransmit.
+	dupAckThreshold = 3
+)
+
+// seqHole is a gap in the sequence space, at is when data past it arrived.
+type seqHole struct {
+	start, end uint32
+	at         int64
+}
+
+// arrived accounts for a data segment received at ts (ns). Segments filling a
+// gap within window (about an RTT, the soonest a retransmission could make
+// it) of it opening were reordered on the way, later ones retransmitted.
+func (s *seqSpace) arrived(seq, sz uint32, ts, window int64) {
+	if s.Segments > 0 && int32(seq-s.Next) > 0 {
+		s.holes = append(s.holes, seqHole{start: s.Next, end: seq, at: ts})
+		if len(s.holes) > maxSeqHoles {
+			s.holes = s.holes[1:]
+		}
+	} else if s.fill(seq, sz, ts, window) {
+		s.OutOfOrder++
+		s.Segments++
+		s.Bytes += uint64(sz)
+		return
+	}
+	s.track(seq, sz)
+}
+
+// fill closes the gap a segment falls in, telling whether it arrived out of
+// order rather than retransmitted.
+func (s *seqSpace) fill(seq, sz uint32, ts, window int64) bool {
+	for i, h := range s.holes {
+		if seq-h.start >= h.end-h.start {
+			continue
+		}
+		if end := seq + sz; int32(end-h.end) < 0 {
+			// more to come.
+			s.holes[i].start = end
+		} else {
+			s.holes = append(s.holes[:i], s.holes[i+1:]...)
+		}
+		return ts-h.at < window
+	}
+	return false
+}
+
+// reorderWindow is how soon after a gap opens data filling it is considered
+// reordered rather than retransmitted. Call holding the flow lock.
+func (t *TCPAccounting) reorderWindow() int64 {
+	if t.Sampled == 0 {
+		return defaultReorderWindow
+	}
+	return int64(t.SRTT)
+}
+
+// dupAcks counts the duplicate ACKs a flow's end sends: pure ACKs repeating
+// the previous one's acknowledgment number and window (RFC 5681), a sign the
+// data it receives went missing or arrived out of order.
+type dupAcks struct {
+	seen   bool
+	ack    uint32
+	window uint16
+	run    int
+	Count  uint64
+	Bursts uint64 // runs long enough to trigger a fast retransmit
+}
+
+func (a *dupAcks) track(tcp *layers.TCP, payload uint32) {
+	if !tcp.ACK || tcp.SYN || tcp.FIN || tcp.RST {
+		a.run = 0
+		return
+	}
+	if payload == 0 && a.seen && tcp.Ack == a.ack && tcp.Window == a.window {
+		a.Count++
+		a.run++
+		if a.run == dupAckThreshold {
+			a.Bursts++
+		}
+	} else {
+		a.run = 0
+	}
+	a.seen, a.ack, a.window = true, tcp.Ack, tcp.Window
+}
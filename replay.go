@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// replayClock paces offline packet processing after the capture timestamps,
+// speed times faster than real time.
+type replayClock struct {
+	sync.Mutex
+	speed   float64
+	started bool
+	first   time.Time // capture time of the first packet
+	start   time.Time // wall time we started replaying at
+}
+
+func newReplayClock(speed float64) *replayClock {
+	return &replayClock{speed: speed}
+}
+
+// wait blocks until it's time to process a packet captured at ts. It returns
+// false if interrupted by dying.
+func (c *replayClock) wait(ts time.Time, dying <-chan struct{}) bool {
+	c.Lock()
+	if !c.started {
+		c.started = true
+		c.first = ts
+		c.start = time.Now()
+	}
+	offset := time.Duration(float64(ts.Sub(c.first)) / c.speed)
+	delay := c.start.Add(offset).Sub(time.Now())
+	c.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-dying:
+		return false
+	}
+}
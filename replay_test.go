@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayClock(t *testing.T) {
+	c := newReplayClock(10)
+	dying := make(chan struct{})
+
+	first := time.Unix(1500000000, 0)
+	start := time.Now()
+	if !c.wait(first, dying) {
+		t.Fatalf("Expected first packet to be processed right away")
+	}
+	// 500ms of capture at 10x
+	if !c.wait(first.Add(500*time.Millisecond), dying) {
+		t.Fatalf("Expected wait to complete")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected ~50ms replay pacing, took %v", elapsed)
+	}
+
+	close(dying)
+	if c.wait(first.Add(time.Hour), dying) {
+		t.Fatalf("Expected wait to be interrupted")
+	}
+}
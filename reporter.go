@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bufio"
-	"errors"
 	"gopkg.in/tomb.v2"
 	"net"
-	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -16,48 +13,224 @@ import (
 )
 
 type Client struct {
-	client *statsd.Client
-	ip     net.IP
-	port   int32
-	sleep  int32
-	flows  *FlowMap
-	tags   []string
-	lookup map[string]string
-	t      tomb.Tomb
+	client  *statsd.Client
+	api     *APIClient
+	otlp    *OTLPClient
+	ip      net.IP
+	port    int32
+	sleep   int32
+	flows   *FlowMap
+	tags    []string
+	enrich  *EnrichmentPipeline
+	metrics map[string]bool
+	tagMode string
+	// flows shorter than this (ns) are not reported
+	minLifetime int64
+	// UDP, ICMP flows and DNS resolvers are forgotten when idle this long
+	idleTTL time.Duration
+	// aggregation dimension
+	aggTag    string
+	aggRanges *LookupTable
+	classify  *TrafficClassifier
+	policies  *trafficPolicies
+	// start of the current reporting interval (unix seconds)
+	lastReport int64
+	health     *HealthConfig
+	checks     *healthChecks // nil unless recognising health checks
+	cloudLBs   *cloudLBs     // nil if off
+	bgp        *ribTable     // nil unless tagging routes to external hosts
+	switches   *switchPorts  // nil unless tagging switch ports
+	sockets    *socketStats
+	link       *linkStats // nil unless reporting the capture interface's load
+	groups     *peerGroups
+	groupSRTT  map[string]float64 // previous rtt.avg of each peer group, by tag set
+	maint      *maintenanceSchedule
+	notes      *annotationStore
+	election   *leaderElection // nil if not running redundantly
+	dedup      bool            // tag submissions with dedup keys
+	remarks    bool            // share DSCP observations with the dedup proxy
+	vlanTags   bool            // tag flows with their VLANs
+	vlanStats  bool            // aggregate RTTs per VLAN
+	macTags    bool            // tag flows with their MACs' OUIs
+	synTags    bool            // tag flows with their SYNs' MSS and window scale
+	t          tomb.Tomb
+	// failed connection attempts over the interval, by tag set
+	failures map[string]*flowTally
+	// traces our own pipeline, when on
+	tracer *pipelineTracer
+	// connections closed over the interval, by tag set and how
+	closes map[string]*flowTally
+	// declared chaos experiments, and those being verified by ID
+	experiments *chaosExperiments
+	chaos       map[int]*chaosCheck
+	// destinations ranked by RTT, published every interval
+	board *latencyBoard
+	// metrics derived from the flow fields, per the configuration
+	computed []computedMetric
+	hooks    []*analyzerHook
+	// user-provided analyzers, run over the flows every interval
+	scripts []*scriptAnalyzer
+	// external analyzers streamed the flows, answering with metrics
+	sidecar *sidecarHub
+	// report RTT percentiles, off the flows' sample distributions
+	percentiles bool
+	// tally of the interval, logged at its end
+	summary intervalSummary
+	// whether the capture interface is down, live captures only
+	ifstate *interfaceState
 }
 
 const (
 	statsdBufflen = 5
 	statsdSleep   = 30
+	metricPrefix  = "system.net.tcp."
 )
 
-func memorySize() (uint64, error) {
-	f, err := os.Open("/proc/meminfo")
-	if err != nil {
-		return 0, err
-	}
+// Metrics we know how to report - all enabled by default.
+var reportedMetrics = []string{
+	metricPrefix + "rtt",
+	metricPrefix + "rtt.avg",
+	metricPrefix + "rtt.jitter",
+	metricPrefix + "rtt.avg.delta",
+	metricPrefix + "rtt.min",
+	metricPrefix + "rtt.max",
+	metricPrefix + "rtt.samples",
+	metricPrefix + "rtt.one_way",
+	metricPrefix + "rtt.p50",
+	metricPrefix + "rtt.p95",
+	metricPrefix + "rtt.p99",
+	metricPrefix + "rtt.rollup",
+	metricPrefix + "rtt.rollup.max",
+	metricPrefix + "vlan.rtt.avg",
+	metricPrefix + "vlan.rtt.max",
+	metricPrefix + "vlan.flows",
+	metricPrefix + "health",
+	metricPrefix + "rtt.distribution",
+	metricPrefix + "path_changes",
+	metricPrefix + "flow_label_changes",
+	metricPrefix + "retransmits",
+	metricPrefix + "retransmit_bytes",
+	metricPrefix + "retransmit_rate",
+	metricPrefix + "throughput",
+	metricPrefix + "goodput",
+	metricPrefix + "dup_acks",
+	metricPrefix + "dup_ack_bursts",
+	metricPrefix + "out_of_order",
+	metricPrefix + "mss",
+	metricPrefix + "window_scale",
+	metricPrefix + "zero_window",
+	metricPrefix + "window_full",
+	metricPrefix + "ecn.ce",
+	metricPrefix + "ecn.ce_rate",
+	metricPrefix + "ecn.ece",
+	metricPrefix + "ecn.cwr",
+	metricPrefix + "sack.holes",
+	metricPrefix + "sack.hole_bytes",
+	metricPrefix + "connect_time",
+	metricPrefix + "connect_time.syn_ack",
+	metricPrefix + "connect_time.ack",
+	metricPrefix + "connect_failures",
+	metricPrefix + "closed",
+	metricPrefix + "connection.duration",
+	metricPrefix + "connections.open",
+	tlsMetricPrefix + "handshake_time",
+	tlsMetricPrefix + "server_hello_time",
+	metricPrefix + "socket.bytes_sent",
+	metricPrefix + "socket.bytes_received",
+	metricPrefix + "socket.retransmits",
+	metricPrefix + "socket.drops",
+	metricPrefix + "link.speed",
+	metricPrefix + "link.bytes",
+	metricPrefix + "link.utilization",
+	udpMetricPrefix + "packets",
+	udpMetricPrefix + "bytes",
+	udpMetricPrefix + "unanswered",
+	quicMetricPrefix + "rtt",
+	quicMetricPrefix + "rtt.avg",
+	icmpMetricPrefix + "rtt",
+	icmpMetricPrefix + "rtt.avg",
+	dnsMetricPrefix + "response_time",
+	dnsMetricPrefix + "response_time.max",
+	"go_metro.capture.restarts",
+	"go_metro.capture.startup_retries",
+	"go_metro.capture.interface_down",
+	"go_metro.capture.dropped",
+	"go_metro.capture.super_packets",
+	"go_metro.capture.truncated",
+	"go_metro.capture.clock_offset",
+	"go_metro.capture.clock_drift",
+	"go_metro.maintenance.suppressed",
+	"go_metro.flows.no_timestamps",
+	"go_metro.flows.seen_entries",
+	"go_metro.flows.timed_entries",
+	"go_metro.flows.evicted_entries",
+	"go_metro.chaos.added_latency",
+	"go_metro.chaos.expected_latency",
+	"go_metro.chaos.compliant",
+	"go_metro.health_check.flows",
+	"go_metro.esp.packets",
+	"go_metro.ip.fragments",
+}
 
-	s := bufio.NewScanner(f)
-	if !s.Scan() {
-		return 0, errors.New("/proc/meminfo parse error")
+// rollup pre-aggregates flow RTTs along the configured aggregation dimension.
+type rollup struct {
+	tags []string
+	sum  float64
+	max  float64
+	n    int
+	ts   int64
+}
+
+func (ru *rollup) add(value float64, ts int64) {
+	ru.sum += value
+	ru.n++
+	if value > ru.max {
+		ru.max = value
+	}
+	if ts > ru.ts {
+		ru.ts = ts
 	}
+}
 
-	l := s.Text()
-	fs := strings.Fields(l)
-	if len(fs) != 3 || fs[2] != "kB" {
-		return 0, errors.New("/proc/meminfo parse error")
+// metricName expands the short metric names accepted in the configuration
+// (eg. "rtt.jitter") to their full name.
+func metricName(name string) string {
+	if strings.HasPrefix(name, "system.") || strings.HasPrefix(name, "go_metro.") {
+		return name
 	}
+	return metricPrefix + name
+}
 
-	kb, err := strconv.ParseUint(fs[1], 10, 64)
-	if err != nil {
-		return 0, err
+func enabledMetrics(names []string) map[string]bool {
+	enabled := make(map[string]bool)
+	if len(names) == 0 {
+		for _, m := range reportedMetrics {
+			enabled[m] = true
+		}
+		return enabled
 	}
 
-	//return bytes
-	return kb * 1024, nil
+	for _, n := range names {
+		m := metricName(n)
+		known := false
+		for i := range reportedMetrics {
+			if reportedMetrics[i] == m {
+				known = true
+				break
+			}
+		}
+		if !known {
+			log.Warnf("Unknown metric %q in configuration, ignoring.", n)
+			continue
+		}
+		enabled[m] = true
+	}
+	return enabled
 }
 
-func NewClient(ip net.IP, port int32, sleep int32, flows *FlowMap, lookup map[string]string, tags []string) (*Client, error) {
+func NewClient(instcfg InitConfig, cfg Config, sleep int32, flows *FlowMap, enrich *EnrichmentPipeline) (*Client, error) {
+	ip := net.ParseIP(instcfg.StatsdIP)
+	port := int32(instcfg.StatsdPort)
 	cli, err := statsd.NewBuffered(net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), statsdBufflen)
 	if err != nil {
 		cli = nil
@@ -66,12 +239,146 @@ func NewClient(ip net.IP, port int32, sleep int32, flows *FlowMap, lookup map[st
 	}
 
 	r := &Client{
-		client: cli,
-		port:   port,
-		sleep:  sleep,
-		flows:  flows,
-		tags:   tags,
-		lookup: lookup,
+		client:   cli,
+		ip:       ip,
+		port:     port,
+		sleep:    sleep,
+		flows:    flows,
+		tags:     cfg.Tags,
+		enrich:   enrich,
+		metrics:  enabledMetrics(cfg.Metrics),
+		tagMode:  cfg.TagMode,
+		health:   cfg.Health,
+		maint:    maintenance,
+		notes:    annotations,
+		election: election,
+		dedup:    instcfg.DedupKeys,
+		failures: make(map[string]*flowTally),
+		closes:   make(map[string]*flowTally),
+	}
+	r.minLifetime = int64(cfg.MinLifetime) * int64(time.Millisecond)
+	r.idleTTL = time.Duration(instcfg.IdleTTL) * time.Second
+	r.remarks = instcfg.DedupKeys && cfg.DSCPTags
+	r.vlanTags, r.vlanStats, r.macTags = cfg.VLANTags, cfg.VLANStats, cfg.MACTags
+	r.synTags = cfg.SYNTags
+	if cfg.Aggregation != nil && cfg.Aggregation.Tag != "" {
+		r.aggTag = cfg.Aggregation.Tag
+		r.aggRanges = NewLookupTable()
+		for k, v := range cfg.Aggregation.Ranges {
+			if err := r.aggRanges.Add(k, v); err != nil {
+				log.Errorf("Invalid aggregation range %q: %v", k, err)
+				return nil, err
+			}
+		}
+	}
+	r.policies, err = newTrafficPolicies(cfg.Policies)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TrafficClass != nil {
+		r.classify, err = NewTrafficClassifier(cfg.TrafficClass)
+		if err != nil {
+			log.Errorf("Unable to set up traffic classifier: %v", err)
+			return nil, err
+		}
+	}
+	var lbs CloudLBConfig
+	if cfg.CloudLBs != nil {
+		lbs = *cfg.CloudLBs
+	}
+	r.cloudLBs, err = newCloudLBs(lbs)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BGP != nil {
+		r.bgp, err = newRIBTable(cfg.BGP)
+		if err != nil {
+			log.Errorf("Unable to load RIB dump %q: %v", cfg.BGP.RIB, err)
+			return nil, err
+		}
+	}
+	if cfg.SwitchPorts != nil {
+		r.switches, err = newSwitchPorts(cfg.SwitchPorts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.HealthChecks != nil {
+		r.checks, err = newHealthChecks(*cfg.HealthChecks)
+		if err != nil {
+			log.Errorf("Invalid health check configuration: %v", err)
+			return nil, err
+		}
+	}
+	if len(cfg.PeerGroups) > 0 {
+		r.groups, err = newPeerGroups(cfg.PeerGroups)
+		if err != nil {
+			log.Errorf("Invalid peer group: %v", err)
+			return nil, err
+		}
+	}
+	if cfg.SocketStats {
+		r.sockets = newSocketStats()
+		// first collection sets the baseline.
+		if _, _, err := r.sockets.collect(); err != nil {
+			log.Warnf("Unable to collect socket statistics, disabling: %v", err)
+			r.sockets = nil
+		}
+	}
+	if cfg.Interface != fileInterface {
+		r.ifstate = &interfaceState{}
+	}
+	if cfg.LinkStats && cfg.Interface != fileInterface {
+		r.link = newLinkStats(cfg.Interface)
+		// first collection sets the baseline.
+		if _, _, err := r.link.collect(); err != nil {
+			log.Warnf("Unable to collect link statistics of %q, disabling: %v", cfg.Interface, err)
+			r.link = nil
+		}
+	}
+	if instcfg.Reporter == reporterDatadogAPI {
+		r.api = NewAPIClient(instcfg.APIURL, instcfg.APIKey)
+	} else if instcfg.Reporter == reporterOTLP {
+		r.otlp = NewOTLPClient(instcfg.OTLPEndpoint, instcfg.OTLPHeaders)
+	}
+	if instcfg.Spool != nil && (r.api != nil || r.otlp != nil) {
+		spool, err := newDiskSpool(instcfg.Spool, cfg.Interface)
+		if err != nil {
+			log.Errorf("Unable to open spool in %q: %v", instcfg.Spool.Path, err)
+			return nil, err
+		}
+		if r.api != nil {
+			r.api.spool = spool
+		} else {
+			r.otlp.spool = spool
+		}
+	}
+	r.tracer = newPipelineTracer(cfg.Tracing, instcfg, cfg.Tags)
+	r.experiments, r.chaos = experiments, make(map[int]*chaosCheck)
+	r.board = destinations
+	r.sidecar = sidecars
+	r.percentiles = cfg.Percentiles
+	r.computed, err = newComputedMetrics(cfg.Computed)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range r.computed {
+		// always on, configuring one asks for it.
+		r.metrics[m.name] = true
+	}
+	r.hooks, err = newAnalyzerHooks(cfg.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range r.hooks {
+		r.metrics[h.metric] = true
+	}
+	for _, sc := range cfg.Scripts {
+		s := newScriptAnalyzer(sc)
+		for m := range s.metrics {
+			r.metrics[m] = true
+		}
+		r.scripts = append(r.scripts, s)
 	}
 	r.t.Go(r.Report)
 	return r, nil
@@ -82,22 +389,191 @@ func (r *Client) Stop() error {
 	return r.t.Wait()
 }
 
-func (r *Client) submit(key, metric string, value float64, tags []string, asHistogram bool) error {
+// submit reports a metric, ts is the time (seconds since the epoch) the value
+// was observed at - honored only by the API reporter. Standby instances don't
+// report.
+func (r *Client) submit(key, metric string, value float64, tags []string, asHistogram bool, ts int64) error {
+	if !r.wanted(metric) || !r.election.Leader() {
+		return nil
+	}
+
+	if r.dedup {
+		tags = append(tags[:len(tags):len(tags)], dedupTag+":"+dedupKey(metric, key, ts, r.sleep))
+	}
+
 	var err error
-	if asHistogram {
+	if r.api != nil {
+		r.api.Gauge(metric, value, tags, ts)
+	} else if r.otlp != nil {
+		r.otlp.Gauge(metric, value, tags, ts)
+	} else if asHistogram {
 		err = r.client.Histogram(metric, value, tags, 1)
 	} else {
 		err = r.client.Gauge(metric, value, tags, 1)
 	}
+	r.summary.submission(err)
 	if err != nil {
 		log.Infof("There was an issue reporting metric: [%s] %s = %v - error: %v", key, metric, value, err)
 		return err
 	} else {
-		log.Infof("Reported successfully! Metric: [%s] %s = %v - tags: %v", key, metric, value, tags)
+		log.Debugf("Reported successfully! Metric: [%s] %s = %v - tags: %v", key, metric, value, tags)
 	}
 	return nil
 }
 
+// wanted tells whether a metric is enabled. Those of sidecar analyzers are
+// named by them, anything they send is wanted. r.metrics is only read once
+// built, by the reporter and the sniffer.
+func (r *Client) wanted(metric string) bool {
+	return r.metrics[metric] || strings.HasPrefix(metric, sidecarMetricPrefix)
+}
+
+// count submits a counter tagged with the instance tags.
+func (r *Client) count(metric string, value int64) {
+	if !r.metrics[metric] || !r.election.Leader() {
+		return
+	}
+
+	var err error
+	if r.api != nil {
+		r.api.Count(metric, float64(value), r.tags, time.Now().Unix())
+	} else if r.otlp != nil {
+		r.otlp.Count(metric, float64(value), r.tags, time.Now().Unix())
+	} else {
+		err = r.client.Count(metric, value, r.tags, 1)
+	}
+	r.summary.submission(err)
+	if err != nil {
+		log.Infof("There was an issue reporting metric: %s = %v - error: %v", metric, value, err)
+	}
+}
+
+func (r *Client) hostname(ip net.IP) string {
+	host, ok := r.enrich.Resolve(ip.String())
+	if !ok {
+		host = ip.String()
+	}
+	return host
+}
+
+// endpoints returns a flow's endpoints, and the tag names they go by,
+// according to the configured tagging mode. Call holding the flow lock.
+func (r *Client) endpoints(flow *TCPAccounting) (net.IP, net.IP, string, string) {
+	switch r.tagMode {
+	case tagModeLocalRemote:
+		return flow.Src, flow.Dst, "local", "remote"
+	case tagModeClientServer:
+		if flow.Client {
+			return flow.Src, flow.Dst, "client", "server"
+		}
+		return flow.Dst, flow.Src, "client", "server"
+	default:
+		return flow.Src, flow.Dst, "src", "dst"
+	}
+}
+
+// flowTags returns the endpoint tags for a flow, including the aggregation
+// dimension if configured. Call holding the flow lock.
+func (r *Client) flowTags(flow *TCPAccounting) []string {
+	a, b, aKey, bKey := r.endpoints(flow)
+	aHost, bHost := r.hostname(a), r.hostname(b)
+	if group, ok := r.peerGroup(flow); ok {
+		// the remote end (Dst) is a member of a logical service.
+		if a.Equal(flow.Dst) {
+			aHost = group
+		} else {
+			bHost = group
+		}
+	} else if r.policies.aggregated(flow.External) {
+		// collapse the remote end (Dst) into its traffic class.
+		if a.Equal(flow.Dst) {
+			aHost = trafficClassName(flow.External)
+		} else {
+			bHost = trafficClassName(flow.External)
+		}
+	}
+	tags := []string{aKey + ":" + aHost, bKey + ":" + bHost}
+	if r.aggTag != "" {
+		tags = append(tags, r.dimensionTags(flow)...)
+	}
+	if r.vlanTags {
+		tags = append(tags, vlanTags(flow.VLANs)...)
+	}
+	if r.macTags {
+		tags = append(tags, r.ouiTags(flow)...)
+	}
+	if r.synTags {
+		tags = append(tags, r.synOptionTags(flow)...)
+	}
+	if flow.Tunnel != "" {
+		tags = append(tags, flow.Tunnel)
+	}
+	if flow.QoS != "" {
+		tags = append(tags, "dscp:"+flow.QoS)
+	}
+	if flow.Iface != "" {
+		tags = append(tags, "capture_iface:"+flow.Iface)
+	}
+	tags = append(tags, filterTags(flow)...)
+	if r.checks.matches(flow) {
+		tags = append(tags, healthCheckTag)
+	}
+	if provider, ok := r.cloudLBs.provider(flow); ok {
+		tags = append(tags, "cloud_lb:"+provider)
+	}
+	tags = append(tags, r.bgp.tags(flow)...)
+	tags = append(tags, r.switches.tags(flow)...)
+	tags = append(tags, r.annotationTags(flow)...)
+	if r.classify != nil {
+		// Src is always our end of the flow.
+		tags = append(tags, "traffic_class:"+r.classify.Classify(flow.Src, flow.Dst))
+	}
+	return tags
+}
+
+// suppressed returns whether a flow's remote end (Dst) is under maintenance,
+// by address, hostname or peer group. Call holding the flow lock.
+func (r *Client) suppressed(flow *TCPAccounting, now time.Time) bool {
+	if r.maint == nil {
+		return false
+	}
+	names := []string{r.hostname(flow.Dst)}
+	if group, ok := r.peerGroup(flow); ok {
+		names = append(names, group)
+	}
+	return r.maint.Suppressed(now, flow.Dst, names...)
+}
+
+func (r *Client) peerGroup(flow *TCPAccounting) (string, bool) {
+	if r.groups == nil {
+		return "", false
+	}
+	return r.groups.group(flow.Dst)
+}
+
+// grouped tells whether a flow is reported combined with the others sharing
+// its tags: peer group members, and flows whose remote end the traffic
+// policy collapses into its class.
+func (r *Client) grouped(flow *TCPAccounting) bool {
+	_, ok := r.peerGroup(flow)
+	return ok || r.policies.aggregated(flow.External)
+}
+
+// dimensionTags returns the aggregation dimension tags for a flow, eg.
+// src_az:us-east-1a, dst_az:us-east-1b.
+func (r *Client) dimensionTags(flow *TCPAccounting) []string {
+	a, b, aKey, bKey := r.endpoints(flow)
+	aDim, ok := r.aggRanges.Get(a.String())
+	if !ok {
+		aDim = "unknown"
+	}
+	bDim, ok := r.aggRanges.Get(b.String())
+	if !ok {
+		bDim = "unknown"
+	}
+	return []string{aKey + "_" + r.aggTag + ":" + aDim, bKey + "_" + r.aggTag + ":" + bDim}
+}
+
 func (r *Client) Report() error {
 	defer r.client.Close()
 
@@ -108,84 +584,485 @@ func (r *Client) Report() error {
 		log.Warnf("Error getting memory size. Relying on OOM to keep process in check. Err: %v", err)
 	}
 
-	ticker := time.NewTicker(time.Duration(r.sleep) * time.Second)
+	interval := time.Duration(r.sleep) * time.Second
+	timer := time.NewTimer(splayed(interval))
+	defer timer.Stop()
 	done := false
-	var memstats runtime.MemStats
-	var pct float64
 	for !done {
 		select {
 		case key := <-r.flows.Expire:
+			r.reportExpired(key)
 			r.flows.Delete(key)
 			log.Infof("Flow expired: [%s]", key)
-		case <-ticker.C:
-			flush := false
-			now := time.Now().Unix()
+		case <-timer.C:
+			start := time.Now()
+			r.reportFlows(memsize)
+			r.tracer.report(start, time.Now())
+			r.tracer.Flush()
+			timer.Reset(jittered(interval))
+		case <-r.t.Dying():
+			// last chance to report whatever we have, eg. when done with a pcap file.
+			r.reportFlows(memsize)
+			log.Infof("Done reporting.")
+			done = true
+		}
+	}
+	r.board.Withdraw(r)
+	r.sidecar.Forget(r)
 
-			runtime.ReadMemStats(&memstats)
-			if memsize > 0 {
-				pct = float64(memstats.Alloc) / float64(memsize)
-			} else {
-				pct = 0
-			}
+	return nil
+}
 
-			if pct >= FORCE_FLUSH_PCT { //memory out of control
-				flush = true
-				log.Warnf("Forcing flush - memory consumption above maximum allowed system usage: %v %%", pct*100)
-			}
+// reportFlows submits the statistics for all sampled flows and flushes the
+// book-keeping of long-lived flows (or all of them if memory is running out).
+func (r *Client) reportFlows(memsize uint64) {
+	var memstats runtime.MemStats
+	var pct float64
+	flush := false
+	now := time.Now().Unix()
+	secs := float64(now - r.lastReport)
+	if r.lastReport == 0 || secs <= 0 {
+		secs = float64(r.sleep)
+	}
 
-			r.flows.Lock()
-			for k := range r.flows.Map {
-				flow, e := r.flows.GetUnsafe(k)
-				flow.Lock()
-				if e && flow.Sampled > 0 {
-					success := true
-					value := float64(flow.SRTT) * float64(time.Nanosecond) / float64(time.Millisecond)
-					value_jitter := float64(flow.Jitter) * float64(time.Nanosecond) / float64(time.Millisecond)
-					value_last := float64(flow.Last) * float64(time.Nanosecond) / float64(time.Millisecond)
-
-					srcHost, ok := r.lookup[flow.Src.String()]
-					if !ok {
-						srcHost = flow.Src.String()
-					}
-					dstHost, ok := r.lookup[flow.Dst.String()]
-					if !ok {
-						dstHost = flow.Dst.String()
-					}
+	runtime.ReadMemStats(&memstats)
+	if memsize > 0 {
+		pct = float64(memstats.Alloc) / float64(memsize)
+	} else {
+		pct = 0
+	}
+
+	if pct >= FORCE_FLUSH_PCT { //memory out of control
+		flush = true
+		log.Warnf("Forcing flush - memory consumption above maximum allowed system usage: %v %%", pct*100)
+	}
 
-					tags := []string{"src:" + srcHost, "dst:" + dstHost}
-					tags = append(tags, r.tags...)
+	rollups := make(map[string]*rollup)
+	vlans := make(map[string]*rollup)
+	healths := make(map[string]*health)
+	distributions := make(map[string]*ExpHistogram)
+	dtags := make(map[string][]string)
+	exemplars := make(map[string][]otlpExemplar)
+	peers := make(map[string]bool)
+	groups := make(map[string]*groupStats)
+	muted := 0
+	checks := 0
+	noTS := 0
+	var seen, timed int
+	var evicted uint64
+	dests := make(map[string]*Destination)
+	opens := make(map[string]*flowTally)
+	var events []scriptEvent
 
-					metric := "system.net.tcp.rtt.avg"
-					err := r.submit(k, metric, value, tags, false)
-					if err != nil {
-						success = false
-					}
-					metric = "system.net.tcp.rtt.jitter"
-					err = r.submit(k, metric, value_jitter, tags, false)
-					if err != nil {
-						success = false
-					}
-					metric = "system.net.tcp.rtt"
-					err = r.submit(k, metric, value_last, tags, false)
+	r.bgp.refresh()
+	r.switches.refresh()
+
+	r.flows.Lock()
+	tracked := len(r.flows.Map)
+	for k := range r.flows.Map {
+		flow, e := r.flows.GetUnsafe(k)
+		flow.Lock()
+		suppressed := r.suppressed(flow, time.Unix(now, 0))
+		if r.sockets != nil && !suppressed {
+			peers[flow.Src.String()+"-"+flow.Dst.String()] = true
+		}
+		if r.checks != nil {
+			r.checks.observe(flow)
+		}
+		r.connectFailed(flow, time.Unix(now, 0), false)
+		r.closed(flow, time.Unix(now, 0), false)
+		r.observeOpen(opens, flow, time.Unix(now, 0))
+		r.observeChaos(flow, time.Unix(now, 0))
+		seen, timed, evicted = seen+len(flow.Seen), timed+len(flow.Timed), evicted+flow.Evicted
+		flow.Evicted = 0
+		if flow.NoTS && !flow.NoTSCounted {
+			flow.NoTSCounted = true
+			noTS++
+		}
+		check := e && flow.Sampled > 0 && r.checks.matches(flow)
+		if check {
+			checks++
+		}
+		report := e && flow.Sampled > 0 && r.policies.reported(flow.External) && !r.shortLived(flow)
+		// health checks and cloud load balancers may be left out.
+		report = report && !(check && r.checks.drop()) && !r.cloudLBs.dropped(flow)
+		if report {
+			r.observeDestination(dests, flow)
+			success := true
+			value := float64(flow.SRTT) * float64(time.Nanosecond) / float64(time.Millisecond)
+			value_jitter := float64(flow.Jitter) * float64(time.Nanosecond) / float64(time.Millisecond)
+			value_last := float64(flow.Last) * float64(time.Nanosecond) / float64(time.Millisecond)
+
+			ts := flow.LastTS / int64(time.Second)
+			tags := r.flowTags(flow)
+			tags = append(tags, r.tags...)
+
+			if grouped := r.grouped(flow); suppressed {
+				// still tracked, just not emitted until the window is over.
+				log.Debugf("Flow under maintenance, not reporting: [%s]", k)
+				muted++
+			} else if grouped {
+				// reported per group below: members' series are too noisy,
+				// or would overwrite each other once collapsed.
+				key := strings.Join(tags, ",")
+				g, ok := groups[key]
+				if !ok {
+					g = &groupStats{tags: tags}
+					groups[key] = g
+				}
+				g.add(flow)
+			} else {
+				r.summary.flow(k, flow)
+				metric := "system.net.tcp.rtt.avg"
+				err := r.submit(k, metric, value, tags, false, ts)
+				if err != nil {
+					success = false
+				}
+				metric = "system.net.tcp.rtt.jitter"
+				err = r.submit(k, metric, value_jitter, tags, false, ts)
+				if err != nil {
+					success = false
+				}
+				metric = "system.net.tcp.rtt"
+				err = r.submit(k, metric, value_last, tags, false, ts)
+				if err != nil {
+					success = false
+				}
+				// spread of the samples, and how many back the figures.
+				r.submit(k, metricPrefix+"rtt.min", nsToMs(flow.Min), tags, false, ts)
+				r.submit(k, metricPrefix+"rtt.max", nsToMs(flow.Max), tags, false, ts)
+				r.submit(k, metricPrefix+"rtt.samples", float64(flow.Sampled-flow.RepSampled), tags, false, ts)
+				r.reportOneWay(k, flow, tags, ts)
+				r.reportPercentiles(k, flow, tags, ts)
+				r.reportTLS(k, flow, tags, ts)
+				r.reportHandshake(k, flow, tags, ts)
+				if paths := flow.PathChanges - flow.RepPathChanges; paths > 0 {
+					r.submit(k, metricPrefix+"path_changes", float64(paths), tags, false, ts)
+				}
+				if labels := flow.LabelChanges - flow.RepLabels; labels > 0 {
+					r.submit(k, metricPrefix+"flow_label_changes", float64(labels), tags, false, ts)
+				}
+				r.reportLoss(k, flow, tags, ts, secs)
+				r.reportWindows(k, flow, tags, ts)
+				r.reportECN(k, flow, tags, ts)
+				r.reportSACK(k, flow, tags, ts)
+				r.reportSYNOptions(k, flow, tags, ts)
+				r.reportComputed(k, flow, tags, ts, secs)
+				r.reportHooks(k, flow, tags, ts, secs)
+				if len(r.scripts) > 0 || r.sidecar != nil {
+					events = append(events, newScriptEvent(k, flow, tags))
+				}
+				if flow.Reported {
+					// change since the last interval - to catch rapid degradation.
+					delta := value - float64(flow.RepSRTT)*float64(time.Nanosecond)/float64(time.Millisecond)
+					metric = "system.net.tcp.rtt.avg.delta"
+					err = r.submit(k, metric, delta, tags, false, ts)
 					if err != nil {
 						success = false
 					}
-					if success {
-						log.Debugf("Reported successfully on: %v", k)
-					}
 				}
-				if flush || (now-flow.LastFlush) > FLUSH_IVAL {
-					log.Debugf("Flushing book-keeping for long-lived flow: %v", k)
-					flow.Flush()
+			}
+			if r.health != nil && !suppressed {
+				// one score per destination, ie. tag set.
+				key := strings.Join(tags, ",")
+				h, ok := healths[key]
+				if !ok {
+					h = &health{tags: tags}
+					healths[key] = h
 				}
-				flow.Unlock()
+				h.add(flow, ts)
 			}
-			r.flows.Unlock()
-		case <-r.t.Dying():
-			log.Infof("Done reporting.")
-			done = true
+			if flow.RTTs != nil && !suppressed && r.otlp != nil && r.metrics[metricPrefix+"rtt.distribution"] {
+				key := strings.Join(tags, ",")
+				dist, ok := distributions[key]
+				if !ok {
+					dist = NewExpHistogram()
+					distributions[key] = dist
+					dtags[key] = tags
+				}
+				dist.Merge(flow.RTTs)
+			}
+			flow.RTTs = nil
+			for _, tr := range flow.Traces {
+				rtt := tr.RTT
+				if rtt == 0 {
+					rtt = flow.SRTT
+				}
+				ms := float64(rtt) * float64(time.Nanosecond) / float64(time.Millisecond)
+				log.Infof("Trace correlation: [%s] trace_id=%s span_id=%s rtt=%.3f ms rtt.avg=%.3f ms", k, tr.TraceID, tr.SpanID, ms, value)
+				if r.otlp != nil && !suppressed {
+					key := strings.Join(tags, ",")
+					exemplars[key] = append(exemplars[key], otlpExemplar{
+						TimeUnixNano: strconv.FormatInt(tr.TS, 10),
+						AsDouble:     ms,
+						TraceID:      tr.TraceID,
+						SpanID:       tr.SpanID,
+					})
+				}
+			}
+			flow.Traces = nil
+			if r.remarks && !suppressed {
+				r.observeDSCP(flow)
+			}
+			flow.Reported = true
+			flow.RepSRTT = flow.SRTT
+			flow.RepSampled = flow.Sampled
+			flow.RepSegments = flow.Segments
+			flow.RepRetransmits = flow.Retransmits
+			flow.RepRetxBytes = flow.RetxBytes
+			flow.RepSentBytes = flow.SentBytes
+			flow.RepRcvd = flow.Rcvd
+			flow.RepDupAcks = flow.DupAcks
+			flow.RepRcvdDupAcks = flow.RcvdDupAcks
+			flow.RepWnd = flow.Wnd
+			flow.RepRcvdWnd = flow.RcvdWnd
+			flow.RepECN = flow.ECN
+			flow.RepRcvdECN = flow.RcvdECN
+			flow.RepSACK = flow.SACK
+			flow.RepRcvdSACK = flow.RcvdSACK
+			flow.RepResets = flow.Resets
+			flow.RepPathChanges = flow.PathChanges
+			flow.RepLabels = flow.LabelChanges
+			if success {
+				log.Debugf("Reported successfully on: %v", k)
+			}
+
+			if r.aggTag != "" && !suppressed {
+				dims := r.dimensionTags(flow)
+				key := strings.Join(dims, ",")
+				ru, ok := rollups[key]
+				if !ok {
+					ru = &rollup{tags: append(dims, r.tags...)}
+					rollups[key] = ru
+				}
+				ru.add(value, ts)
+			}
+			if r.vlanStats && len(flow.VLANs) > 0 && !suppressed {
+				vtags := vlanTags(flow.VLANs)
+				key := strings.Join(vtags, ",")
+				ru, ok := vlans[key]
+				if !ok {
+					ru = &rollup{tags: append(vtags, r.tags...)}
+					vlans[key] = ru
+				}
+				ru.add(value, ts)
+			}
+		}
+		if flush || (now-flow.LastFlush) > FLUSH_IVAL {
+			log.Debugf("Flushing book-keeping for long-lived flow: %v", k)
+			flow.Flush()
 		}
+		flow.Unlock()
 	}
+	r.flows.Unlock()
 
-	return nil
+	for k, ru := range rollups {
+		r.submit(k, metricPrefix+"rtt.rollup", ru.sum/float64(ru.n), ru.tags, false, ru.ts)
+		r.submit(k, metricPrefix+"rtt.rollup.max", ru.max, ru.tags, false, ru.ts)
+	}
+	for k, ru := range vlans {
+		r.submit(k, metricPrefix+"vlan.rtt.avg", ru.sum/float64(ru.n), ru.tags, false, ru.ts)
+		r.submit(k, metricPrefix+"vlan.rtt.max", ru.max, ru.tags, false, ru.ts)
+		r.submit(k, metricPrefix+"vlan.flows", float64(ru.n), ru.tags, false, ru.ts)
+	}
+
+	r.reportGroups(groups, secs)
+	r.reportConnectFailures(now)
+	r.reportCloses(now)
+	r.reportOpen(opens, now)
+	r.reportChaos(time.Unix(now, 0))
+
+	r.reportFlowMaps(seen, timed, evicted, now)
+	r.board.Publish(r, dests, time.Unix(now, 0))
+	r.reportScripts(events, now)
+	r.reportSidecar(events, now)
+	if noTS > 0 {
+		r.count("go_metro.flows.no_timestamps", int64(noTS))
+	}
+	if muted > 0 {
+		r.count("go_metro.maintenance.suppressed", int64(muted))
+	}
+	if r.checks != nil {
+		r.checks.prune()
+		r.count("go_metro.health_check.flows", int64(checks))
+	}
+
+	for k, h := range healths {
+		r.submit(k, metricPrefix+"health", h.score(r.health), h.tags, false, h.ts)
+	}
+
+	if r.sockets != nil {
+		r.reportSockets(peers)
+	}
+	if r.link != nil {
+		r.reportLink()
+	}
+
+	r.reportUDP(now)
+	r.reportICMP(now)
+	r.reportDNS(now)
+	r.reportInterface(now)
+
+	if r.otlp != nil && r.election.Leader() {
+		for k, dist := range distributions {
+			r.otlp.Histogram(metricPrefix+"rtt.distribution", "ms", dist, dtags[k], r.lastReport, now, exemplars[k])
+		}
+		if err := r.otlp.Flush(); err != nil {
+			log.Warnf("Error exporting metrics over OTLP, will retry: %v", err)
+		}
+	}
+	r.lastReport = now
+
+	if r.api != nil {
+		if err := r.api.Flush(); err != nil {
+			log.Warnf("Error submitting metrics to the API, will retry: %v", err)
+		}
+	}
+	log.Info(r.summary.end(tracked, muted))
+}
+
+// shortLived tells whether a flow hasn't lived long enough to be reported -
+// health checks, port scans and the like carry no useful latency signal.
+func (r *Client) shortLived(flow *TCPAccounting) bool {
+	return r.minLifetime > 0 && flow.LastSeen-flow.FirstSeen < r.minLifetime
+}
+
+// reportExpired submits the final statistics of an expiring flow if it was
+// sampled since the last report - flows living less than a reporting interval
+// would otherwise never produce a data point.
+func (r *Client) reportExpired(k string) {
+	flow, ok := r.flows.Get(k)
+	if !ok {
+		return
+	}
+	flow.Lock()
+	defer flow.Unlock()
+	if r.checks != nil {
+		r.checks.observe(flow)
+	}
+	r.connectFailed(flow, time.Now(), true)
+	r.closed(flow, time.Now(), true)
+	if !flow.CloseCounted {
+		flow.CloseCounted = true
+		r.connectionEnded(flow, closeIdle, time.Now())
+	}
+	if (r.checks.drop() && r.checks.matches(flow)) || r.cloudLBs.dropped(flow) {
+		return
+	}
+	if flow.Sampled == 0 || flow.Sampled == flow.RepSampled || !r.policies.reported(flow.External) || r.shortLived(flow) {
+		return
+	}
+	if r.suppressed(flow, time.Now()) {
+		r.count("go_metro.maintenance.suppressed", 1)
+		return
+	}
+	if r.grouped(flow) {
+		// groups, and flows collapsed by policy, are only reported per
+		// interval.
+		return
+	}
+
+	ts := flow.LastTS / int64(time.Second)
+	tags := r.flowTags(flow)
+	tags = append(tags, r.tags...)
+	r.submit(k, "system.net.tcp.rtt.avg", nsToMs(flow.SRTT), tags, false, ts)
+	r.submit(k, "system.net.tcp.rtt.jitter", nsToMs(flow.Jitter), tags, false, ts)
+	r.submit(k, "system.net.tcp.rtt", nsToMs(flow.Last), tags, false, ts)
+	r.reportTLS(k, flow, tags, ts)
+	r.reportHandshake(k, flow, tags, ts)
+	flow.Reported = true
+	flow.RepSRTT = flow.SRTT
+	flow.RepSampled = flow.Sampled
+	log.Debugf("Reported final statistics of expired flow: %v", k)
+}
+
+// reportSockets submits kernel socket counters (per second) for the host
+// pairs we have flows for, so they can be checked against pcap figures.
+func (r *Client) reportSockets(peers map[string]bool) {
+	deltas, interval, err := r.sockets.collect()
+	if err != nil {
+		log.Warnf("Error collecting socket statistics: %v", err)
+		return
+	}
+	secs := interval.Seconds()
+	if secs <= 0 {
+		return
+	}
+
+	type pair struct {
+		src, dst  net.IP
+		sent, rcv uint64
+		retrans   uint64
+		drops     uint64
+	}
+	pairs := make(map[string]*pair)
+	for i := range deltas {
+		k := deltas[i].Src.String() + "-" + deltas[i].Dst.String()
+		if !peers[k] {
+			continue
+		}
+		p, ok := pairs[k]
+		if !ok {
+			p = &pair{src: deltas[i].Src, dst: deltas[i].Dst}
+			pairs[k] = p
+		}
+		p.sent += deltas[i].BytesAcked
+		p.rcv += deltas[i].BytesReceived
+		p.retrans += uint64(deltas[i].Retrans)
+		p.drops += uint64(deltas[i].Drops)
+	}
+
+	ts := time.Now().Unix()
+	for k, p := range pairs {
+		tags := append([]string{"src:" + r.hostname(p.src), "dst:" + r.hostname(p.dst)}, r.tags...)
+		r.submit(k, metricPrefix+"socket.bytes_sent", float64(p.sent)/secs, tags, false, ts)
+		r.submit(k, metricPrefix+"socket.bytes_received", float64(p.rcv)/secs, tags, false, ts)
+		r.submit(k, metricPrefix+"socket.retransmits", float64(p.retrans)/secs, tags, false, ts)
+		r.submit(k, metricPrefix+"socket.drops", float64(p.drops)/secs, tags, false, ts)
+	}
+}
+
+// reportGroups submits the RTT statistics of peer groups, and of the flows
+// collapsed by aggregate traffic policies, weighted by the samples of their
+// members' flows: the extremes are across members, retransmissions and
+// throughput summed. Percentiles are of all members' samples, the service
+// level indicators of the group.
+func (r *Client) reportGroups(groups map[string]*groupStats, secs float64) {
+	toMs := float64(time.Nanosecond) / float64(time.Millisecond)
+	if r.groupSRTT == nil {
+		r.groupSRTT = make(map[string]float64)
+	}
+	for k, g := range groups {
+		if g.samples == 0 {
+			continue
+		}
+		ts := g.lastTS / int64(time.Second)
+		srtt := g.srtt / float64(g.samples) * toMs
+		r.submit(k, metricPrefix+"rtt.avg", srtt, g.tags, false, ts)
+		r.submit(k, metricPrefix+"rtt.jitter", g.jitter/float64(g.samples)*toMs, g.tags, false, ts)
+		r.submit(k, metricPrefix+"rtt", g.last*toMs, g.tags, false, ts)
+		r.submit(k, metricPrefix+"rtt.min", nsToMs(g.min), g.tags, false, ts)
+		r.submit(k, metricPrefix+"rtt.max", nsToMs(g.max), g.tags, false, ts)
+		r.submit(k, metricPrefix+"rtt.samples", float64(g.sampled), g.tags, false, ts)
+		for _, dir := range []struct {
+			tag   string
+			space seqSpace
+		}{
+			{"direction:sent", g.sent},
+			{"direction:received", g.rcvd},
+		} {
+			if dir.space.Segments > 0 {
+				r.submitSpace(k, dir.space, append(append([]string(nil), g.tags...), dir.tag), ts, secs)
+			}
+		}
+		if prev, ok := r.groupSRTT[k]; ok {
+			r.submit(k, metricPrefix+"rtt.avg.delta", srtt-prev, g.tags, false, ts)
+		}
+		r.groupSRTT[k] = srtt
+		if r.percentiles && g.rtts != nil {
+			for _, p := range rttPercentiles {
+				r.submit(k, p.metric, g.rtts.Quantile(p.q), g.tags, false, ts)
+			}
+		}
+	}
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestReportFlowSpread(t *testing.T) {
+	flows := NewFlowMap()
+	flow := NewTCPAccounting(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 40000, 443, time.Minute, nil)
+	for _, rtt := range []time.Duration{5 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond} {
+		flow.CalcSRTT(uint64(rtt), false)
+		flow.MaxRTT(uint64(rtt))
+		flow.MinRTT(uint64(rtt))
+		flow.Last = uint64(rtt)
+		flow.Sampled++
+	}
+	flow.RepSampled = 1
+	flow.LastTS = time.Now().UnixNano()
+	flows.Add("10.0.0.1:40000-10.0.0.2:443", flow)
+
+	policies, _ := newTrafficPolicies(nil)
+	r := &Client{
+		api:      NewAPIClient("http://127.0.0.1:0", "key"),
+		flows:    flows,
+		policies: policies,
+		sleep:    statsdSleep,
+		metrics:  enabledMetrics(nil),
+		enrich:   &EnrichmentPipeline{},
+		failures: make(map[string]*flowTally),
+		closes:   make(map[string]*flowTally),
+		chaos:    make(map[int]*chaosCheck),
+	}
+	r.reportFlows(0)
+
+	reported := make(map[string]float64)
+	for _, s := range r.api.pending {
+		reported[s.Metric] = s.Points[0][1]
+	}
+	for metric, expected := range map[string]float64{
+		metricPrefix + "rtt.min":     5,
+		metricPrefix + "rtt.max":     20,
+		metricPrefix + "rtt.samples": 2,
+	} {
+		if v, ok := reported[metric]; !ok || v != expected {
+			t.Errorf("Expected %s = %v, got %v", metric, expected, v)
+		}
+	}
+}
+
+func TestReportGoodput(t *testing.T) {
+	flows := NewFlowMap()
+	flow := NewTCPAccounting(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 40000, 443, time.Minute, nil)
+	for _, seq := range []uint32{1000, 1100, 1000, 1150} {
+		flow.TrackSeq(seq, 100)
+	}
+	flow.Rcvd.arrived(1, 100, 0, defaultReorderWindow)
+	flow.Rcvd.arrived(1, 100, 0, defaultReorderWindow)
+	flow.Sampled = 1
+	flow.LastTS = time.Now().UnixNano()
+	flows.Add("10.0.0.1:40000-10.0.0.2:443", flow)
+
+	policies, _ := newTrafficPolicies(nil)
+	r := &Client{
+		api:      NewAPIClient("http://127.0.0.1:0", "key"),
+		flows:    flows,
+		policies: policies,
+		sleep:    10,
+		metrics:  enabledMetrics(nil),
+		enrich:   &EnrichmentPipeline{},
+		failures: make(map[string]*flowTally),
+		closes:   make(map[string]*flowTally),
+		chaos:    make(map[int]*chaosCheck),
+	}
+	r.reportFlows(0)
+
+	reported := make(map[string]float64)
+	for _, s := range r.api.pending {
+		for _, tag := range s.Tags {
+			if strings.HasPrefix(tag, "direction:") {
+				reported[s.Metric+","+tag] = s.Points[0][1]
+			}
+		}
+	}
+	for metric, expected := range map[string]float64{
+		metricPrefix + "throughput,direction:sent":     40,
+		metricPrefix + "goodput,direction:sent":        25,
+		metricPrefix + "throughput,direction:received": 20,
+		metricPrefix + "goodput,direction:received":    10,
+	} {
+		if v, ok := reported[metric]; !ok || v != expected {
+			t.Errorf("Expected %s = %v, got %v", metric, expected, v)
+		}
+	}
+	if flow.RepSentBytes != 400 || flow.RepRcvd.Bytes != 200 {
+		t.Errorf("Expected bytes marked reported, got %d sent, %d received", flow.RepSentBytes, flow.RepRcvd.Bytes)
+	}
+}
+
+func TestIntervalSummary(t *testing.T) {
+	var s intervalSummary
+	s.flow("a", &TCPAccounting{SRTT: uint64(5 * time.Millisecond), Sampled: 4, RepSampled: 1})
+	s.flow("b", &TCPAccounting{SRTT: uint64(20 * time.Millisecond), Sampled: 2})
+	s.submission(nil)
+	s.submission(errors.New("unreachable"))
+	s.drop(7)
+
+	expected := `Interval summary: flows=3 reported=2 muted=1 samples=5 submitted=2 errors=1 dropped=7 top="b" top_rtt_ms=20.000`
+	if line := s.end(3, 1); line != expected {
+		t.Fatalf("Expected summary %q, got %q", expected, line)
+	}
+	if line := s.end(0, 0); !strings.Contains(line, "reported=0 muted=0 samples=0 submitted=0 errors=0 dropped=0") {
+		t.Errorf("Expected summary to reset every interval, got %q", line)
+	}
+}
+
+func TestReportLifecycle(t *testing.T) {
+	flows := NewFlowMap()
+	start := time.Now().UnixNano()
+	for _, f := range []struct {
+		sport layers.TCPPort
+		close string
+		secs  int64
+	}{
+		{40000, closeFIN, 5},
+		{40001, "", 10},
+		{40002, "", 20},
+	} {
+		flow := NewTCPAccounting(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), f.sport, 443, time.Minute, nil)
+		flow.SYN, flow.SYNACK, flow.FirstSeen = start, start+int64(time.Millisecond), start+int64(time.Millisecond)
+		flow.LastSeen = start + f.secs*int64(time.Second)
+		flow.Close = f.close
+		flows.Add(fmt.Sprintf("10.0.0.1:%d-10.0.0.2:443", f.sport), flow)
+	}
+
+	policies, _ := newTrafficPolicies(nil)
+	r := &Client{
+		api:      NewAPIClient("http://127.0.0.1:0", "key"),
+		flows:    flows,
+		policies: policies,
+		sleep:    statsdSleep,
+		metrics:  enabledMetrics(nil),
+		enrich:   &EnrichmentPipeline{},
+		failures: make(map[string]*flowTally),
+		closes:   make(map[string]*flowTally),
+		chaos:    make(map[int]*chaosCheck),
+	}
+	r.reportFlows(0)
+	r.reportExpired("10.0.0.1:40002-10.0.0.2:443")
+
+	durations := make(map[string]float64)
+	var open float64
+	for _, s := range r.api.pending {
+		switch s.Metric {
+		case metricPrefix + "connection.duration":
+			durations[s.Tags[2]] = s.Points[0][1]
+		case metricPrefix + "connections.open":
+			open = s.Points[0][1]
+		}
+	}
+	if len(durations) != 2 || durations["close:fin"] != 5 || durations["close:idle"] != 20 {
+		t.Errorf("Unexpected connection durations: %v", durations)
+	}
+	if open != 2 {
+		t.Errorf("Expected 2 open connections, got %v", open)
+	}
+}
+
+func TestReportAggregated(t *testing.T) {
+	flows := NewFlowMap()
+	for i, f := range []struct {
+		dst     string
+		srtt    time.Duration
+		sampled uint64
+	}{
+		{"8.8.8.8", 10 * time.Millisecond, 1},
+		{"1.1.1.1", 30 * time.Millisecond, 3},
+	} {
+		flow := NewTCPAccounting(net.ParseIP("10.0.0.1"), net.ParseIP(f.dst), layers.TCPPort(40000+i), 443, time.Minute, nil)
+		flow.External = true
+		flow.TrackSeq(1000, 100)
+		flow.SRTT, flow.Last = uint64(f.srtt), uint64(f.srtt)
+		flow.Min, flow.Max = uint64(f.srtt), uint64(f.srtt)
+		flow.Sampled = f.sampled
+		flow.LastTS = time.Now().UnixNano()
+		flows.Add(fmt.Sprintf("10.0.0.1:%d-%s:443", 40000+i, f.dst), flow)
+	}
+
+	policies, _ := newTrafficPolicies(&PolicyConfig{External: ClassPolicy{Aggregate: true}})
+	r := &Client{
+		api:      NewAPIClient("http://127.0.0.1:0", "key"),
+		flows:    flows,
+		policies: policies,
+		sleep:    10,
+		metrics:  enabledMetrics(nil),
+		enrich:   &EnrichmentPipeline{},
+		failures: make(map[string]*flowTally),
+		closes:   make(map[string]*flowTally),
+		chaos:    make(map[int]*chaosCheck),
+	}
+	r.reportFlows(0)
+
+	reported := make(map[string][]float64)
+	for _, s := range r.api.pending {
+		key := s.Metric
+		for _, tag := range s.Tags {
+			if strings.HasPrefix(tag, "direction:") {
+				key += "," + tag
+			}
+		}
+		reported[key] = append(reported[key], s.Points[0][1])
+	}
+	// one series for both flows, collapsed to dst:external.
+	for metric, expected := range map[string]float64{
+		metricPrefix + "rtt.avg":                   25,
+		metricPrefix + "rtt.min":                   10,
+		metricPrefix + "rtt.max":                   30,
+		metricPrefix + "rtt.samples":               4,
+		metricPrefix + "throughput,direction:sent": 20,
+	} {
+		if v := reported[metric]; len(v) != 1 || v[0] != expected {
+			t.Errorf("Expected %s = %v once, got %v", metric, expected, v)
+		}
+	}
+
+	// expiring, a collapsed flow isn't reported alone over the combined series.
+	r.api.pending = nil
+	for k := range flows.Map {
+		flow := flows.Map[k]
+		flow.Sampled++
+		r.reportExpired(k)
+	}
+	if len(r.api.pending) != 0 {
+		t.Errorf("Expected expired collapsed flows left to the interval report, got %d points", len(r.api.pending))
+	}
+}
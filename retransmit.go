@@ -0,0 +1,106 @@
+package main
+
+// seqSpace follows the sequence space covered by a flow's data segments in
+// one direction, to tell retransmissions apart.
+type seqSpace struct {
+	Next        uint32 // past the highest sequence number seen
+	Segments    uint64
+	Bytes       uint64 // payload, retransmissions included
+	Retransmits uint64
+	RetxBytes   uint64
+	OutOfOrder  uint64    // segments filling a gap sooner than a retransmission could
+	holes       []seqHole // gaps in what arrived, most recent last
+}
+
+// track accounts for a data segment, a retransmission if it doesn't extend
+// past what was seen already. Bytes are counted as retransmitted as far as
+// they cover it. Returns whether any were.
+func (s *seqSpace) track(seq, sz uint32) bool {
+	end := seq + sz
+	resent := false
+	switch {
+	case s.Segments == 0:
+		s.Next = end
+	case int32(end-s.Next) <= 0:
+		s.Retransmits++
+		s.RetxBytes += uint64(sz)
+		resent = true
+	default:
+		if int32(s.Next-seq) > 0 {
+			s.RetxBytes += uint64(s.Next - seq)
+			resent = true
+		}
+		s.Next = end
+	}
+	s.Segments++
+	s.Bytes += uint64(sz)
+	return resent
+}
+
+// forgetSent drops the send times of a retransmitted range: ACKs covering it
+// are ambiguous, they may be for either transmission, so it isn't sampled
+// (Karn's algorithm). Call holding the flow lock.
+func (t *TCPAccounting) forgetSent(seq, sz uint32) {
+	for k := range t.Timed {
+		if k.Seq-seq <= sz {
+			delete(t.Timed, k)
+		}
+	}
+}
+
+// reportLoss submits the loss indicators of the interval for the data sent
+// either way, tagged direction:sent (by Src) or direction:received: the per
+// second rates of segments and bytes retransmitted, the ratio of segments
+// retransmitted, the throughput (bytes per second, retransmissions included)
+// against the goodput (unique bytes per second) - the difference being the
+// bandwidth wasted on a lossy path - and counts of duplicate ACKs, their
+// bursts and (received data only) out-of-order arrivals. Call holding the
+// flow lock.
+func (r *Client) reportLoss(k string, flow *TCPAccounting, tags []string, ts int64, secs float64) {
+	sent := seqSpace{
+		Segments:    flow.Segments - flow.RepSegments,
+		Bytes:       flow.SentBytes - flow.RepSentBytes,
+		Retransmits: flow.Retransmits - flow.RepRetransmits,
+		RetxBytes:   flow.RetxBytes - flow.RepRetxBytes,
+	}
+	rcvd := seqSpace{
+		Segments:    flow.Rcvd.Segments - flow.RepRcvd.Segments,
+		Bytes:       flow.Rcvd.Bytes - flow.RepRcvd.Bytes,
+		Retransmits: flow.Rcvd.Retransmits - flow.RepRcvd.Retransmits,
+		RetxBytes:   flow.Rcvd.RetxBytes - flow.RepRcvd.RetxBytes,
+		OutOfOrder:  flow.Rcvd.OutOfOrder - flow.RepRcvd.OutOfOrder,
+	}
+	for _, dir := range []struct {
+		tag   string
+		space seqSpace
+		dups  dupAcks
+	}{
+		{"direction:sent", sent, dupAcks{Count: flow.DupAcks.Count - flow.RepDupAcks.Count, Bursts: flow.DupAcks.Bursts - flow.RepDupAcks.Bursts}},
+		{"direction:received", rcvd, dupAcks{Count: flow.RcvdDupAcks.Count - flow.RepRcvdDupAcks.Count, Bursts: flow.RcvdDupAcks.Bursts - flow.RepRcvdDupAcks.Bursts}},
+	} {
+		if dir.space.Segments == 0 && dir.dups.Count == 0 {
+			continue
+		}
+		dtags := append(append([]string(nil), tags...), dir.tag)
+		if dir.space.Segments > 0 {
+			r.submitSpace(k, dir.space, dtags, ts, secs)
+		}
+		if dir.dups.Count > 0 {
+			r.submit(k, metricPrefix+"dup_acks", float64(dir.dups.Count), dtags, false, ts)
+			r.submit(k, metricPrefix+"dup_ack_bursts", float64(dir.dups.Bursts), dtags, false, ts)
+		}
+		if dir.space.OutOfOrder > 0 {
+			r.submit(k, metricPrefix+"out_of_order", float64(dir.space.OutOfOrder), dtags, false, ts)
+		}
+	}
+}
+
+// submitSpace submits the retransmissions and throughput of a direction,
+// sent over the interval, per second.
+func (r *Client) submitSpace(k string, space seqSpace, tags []string, ts int64, secs float64) {
+	r.submit(k, metricPrefix+"retransmits", float64(space.Retransmits)/secs, tags, false, ts)
+	r.submit(k, metricPrefix+"retransmit_bytes", float64(space.RetxBytes)/secs, tags, false, ts)
+	r.submit(k, metricPrefix+"retransmit_rate", float64(space.Retransmits)/float64(space.Segments), tags, false, ts)
+	r.submit(k, metricPrefix+"throughput", float64(space.Bytes)/secs, tags, false, ts)
+	r.submit(k, metricPrefix+"goodput", float64(space.Bytes-space.RetxBytes)/secs, tags, false, ts)
+}
@@ -0,0 +1,71 @@
+package main
+
+// sackLoss estimates the loss of one end's data from the SACK blocks the
+// other end acknowledges it with (RFC 2018): the gaps below the data SACKed
+// are holes, segments lost or still on their way.
+type sackLoss struct {
+	high      uint32 // right edge of the data SACKed so far...
+	recovery  bool   // ...until acknowledged
+	Acks      uint64 // ACKs carrying SACK blocks
+	Holes     uint64 // gaps revealed, counted once
+	HoleBytes uint64
+}
+
+// track accounts for an ACK, with the SACK blocks among its options. D-SACK
+// blocks (RFC 2883), below the acknowledgment number, are ignored.
+func (s *sackLoss) track(ack uint32, o *tcpOptions) {
+	if s.recovery && int32(ack-s.high) >= 0 {
+		s.recovery = false
+	}
+	if o.SACKs == 0 {
+		return
+	}
+	s.Acks++
+
+	// blocks come most recent first, walk them in sequence order.
+	blocks := o.SACK
+	n := o.SACKs
+	for i := 1; i < n; i++ {
+		for j := i; j > 0 && int32(blocks[j].left-blocks[j-1].left) < 0; j-- {
+			blocks[j], blocks[j-1] = blocks[j-1], blocks[j]
+		}
+	}
+	edge := ack
+	if s.recovery && int32(s.high-ack) > 0 {
+		edge = s.high
+	}
+	for _, b := range blocks[:n] {
+		if int32(b.right-edge) <= 0 {
+			continue
+		}
+		if gap := b.left - edge; int32(gap) > 0 {
+			s.Holes++
+			s.HoleBytes += uint64(gap)
+		}
+		edge = b.right
+	}
+	if int32(edge-ack) > 0 {
+		s.high, s.recovery = edge, true
+	}
+}
+
+// reportSACK submits the holes SACK blocks revealed over the interval,
+// tagged direction:sent for Src's data (Dst's SACKs) and direction:received
+// for Dst's. Only flows with holes are reported. Call holding the flow lock.
+func (r *Client) reportSACK(k string, flow *TCPAccounting, tags []string, ts int64) {
+	for _, dir := range []struct {
+		tag      string
+		cur, rep sackLoss
+	}{
+		{"direction:sent", flow.SACK, flow.RepSACK},
+		{"direction:received", flow.RcvdSACK, flow.RepRcvdSACK},
+	} {
+		holes := dir.cur.Holes - dir.rep.Holes
+		if holes == 0 {
+			continue
+		}
+		dtags := append(append([]string(nil), tags...), dir.tag)
+		r.submit(k, metricPrefix+"sack.holes", float64(holes), dtags, false, ts)
+		r.submit(k, metricPrefix+"sack.hole_bytes", float64(dir.cur.HoleBytes-dir.rep.HoleBytes), dtags, false, ts)
+	}
+}
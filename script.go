@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	scriptMetricPrefix   = metricPrefix + "script."
+	defaultScriptTimeout = 5000 // ms
+)
+
+// ScriptConfig hooks a user-provided analyzer to the flows reported every
+// interval, for site-specific metrics: any program - eg. a WASM runtime or a
+// Lua interpreter running the analyzer - reading the flows as JSON lines on
+// its stdin and writing the metrics it derives, likewise, to its stdout.
+//
+// They see the flow summaries as reported: analyzers looking into packets are
+// embedded hooks instead, see HookConfig.
+type ScriptConfig struct {
+	Command []string `yaml:"command"` // program and arguments
+	Metrics []string `yaml:"metrics"` // it may emit, as system.net.tcp.script.<metric>
+	Timeout int      `yaml:"timeout"` // ms to wait for it every interval
+}
+
+func (c *ScriptConfig) validate() error {
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return errors.New("Error parsing configuration - script analyzers require a command.")
+	}
+	if len(c.Metrics) == 0 {
+		return fmt.Errorf("Error parsing configuration - script analyzer %q declares no metrics.", c.Command[0])
+	}
+	for _, m := range c.Metrics {
+		if m == "" || strings.Trim(m, metricNameChars) != "" {
+			return fmt.Errorf("Error parsing configuration - bad script analyzer metric %q, expected lowercase letters, digits, _ and dots.", m)
+		}
+	}
+	if c.Timeout < 0 {
+		return errors.New("Error parsing configuration - script analyzer timeout must be positive.")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultScriptTimeout
+	}
+	return nil
+}
+
+// scriptEvent is a flow reported over the interval, as fed to analyzers.
+// Counters are since the last interval, times in milliseconds.
+type scriptEvent struct {
+	Flow            string   `json:"flow"`
+	Src             string   `json:"src"`
+	Dst             string   `json:"dst"`
+	Sport           uint16   `json:"sport"`
+	Dport           uint16   `json:"dport"`
+	Client          bool     `json:"client"`
+	RTT             float64  `json:"rtt"`
+	RTTAvg          float64  `json:"rtt_avg"`
+	Jitter          float64  `json:"jitter"`
+	Samples         uint64   `json:"samples"`
+	PacketsSent     uint64   `json:"packets_sent"`
+	PacketsReceived uint64   `json:"packets_received"`
+	Retransmits     uint64   `json:"retransmits"`
+	Bytes           uint64   `json:"bytes"` // over the flow's lifetime
+	Tags            []string `json:"tags"`
+}
+
+func newScriptEvent(k string, flow *TCPAccounting, tags []string) scriptEvent {
+	return scriptEvent{
+		Flow:            k,
+		Src:             flow.Src.String(),
+		Dst:             flow.Dst.String(),
+		Sport:           uint16(flow.Sport),
+		Dport:           uint16(flow.Dport),
+		Client:          flow.Client,
+		RTT:             nsToMs(flow.Last),
+		RTTAvg:          nsToMs(flow.SRTT),
+		Jitter:          nsToMs(flow.Jitter),
+		Samples:         flow.Sampled - flow.RepSampled,
+		PacketsSent:     flow.Segments - flow.RepSegments,
+		PacketsReceived: flow.Rcvd.Segments - flow.RepRcvd.Segments,
+		Retransmits:     flow.Retransmits - flow.RepRetransmits,
+		Bytes:           flow.Bytes,
+		Tags:            tags,
+	}
+}
+
+// scriptMetric is a metric emitted by an analyzer. Those of a flow are
+// tagged like it, plus their own tags.
+type scriptMetric struct {
+	Metric string   `json:"metric"`
+	Value  float64  `json:"value"`
+	Flow   string   `json:"flow"`
+	Tags   []string `json:"tags"`
+}
+
+type scriptAnalyzer struct {
+	cfg     ScriptConfig
+	metrics map[string]bool
+}
+
+func newScriptAnalyzer(cfg ScriptConfig) *scriptAnalyzer {
+	s := &scriptAnalyzer{cfg: cfg, metrics: make(map[string]bool)}
+	for _, m := range cfg.Metrics {
+		s.metrics[scriptMetricPrefix+m] = true
+	}
+	return s
+}
+
+// run feeds the analyzer the events, returning the metrics it emitted.
+func (s *scriptAnalyzer) run(events []scriptEvent) ([]scriptMetric, error) {
+	var in, out bytes.Buffer
+	enc := json.NewEncoder(&in)
+	for i := range events {
+		enc.Encode(&events[i])
+	}
+
+	cmd := exec.Command(s.cfg.Command[0], s.cfg.Command[1:]...)
+	cmd.Stdin, cmd.Stdout = &in, &out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.cfg.Command[0], err)
+		}
+	case <-time.After(time.Duration(s.cfg.Timeout) * time.Millisecond):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("%s timed out", s.cfg.Command[0])
+	}
+
+	var metrics []scriptMetric
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var m scriptMetric
+		if err := json.Unmarshal(line, &m); err != nil {
+			log.Warnf("Ignoring bad output of script analyzer %s: %q", s.cfg.Command[0], line)
+			continue
+		}
+		m.Metric = scriptMetricPrefix + m.Metric
+		if !s.metrics[m.Metric] {
+			log.Warnf("Ignoring undeclared metric %s of script analyzer %s.", m.Metric, s.cfg.Command[0])
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// reportScripts runs the script analyzers over the flows reported in the
+// interval, submitting what they emit.
+func (r *Client) reportScripts(events []scriptEvent, ts int64) {
+	if len(r.scripts) == 0 || len(events) == 0 {
+		return
+	}
+	tags := make(map[string][]string, len(events))
+	for _, e := range events {
+		tags[e.Flow] = e.Tags
+	}
+	for _, s := range r.scripts {
+		metrics, err := s.run(events)
+		if err != nil {
+			log.Warnf("Script analyzer failed: %v", err)
+			continue
+		}
+		for _, m := range metrics {
+			mtags := r.tags
+			if m.Flow != "" {
+				ftags, ok := tags[m.Flow]
+				if !ok {
+					log.Warnf("Ignoring metric %s of script analyzer %s for unknown flow %q.", m.Metric, s.cfg.Command[0], m.Flow)
+					continue
+				}
+				mtags = ftags
+			}
+			r.submit(m.Flow, m.Metric, m.Value, append(mtags[:len(mtags):len(mtags)], m.Tags...), false, ts)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestScriptAnalyzer(t *testing.T) {
+	cfg := ScriptConfig{
+		Command: []string{"sh", "-c", `read flow && echo "$flow" | grep -q '"dport":443' && echo '{"metric":"tier","value":2,"flow":"k1","tags":["tier:gold"]}' && echo garbage && echo '{"metric":"undeclared","value":1}'`},
+		Metrics: []string{"tier"},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Unexpected error validating script analyzer: %v", err)
+	}
+
+	flow := &TCPAccounting{Src: net.ParseIP("2001:db8::1"), Dst: net.ParseIP("2001:db8::2"), Sport: 40000, Dport: 443}
+	metrics, err := newScriptAnalyzer(cfg).run([]scriptEvent{newScriptEvent("k1", flow, []string{"dst:b"})})
+	if err != nil {
+		t.Fatalf("Unexpected error running script analyzer: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].Metric != scriptMetricPrefix+"tier" || metrics[0].Value != 2 || metrics[0].Flow != "k1" {
+		t.Fatalf("Unexpected metrics: %+v", metrics)
+	}
+
+	cfg = ScriptConfig{Command: []string{"sleep", "5"}, Metrics: []string{"tier"}, Timeout: 50}
+	if _, err := newScriptAnalyzer(cfg).run(nil); err == nil {
+		t.Errorf("Expected slow script analyzer to time out")
+	}
+
+	for _, cfg := range []ScriptConfig{{Metrics: []string{"tier"}}, {Command: []string{"true"}}, {Command: []string{"true"}, Metrics: []string{"Tier"}}} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
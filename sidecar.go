@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	sidecarMetricPrefix = metricPrefix + "sidecar."
+	defaultSidecarQueue = 10000
+	sidecarBatches      = 16   // recent batches analyzers may still answer
+	sidecarConnQueue    = 4096 // events queued per analyzer before dropping
+	sidecarWriteTimeout = time.Second
+)
+
+// SidecarConfig opens a socket external analyzer processes connect to, for
+// heavyweight analysis out of the probe. The protocol is JSON, one message
+// per line. Analyzers subscribe to the events they want, at any time:
+//
+//	{"subscribe": {"flows": true, "packets": true, "ports": [5432], "payload": 64}}
+//
+// Until they do, they get flow events only. Flow events are every instance's
+// flows as they're reported, in batches, flows as fed to script analyzers:
+//
+//	{"batch": 12, "source": 1, "ts": 1700000000, "flows": [<flow>, ...]}
+//
+// Packet events are the TCP segments of the flows, to or from the subscribed
+// ports (all if none), with as many payload bytes as subscribed (base64):
+//
+//	{"packet": {"source": 1, "flow": "<key>", "ts": <ns>, "outbound": true, "sport": 40000,
+//	  "dport": 5432, "seq": 1, "ack": 1, "flags": "PA", "window": 502, "len": 13, "payload": "UQAAAA=="}}
+//
+// Analyzers lagging behind are dropped events, rather than stalling capture.
+// They answer with metrics, likewise one per line and at any time, reported
+// as system.net.tcp.sidecar.<metric>:
+//
+//	{"batch": 12, "metric": "tier", "value": 2, "flow": "<key>", "tags": ["tier:gold"]}
+//	{"source": 1, "metric": "queries", "value": 1, "flow": "<key>"}
+//
+// Those naming a flow of the batch, or of a recent batch of the source, are
+// tagged like it, the others with the instance tags.
+type SidecarConfig struct {
+	Listen string `yaml:"listen"` // host:port, or the path of a unix socket
+	Queue  int    `yaml:"queue"`  // metrics held per instance until reported
+}
+
+func (c *SidecarConfig) validate() error {
+	if c.Listen == "" {
+		return errors.New("Error parsing configuration - analyzer_sidecar requires a listen address.")
+	}
+	if c.Queue < 0 {
+		return errors.New("Error parsing configuration - analyzer_sidecar queue must be positive.")
+	}
+	if c.Queue == 0 {
+		c.Queue = defaultSidecarQueue
+	}
+	return nil
+}
+
+type sidecarBatch struct {
+	ID     uint64        `json:"batch"`
+	Source uint64        `json:"source"`
+	TS     int64         `json:"ts"`
+	Flows  []scriptEvent `json:"flows"`
+}
+
+type sidecarPacket struct {
+	Source   uint64 `json:"source"`
+	Flow     string `json:"flow"`
+	TS       int64  `json:"ts"`
+	Outbound bool   `json:"outbound"`
+	Sport    uint16 `json:"sport"`
+	Dport    uint16 `json:"dport"`
+	Seq      uint32 `json:"seq"`
+	Ack      uint32 `json:"ack"`
+	Flags    string `json:"flags"`
+	Window   uint16 `json:"window"`
+	Len      uint32 `json:"len"` // of the payload, as per the IP headers
+	Payload  []byte `json:"payload,omitempty"`
+}
+
+// sidecarSubscription selects the events streamed to an analyzer.
+type sidecarSubscription struct {
+	Flows   bool     `json:"flows"`
+	Packets bool     `json:"packets"`
+	Ports   []uint16 `json:"ports"`   // packets to or from these only, all if none
+	Payload int      `json:"payload"` // bytes of packet payloads
+}
+
+func (s *sidecarSubscription) packet(tcp *layers.TCP) bool {
+	if !s.Packets {
+		return false
+	}
+	for _, p := range s.Ports {
+		if layers.TCPPort(p) == tcp.SrcPort || layers.TCPPort(p) == tcp.DstPort {
+			return true
+		}
+	}
+	return len(s.Ports) == 0
+}
+
+type sidecarMetric struct {
+	Batch  uint64 `json:"batch"`
+	Source uint64 `json:"source"`
+	scriptMetric
+}
+
+// sidecarMessage is a line read off an analyzer: a subscription, or a metric.
+type sidecarMessage struct {
+	Subscribe *sidecarSubscription `json:"subscribe"`
+	sidecarMetric
+}
+
+// sidecarBatchRef routes answers to a batch back to its reporter.
+type sidecarBatchRef struct {
+	id   uint64
+	r    *Client
+	tags map[string][]string // by flow
+}
+
+// sidecarConn is a connected analyzer. Lines are written to it off the out
+// queue, so neither reporters nor sniffers wait on it.
+type sidecarConn struct {
+	net.Conn
+	out     chan []byte
+	sub     sidecarSubscription
+	dropped int // events since last logged
+}
+
+// send queues a line, dropping it if the analyzer lags. Call holding the hub
+// lock.
+func (c *sidecarConn) send(line []byte) {
+	select {
+	case c.out <- line:
+	default:
+		c.dropped++
+	}
+}
+
+// sidecarHub serves the connected analyzers.
+type sidecarHub struct {
+	sync.Mutex
+	cfg        SidecarConfig
+	listener   net.Listener
+	conns      map[*sidecarConn]bool
+	packetSubs int32 // analyzers subscribed to packets, read atomically
+	next       uint64
+	batches    []sidecarBatchRef // most recent last
+	nextSource uint64
+	sources    map[*Client]uint64
+	reporters  map[uint64]*Client // by source
+	inboxes    map[*Client][]scriptMetric
+	dropped    map[*Client]int
+}
+
+// sidecars is the process-wide hub, nil unless configured.
+var sidecars *sidecarHub
+
+func newSidecarHub(cfg SidecarConfig) (*sidecarHub, error) {
+	network := "tcp"
+	if strings.Contains(cfg.Listen, "/") {
+		network = "unix"
+	}
+	l, err := net.Listen(network, cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	h := &sidecarHub{
+		cfg:       cfg,
+		listener:  l,
+		conns:     make(map[*sidecarConn]bool),
+		sources:   make(map[*Client]uint64),
+		reporters: make(map[uint64]*Client),
+		inboxes:   make(map[*Client][]scriptMetric),
+		dropped:   make(map[*Client]int),
+	}
+	go h.accept()
+	log.Infof("Analyzer sidecar socket listening on %s", l.Addr())
+	return h, nil
+}
+
+func (h *sidecarHub) Stop() error {
+	if h == nil {
+		return nil
+	}
+	err := h.listener.Close()
+	h.Lock()
+	for c := range h.conns {
+		// serve drops it.
+		c.Close()
+	}
+	h.Unlock()
+	return err
+}
+
+func (h *sidecarHub) accept() {
+	for {
+		nc, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+		log.Infof("Analyzer connected from %s", nc.RemoteAddr())
+		c := &sidecarConn{Conn: nc, out: make(chan []byte, sidecarConnQueue), sub: sidecarSubscription{Flows: true}}
+		h.Lock()
+		h.conns[c] = true
+		h.Unlock()
+		go h.write(c)
+		go h.serve(c)
+	}
+}
+
+// write streams the queued events to an analyzer. Those too slow to read
+// them are disconnected.
+func (h *sidecarHub) write(c *sidecarConn) {
+	for line := range c.out {
+		c.SetWriteDeadline(time.Now().Add(sidecarWriteTimeout))
+		if _, err := c.Write(line); err != nil {
+			log.Warnf("Unable to stream events to analyzer %s, disconnecting: %v", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+	}
+}
+
+// serve reads an analyzer's subscriptions and metrics until it disconnects.
+func (h *sidecarHub) serve(c *sidecarConn) {
+	defer h.drop(c)
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		var m sidecarMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Warnf("Ignoring bad message of analyzer %s: %q", c.RemoteAddr(), scanner.Bytes())
+			continue
+		}
+		if m.Subscribe != nil {
+			h.subscribe(c, *m.Subscribe)
+			continue
+		}
+		if m.Metric == "" || strings.Trim(m.Metric, metricNameChars) != "" {
+			log.Warnf("Ignoring bad metric name %q of analyzer %s.", m.Metric, c.RemoteAddr())
+			continue
+		}
+		h.add(m.sidecarMetric)
+	}
+}
+
+func (h *sidecarHub) subscribe(c *sidecarConn, sub sidecarSubscription) {
+	if sub.Payload < 0 {
+		sub.Payload = 0
+	}
+	log.Infof("Analyzer %s subscribed to: %+v", c.RemoteAddr(), sub)
+	h.Lock()
+	defer h.Unlock()
+	c.sub = sub
+	h.countPacketSubs()
+}
+
+// countPacketSubs updates the count of analyzers subscribed to packets, that
+// spares sniffers the hub lock while there's none. Call holding the lock.
+func (h *sidecarHub) countPacketSubs() {
+	var n int32
+	for c := range h.conns {
+		if c.sub.Packets {
+			n++
+		}
+	}
+	atomic.StoreInt32(&h.packetSubs, n)
+}
+
+func (h *sidecarHub) drop(c *sidecarConn) {
+	h.Lock()
+	delete(h.conns, c)
+	close(c.out)
+	h.countPacketSubs()
+	h.Unlock()
+	c.Close()
+	log.Infof("Analyzer %s disconnected", c.RemoteAddr())
+}
+
+// source returns the id of a reporter's events. Call holding the lock.
+func (h *sidecarHub) source(r *Client) uint64 {
+	id, ok := h.sources[r]
+	if !ok {
+		h.nextSource++
+		id = h.nextSource
+		h.sources[r], h.reporters[id] = id, r
+	}
+	return id
+}
+
+// add queues an answer for the reporter of its batch or source.
+func (h *sidecarHub) add(m sidecarMetric) {
+	h.Lock()
+	defer h.Unlock()
+	if m.Batch == 0 && m.Source != 0 {
+		r, ok := h.reporters[m.Source]
+		if !ok {
+			log.Debugf("Ignoring sidecar metric %s for unknown source %d.", m.Metric, m.Source)
+			return
+		}
+		tags := r.tags
+		// tagged like the flow when last reported, if it was yet.
+		for i := len(h.batches) - 1; i >= 0 && m.Flow != ""; i-- {
+			if ftags, ok := h.batches[i].tags[m.Flow]; ok && h.batches[i].r == r {
+				tags = ftags
+				break
+			}
+		}
+		h.queue(r, m, tags)
+		return
+	}
+	for _, b := range h.batches {
+		if b.id != m.Batch {
+			continue
+		}
+		tags := b.r.tags
+		if m.Flow != "" {
+			var ok bool
+			if tags, ok = b.tags[m.Flow]; !ok {
+				log.Warnf("Ignoring sidecar metric %s for unknown flow %q.", m.Metric, m.Flow)
+				return
+			}
+		}
+		h.queue(b.r, m, tags)
+		return
+	}
+	log.Debugf("Ignoring sidecar metric %s for expired batch %d.", m.Metric, m.Batch)
+}
+
+// queue holds a metric until its reporter drains it. Call holding the lock.
+func (h *sidecarHub) queue(r *Client, m sidecarMetric, tags []string) {
+	if len(h.inboxes[r]) >= h.cfg.Queue {
+		h.dropped[r]++
+		return
+	}
+	m.Metric = sidecarMetricPrefix + m.Metric
+	m.Tags = append(tags[:len(tags):len(tags)], m.Tags...)
+	h.inboxes[r] = append(h.inboxes[r], m.scriptMetric)
+}
+
+// Publish streams a reporter's flows to the analyzers subscribed to them.
+func (h *sidecarHub) Publish(r *Client, events []scriptEvent, ts int64) {
+	if h == nil || len(events) == 0 {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.next++
+	ref := sidecarBatchRef{id: h.next, r: r, tags: make(map[string][]string, len(events))}
+	for _, e := range events {
+		ref.tags[e.Flow] = e.Tags
+	}
+	if h.batches = append(h.batches, ref); len(h.batches) > sidecarBatches {
+		h.batches = h.batches[1:]
+	}
+
+	line, err := json.Marshal(sidecarBatch{ID: ref.id, Source: h.source(r), TS: ts, Flows: events})
+	if err != nil {
+		log.Errorf("Unable to encode sidecar batch: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	for c := range h.conns {
+		if c.dropped > 0 {
+			log.Warnf("Dropped %d events for analyzer %s, not reading fast enough.", c.dropped, c.RemoteAddr())
+			c.dropped = 0
+		}
+		if c.sub.Flows {
+			c.send(line)
+		}
+	}
+}
+
+// Packet streams a TCP segment of a reporter's flow to the analyzers
+// subscribed to it. It's called for every segment captured: cheap unless
+// analyzers subscribed to packets, and never blocking.
+func (h *sidecarHub) Packet(r *Client, flow string, ts int64, tcp *layers.TCP, outbound bool, size uint32) {
+	if h == nil || atomic.LoadInt32(&h.packetSubs) == 0 {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	p := sidecarPacket{
+		Source:   h.source(r),
+		Flow:     flow,
+		TS:       ts,
+		Outbound: outbound,
+		Sport:    uint16(tcp.SrcPort),
+		Dport:    uint16(tcp.DstPort),
+		Seq:      tcp.Seq,
+		Ack:      tcp.Ack,
+		Flags:    tcpFlags(tcp),
+		Window:   tcp.Window,
+		Len:      size,
+	}
+	for c := range h.conns {
+		if !c.sub.packet(tcp) {
+			continue
+		}
+		p.Payload = tcp.Payload
+		if len(p.Payload) > c.sub.Payload {
+			p.Payload = p.Payload[:c.sub.Payload]
+		}
+		line, err := json.Marshal(struct {
+			Packet *sidecarPacket `json:"packet"`
+		}{&p})
+		if err != nil {
+			continue
+		}
+		c.send(append(line, '\n'))
+	}
+}
+
+// tcpFlags spells a segment's flags, eg. "SA" for a SYN-ACK.
+func tcpFlags(tcp *layers.TCP) string {
+	var b []byte
+	for _, f := range []struct {
+		set bool
+		c   byte
+	}{{tcp.SYN, 'S'}, {tcp.FIN, 'F'}, {tcp.RST, 'R'}, {tcp.PSH, 'P'}, {tcp.ACK, 'A'}, {tcp.URG, 'U'}, {tcp.ECE, 'E'}, {tcp.CWR, 'W'}} {
+		if f.set {
+			b = append(b, f.c)
+		}
+	}
+	return string(b)
+}
+
+// Drain returns the metrics answered for a reporter since last drained, and
+// how many were dropped off a full queue.
+func (h *sidecarHub) Drain(r *Client) ([]scriptMetric, int) {
+	if h == nil {
+		return nil, 0
+	}
+	h.Lock()
+	defer h.Unlock()
+	metrics, dropped := h.inboxes[r], h.dropped[r]
+	delete(h.inboxes, r)
+	delete(h.dropped, r)
+	return metrics, dropped
+}
+
+// Forget drops a reporter's batches and answers, eg. as it stops.
+func (h *sidecarHub) Forget(r *Client) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	batches := h.batches[:0]
+	for _, b := range h.batches {
+		if b.r != r {
+			batches = append(batches, b)
+		}
+	}
+	h.batches = batches
+	delete(h.reporters, h.sources[r])
+	delete(h.sources, r)
+	delete(h.inboxes, r)
+	delete(h.dropped, r)
+}
+
+// reportSidecar submits what analyzers answered over the interval, then
+// streams them the flows reported in it.
+func (r *Client) reportSidecar(events []scriptEvent, ts int64) {
+	if r.sidecar == nil {
+		return
+	}
+	metrics, dropped := r.sidecar.Drain(r)
+	if dropped > 0 {
+		log.Warnf("Dropped %d sidecar metrics, queue full.", dropped)
+	}
+	for _, m := range metrics {
+		r.submit(m.Flow, m.Metric, m.Value, m.Tags, false, ts)
+	}
+	r.sidecar.Publish(r, events, ts)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestSidecarHub(t *testing.T) {
+	cfg := SidecarConfig{Listen: "127.0.0.1:0"}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Unexpected error validating sidecar: %v", err)
+	}
+	h, err := newSidecarHub(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error opening sidecar socket: %v", err)
+	}
+	defer h.Stop()
+
+	c, err := net.Dial("tcp", h.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error connecting analyzer: %v", err)
+	}
+	defer c.Close()
+	for i := 0; ; i++ {
+		h.Lock()
+		n := len(h.conns)
+		h.Unlock()
+		if n == 1 {
+			break
+		} else if i == 100 {
+			t.Fatalf("Analyzer connection never accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r := &Client{tags: []string{"iface:eth0"}}
+	h.Publish(r, []scriptEvent{{Flow: "k1", Dport: 443, Tags: []string{"dst:b"}}}, 1700000000)
+
+	var batch sidecarBatch
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil || json.Unmarshal(line, &batch) != nil {
+		t.Fatalf("Unexpected batch %q: %v", line, err)
+	}
+	if batch.TS != 1700000000 || len(batch.Flows) != 1 || batch.Flows[0].Dport != 443 {
+		t.Fatalf("Unexpected batch: %+v", batch)
+	}
+
+	fmt.Fprintf(c, `{"batch":%d,"metric":"tier","value":2,"flow":"k1","tags":["tier:gold"]}`+"\n", batch.ID)
+	fmt.Fprintf(c, `{"batch":%d,"metric":"events","value":5}`+"\n", batch.ID)
+	fmt.Fprintf(c, `{"batch":%d,"metric":"tier","value":1,"flow":"k2"}`+"\n", batch.ID)
+	fmt.Fprintf(c, `{"batch":%d,"metric":"Bad Name","value":1}`+"\n", batch.ID)
+	fmt.Fprintf(c, `{"batch":%d,"metric":"late","value":1}`+"\n", batch.ID+1)
+
+	var metrics []scriptMetric
+	for i := 0; i < 100 && len(metrics) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		m, _ := h.Drain(r)
+		metrics = append(metrics, m...)
+	}
+	time.Sleep(20 * time.Millisecond)
+	m, _ := h.Drain(r)
+	if metrics = append(metrics, m...); len(metrics) != 2 {
+		t.Fatalf("Unexpected metrics: %+v", metrics)
+	}
+	if metrics[0].Metric != sidecarMetricPrefix+"tier" || len(metrics[0].Tags) != 2 || metrics[0].Tags[1] != "tier:gold" {
+		t.Errorf("Expected flow metric tagged like its flow, got %+v", metrics[0])
+	}
+	if metrics[1].Metric != sidecarMetricPrefix+"events" || len(metrics[1].Tags) != 1 || metrics[1].Tags[0] != "iface:eth0" {
+		t.Errorf("Expected metric tagged like the instance, got %+v", metrics[1])
+	}
+}
+
+func TestSidecarMetricsWanted(t *testing.T) {
+	r := &Client{metrics: enabledMetrics(nil)}
+	n := len(r.metrics)
+	if !r.wanted(sidecarMetricPrefix + "tier") {
+		t.Errorf("Expected sidecar metrics wanted")
+	}
+	if r.wanted(metricPrefix + "unknown") {
+		t.Errorf("Expected unknown metrics unwanted")
+	}
+	if len(r.metrics) != n {
+		t.Errorf("Expected enabled metrics left untouched")
+	}
+}
+
+func TestSidecarPackets(t *testing.T) {
+	h, err := newSidecarHub(SidecarConfig{Listen: "127.0.0.1:0", Queue: 10})
+	if err != nil {
+		t.Fatalf("Unexpected error opening sidecar socket: %v", err)
+	}
+	defer h.Stop()
+
+	c, err := net.Dial("tcp", h.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error connecting analyzer: %v", err)
+	}
+	defer c.Close()
+	fmt.Fprintln(c, `{"subscribe":{"packets":true,"ports":[5432],"payload":4}}`)
+	for i := 0; atomic.LoadInt32(&h.packetSubs) != 1; i++ {
+		if i == 100 {
+			t.Fatalf("Analyzer never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r := &Client{tags: []string{"iface:eth0"}}
+	h.Publish(r, []scriptEvent{{Flow: "k1", Dport: 5432, Tags: []string{"dst:db"}}}, 1700000000)
+	web := &layers.TCP{SrcPort: 40001, DstPort: 80, ACK: true}
+	h.Packet(r, "k2", 1, web, true, 0)
+	query := &layers.TCP{SrcPort: 40000, DstPort: 5432, Seq: 7, PSH: true, ACK: true}
+	query.Payload = []byte("Q\x00\x00\x00\x0dselect 1")
+	h.Packet(r, "k1", 2, query, true, uint32(len(query.Payload)))
+
+	// neither the flows, nor packets of other ports.
+	var event struct {
+		Batch  *sidecarBatch  `json:"batch"`
+		Packet *sidecarPacket `json:"packet"`
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil || json.Unmarshal(line, &event) != nil || event.Packet == nil {
+		t.Fatalf("Unexpected event %q: %v", line, err)
+	}
+	p := event.Packet
+	if p.Flow != "k1" || p.Dport != 5432 || p.Seq != 7 || p.Flags != "PA" || p.Len != 13 || string(p.Payload) != "Q\x00\x00\x00" || !p.Outbound {
+		t.Fatalf("Unexpected packet: %+v", p)
+	}
+
+	fmt.Fprintf(c, `{"source":%d,"metric":"queries","value":1,"flow":"k1"}`+"\n", p.Source)
+	fmt.Fprintf(c, `{"source":%d,"metric":"queries","value":1,"flow":"k3"}`+"\n", p.Source)
+	fmt.Fprintf(c, `{"source":%d,"metric":"queries","value":1}`+"\n", p.Source+1)
+	var metrics []scriptMetric
+	for i := 0; i < 100 && len(metrics) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		m, _ := h.Drain(r)
+		metrics = append(metrics, m...)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Unexpected metrics: %+v", metrics)
+	}
+	if metrics[0].Flow != "k1" || len(metrics[0].Tags) != 1 || metrics[0].Tags[0] != "dst:db" {
+		t.Errorf("Expected metric tagged like its flow was reported, got %+v", metrics[0])
+	}
+	if metrics[1].Flow != "k3" || len(metrics[1].Tags) != 1 || metrics[1].Tags[0] != "iface:eth0" {
+		t.Errorf("Expected metric of a flow not reported yet tagged like the instance, got %+v", metrics[1])
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	smoothMean    = "mean"    // cumulative average of all samples
+	smoothEWMA    = "ewma"    // exponentially weighted, by alpha
+	smoothRFC3550 = "rfc3550" // interarrival jitter, gain 1/16
+	smoothRFC6298 = "rfc6298" // RTTVAR, by beta
+
+	defaultSmoothAlpha = 0.125
+	defaultSmoothBeta  = 0.25
+)
+
+// SmoothingConfig selects how RTT samples are smoothed into the reported
+// rtt.avg and rtt.jitter. By default both are the mean of all samples.
+type SmoothingConfig struct {
+	SRTT   string  `yaml:"srtt"`   // mean or ewma
+	Alpha  float64 `yaml:"alpha"`  // ewma gain of new samples
+	Jitter string  `yaml:"jitter"` // mean, ewma, rfc3550 or rfc6298
+	Beta   float64 `yaml:"beta"`   // rfc6298 gain of new deviations
+}
+
+func (c *SmoothingConfig) validate() error {
+	switch c.SRTT {
+	case "":
+		c.SRTT = smoothMean
+	case smoothMean, smoothEWMA:
+	default:
+		return fmt.Errorf("Error parsing configuration - unknown smoothing srtt %q, expected mean or ewma.", c.SRTT)
+	}
+	switch c.Jitter {
+	case "":
+		c.Jitter = smoothMean
+	case smoothMean, smoothEWMA, smoothRFC3550, smoothRFC6298:
+	default:
+		return fmt.Errorf("Error parsing configuration - unknown smoothing jitter %q, expected mean, ewma, rfc3550 or rfc6298.", c.Jitter)
+	}
+	if c.Alpha < 0 || c.Alpha > 1 || c.Beta < 0 || c.Beta > 1 {
+		return errors.New("Error parsing configuration - smoothing alpha and beta must be between 0 and 1.")
+	}
+	if c.Alpha == 0 {
+		c.Alpha = defaultSmoothAlpha
+	}
+	if c.Beta == 0 {
+		c.Beta = defaultSmoothBeta
+	}
+	return nil
+}
+
+// sample smooths an RTT sample of flow into its SRTT and jitter, in place of
+// CalcSRTT and CalcJitter. Call before counting it in Sampled and Last.
+func (c *SmoothingConfig) sample(t *TCPAccounting, rtt uint64) {
+	if rtt < 1000 {
+		rtt = 1001
+	}
+	r, n := float64(rtt), float64(t.Sampled)
+
+	// jitter first, RFC 6298 deviates from the previous SRTT.
+	if t.Sampled > 0 {
+		diff := math.Abs(r - float64(t.Last))
+		jitter := float64(t.Jitter)
+		switch c.Jitter {
+		case smoothEWMA:
+			jitter += c.Alpha * (diff - jitter)
+		case smoothRFC3550:
+			jitter += (diff - jitter) / 16
+		case smoothRFC6298:
+			jitter += c.Beta * (math.Abs(float64(t.SRTT)-r) - jitter)
+		default:
+			jitter = (n*jitter + diff) / (n + 1)
+		}
+		t.Jitter = uint64(jitter)
+	} else if c.Jitter == smoothRFC6298 {
+		t.Jitter = rtt / 2
+	}
+
+	switch {
+	case t.SRTT == 0:
+		t.SRTT = rtt
+	case c.SRTT == smoothEWMA:
+		t.SRTT = uint64(float64(t.SRTT) + c.Alpha*(r-float64(t.SRTT)))
+	default:
+		t.SRTT = uint64((n*float64(t.SRTT) + r) / (n + 1))
+	}
+}
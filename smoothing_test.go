@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSmoothing(t *testing.T) {
+	ms := uint64(time.Millisecond)
+	samples := []uint64{10 * ms, 20 * ms, 10 * ms}
+	for _, tc := range []struct {
+		cfg    SmoothingConfig
+		srtt   uint64
+		jitter uint64
+	}{
+		{SmoothingConfig{}, 40 * ms / 3, 20 * ms / 3},
+		{SmoothingConfig{SRTT: "ewma", Alpha: 0.5, Jitter: "ewma"}, 12500 * ms / 1000, 7500 * ms / 1000},
+		{SmoothingConfig{SRTT: "ewma", Jitter: "rfc3550"}, 11093750, 1210937},
+		// RTTVAR: 5, then 3/4*5 + 1/4*10, then 3/4*6.25 + 1/4*|11.25-10|.
+		{SmoothingConfig{SRTT: "ewma", Jitter: "rfc6298"}, 11093750, 5000000},
+	} {
+		if err := tc.cfg.validate(); err != nil {
+			t.Fatalf("Unexpected error validating %+v: %v", tc.cfg, err)
+		}
+		flow := &TCPAccounting{}
+		for _, rtt := range samples {
+			tc.cfg.sample(flow, rtt)
+			flow.Last = rtt
+			flow.Sampled++
+		}
+		if flow.SRTT != tc.srtt || flow.Jitter != tc.jitter {
+			t.Errorf("Expected %+v to smooth to SRTT %d jitter %d, got %d %d", tc.cfg, tc.srtt, tc.jitter, flow.SRTT, flow.Jitter)
+		}
+	}
+
+	for _, cfg := range []SmoothingConfig{{SRTT: "rfc3550"}, {Jitter: "median"}, {Alpha: 2}} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -2,45 +2,154 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/tomb.v2"
 
 	log "github.com/cihub/seelog"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
+const (
+	// Longest we'll wait between attempts to re-open a failed capture.
+	maxCaptureBackoff = 60 * time.Second
+	// How often we check our addresses and whitelisted hosts for changes.
+	hostRefreshInterval = 60 * time.Second
+	// How long before looking up names again for whitelisted IPs without.
+	ptrRetryInterval = 10 * time.Minute
+)
+
+// Worst case header sizes we may need to decode, used to size the snaplen
+// when capturing headers only: ethernet with up to 4 VLAN tags, IPv6 with 64
+// bytes of extension headers (larger than IPv4 with options) and TCP with
+// options.
+const (
+	maxL2HeaderLen     = 14 + 4*4
+	maxL3HeaderLen     = 40 + 64
+	maxL4HeaderLen     = 60
+	maxTunnelLen       = maxL3HeaderLen + 8 + 8 + 252 + maxL2HeaderLen
+	headersOnlySnaplen = maxL2HeaderLen + maxL3HeaderLen + maxL4HeaderLen
+	maxSnaplen         = 65535
+)
+
+// headersSnaplen is the snaplen capturing headers only, room made for the
+// encapsulation when decoding tunnels: the outer IP header, UDP and Geneve
+// with the most options (VXLAN and GRE being shorter) and the inner ethernet.
+func headersSnaplen(cfg Config) int {
+	if cfg.Tunnels {
+		return headersOnlySnaplen + maxTunnelLen
+	}
+	return headersOnlySnaplen
+}
+
+// payloadAnalyses names what an instance looks for in packet payloads, that
+// capturing headers only mostly cuts off.
+func payloadAnalyses(cfg Config) []string {
+	names := []string{"TLS handshake timing"}
+	for _, a := range cfg.Analyzers {
+		if a == analyzerHTTP {
+			names = append(names, "HTTP analyzer")
+		}
+	}
+	if cfg.DNS {
+		names = append(names, "DNS response timing")
+	}
+	if cfg.UDP != nil {
+		names = append(names, "QUIC spin bit RTT")
+	}
+	return names
+}
+
 type MetroDecoder struct {
+	link          layers.LinkType
+	loopback      layers.Loopback
 	eth           layers.Ethernet
-	dot1q         layers.Dot1Q
+	vlans         vlanStack
 	ip4           layers.IPv4
 	ip6           layers.IPv6
 	ip6extensions layers.IPv6ExtensionSkipper
 	tcp           layers.TCP
+	udp           layers.UDP
+	icmp4         layers.ICMPv4
+	icmp6         layers.ICMPv6
+	icmp6echo     layers.ICMPv6Echo
+	vxlan         layers.VXLAN
+	geneve        geneveLayer
+	gre           greLayer
 	payload       gopacket.Payload
 	parser        *gopacket.DecodingLayerParser
 	decoded       []gopacket.LayerType
+	fragParser    *gopacket.DecodingLayerParser // reassembled IPv4 payloads
+	fragDecoded   []gopacket.LayerType
 }
 
-func NewMetroDecoder() *MetroDecoder {
+// NewMetroDecoder builds a decoder for packets captured off a link of the given
+// type. BSD loopback interfaces, for instance, use a NULL link-layer header.
+func NewMetroDecoder(link layers.LinkType) *MetroDecoder {
 	d := &MetroDecoder{
+		link:    link,
 		decoded: make([]gopacket.LayerType, 0, 4),
 	}
-	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
-		&d.eth, &d.dot1q, &d.ip4, &d.ip6,
-		&d.ip6extensions, &d.tcp, &d.payload)
+
+	first := layers.LayerTypeEthernet
+	switch link {
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		first = layers.LayerTypeLoopback
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4:
+		first = layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		first = layers.LayerTypeIPv6
+	}
+
+	d.parser = gopacket.NewDecodingLayerParser(first,
+		&d.loopback, &d.eth, &d.vlans, &d.ip4, &d.ip6,
+		&d.ip6extensions, &d.tcp, &d.udp, &d.vxlan, &d.geneve, &d.gre,
+		&d.icmp4, &d.icmp6, &d.icmp6echo, &d.payload)
+	d.fragParser = gopacket.NewDecodingLayerParser(layers.LayerTypeTCP, &d.tcp, &d.payload)
 
 	return d
 }
 
+// tcpPayloadSize returns the size of the TCP segment's payload, as per the IP
+// headers - the payload itself may have been cut short by the snaplen.
+func (d *MetroDecoder) tcpPayloadSize(ip4 bool) uint32 {
+	// TSO/BIG TCP super-packets may carry a 0 length, we then only know
+	// the captured payload.
+	hdr := uint32(d.tcp.DataOffset) * 4
+	if ip4 {
+		if uint32(d.ip4.Length) < uint32(d.ip4.IHL)*4+hdr {
+			return uint32(len(d.tcp.Payload))
+		}
+		return uint32(d.ip4.Length) - uint32(d.ip4.IHL)*4 - hdr
+	}
+	// the IPv6 payload length includes extension headers, if any.
+	ext := uint32(len(d.ip6.Payload) - len(d.tcp.Contents) - len(d.tcp.Payload))
+	if uint32(d.ip6.Length) < ext+hdr {
+		return uint32(len(d.tcp.Payload))
+	}
+	return uint32(d.ip6.Length) - ext - hdr
+}
+
+// decoderFor returns the (cached) decoder for a link type.
+func (d *MetroSniffer) decoderFor(link layers.LinkType) *MetroDecoder {
+	dec, ok := d.decoders[link]
+	if !ok {
+		dec = NewMetroDecoder(link)
+		d.decoders[link] = dec
+	}
+	return dec
+}
+
 // We use a DecodingLayerParser here instead of a simpler PacketSource.
 // This approach should be measurably faster, but is also more rigid.
 // PacketSource will handle any known type of packet safely and easily,
@@ -54,15 +163,53 @@ type MetroSniffer struct {
 	ExpTTL         int
 	IdleTTL        int
 	Soften         bool
+	smoothing      *SmoothingConfig
+	startupTimeout time.Duration // to keep retrying opening the capture for at startup
+	TSSource       string
 	statsdIP       string
 	statsdPort     int32
-	pcapHandle     *pcap.Handle
+	handle         CaptureSource
 	decoder        *MetroDecoder
+	decoders       map[layers.LinkType]*MetroDecoder
 	hostIPs        map[string]bool
-	nameLookup     map[string]string
+	whitelist      map[string]bool
+	userFilter     bool
+	bpf            string
+	nextRefresh    time.Time
+	ips            []string             // whitelisted IPs, as last resolved
+	ptrMisses      map[string]time.Time // whitelisted IPs without a name, when to retry
+	nameLookup     *LookupTable
+	policies       *trafficPolicies
 	sampleTS       int64
 	sampleDeadline int64
+	histograms     bool   // keep RTT distributions, for the OTLP reporter or percentiles
+	httpTraces     bool   // look for trace context in HTTP requests
+	encrypted      int64  // ESP packets since last reported
+	fragments      int64  // IP fragments since last reported
+	backend        string // capture backend, live captures only
+	dropped        uint64 // capture drops last reported
+	superPackets   int64  // GRO/GSO aggregates since last reported
+	truncated      int64  // packets cut short of their headers since last reported
+	calib          *clockCalibration
+	offloadWarned  bool
+	truncWarned    bool
+	defrag         *ip4defrag.IPv4Defragmenter
+	fragSweep      time.Time // last expiry of incomplete datagrams
 	flows          *FlowMap
+	pcaps          []string // offline files to read
+	replay         *replayClock
+	offline        *offlineFilter
+	tee            *pcapTee
+	matrix         *trafficMatrix // nil unless exporting a traffic matrix
+	narrow         *bpfNarrowing  // nil unless narrowing the filter to top destinations
+	filters        *namedFilters  // nil unless classifying flows by named filters
+	tracer         *pipelineTracer
+	hooks          []*analyzerHook
+	sidecar        *sidecarHub
+	captureCtl     chan captureRequest
+	capturePaused  int32
+	downSince      time.Time     // capture failing since, zero unless degraded
+	downBackoff    time.Duration // before reopening the capture next, while degraded
 	reporter       *Client
 	config         Config
 	t              tomb.Tomb
@@ -70,47 +217,103 @@ type MetroSniffer struct {
 
 func NewMetroSniffer(instcfg InitConfig, cfg Config, filter string) (*MetroSniffer, error) {
 	d := &MetroSniffer{
-		Iface:      cfg.Interface,
-		Snaplen:    instcfg.Snaplen,
-		Filter:     filter,
-		ExpTTL:     instcfg.ExpTTL,
-		IdleTTL:    instcfg.IdleTTL,
-		Soften:     false,
-		statsdIP:   instcfg.StatsdIP,
-		statsdPort: int32(instcfg.StatsdPort),
-		pcapHandle: nil,
-		hostIPs:    make(map[string]bool),
-		nameLookup: make(map[string]string),
-		sampleTS:   time.Now().UnixNano(),
-		flows:      NewFlowMap(),
-		config:     cfg,
+		Iface:          cfg.Interface,
+		Snaplen:        instcfg.Snaplen,
+		Filter:         filter,
+		ExpTTL:         instcfg.ExpTTL,
+		IdleTTL:        instcfg.IdleTTL,
+		smoothing:      cfg.Smoothing,
+		startupTimeout: time.Duration(instcfg.StartupTimeout) * time.Second,
+		filters:        newNamedFilters(cfg.Filters),
+		TSSource:       instcfg.TimestampSource,
+		statsdIP:       instcfg.StatsdIP,
+		statsdPort:     int32(instcfg.StatsdPort),
+		handle:         nil,
+		decoders:       make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:        make(map[string]bool),
+		whitelist:      make(map[string]bool),
+		nameLookup:     NewLookupTable(),
+		sampleTS:       time.Now().UnixNano(),
+		flows:          NewFlowMap(),
+		captureCtl:     make(chan captureRequest),
+		histograms:     instcfg.Reporter == reporterOTLP || cfg.Percentiles,
+		config:         cfg,
+	}
+	if cfg.ReplaySpeed > 0 {
+		d.replay = newReplayClock(cfg.ReplaySpeed)
+	}
+	switch {
+	case cfg.Soften != nil:
+		d.Soften = *cfg.Soften
+	case instcfg.Soften != nil:
+		d.Soften = *instcfg.Soften
+	case cfg.Smoothing != nil && cfg.Smoothing.SRTT == smoothEWMA:
+		// unless told otherwise, ICMP and QUIC RTTs too, smoothed with
+		// the fixed 1/8 gain.
+		d.Soften = true
+	}
+	if cfg.OfflineFilter != nil && cfg.Interface == fileInterface {
+		var err error
+		if d.offline, err = newOfflineFilter(cfg.OfflineFilter); err != nil {
+			return nil, err
+		}
 	}
 	d.sampleDeadline = d.sampleTS + int64(d.config.SampleDuration)*time.Second.Nanoseconds()
-	d.decoder = NewMetroDecoder()
+	if instcfg.HeadersOnly {
+		if instcfg.Snaplen != 0 {
+			log.Infof("Capturing headers only, configured snaplen %d will be ignored.", instcfg.Snaplen)
+		}
+		d.Snaplen = headersSnaplen(cfg)
+	}
+	d.decoder = NewMetroDecoder(layers.LinkTypeEthernet)
+
+	for _, a := range d.config.Analyzers {
+		if a == analyzerHTTP {
+			d.httpTraces = true
+		}
+	}
+	if instcfg.HeadersOnly {
+		for _, a := range payloadAnalyses(cfg) {
+			log.Warnf("%s enabled capturing headers only: payloads are cut to the few bytes left by the snaplen, "+
+				"expect most of it missing.", a)
+		}
+	}
+
+	for k, v := range d.config.Lookup {
+		if err := d.nameLookup.Add(k, v); err != nil {
+			log.Errorf("Invalid lookup entry %q: %v", k, err)
+			return nil, err
+		}
+	}
 
 	var err error
+	d.policies, err = newTrafficPolicies(d.config.Policies)
+	if err != nil {
+		log.Errorf("Invalid traffic policies: %v", err)
+		return nil, err
+	}
+
+	enrich, err := NewEnrichmentPipeline(d.config.Enrichment, d.nameLookup)
+	if err != nil {
+		log.Errorf("Invalid enrichment configuration: %v", err)
+		return nil, err
+	}
+
 	d.config.Tags = append(d.config.Tags, "iface:"+d.Iface)
-	d.reporter, err = NewClient(net.ParseIP(d.statsdIP), d.statsdPort, statsdSleep, d.flows, d.nameLookup, d.config.Tags)
+	d.reporter, err = NewClient(instcfg, d.config, statsdSleep, d.flows, enrich)
 	if err != nil {
 		return nil, err
 	}
+	d.tracer = d.reporter.tracer
+	d.hooks = d.reporter.hooks
+	d.sidecar = d.reporter.sidecar
 
 	return d, nil
 }
 
-func readUint32(data []byte) (ret uint32) {
-	buf := bytes.NewBuffer(data)
-	binary.Read(buf, binary.BigEndian, &ret)
-	return
-}
-
 func GetTimestamps(tcp *layers.TCP) (uint32, uint32, error) {
-	for i := range tcp.Options {
-		if tcp.Options[i].OptionType == 8 {
-			ts := readUint32(tcp.Options[i].OptionData[:4])
-			tsecr := readUint32(tcp.Options[i].OptionData[4:])
-			return ts, tsecr, nil
-		}
+	if o := parseTCPOptions(tcp); o.HasTS {
+		return o.TS, o.TSecr, nil
 	}
 	return 0, 0, errors.New("No TCP timestamp Options!")
 }
@@ -133,46 +336,154 @@ func (d *MetroSniffer) Running() bool {
 	return d.t.Alive()
 }
 
-func (d *MetroSniffer) SetPcapHandle(handle *pcap.Handle) {
-	d.pcapHandle = handle
+func (d *MetroSniffer) SetPcapHandle(handle CaptureSource) {
+	d.handle = handle
+}
+
+// isLocal tells whether the source of a packet should be considered our end
+// of the flow. When sniffing off a mirror/SPAN port neither end is actually
+// local, so we treat the client - the ephemeral, higher port - as our end.
+func (d *MetroSniffer) isLocal(src net.IP, sport, dport layers.TCPPort) bool {
+	if !d.config.Mirror {
+		return d.hostIPs[src.String()]
+	}
+	return sport > dport
 }
 
 func (d *MetroSniffer) handlePacket(data []byte, ci *gopacket.CaptureInfo) error {
 	var buffer bytes.Buffer
+	var decoded time.Time
 
+	traced := d.tracer.sample()
+	if traced {
+		start := time.Now()
+		defer func() {
+			d.tracer.packet(d.config.Pcap == "", ci.Timestamp, start, decoded, time.Now())
+		}()
+	}
+	meta := d.packetMeta(ci)
 	err := d.decoder.parser.DecodeLayers(data, &d.decoder.decoded)
-	if err != nil {
+	if traced {
+		decoded = time.Now()
+	}
+	if unneededPayload(err, d.decoder.decoded) {
+		// eg. TLS or DNS, we've got all we need.
+		err = nil
+	}
+	if encrypted(err) {
+		d.encrypted++
+		return nil
+	} else if fragmented(err) {
+		if !d.reassemble(ci.Timestamp) {
+			return nil
+		}
+	} else if err != nil {
+		if ci.CaptureLength < ci.Length {
+			d.truncatedHeaders(ci)
+		}
 		log.Infof("error decoding packet: %v", err)
 		return err
 	}
 	// Find either the IPv4 or IPv6 address to use as our network
 	// layer.
 	foundNetLayer := false
-	foundIPv4Layer := false
+	var srcIP, dstIP net.IP
 	for _, typ := range d.decoder.decoded {
 		switch typ {
+		case layers.LayerTypeEthernet:
+			if d.config.SwitchPorts != nil || d.config.MACTags {
+				meta.SrcMAC, meta.DstMAC = d.decoder.eth.SrcMAC.String(), d.decoder.eth.DstMAC.String()
+			}
+		case layers.LayerTypeDot1Q:
+			meta.VLANs = d.decoder.vlans.IDs
+		case layers.LayerTypeVXLAN, layers.LayerTypeGeneve, layers.LayerTypeGRE:
+			meta.Tunnel = d.decoder.tunnelTag(typ)
 		case layers.LayerTypeIPv4:
+			if foundNetLayer && meta.Tunnel == "" {
+				meta.Tunnel = ipTunnelTag(srcIP, typ)
+			}
 			foundNetLayer = true
-			foundIPv4Layer = true
+			srcIP, dstIP = d.decoder.ip4.SrcIP, d.decoder.ip4.DstIP
+			meta.DSCP, meta.ECN = d.decoder.ip4.TOS>>2, d.decoder.ip4.TOS&3
+			meta.HopLimit, meta.FlowLabel = d.decoder.ip4.TTL, 0
 		case layers.LayerTypeIPv6:
+			if d.decoder.ip6.NextHeader == layers.IPProtocolIPv6Fragment {
+				// not reassembled, only counted.
+				d.fragments++
+				return nil
+			}
+			if foundNetLayer && meta.Tunnel == "" {
+				meta.Tunnel = ipTunnelTag(srcIP, typ)
+			}
 			foundNetLayer = true
+			srcIP, dstIP = d.decoder.ip6.SrcIP, d.decoder.ip6.DstIP
+			meta.DSCP, meta.ECN = d.decoder.ip6.TrafficClass>>2, d.decoder.ip6.TrafficClass&3
+			meta.HopLimit, meta.FlowLabel = d.decoder.ip6.HopLimit, d.decoder.ip6.FlowLabel
+		case layers.LayerTypeUDP:
+			udp := &d.decoder.udp
+			if d.calib.captured(srcIP, udp.SrcPort, ci.Timestamp) {
+				continue
+			}
+			if next := udp.NextLayerType(); (d.config.UDP == nil && !d.config.DNS) || !foundNetLayer ||
+				next == layers.LayerTypeVXLAN || next == layers.LayerTypeGeneve {
+				continue
+			}
+			if d.userFilter && !d.whitelist[srcIP.String()] && !d.whitelist[dstIP.String()] {
+				continue
+			}
+			if d.offline != nil && !d.offline.matchesFlow(srcIP, dstIP, layers.TCPPort(udp.SrcPort), layers.TCPPort(udp.DstPort)) {
+				continue
+			}
+			if d.config.DNS && (udp.SrcPort == dnsPort || udp.DstPort == dnsPort) {
+				d.handleDNS(srcIP, dstIP, uint16(udp.SrcPort), uint16(udp.DstPort), udp.Payload, &meta)
+			}
+			if d.config.UDP != nil {
+				d.handleUDP(srcIP, dstIP, &meta)
+			}
+		case layers.LayerTypeICMPv4, layers.LayerTypeICMPv6:
+			echo, request, id, seq := d.decoder.echo(typ == layers.LayerTypeICMPv6)
+			if !echo || !d.config.ICMP || !foundNetLayer {
+				continue
+			}
+			if d.userFilter && !d.whitelist[srcIP.String()] && !d.whitelist[dstIP.String()] {
+				continue
+			}
+			d.handleEcho(srcIP, dstIP, request, id, seq, &meta)
 		case layers.LayerTypeTCP:
-			if foundNetLayer && foundIPv4Layer {
+			if d.userFilter && !d.whitelist[srcIP.String()] && !d.whitelist[dstIP.String()] {
+				continue
+			}
+			if d.offline != nil && !d.offline.matchesFlow(srcIP, dstIP, d.decoder.tcp.SrcPort, d.decoder.tcp.DstPort) {
+				continue
+			}
+			if tcp := &d.decoder.tcp; foundNetLayer && d.config.DNS && (tcp.SrcPort == dnsPort || tcp.DstPort == dnsPort) && len(tcp.Payload) > 2 {
+				// messages are length prefixed, we only look at the first of a segment.
+				d.handleDNS(srcIP, dstIP, uint16(tcp.SrcPort), uint16(tcp.DstPort), tcp.Payload[2:], &meta)
+			}
+			if foundNetLayer {
 				//do we have this flow? Build key
 				var src, dst string
-				ourIP := d.hostIPs[d.decoder.ip4.SrcIP.String()]
+				ourIP := d.isLocal(srcIP, d.decoder.tcp.SrcPort, d.decoder.tcp.DstPort)
+				if meta.Tunnel != "" {
+					// encapsulated flows are between guests, not us - as if mirrored.
+					ourIP = d.decoder.tcp.SrcPort > d.decoder.tcp.DstPort
+				}
 
 				// consider us always the SRC (this will help us keep just one tag for
 				// all comms between two ip's
 				if ourIP {
-					src = net.JoinHostPort(d.decoder.ip4.SrcIP.String(), strconv.Itoa(int(d.decoder.tcp.SrcPort)))
-					dst = net.JoinHostPort(d.decoder.ip4.DstIP.String(), strconv.Itoa(int(d.decoder.tcp.DstPort)))
+					src = net.JoinHostPort(srcIP.String(), strconv.Itoa(int(d.decoder.tcp.SrcPort)))
+					dst = net.JoinHostPort(dstIP.String(), strconv.Itoa(int(d.decoder.tcp.DstPort)))
 				} else {
-					src = net.JoinHostPort(d.decoder.ip4.DstIP.String(), strconv.Itoa(int(d.decoder.tcp.DstPort)))
-					dst = net.JoinHostPort(d.decoder.ip4.SrcIP.String(), strconv.Itoa(int(d.decoder.tcp.SrcPort)))
+					src = net.JoinHostPort(dstIP.String(), strconv.Itoa(int(d.decoder.tcp.DstPort)))
+					dst = net.JoinHostPort(srcIP.String(), strconv.Itoa(int(d.decoder.tcp.SrcPort)))
 				}
 
 				buffer.Reset()
+				if meta.Tunnel != "" {
+					buffer.WriteString(meta.Tunnel)
+					buffer.WriteString("/")
+				}
 				buffer.WriteString(src)
 				buffer.WriteString("-")
 				buffer.WriteString(dst)
@@ -181,12 +492,24 @@ func (d *MetroSniffer) handlePacket(data []byte, ci *gopacket.CaptureInfo) error
 				idle := time.Duration(d.IdleTTL * int(time.Second))
 				flow, exists := d.flows.Get(flowkey)
 				if exists == false {
+					remote := srcIP
+					if ourIP {
+						remote = dstIP
+					}
+					external := d.policies.external(remote)
+					if !d.policies.sampled(flowkey, external) {
+						continue
+					}
+
 					// TCPAccounting objects self-expire if they are inactive for a period of time >idle
 					if ourIP {
-						flow = NewTCPAccounting(d.decoder.ip4.SrcIP, d.decoder.ip4.DstIP, d.decoder.tcp.SrcPort, d.decoder.tcp.DstPort, idle, &d.flows.Expire)
+						flow = NewTCPAccounting(srcIP, dstIP, d.decoder.tcp.SrcPort, d.decoder.tcp.DstPort, idle, &d.flows.Expire)
 					} else {
-						flow = NewTCPAccounting(d.decoder.ip4.DstIP, d.decoder.ip4.SrcIP, d.decoder.tcp.DstPort, d.decoder.tcp.SrcPort, idle, &d.flows.Expire)
+						flow = NewTCPAccounting(dstIP, srcIP, d.decoder.tcp.DstPort, d.decoder.tcp.SrcPort, idle, &d.flows.Expire)
 					}
+					flow.External = external
+					flow.Filters = d.filters.match(d.decoder.link, *ci, data)
+					meta.annotate(flow, d)
 					flow.Lock()
 					d.flows.Add(flowkey, flow)
 					flow.SetExpiration(idle, flowkey)
@@ -196,51 +519,170 @@ func (d *MetroSniffer) handlePacket(data []byte, ci *gopacket.CaptureInfo) error
 					flow.Alive.Reset(idle)
 				}
 
-				if d.ExpTTL > 0 && d.decoder.tcp.ACK && d.decoder.tcp.FIN && !flow.Done {
+				if d.decoder.tcp.SYN && !d.decoder.tcp.ACK {
+					// the handshake tells us who the client is - better than the port guess.
+					flow.Client = ourIP
+				}
+				if flow.ACKTime == 0 {
+					flow.trackHandshake(ourIP, &d.decoder.tcp, ci.Timestamp.UnixNano())
+				}
+				if ourIP && d.config.DSCPTags {
+					// our marking, as the network is supposed to honour it. Samples
+					// are reported under the class of the latest.
+					flow.QoS = dscpClass(meta.DSCP)
+				} else if d.config.DSCPTags {
+					flow.RcvdQoS = dscpClass(meta.DSCP)
+				}
+				flow.trackPath(ourIP, meta.HopLimit, meta.FlowLabel)
+				if ourIP && meta.DstMAC != "" {
+					flow.LocalMAC, flow.RemoteMAC = meta.SrcMAC, meta.DstMAC
+				} else if !ourIP && meta.SrcMAC != "" {
+					flow.LocalMAC, flow.RemoteMAC = meta.DstMAC, meta.SrcMAC
+				}
+				if d.decoder.tcp.SYN && !ourIP {
+					// the remote end's MSS caps the segments we send.
+					flow.MSS = synMSS(&d.decoder.tcp)
+				} else if d.decoder.tcp.SYN {
+					flow.SrcMSS = synMSS(&d.decoder.tcp)
+				}
+
+				if d.ExpTTL > 0 && (d.decoder.tcp.ACK && d.decoder.tcp.FIN || flow.Refused) && !flow.Done {
 					expTTL := time.Duration(d.ExpTTL * int(time.Second))
 
 					// Here we clean up flows that have expired by the book - that is, we have seen
 					// the TCP stream come to an end FIN/ACK and have kept these around so short-lived
-					// flows actually get reported.
+					// flows actually get reported. Refused connections won't go any further.
 
 					//set timer
 					flow.Done = true
 					flow.SetExpiration(expTTL, flowkey)
 				}
 
-				tcp_payload_sz := uint32(d.decoder.ip4.Length) - uint32((d.decoder.ip4.IHL+d.decoder.tcp.DataOffset)*4)
+				if d.decoder.tcp.RST {
+					flow.Resets++
+				}
+				flow.trackClose(ourIP, &d.decoder.tcp)
+
+				tcp_payload_sz := d.decoder.tcpPayloadSize(srcIP.To4() != nil)
+				flow.Bytes += uint64(tcp_payload_sz)
+				if ourIP {
+					flow.RcvdDupAcks.track(&d.decoder.tcp, tcp_payload_sz)
+				} else {
+					flow.DupAcks.track(&d.decoder.tcp, tcp_payload_sz)
+				}
+				flow.trackWindow(ourIP, &d.decoder.tcp, tcp_payload_sz)
+				opts := parseTCPOptions(&d.decoder.tcp)
+				if !opts.HasTS && !d.decoder.tcp.RST {
+					flow.NoTS = true
+				}
+				if ourIP {
+					flow.ECN.track(meta.ECN, &d.decoder.tcp)
+				} else {
+					flow.RcvdECN.track(meta.ECN, &d.decoder.tcp)
+				}
+				if ourIP && d.decoder.tcp.ACK {
+					flow.RcvdSACK.track(d.decoder.tcp.Ack, &opts)
+				} else if d.decoder.tcp.ACK {
+					flow.SACK.track(d.decoder.tcp.Ack, &opts)
+				}
+				if flow.FirstSeen == 0 {
+					flow.FirstSeen = ci.Timestamp.UnixNano()
+				}
+				flow.LastSeen = ci.Timestamp.UnixNano()
+				if tcp_payload_sz > 0 && flow.TLSHandshake == 0 {
+					flow.trackTLS(ourIP, d.decoder.tcp.Payload, ci.Timestamp.UnixNano())
+				}
+				if tcp_payload_sz > 0 && features.enabled(featureHTTPAnalyzer, d.httpTraces) {
+					if traceID, spanID, ok := parseTraceparent(d.decoder.tcp.Payload); ok {
+						flow.AddTrace(traceID, spanID, ci.Timestamp.UnixNano())
+					}
+				}
+				if len(d.hooks) > 0 {
+					runPacketHooks(d.hooks, flow, &d.decoder.tcp, ourIP, tcp_payload_sz)
+				}
+				d.sidecar.Packet(d.reporter, flowkey, ci.Timestamp.UnixNano(), &d.decoder.tcp, ourIP, tcp_payload_sz)
 				if ourIP && tcp_payload_sz > 0 {
-					var t TCPKey
-					//get the TS
-					ts, _, _ := GetTimestamps(&d.decoder.tcp)
-					t.TS = ts
-					t.Seq = d.decoder.tcp.Seq
+					resent := flow.TrackSeq(d.decoder.tcp.Seq, tcp_payload_sz)
+					segs, mss := logicalSegments(tcp_payload_sz, flow.MSS)
+					if segs > 1 {
+						d.superPacket(tcp_payload_sz, &meta)
+						flow.Segments += uint64(segs - 1)
+					}
 
-					//insert or update
-					flow.Timed[t] = ci.Timestamp.UnixNano()
+					if resent {
+						flow.forgetSent(d.decoder.tcp.Seq, tcp_payload_sz)
+					} else if !opts.HasTS {
+						// no timestamps to pair segments and ACKs by, expect
+						// the end of each segment to be acknowledged.
+						var t TCPKey
+						for i := uint32(1); i <= segs; i++ {
+							t.Seq = d.decoder.tcp.Seq + i*mss
+							if i == segs {
+								t.Seq = d.decoder.tcp.Seq + tcp_payload_sz
+							}
+							flow.markSent(t, ci.Timestamp.UnixNano())
+						}
+					} else {
+						flow.sentTS(opts.TS, ci.Timestamp.UnixNano())
+						var t TCPKey
+						//get the TS
+						t.TS = opts.TS
+						t.Seq = d.decoder.tcp.Seq
+
+						//insert or update
+						flow.markSent(t, ci.Timestamp.UnixNano())
+						// super-packets: as if we'd seen each segment sent.
+						for i := uint32(1); i < segs; i++ {
+							t.Seq = d.decoder.tcp.Seq + i*mss
+							flow.markSent(t, ci.Timestamp.UnixNano())
+						}
+					}
 
 				} else if !ourIP {
+					if tcp_payload_sz > 0 {
+						flow.Rcvd.arrived(d.decoder.tcp.Seq, tcp_payload_sz, ci.Timestamp.UnixNano(), flow.reorderWindow())
+					}
+					if opts.HasTS {
+						flow.OWD.observe(opts.TS, ci.Timestamp.UnixNano())
+					}
+
 					var t TCPKey
 					//get the TS
-					_, tsecr, _ := GetTimestamps(&d.decoder.tcp)
-					t.TS = tsecr
+					t.TS = opts.TSecr
 					t.Seq = d.decoder.tcp.Ack
 
-					if flow.Timed[t] != 0 {
+					if sent := flow.Timed[t]; sent != 0 && flow.staleSample(opts.HasTS, opts.TSecr, time.Duration(ci.Timestamp.UnixNano()-sent)) {
+						// matched across a TSval wraparound, or lost long ago.
+						delete(flow.Timed, t)
+					} else if sent != 0 {
 						if _, ok := flow.Seen[d.decoder.tcp.Ack]; !ok && d.decoder.tcp.ACK {
 							//we can't receive an ACK for packet we haven't seen sent - we're the source
 							rtt := uint64(ci.Timestamp.UnixNano() - flow.Timed[t])
-							flow.CalcSRTT(rtt, d.Soften)
-							flow.CalcJitter(rtt, d.Soften)
+							if d.smoothing != nil {
+								d.smoothing.sample(flow, rtt)
+							} else {
+								flow.CalcSRTT(rtt, d.Soften)
+								flow.CalcJitter(rtt, d.Soften)
+							}
 							flow.MaxRTT(rtt)
 							flow.MinRTT(rtt)
 							flow.Last = rtt
+							if opts.HasTS {
+								flow.OWD.sample(flow.Timed[t], ci.Timestamp.UnixNano(), opts.TS)
+							}
+							if d.histograms {
+								if flow.RTTs == nil {
+									flow.RTTs = NewExpHistogram()
+								}
+								flow.RTTs.Record(float64(rtt) / float64(time.Millisecond))
+							}
+							flow.LastTS = ci.Timestamp.UnixNano()
 							flow.Sampled++
 
 							//we can clean-up
 							delete(flow.Timed, t)
 						}
-						flow.Seen[d.decoder.tcp.Ack] = struct{}{}
+						flow.markSeen(d.decoder.tcp.Ack)
 					}
 				}
 				flow.Unlock()
@@ -252,6 +694,14 @@ func (d *MetroSniffer) handlePacket(data []byte, ci *gopacket.CaptureInfo) error
 
 func (d *MetroSniffer) SniffLive() {
 
+	var resolved chan []string
+	if len(d.config.Ips) > 0 || len(d.config.Hosts) > 0 {
+		resolved = make(chan []string)
+		done := make(chan struct{})
+		defer close(done)
+		go d.resolveWhitelist(resolved, done)
+	}
+
 	quit := false
 	for !quit {
 
@@ -260,7 +710,23 @@ func (d *MetroSniffer) SniffLive() {
 		// data slice we're operating on. Giving place to bad results.
 		// Keep this in mind as a viable optimization for the future:
 		//   - packet retrieval using  ZeroCopyReadPacketData.
-		data, ci, err := d.pcapHandle.ReadPacketData()
+		data, ci, err := d.handle.ReadPacketData()
+		if err != nil && !isTimeout(err) {
+			// interface gone or down (VM migration, bond failover...)
+			d.interfaceDown(err)
+			if !d.reopen() {
+				log.Infof("Done sniffing.")
+				quit = true
+			}
+			continue
+		}
+		d.interfaceUp()
+		if err == nil && d.tee != nil {
+			d.tee.Write(data, &ci)
+		}
+		if err == nil {
+			ci.Timestamp = d.calib.correct(ci.Timestamp)
+		}
 
 		if d.config.Sample {
 			ts := ci.Timestamp.UnixNano()
@@ -281,22 +747,178 @@ func (d *MetroSniffer) SniffLive() {
 			}
 		}
 
+		d.calib.probe(time.Now())
+		if now := time.Now(); now.After(d.nextRefresh) {
+			d.refresh()
+			d.reportCounters()
+			d.nextRefresh = now.Add(jittered(hostRefreshInterval))
+		}
+		if d.narrow.due(time.Now()) {
+			d.refresh()
+		}
+
 		select {
 		case <-d.t.Dying():
+			d.reportCounters()
 			log.Infof("Done sniffing.")
 			quit = true
+		case req := <-d.captureCtl:
+			d.reportCounters()
+			if !d.handleCaptureRequest(req) {
+				log.Infof("Done sniffing.")
+				quit = true
+			}
+		case ips := <-resolved:
+			d.ips = ips
+			d.refresh()
 		default:
 			continue
 		}
 	}
 }
 
+// truncatedHeaders accounts for a packet the snaplen cut before we could
+// decode its headers (eg. TCP options, more VLAN tags or extension headers
+// than headers_only makes room for), warning once.
+func (d *MetroSniffer) truncatedHeaders(ci *gopacket.CaptureInfo) {
+	d.truncated++
+	if d.truncWarned {
+		return
+	}
+	d.truncWarned = true
+	log.Warnf("Captured %d of a %d byte packet on %q, not enough to decode its headers: "+
+		"consider raising snaplen, or disabling headers_only.", ci.CaptureLength, ci.Length, d.Iface)
+}
+
+// reportCounters submits the packet counters kept while sniffing.
+func (d *MetroSniffer) reportCounters() {
+	if d.encrypted > 0 && d.reporter != nil {
+		d.reporter.count("go_metro.esp.packets", d.encrypted)
+	}
+	if d.fragments > 0 && d.reporter != nil {
+		d.reporter.count("go_metro.ip.fragments", d.fragments)
+	}
+	if d.superPackets > 0 && d.reporter != nil {
+		d.reporter.count("go_metro.capture.super_packets", d.superPackets)
+	}
+	if d.truncated > 0 && d.reporter != nil {
+		d.reporter.count("go_metro.capture.truncated", d.truncated)
+	}
+	d.encrypted, d.fragments, d.superPackets, d.truncated = 0, 0, 0, 0
+	d.calib.report(d.reporter)
+
+	if d.handle == nil {
+		return
+	}
+	stats, err := d.handle.Stats()
+	if err != nil {
+		log.Debugf("Unable to get capture statistics for %q: %v", d.Iface, err)
+		return
+	}
+	if stats.Dropped < d.dropped {
+		// the capture was reopened.
+		d.dropped = 0
+	}
+	if stats.Dropped > d.dropped && d.reporter != nil {
+		d.reporter.count("go_metro.capture.dropped", int64(stats.Dropped-d.dropped))
+		d.reporter.summary.drop(stats.Dropped - d.dropped)
+	}
+	d.dropped = stats.Dropped
+}
+
+// reopen keeps trying to re-open the live capture handle, backing off
+// exponentially, until it succeeds or we're told to stop. Flow state is
+// retained meanwhile. The backoff keeps growing until the interface is back
+// up, handles reopening fine only to fail reading included.
+func (d *MetroSniffer) reopen() bool {
+	d.handle.Close()
+
+	for {
+		backoff := d.downBackoff
+		if d.downBackoff *= 2; d.downBackoff > maxCaptureBackoff {
+			d.downBackoff = maxCaptureBackoff
+		}
+		select {
+		case <-d.t.Dying():
+			return false
+		case <-time.After(jittered(backoff)):
+		}
+
+		handle, err := d.openCapture()
+		if err == nil {
+			err = handle.SetBPFFilter(d.bpf)
+			if err == nil || err == errBPFUnsupported {
+				d.handle = handle
+				d.reporter.count("go_metro.capture.restarts", 1)
+				log.Infof("Capture on %q restarted.", d.Iface)
+				return true
+			}
+			handle.Close()
+		}
+
+		log.Warnf("Unable to reopen capture on %q, retrying in %v: %v", d.Iface, d.downBackoff, err)
+	}
+}
+
+// openStartup opens the live capture handle, retrying with exponential
+// backoff for up to startupTimeout should it fail - eg. the interface isn't
+// up yet at boot.
+func (d *MetroSniffer) openStartup() (CaptureSource, error) {
+	deadline := time.Now().Add(d.startupTimeout)
+	backoff := time.Second
+	for {
+		handle, err := d.openCapture()
+		if err == nil {
+			return handle, nil
+		}
+
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, err
+		}
+		wait := jittered(backoff)
+		if wait > left {
+			wait = left
+		}
+		log.Warnf("Unable to open capture on %q, retrying in %v (giving up in %v): %v", d.Iface, wait, left.Round(time.Second), err)
+		d.reporter.count("go_metro.capture.startup_retries", 1)
+		select {
+		case <-d.t.Dying():
+			return nil, tomb.ErrDying
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > maxCaptureBackoff {
+			backoff = maxCaptureBackoff
+		}
+	}
+}
+
 func (d *MetroSniffer) SniffOffline() {
-	packetSource := gopacket.NewPacketSource(d.pcapHandle, d.pcapHandle.LinkType())
+	packetSource := gopacket.NewPacketSource(d.handle, d.handle.LinkType())
 
 	for packet := range packetSource.Packets() {
 		//Grab Packet CaptureInfo metadata
 		ci := packet.Metadata().CaptureInfo
+		if d.offline != nil && d.offline.before(ci.Timestamp) {
+			continue
+		} else if d.offline != nil && d.offline.after(ci.Timestamp) {
+			// captures are chronological, we're done with the window.
+			log.Infof("Done sniffing, past the end of the time window.")
+			break
+		}
+		if d.replay != nil && !d.replay.wait(ci.Timestamp, d.t.Dying()) {
+			log.Infof("Done sniffing.")
+			break
+		}
+		if d.tee != nil {
+			d.tee.Write(packet.Data(), &ci)
+		}
+		if link, ok := packetLinkType(&ci); ok {
+			// pcapng files may hold interfaces of different link types.
+			d.decoder = d.decoderFor(link)
+		}
 		d.handlePacket(packet.Data(), &ci)
 		select {
 		case <-d.t.Dying():
@@ -308,81 +930,175 @@ func (d *MetroSniffer) SniffOffline() {
 	}
 }
 
-func (d *MetroSniffer) Sniff() error {
-
-	if d.pcapHandle == nil {
-
-		log.Infof("starting capture on interface %q", d.Iface)
+// sniffFiles processes several pcap files concurrently, each file with its
+// own handle, decoders, counters and FlowMap - merged into ours, in order,
+// once all are read so a single consolidated report is emitted. A single
+// worker accounts into ours directly, a file after the other.
+func (d *MetroSniffer) sniffFiles() {
+	workers := d.config.PcapWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if d.replay != nil {
+		// files are replayed one after the other.
+		workers = 1
+	}
+	if workers > len(d.pcaps) {
+		workers = len(d.pcaps)
+	}
+	log.Infof("Reading %d pcap files with %d workers", len(d.pcaps), workers)
 
-		if d.Iface != fileInterface {
-			// Set up pcap packet capture
-			inactive, err := pcap.NewInactiveHandle(d.Iface)
-			if err != nil {
-				log.Errorf("Unable to create inactive handle for %q", d.Iface)
-				d.reporter.Stop()
-				d.die(err)
-				return err
+	own := workers > 1
+	read := make([]*MetroSniffer, len(d.pcaps)) // by file
+	files := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first bool) {
+			defer wg.Done()
+			if first {
+				// we already have the first file open.
+				read[0] = d.sniffHandle(d.pcaps[0], d.handle, own)
+			}
+			for i := range files {
+				read[i] = d.sniffFile(d.pcaps[i], own)
 			}
-			defer inactive.CleanUp()
+		}(i == 0)
+	}
 
-			inactive.SetSnapLen(d.Snaplen)
-			inactive.SetPromisc(false)
-			inactive.SetTimeout(time.Second)
+	quit := false
+	for i := 1; i < len(d.pcaps) && !quit; i++ {
+		select {
+		case files <- i:
+		case <-d.t.Dying():
+			quit = true
+		}
+	}
+	close(files)
+	wg.Wait()
 
-			// TODO: Make the timestamp source selectable - Not all OS will allow that.
-			//       call SupportedTimestamps() on handle to check what's available
-			handle, err := inactive.Activate()
-			if err != nil {
-				log.Errorf("Unable to activate %q", d.Iface)
-				d.reporter.Stop()
-				d.die(err)
-				return err
-			}
-			d.pcapHandle = handle
-		} else {
-			handle, err := pcap.OpenOffline(d.config.Pcap)
-			if err != nil {
-				log.Errorf("Unable to open pcap file %q", d.config.Pcap)
-				d.reporter.Stop()
-				d.die(err)
-				return err
+	for _, w := range read {
+		if w == nil {
+			continue
+		}
+		d.encrypted += w.encrypted
+		d.fragments += w.fragments
+		d.superPackets += w.superPackets
+		d.truncated += w.truncated
+		if w.flows != d.flows {
+			for _, k := range d.flows.mergeFlows(w.flows) {
+				d.flows.Expire <- k
 			}
-			d.pcapHandle = handle
 		}
 	}
+	d.reportCounters()
+}
 
-	ifaces, err := pcap.FindAllDevs()
+func (d *MetroSniffer) sniffFile(path string, own bool) *MetroSniffer {
+	handle, err := openOffline(path)
 	if err != nil {
-		log.Criticalf("Error getting interface details: %s", err)
-		panic(Exit{1})
+		log.Errorf("Unable to open pcap file %q, skipping: %v", path, err)
+		return nil
 	}
+	defer handle.Close()
 
-	ifaceFound := false
-	ifaceDetails := make([]pcap.Interface, len(ifaces)-1)
-	for i := range ifaces {
-		if ifaces[i].Name == d.Iface {
-			ifaceDetails[i] = ifaces[i]
-			ifaceFound = true
+	if !d.userFilter {
+		if err := handle.SetBPFFilter(d.bpf); err != nil {
+			log.Errorf("Error setting BPF filter on %q, skipping: %v", path, err)
+			return nil
 		}
 	}
+	return d.sniffHandle(path, handle, own)
+}
 
-	if !ifaceFound && d.Iface != fileInterface {
-		log.Criticalf("Could not find interface details for: %s", d.Iface)
-		panic(Exit{1})
+// sniffHandle reads a file off a worker sniffer sharing our (read-only
+// while offline) settings, accounting into a FlowMap of its own if own, else
+// into ours. Returns the worker, to merge its flows and counters.
+func (d *MetroSniffer) sniffHandle(path string, handle CaptureSource, own bool) *MetroSniffer {
+	flows := d.flows
+	if own {
+		flows = NewFlowMap()
+	}
+	w := &MetroSniffer{
+		Iface:      d.Iface,
+		Snaplen:    d.Snaplen,
+		ExpTTL:     d.ExpTTL,
+		IdleTTL:    d.IdleTTL,
+		Soften:     d.Soften,
+		smoothing:  d.smoothing,
+		filters:    d.filters,
+		handle:     handle,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    d.hostIPs,
+		whitelist:  d.whitelist,
+		userFilter: d.userFilter,
+		replay:     d.replay,
+		offline:    d.offline,
+		nameLookup: d.nameLookup,
+		policies:   d.policies,
+		histograms: d.histograms,
+		httpTraces: d.httpTraces,
+		hooks:      d.hooks,
+		sidecar:    d.sidecar,
+		flows:      flows,
+		tracer:     d.tracer,
+		reporter:   d.reporter,
+		config:     d.config,
 	}
+	w.decoder = w.decoderFor(handle.LinkType())
 
-	// we need to identify if we're the source/destination
-	for i := range ifaceDetails {
-		for j := range ifaceDetails[i].Addresses {
-			ipStr := ifaceDetails[i].Addresses[j].IP.String()
-			if strings.Contains(ipStr, "::") {
-				log.Infof("IPv6 currently unsupported ignoring: %s", ipStr)
-			} else {
-				d.hostIPs[ipStr] = true
-			}
+	// stop along with us.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-d.t.Dying():
+			w.t.Kill(nil)
+		case <-done:
 		}
+	}()
+
+	log.Infof("Reading pcap file %q", path)
+	w.SniffOffline()
+	return w
+}
+
+// localAddresses enumerates the addresses of the interface we're sniffing
+// off - we need them to identify if we're the source/destination.
+func (d *MetroSniffer) localAddresses() (map[string]bool, bool, error) {
+	if isDPDKInterface(d.Iface) {
+		// DPDK ports are invisible to the kernel, our addresses are configured.
+		hostIPs := make(map[string]bool)
+		for _, ip := range d.dpdkConfig().LocalIPs {
+			hostIPs[ip] = true
+		}
+		return hostIPs, true, nil
+	}
+
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return nil, false, err
 	}
 
+	found := false
+	hostIPs := make(map[string]bool)
+	for i := range ifaces {
+		if ifaces[i].Name != d.Iface {
+			continue
+		}
+		found = true
+		for j := range ifaces[i].Addresses {
+			hostIPs[ifaces[i].Addresses[j].String()] = true
+		}
+	}
+	return hostIPs, found, nil
+}
+
+// whitelistIPs returns the whitelisted IPs, including those the whitelisted
+// hosts currently resolve to, and makes sure we have names for them. This
+// takes DNS lookups: past startup, it only runs in resolveWhitelist.
+func (d *MetroSniffer) whitelistIPs() []string {
+	ips := append([]string{}, d.config.Ips...)
 	for i := range d.config.Hosts {
 		hostIPs, err := net.LookupHost(d.config.Hosts[i])
 		if err != nil {
@@ -390,34 +1106,208 @@ func (d *MetroSniffer) Sniff() error {
 			continue
 		}
 		for k := range hostIPs {
-			d.config.Ips = append(d.config.Ips, hostIPs[k])
-			d.nameLookup[hostIPs[k]] = d.config.Hosts[i]
-			log.Infof("%s resolving to: %s", d.config.Hosts[i], hostIPs[k])
+			ips = append(ips, hostIPs[k])
+			if name, ok := d.nameLookup.Get(hostIPs[k]); !ok || name != d.config.Hosts[i] {
+				d.nameLookup.Set(hostIPs[k], d.config.Hosts[i])
+				log.Infof("%s resolving to: %s", d.config.Hosts[i], hostIPs[k])
+			}
 		}
 	}
 
-	hosts := make([]string, 0)
-	for i := range d.config.Ips {
-		hosts = append(hosts, fmt.Sprintf("host %s", d.config.Ips[i]))
-
+	if d.ptrMisses == nil {
+		d.ptrMisses = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for i := range ips {
 		//add posible missing hostnames
-		_, ok := d.nameLookup[d.config.Ips[i]]
+		_, ok := d.nameLookup.Get(ips[i])
+		if retry, missed := d.ptrMisses[ips[i]]; !ok && missed && now.Before(retry) {
+			continue
+		}
 		if !ok {
-			hostnames, err := net.LookupAddr(d.config.Ips[i])
+			hostnames, err := net.LookupAddr(ips[i])
 			if err != nil {
-				log.Errorf("Problem looking up hostnames for: %s", d.config.Ips[i])
+				log.Errorf("Problem looking up hostnames for: %s", ips[i])
+				d.ptrMisses[ips[i]] = now.Add(ptrRetryInterval)
 				continue
 			}
+			delete(d.ptrMisses, ips[i])
 			for j := range hostnames {
-				d.nameLookup[d.config.Ips[i]] = hostnames[j]
-				log.Infof("%s resolving to: %s", hostnames[j], d.config.Ips[i])
+				d.nameLookup.Set(ips[i], hostnames[j])
+				log.Infof("%s resolving to: %s", hostnames[j], ips[i])
 			}
 		}
 	}
+	return ips
+}
+
+// resolveWhitelist re-resolves the whitelisted hosts every hostRefreshInterval
+// until done is closed, handing their IPs to the sniffing goroutine: lookups
+// may take a while, and must not hold up the capture.
+func (d *MetroSniffer) resolveWhitelist(resolved chan<- []string, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(jittered(hostRefreshInterval)):
+		}
+
+		ips := d.whitelistIPs()
+		select {
+		case resolved <- ips:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (d *MetroSniffer) bpfFilter(ips []string) string {
+	hosts := make([]string, 0)
+	for i := range ips {
+		hosts = append(hosts, fmt.Sprintf("host %s", ips[i]))
+	}
+
+	filter := d.Filter
+	if union := d.filters.union(); union != "" {
+		filter = "(" + filter + ") and (" + union + ")"
+	}
+	if d.config.Tunnels {
+		filter = "(" + filter + " or " + tunnelFilter + ")"
+	}
+	if d.config.UDP != nil {
+		filter = "(" + filter + " or udp)"
+	}
+	if d.config.ICMP {
+		filter = "(" + filter + " or icmp or icmp6)"
+	}
+	if d.config.DNS {
+		filter = "(" + filter + " or port 53)"
+	}
+	filter += " and not host 127.0.0.1 and not host ::1"
+	// with tunnels, hosts are matched against the inner headers in userspace.
+	if len(hosts) > 0 && !d.config.Tunnels {
+		filter += " and (" + strings.Join(hosts, " or ") + ")"
+	}
+	if narrowed := d.narrow.hosts(); len(narrowed) > 0 {
+		for i := range narrowed {
+			narrowed[i] = "host " + narrowed[i]
+		}
+		filter += " and (" + strings.Join(narrowed, " or ") + ")"
+	}
+	if d.calib != nil {
+		filter = "(" + filter + ") or (" + d.calib.filter() + ")"
+	}
+	return filter
+}
+
+func (d *MetroSniffer) setWhitelist(ips []string) {
+	d.whitelist = make(map[string]bool)
+	for _, host := range ips {
+		d.whitelist[host] = true
+	}
+	d.userFilter = len(d.whitelist) > 0
+}
+
+// refresh re-enumerates our addresses (DHCP renewals, floating IPs...) and
+// picks up the whitelisted IPs last resolved, updating the BPF filter if
+// needed. Called from the sniffing goroutine so no locking is required.
+func (d *MetroSniffer) refresh() {
+	hostIPs, found, err := d.localAddresses()
+	if err != nil || !found {
+		log.Warnf("Unable to refresh addresses for %q: %v", d.Iface, err)
+	} else if !reflect.DeepEqual(hostIPs, d.hostIPs) {
+		log.Infof("Addresses for %q changed: %v", d.Iface, hostIPs)
+		d.hostIPs = hostIPs
+	}
+
+	ips := d.ips
+	bpf := d.bpfFilter(ips)
+	if bpf == d.bpf {
+		return
+	}
+
+	log.Infof("Updating BPF filter: %s", bpf)
+	if err := d.handle.SetBPFFilter(bpf); err == errBPFUnsupported {
+		d.setWhitelist(ips)
+	} else if err != nil {
+		log.Errorf("error updating BPF filter: %s", err)
+		return
+	}
+	d.bpf = bpf
+}
+
+func (d *MetroSniffer) Sniff() error {
+
+	if d.handle == nil {
+
+		log.Infof("starting capture on interface %q", d.Iface)
+
+		if d.Iface != fileInterface {
+			handle, err := d.openStartup()
+			if err != nil {
+				d.reporter.Stop()
+				d.die(err)
+				return err
+			}
+			d.handle = handle
+		} else {
+			files, err := pcapFiles(d.config.Pcap)
+			if err != nil {
+				log.Errorf("Unable to find pcap files %q", d.config.Pcap)
+				d.reporter.Stop()
+				d.die(err)
+				return err
+			}
+			handle, err := openOffline(files[0])
+			if err != nil {
+				log.Errorf("Unable to open pcap file %q", files[0])
+				d.reporter.Stop()
+				d.die(err)
+				return err
+			}
+			d.handle = handle
+			d.pcaps = files
+		}
+	}
+
+	d.decoder = d.decoderFor(d.handle.LinkType())
+
+	// failing from here on stops the instance, not the daemon: it may have
+	// been added through the control API. At startup, we exit finding it
+	// isn't running.
+	hostIPs, found, err := d.localAddresses()
+	if err != nil {
+		log.Criticalf("Error getting interface details: %s", err)
+		d.reporter.Stop()
+		d.die(err)
+		return err
+	}
+	if !found && d.Iface != fileInterface {
+		err := fmt.Errorf("Could not find interface details for: %s", d.Iface)
+		log.Criticalf("%v", err)
+		d.reporter.Stop()
+		d.die(err)
+		return err
+	}
+	for ip := range hostIPs {
+		d.hostIPs[ip] = true
+	}
+
+	ips := d.whitelistIPs()
+	d.ips = ips
+
+	if d.config.Calibration != "" && d.Iface != fileInterface {
+		d.calib, err = newClockCalibration(d.config.Calibration, net.JoinHostPort(d.statsdIP, strconv.Itoa(int(d.statsdPort))))
+		if err != nil {
+			log.Warnf("Clock calibration disabled: %v", err)
+		} else {
+			defer d.calib.Close()
+		}
+	}
 
 	//let's make sure they haven't just whitelisted local ips/hosts
 	localWhitelist := true
-	for _, host := range d.config.Ips {
+	for _, host := range ips {
 		_, local := d.hostIPs[host]
 		if !local {
 			localWhitelist = false
@@ -425,36 +1315,62 @@ func (d *MetroSniffer) Sniff() error {
 	}
 	if localWhitelist {
 		err := errors.New("Whitelist cannot contain just local addresses! Bailing out")
-		log.Errorf("%v : %v", err, hosts)
+		log.Errorf("%v : %v", err, ips)
 		d.reporter.Stop()
 		d.die(err)
 		return err
 	}
 
-	bpfFilter := ""
-	if len(hosts) > 0 {
-		bpfFilter = "(" + strings.Join(hosts, " or ") + ")"
+	if d.config.Narrowing != nil && d.Iface != fileInterface && !d.config.Tunnels {
+		d.narrow = newBPFNarrowing(d.config.Narrowing, d.flows, time.Now())
+	} else if d.config.Narrowing != nil {
+		log.Warnf("Adaptive filter ignored, only live captures without tunnels can be narrowed.")
 	}
 
-	d.Filter += " and not host 127.0.0.1"
-	if len(hosts) > 0 {
-		d.Filter += " and " + bpfFilter
+	d.bpf = d.bpfFilter(ips)
+	log.Infof("Setting BPF filter: %s", d.bpf)
+	if err := d.handle.SetBPFFilter(d.bpf); err == errBPFUnsupported {
+		log.Warnf("BPF filters unsupported by this build, falling back to userspace whitelisting (custom filters are ignored).")
+		d.setWhitelist(ips)
+	} else if err != nil {
+		log.Criticalf("error setting BPF filter: %s", err)
+		d.reporter.Stop()
+		d.die(err)
+		return err
 	}
+	d.nextRefresh = time.Now().Add(splayed(hostRefreshInterval))
 
-	log.Infof("Setting BPF filter: %s", d.Filter)
-	if err := d.pcapHandle.SetBPFFilter(d.Filter); err != nil {
-		log.Criticalf("error setting BPF filter: %s", err)
-		panic(Exit{1})
+	if d.config.Tee != nil && d.config.Tee.Path != "" && len(d.pcaps) > 1 {
+		log.Warnf("Teeing is unsupported when reading several pcap files, ignoring.")
+	} else if d.config.Tee != nil && d.config.Tee.Path != "" {
+		d.tee, err = newPcapTee(d.config.Tee, d.Snaplen, d.handle.LinkType())
+		if err != nil {
+			log.Errorf("Unable to open pcap tee %q: %v", d.config.Tee.Path, err)
+		} else {
+			defer d.tee.Close()
+		}
+	}
+
+	if d.config.Matrix != nil {
+		d.matrix, err = newTrafficMatrix(d.config.Matrix, d.flows)
+		if err != nil {
+			log.Errorf("Unable to set up traffic matrix export: %v", err)
+		} else {
+			d.matrix.Start()
+			defer d.matrix.Close()
+		}
 	}
 
 	log.Infof("reading in packets")
-	if d.Iface == fileInterface {
+	if d.Iface == fileInterface && len(d.pcaps) > 1 {
+		d.sniffFiles()
+	} else if d.Iface == fileInterface {
 		d.SniffOffline()
 	} else {
 		d.SniffLive()
 	}
 
-	for k := range d.flows.FlowMapKeyIterator() {
+	for _, k := range d.flows.Keys() {
 		flow, e := d.flows.Get(k)
 		if e && flow.Sampled > 0 {
 			if d.Soften {
@@ -465,6 +1381,12 @@ func (d *MetroSniffer) Sniff() error {
 		}
 	}
 
+	if d.Iface == fileInterface && d.config.Summary != nil {
+		if err := writeSummary(d.config.Summary, d.flows); err != nil {
+			log.Errorf("Unable to write offline summary: %v", err)
+		}
+	}
+
 	//Shutdown reporter thread
 	return d.reporter.Stop()
 }
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 const goodCfg = `
@@ -135,6 +142,32 @@ config:
   ips:
 `
 
+const legacyCfg = `
+init_config:
+    snaplen: 512
+    idle_ttl: 300
+    exp_ttl: 60
+    statsd_ip: 127.0.0.1
+    statsd_port: 8125
+
+instances:
+- interface: en0
+  ips:
+    - 192.168.1.1
+`
+
+const futureCfg = `
+version: 999
+
+init_config:
+    snaplen: 512
+
+instances:
+- interface: en0
+  ips:
+    - 192.168.1.1
+`
+
 func TestParseConfig(t *testing.T) {
 	var cfg MetroConfig
 	err := cfg.Parse([]byte(goodCfg))
@@ -160,6 +193,67 @@ func TestParseBadConfig(t *testing.T) {
 	}
 }
 
+func TestParseLegacyConfig(t *testing.T) {
+	var cfg MetroConfig
+	err := cfg.Parse([]byte(legacyCfg))
+	if err != nil {
+		t.Fatalf("MetroConfig.parse expected == nil, got %q", err)
+	}
+
+	if cfg.Version != configVersion {
+		t.Fatalf("MetroConfig.parse should migrate to version %v, got %v", configVersion, cfg.Version)
+	}
+	if cfg.InitConf.ExpTTL != 60 {
+		t.Fatalf("MetroConfig.parse failed to migrate exp_ttl expected == 60, got %v", cfg.InitConf.ExpTTL)
+	}
+}
+
+func TestParseFutureConfig(t *testing.T) {
+	var cfg MetroConfig
+	err := cfg.Parse([]byte(futureCfg))
+	if err == nil {
+		t.Fatalf("MetroConfig.parse expected error for unknown version, got %v", err)
+	}
+}
+
+func TestSnifferSoften(t *testing.T) {
+	on := true
+	instcfg := InitConfig{StatsdIP: "127.0.0.1", StatsdPort: 8125, Soften: &on}
+	cfg := Config{Interface: fileInterface, Pcap: "fixtures/test_scp.pcap", Ips: []string{"162.243.251.92"}}
+	s, err := NewMetroSniffer(instcfg, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error creating sniffer: %v", err)
+	}
+	if !s.Soften {
+		t.Errorf("Expected init_config soften to be applied")
+	}
+
+	off := false
+	cfg.Soften = &off
+	if s, err = NewMetroSniffer(instcfg, cfg, "tcp"); err != nil {
+		t.Fatalf("Unexpected error creating sniffer: %v", err)
+	}
+	if s.Soften {
+		t.Errorf("Expected instance soften to override init_config")
+	}
+
+	// ewma smoothing softens unless told not to.
+	cfg.Smoothing = &SmoothingConfig{SRTT: smoothEWMA}
+	if s, err = NewMetroSniffer(instcfg, cfg, "tcp"); err != nil {
+		t.Fatalf("Unexpected error creating sniffer: %v", err)
+	}
+	if s.Soften {
+		t.Errorf("Expected instance soften: false to hold with ewma smoothing")
+	}
+	cfg.Soften, instcfg.Soften = nil, nil
+	if s, err = NewMetroSniffer(instcfg, cfg, "tcp"); err != nil {
+		t.Fatalf("Unexpected error creating sniffer: %v", err)
+	}
+	if !s.Soften {
+		t.Errorf("Expected ewma smoothing to soften by default")
+	}
+}
+
 func TestBadInterfaceSniffer(t *testing.T) {
 	var cfg MetroConfig
 	err := cfg.Parse([]byte(badInterfaceCfg))
@@ -271,6 +365,26 @@ func TestSnifferWhitelistFilter(t *testing.T) {
 	}
 }
 
+func TestWhitelistPTRMisses(t *testing.T) {
+	d := &MetroSniffer{
+		config:     Config{Ips: []string{"192.0.2.1"}},
+		nameLookup: NewLookupTable(),
+	}
+
+	// IPs without a name aren't looked up again before they're due.
+	retry := time.Now().Add(time.Minute)
+	d.ptrMisses = map[string]time.Time{"192.0.2.1": retry}
+	if ips := d.whitelistIPs(); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Fatalf("Expected the whitelisted IP, got %v", ips)
+	}
+	if d.ptrMisses["192.0.2.1"] != retry {
+		t.Fatalf("Expected no lookup before the retry is due")
+	}
+	if _, ok := d.nameLookup.Get("192.0.2.1"); ok {
+		t.Fatalf("Expected no name for the whitelisted IP")
+	}
+}
+
 func TestSnifferFromScp(t *testing.T) {
 	var cfg MetroConfig
 	err := cfg.Parse([]byte(scpFileCfg))
@@ -318,3 +432,1360 @@ func TestSnifferFromScp(t *testing.T) {
 		t.Fatalf("Incorrect number of flows detected %v - only single flow in source pcap.", n_flows)
 	}
 }
+
+// ipv6Segment builds an ethernet frame carrying an IPv6 TCP segment with the
+// timestamps option.
+func ipv6Segment(t *testing.T, src, dst string, sport, dport layers.TCPPort, seq, ack, tsval, tsecr uint32, payload []byte) []byte {
+	ts := make([]byte, 8)
+	ts[0], ts[1], ts[2], ts[3] = byte(tsval>>24), byte(tsval>>16), byte(tsval>>8), byte(tsval)
+	ts[4], ts[5], ts[6], ts[7] = byte(tsecr>>24), byte(tsecr>>16), byte(tsecr>>8), byte(tsecr)
+	opts := []layers.TCPOption{{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: ts}}
+	return ipv6SegmentOpts(t, src, dst, sport, dport, seq, ack, opts, payload)
+}
+
+func ipv6SegmentOpts(t *testing.T, src, dst string, sport, dport layers.TCPPort, seq, ack uint32, options []layers.TCPOption, payload []byte) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolTCP,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP(src),
+		DstIP:      net.ParseIP(dst),
+	}
+	tcp := &layers.TCP{
+		SrcPort: sport,
+		DstPort: dport,
+		Seq:     seq,
+		Ack:     ack,
+		ACK:     true,
+		Window:  1024,
+		Options: options,
+	}
+	tcp.SetNetworkLayerForChecksum(ip6)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip6, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("Unable to build packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnifferIPv6(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	start := time.Now()
+	for _, seq := range []uint32{1000, 1100} {
+		out := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, seq, 1, 100, 50, make([]byte, 100))
+		d.handlePacket(out, &gopacket.CaptureInfo{Timestamp: start})
+	}
+	in := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 5432, 40000, 1, 1100, 51, 100, nil)
+	d.handlePacket(in, &gopacket.CaptureInfo{Timestamp: start.Add(5 * time.Millisecond)})
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+	if !ok {
+		t.Fatalf("Expected an IPv6 flow, got %v", d.flows.Map)
+	}
+	if flow.Sampled != 1 || flow.Last != uint64(5*time.Millisecond) || flow.Bytes != 200 {
+		t.Fatalf("Unexpected IPv6 flow accounting: sampled %d, last %v, bytes %d", flow.Sampled, flow.Last, flow.Bytes)
+	}
+}
+
+// qinq stacks an 802.1ad and an 802.1Q tag onto an ethernet frame.
+func qinq(frame []byte, outer, inner uint16) []byte {
+	out := append([]byte{}, frame[:12]...)
+	out = append(out, 0x88, 0xa8, byte(outer>>8), byte(outer))
+	out = append(out, 0x81, 0x00, byte(inner>>8), byte(inner))
+	return append(out, frame[12:]...)
+}
+
+func TestSnifferQinQ(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{VLANTags: true},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	start := time.Now()
+	for _, seq := range []uint32{1000, 1100} {
+		out := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, seq, 1, 100, 50, make([]byte, 100))
+		d.handlePacket(qinq(out, 100, 20), &gopacket.CaptureInfo{Timestamp: start})
+	}
+	in := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 5432, 40000, 1, 1100, 51, 100, nil)
+	d.handlePacket(qinq(in, 100, 20), &gopacket.CaptureInfo{Timestamp: start.Add(5 * time.Millisecond)})
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+	if !ok {
+		t.Fatalf("Expected a flow through stacked VLANs, got %v", d.flows.Map)
+	}
+	if flow.Sampled != 1 {
+		t.Fatalf("Expected a sample through stacked VLANs, got %d", flow.Sampled)
+	}
+	if tags := vlanTags(flow.VLANs); !reflect.DeepEqual(tags, []string{"vlan:20", "outer_vlan:100"}) {
+		t.Fatalf("Unexpected VLAN tags: %v", tags)
+	}
+}
+
+// encapsulate wraps an ethernet frame in an IPv4 tunnel - the bare IPv6
+// packet in it, without tunnel layers.
+func encapsulate(t *testing.T, frame []byte, tunnel ...gopacket.SerializableLayer) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 7},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 8},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version: 4,
+		TTL:     64,
+		SrcIP:   net.IP{192, 168, 0, 1},
+		DstIP:   net.IP{192, 168, 0, 2},
+	}
+	switch {
+	case len(tunnel) == 0:
+		ip4.Protocol = layers.IPProtocolIPv6
+		frame = frame[14:]
+	case tunnel[0].LayerType() == layers.LayerTypeUDP:
+		ip4.Protocol = layers.IPProtocolUDP
+		tunnel[0].(*layers.UDP).SetNetworkLayerForChecksum(ip4)
+	default:
+		ip4.Protocol = layers.IPProtocolGRE
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	all := append([]gopacket.SerializableLayer{eth, ip4}, tunnel...)
+	if err := gopacket.SerializeLayers(buf, opts, append(all, gopacket.Payload(frame))...); err != nil {
+		t.Fatalf("Unable to build packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnifferTunnels(t *testing.T) {
+	// Geneve header, VNI 43, transparent ethernet bridging.
+	geneve := gopacket.Payload{0, 0, 0x65, 0x58, 0, 0, 43, 0}
+	tunnels := []struct {
+		tag   string
+		layer func() []gopacket.SerializableLayer
+	}{
+		{"vni:42", func() []gopacket.SerializableLayer {
+			return []gopacket.SerializableLayer{&layers.UDP{SrcPort: 50000, DstPort: 4789}, &layers.VXLAN{ValidIDFlag: true, VNI: 42}}
+		}},
+		{"vni:43", func() []gopacket.SerializableLayer {
+			return []gopacket.SerializableLayer{&layers.UDP{SrcPort: 50000, DstPort: 6081}, geneve}
+		}},
+		{"gre_key:7", func() []gopacket.SerializableLayer {
+			return []gopacket.SerializableLayer{&layers.GRE{KeyPresent: true, Key: 7, Protocol: layers.EthernetTypeTransparentEthernetBridging}}
+		}},
+		{"tunnel:sit", func() []gopacket.SerializableLayer {
+			return nil
+		}},
+	}
+
+	for _, tt := range tunnels {
+		policies, _ := newTrafficPolicies(nil)
+		d := &MetroSniffer{
+			IdleTTL:    300,
+			decoders:   make(map[layers.LinkType]*MetroDecoder),
+			hostIPs:    map[string]bool{"192.168.0.1": true},
+			whitelist:  make(map[string]bool),
+			nameLookup: NewLookupTable(),
+			flows:      NewFlowMap(),
+			policies:   policies,
+		}
+		d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+		start := time.Now()
+		for _, seq := range []uint32{1000, 1100} {
+			out := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, seq, 1, 100, 50, make([]byte, 100))
+			d.handlePacket(encapsulate(t, out, tt.layer()...), &gopacket.CaptureInfo{Timestamp: start})
+		}
+		in := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 5432, 40000, 1, 1100, 51, 100, nil)
+		d.handlePacket(encapsulate(t, in, tt.layer()...), &gopacket.CaptureInfo{Timestamp: start.Add(5 * time.Millisecond)})
+
+		flow, ok := d.flows.Get(tt.tag + "/[2001:db8::1]:40000-[2001:db8::2]:5432")
+		if !ok {
+			t.Fatalf("Expected an encapsulated flow in %s, got %v", tt.tag, d.flows.Map)
+		}
+		if flow.Sampled != 1 || flow.Tunnel != tt.tag {
+			t.Fatalf("Unexpected encapsulated flow: sampled %d, tunnel %q", flow.Sampled, flow.Tunnel)
+		}
+	}
+}
+
+func TestSnifferESP(t *testing.T) {
+	d := &MetroSniffer{
+		decoders: make(map[layers.LinkType]*MetroDecoder),
+		flows:    NewFlowMap(),
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolESP,
+		SrcIP:    net.IP{192, 168, 0, 1},
+		DstIP:    net.IP{192, 168, 0, 2},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip4, gopacket.Payload(make([]byte, 64))); err != nil {
+		t.Fatalf("Unable to build packet: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := d.handlePacket(buf.Bytes(), &gopacket.CaptureInfo{Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Unexpected error handling ESP packet: %v", err)
+		}
+	}
+	if d.encrypted != 3 {
+		t.Fatalf("Expected 3 ESP packets counted, got %d", d.encrypted)
+	}
+	d.reportCounters()
+	if d.encrypted != 0 {
+		t.Fatalf("Expected ESP packet counter reset once reported, got %d", d.encrypted)
+	}
+}
+
+// ipv4Fragments builds a TCP segment and splits it into IPv4 fragments, the
+// first carrying size bytes of the IP payload.
+func ipv4Fragments(t *testing.T, src, dst string, sport, dport layers.TCPPort, seq, ack, tsval, tsecr uint32, payload []byte, size int) [][]byte {
+	frame := ipv6Segment(t, "::1", "::2", sport, dport, seq, ack, tsval, tsecr, payload)
+	tcp := frame[14+40:]
+	// IPv6 checksums don't do for IPv4, recompute with the right pseudo-header.
+	p := gopacket.NewPacket(tcp, layers.LayerTypeTCP, gopacket.Default)
+	tcpLayer := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	whole := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	tcpLayer.SetNetworkLayerForChecksum(whole)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, tcpLayer, gopacket.Payload(tcpLayer.Payload)); err != nil {
+		t.Fatalf("Unable to build segment: %v", err)
+	}
+	data := buf.Bytes()
+
+	var frags [][]byte
+	for off := 0; off < len(data); off += size {
+		end := off + size
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Id: 42, Protocol: layers.IPProtocolTCP, FragOffset: uint16(off / 8), SrcIP: whole.SrcIP, DstIP: whole.DstIP}
+		if end < len(data) {
+			ip4.Flags = layers.IPv4MoreFragments
+		} else {
+			end = len(data)
+		}
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		out := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(out, opts, eth, ip4, gopacket.Payload(data[off:end])); err != nil {
+			t.Fatalf("Unable to build fragment: %v", err)
+		}
+		frags = append(frags, append([]byte(nil), out.Bytes()...))
+	}
+	return frags
+}
+
+func TestSnifferFragments(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"10.0.0.1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	start := time.Now()
+	for _, seq := range []uint32{1000, 1100} {
+		frags := ipv4Fragments(t, "10.0.0.1", "10.0.0.2", 40000, 5432, seq, 1, 100, 50, make([]byte, 100), 56)
+		// out of order.
+		for i := len(frags) - 1; i >= 0; i-- {
+			if err := d.handlePacket(frags[i], &gopacket.CaptureInfo{Timestamp: start}); err != nil {
+				t.Fatalf("Unexpected error handling fragment: %v", err)
+			}
+		}
+	}
+	in := ipv4Fragments(t, "10.0.0.2", "10.0.0.1", 5432, 40000, 1, 1100, 51, 100, nil, 1500)
+	d.handlePacket(in[0], &gopacket.CaptureInfo{Timestamp: start.Add(5 * time.Millisecond)})
+
+	flow, ok := d.flows.Get("10.0.0.1:40000-10.0.0.2:5432")
+	if !ok {
+		t.Fatalf("Expected a flow out of reassembled segments, got %v", d.flows.Map)
+	}
+	if flow.Sampled != 1 || flow.Bytes != 200 {
+		t.Fatalf("Unexpected reassembled flow accounting: sampled %d, bytes %d", flow.Sampled, flow.Bytes)
+	}
+	if d.fragments != 6 {
+		t.Fatalf("Expected 6 fragments counted, got %d", d.fragments)
+	}
+}
+
+func TestSnifferSuperPackets(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{IgnoreOffloads: true},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// a GRO aggregate, acked half-way through.
+	start := time.Now()
+	out := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, 1000, 1, 100, 50, make([]byte, 20000))
+	d.handlePacket(out, &gopacket.CaptureInfo{Timestamp: start})
+	in := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 5432, 40000, 1, 1000+3*defaultMSS, 51, 100, nil)
+	d.handlePacket(in, &gopacket.CaptureInfo{Timestamp: start.Add(5 * time.Millisecond)})
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if flow.Sampled != 1 || flow.Bytes != 20000 {
+		t.Fatalf("Unexpected super-packet accounting: sampled %d, bytes %d", flow.Sampled, flow.Bytes)
+	}
+	if flow.Segments != 14 || d.superPackets != 1 {
+		t.Fatalf("Expected 14 segments out of 1 super-packet, got %d out of %d", flow.Segments, d.superPackets)
+	}
+}
+
+func TestSnifferDSCP(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{DSCPTags: true},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	for _, tt := range []struct {
+		dscp  uint8
+		class string
+	}{{46, "ef"}, {34, "af41"}, {0, "cs0"}, {5, "5"}} {
+		out := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 5432, 1000, 1, 100, 50, make([]byte, 100))
+		// the traffic class straddles the version and the flow label.
+		tc := tt.dscp << 2
+		out[14], out[15] = 0x60|tc>>4, tc<<4
+		d.handlePacket(out, &gopacket.CaptureInfo{Timestamp: time.Now()})
+
+		flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+		if !ok {
+			t.Fatalf("Expected a flow, got %v", d.flows.Map)
+		}
+		if flow.QoS != tt.class {
+			t.Fatalf("Expected DSCP %d flow tagged %q, got %q", tt.dscp, tt.class, flow.QoS)
+		}
+	}
+}
+
+// udpDatagram builds an ethernet frame carrying an IPv4 UDP datagram.
+func udpDatagram(t *testing.T, src, dst string, sport, dport layers.UDPPort, payload []byte) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+	udp := &layers.UDP{SrcPort: sport, DstPort: dport}
+	udp.SetNetworkLayerForChecksum(ip4)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip4, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("Unable to build packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnifferUDP(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{UDP: &UDPConfig{RequestPorts: defaultUDPRequestPorts}},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"10.0.0.1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// two DNS queries, one answered.
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+	for i := 0; i < 2; i++ {
+		if err := d.handlePacket(udpDatagram(t, "10.0.0.1", "10.0.0.53", 40000, 53, make([]byte, 30)), ci); err != nil {
+			t.Fatalf("Unexpected error handling DNS query: %v", err)
+		}
+	}
+	d.handlePacket(udpDatagram(t, "10.0.0.53", "10.0.0.1", 53, 40000, make([]byte, 100)), ci)
+
+	flow, ok := d.flows.UDP["10.0.0.1:40000-10.0.0.53:53"]
+	if !ok {
+		t.Fatalf("Expected a UDP flow, got %v", d.flows.UDP)
+	}
+	if flow.Service != 53 || flow.Packets != 3 || flow.Bytes != 160 {
+		t.Fatalf("Unexpected UDP flow accounting: service %d, packets %d, bytes %d", flow.Service, flow.Packets, flow.Bytes)
+	}
+	if flow.Requests != 2 || flow.Responses != 1 {
+		t.Fatalf("Expected 2 requests and 1 response, got %d and %d", flow.Requests, flow.Responses)
+	}
+}
+
+func TestSnifferPathChanges(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// the remote end rehashes its flow label, then packets come in over a
+	// longer path.
+	for _, tt := range []struct {
+		label uint32
+		hops  uint8
+	}{{0x12345, 60}, {0x12345, 60}, {0x54321, 60}, {0x54321, 58}} {
+		in := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 5432, 40000, 1, 1000, 51, 100, nil)
+		in[15], in[16], in[17] = byte(tt.label>>16)&0x0f, byte(tt.label>>8), byte(tt.label)
+		in[21] = tt.hops
+		d.handlePacket(in, &gopacket.CaptureInfo{Timestamp: time.Now()})
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:5432")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if flow.LabelChanges != 1 || flow.PathChanges != 1 {
+		t.Fatalf("Expected a flow label and a path change, got %d and %d", flow.LabelChanges, flow.PathChanges)
+	}
+}
+
+// icmpEcho builds an ethernet frame carrying an ICMP echo request or reply.
+func icmpEcho(t *testing.T, src, dst string, request bool, id, seq uint16) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+	typ := uint8(layers.ICMPv4TypeEchoReply)
+	if request {
+		typ = layers.ICMPv4TypeEchoRequest
+	}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(typ, 0), Id: id, Seq: seq}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip4, icmp, gopacket.Payload(make([]byte, 56))); err != nil {
+		t.Fatalf("Unable to build packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnifferICMP(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{ICMP: true},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"10.0.0.1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// two pings, the second one lost.
+	start := time.Now()
+	for seq := uint16(1); seq <= 2; seq++ {
+		d.handlePacket(icmpEcho(t, "10.0.0.1", "10.0.0.2", true, 7, seq), &gopacket.CaptureInfo{Timestamp: start})
+	}
+	if err := d.handlePacket(icmpEcho(t, "10.0.0.2", "10.0.0.1", false, 7, 1), &gopacket.CaptureInfo{Timestamp: start.Add(3 * time.Millisecond)}); err != nil {
+		t.Fatalf("Unexpected error handling echo reply: %v", err)
+	}
+
+	flow, ok := d.flows.ICMP["10.0.0.1-10.0.0.2"]
+	if !ok {
+		t.Fatalf("Expected an ICMP flow, got %v", d.flows.ICMP)
+	}
+	if flow.Sampled != 1 || flow.Last != uint64(3*time.Millisecond) || len(flow.Pending) != 1 {
+		t.Fatalf("Unexpected echo accounting: sampled %d, last %v, pending %d", flow.Sampled, time.Duration(flow.Last), len(flow.Pending))
+	}
+}
+
+// tlsRecord builds a TLS record of the given content type, for handshakes
+// starting with the given message type.
+func tlsRecord(typ, msg byte, size int) []byte {
+	rec := []byte{typ, 3, 3, byte(size >> 8), byte(size)}
+	body := make([]byte, size)
+	if typ == tlsHandshake {
+		body[0] = msg
+	}
+	return append(rec, body...)
+}
+
+func TestSnifferTLS(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// a TLS 1.2 handshake to port 443, the client's key exchange, change
+	// cipher spec and Finished in one segment.
+	start := time.Now()
+	segments := []struct {
+		out     bool
+		payload []byte
+		at      time.Duration
+	}{
+		{true, tlsRecord(tlsHandshake, tlsClientHello, 200), 0},
+		{false, append(tlsRecord(tlsHandshake, tlsServerHello, 80), tlsRecord(tlsHandshake, 11, 900)...), 10 * time.Millisecond},
+		{true, append(append(tlsRecord(tlsHandshake, 16, 70), tlsRecord(tlsChangeCipherSpec, 0, 1)...), tlsRecord(tlsHandshake, 0, 40)...), 25 * time.Millisecond},
+		{true, tlsRecord(tlsApplicationData, 0, 300), 40 * time.Millisecond},
+	}
+	for i, s := range segments {
+		var out []byte
+		if s.out {
+			out = ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 443, uint32(1000+i*1000), 1, 100, 50, s.payload)
+		} else {
+			out = ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, uint32(1000+i*1000), 1, 51, 100, s.payload)
+		}
+		if err := d.handlePacket(out, &gopacket.CaptureInfo{Timestamp: start.Add(s.at)}); err != nil {
+			t.Fatalf("Unexpected error handling TLS segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if !flow.TLSClient || flow.TLSHandshake != uint64(25*time.Millisecond) || flow.TLSServerHello-flow.TLSHello != int64(10*time.Millisecond) {
+		t.Fatalf("Unexpected TLS handshake: client %v, handshake %v, server hello after %v", flow.TLSClient, time.Duration(flow.TLSHandshake), time.Duration(flow.TLSServerHello-flow.TLSHello))
+	}
+	if flow.Segments != 3 {
+		t.Fatalf("Expected our segments to port 443 to be tracked, got %d", flow.Segments)
+	}
+}
+
+func TestSnifferHandshake(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// we connect, our SYN is retransmitted once before the SYN-ACK.
+	const (
+		syn    = 0x02
+		synAck = 0x12
+		ack    = 0x10
+	)
+	start := time.Now()
+	segments := []struct {
+		out   bool
+		flags byte
+		at    time.Duration
+	}{
+		{true, syn, 0},
+		{true, syn, time.Second},
+		{false, synAck, time.Second + 30*time.Millisecond},
+		{true, ack, time.Second + 31*time.Millisecond},
+		{false, ack, time.Second + 50*time.Millisecond},
+	}
+	for _, s := range segments {
+		var out []byte
+		if s.out {
+			out = ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 443, 1000, 1, 100, 50, nil)
+		} else {
+			out = ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, 1, 1001, 51, 100, nil)
+		}
+		// TCP flags, past the ethernet and IPv6 headers.
+		out[14+40+13] = s.flags
+		if err := d.handlePacket(out, &gopacket.CaptureInfo{Timestamp: start.Add(s.at)}); err != nil {
+			t.Fatalf("Unexpected error handling handshake segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if !flow.Client || flow.SYNACKTime != uint64(time.Second+30*time.Millisecond) || flow.ACKTime != uint64(time.Millisecond) {
+		t.Fatalf("Unexpected handshake: client %v, SYN-ACK after %v, ACK after %v", flow.Client, time.Duration(flow.SYNACKTime), time.Duration(flow.ACKTime))
+	}
+	if flow.Refused {
+		t.Fatalf("Expected a completed handshake not to be refused")
+	}
+
+	// a connection attempt refused, then expiring shortly.
+	d.ExpTTL = 5
+	out := ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40001, 8080, 1000, 0, 100, 0, nil)
+	out[14+40+13] = syn
+	d.handlePacket(out, &gopacket.CaptureInfo{Timestamp: start})
+	rst := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 8080, 40001, 0, 1001, 0, 100, nil)
+	rst[14+40+13] = 0x14 // RST, ACK
+	d.handlePacket(rst, &gopacket.CaptureInfo{Timestamp: start.Add(time.Millisecond)})
+	flow, ok = d.flows.Get("[2001:db8::1]:40001-[2001:db8::2]:8080")
+	if !ok || !flow.Refused || !flow.Done || flow.SYNACK != 0 {
+		t.Fatalf("Expected a refused connection attempt, got %+v", flow)
+	}
+}
+
+func TestSnifferSYNOptions(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// we announce 1440 and scale by 7, the server clamps its MSS and doesn't scale.
+	const (
+		syn    = 0x02
+		synAck = 0x12
+	)
+	for _, s := range []struct {
+		out   bool
+		flags byte
+		opts  []layers.TCPOption
+	}{
+		{true, syn, []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{5, 160}},
+			{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+		}},
+		{false, synAck, []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{4, 176}},
+		}},
+	} {
+		var out []byte
+		if s.out {
+			out = ipv6SegmentOpts(t, "2001:db8::1", "2001:db8::2", 40000, 443, 1000, 0, s.opts, nil)
+		} else {
+			out = ipv6SegmentOpts(t, "2001:db8::2", "2001:db8::1", 443, 40000, 1, 1001, s.opts, nil)
+		}
+		out[14+40+13] = s.flags
+		if err := d.handlePacket(out, &gopacket.CaptureInfo{Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Unexpected error handling handshake segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok || flow.MSS != 1200 || flow.SrcMSS != 1440 {
+		t.Fatalf("Expected the SYNs' MSS, got %v", d.flows.Map)
+	}
+
+	r := &Client{api: NewAPIClient("http://127.0.0.1:0", "key"), metrics: enabledMetrics(nil), synTags: true}
+	expected := []string{"src_mss:1440", "src_wscale:7", "dst_mss:1200", "dst_wscale:none"}
+	if tags := r.synOptionTags(flow); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Expected tags %v, got %v", expected, tags)
+	}
+	r.tagMode = tagModeClientServer
+	flow.Client = false
+	expected = []string{"client_mss:1200", "client_wscale:none", "server_mss:1440", "server_wscale:7"}
+	if tags := r.synOptionTags(flow); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Expected tags %v, got %v", expected, tags)
+	}
+
+	r.reportSYNOptions("flow", flow, nil, time.Now().Unix())
+	reported := make(map[string]float64)
+	for _, s := range r.api.pending {
+		reported[s.Metric+","+strings.Join(s.Tags, ",")] = s.Points[0][1]
+	}
+	for metric, v := range map[string]float64{
+		metricPrefix + "mss,direction:sent":              1200,
+		metricPrefix + "mss,direction:received":          1440,
+		metricPrefix + "window_scale,direction:received": 7,
+	} {
+		if reported[metric] != v {
+			t.Errorf("Expected %s = %v, got %v", metric, v, reported[metric])
+		}
+	}
+	if len(reported) != 3 {
+		t.Errorf("Expected no window scale reported for the end not scaling, got %v", reported)
+	}
+}
+
+func TestSnifferMACTags(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		config:     Config{MACTags: true},
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// an answer from the remote end, MACs swapped.
+	in := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, 1, 1001, 51, 100, nil)
+	if err := d.handlePacket(in, &gopacket.CaptureInfo{Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Unexpected error handling segment: %v", err)
+	}
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok || flow.LocalMAC != "00:01:02:03:04:06" || flow.RemoteMAC != "00:01:02:03:04:05" {
+		t.Fatalf("Unexpected flow MACs: %+v", flow)
+	}
+
+	r := &Client{tagMode: tagModeLocalRemote}
+	if tags := r.ouiTags(flow); !reflect.DeepEqual(tags, []string{"local_oui:00:01:02", "remote_oui:00:01:02"}) {
+		t.Fatalf("Unexpected OUI tags: %v", tags)
+	}
+}
+
+func TestSnifferRetransmits(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	payload := make([]byte, 100)
+	segments := []struct {
+		out bool
+		seq uint32
+	}{
+		{true, 1000},
+		{true, 1100},
+		{true, 1000}, // retransmitted
+		{true, 1150}, // half new
+		{false, 1},
+		{false, 1}, // retransmitted
+	}
+	for _, s := range segments {
+		var pkt []byte
+		if s.out {
+			pkt = ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 443, s.seq, 1, 100, 50, payload)
+		} else {
+			pkt = ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, s.seq, 1000, 51, 100, payload)
+		}
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if flow.Segments != 4 || flow.Retransmits != 1 || flow.RetxBytes != 150 {
+		t.Fatalf("Unexpected sent retransmissions: %d/%d segments, %d bytes", flow.Retransmits, flow.Segments, flow.RetxBytes)
+	}
+	if flow.Rcvd.Segments != 2 || flow.Rcvd.Retransmits != 1 || flow.Rcvd.RetxBytes != 100 {
+		t.Fatalf("Unexpected received retransmissions: %+v", flow.Rcvd)
+	}
+}
+
+func TestSnifferKarn(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// the first segment is retransmitted before being acknowledged, the ACK
+	// can't tell which transmission it's for. The second one is sampled.
+	payload := make([]byte, 100)
+	start := time.Now()
+	segments := []struct {
+		out      bool
+		seq, ack uint32
+		at       time.Duration
+	}{
+		{true, 1000, 1, 0},
+		{true, 1000, 1, 200 * time.Millisecond},
+		{false, 1, 1000, 210 * time.Millisecond},
+		{true, 1100, 1, 220 * time.Millisecond},
+		{false, 1, 1100, 230 * time.Millisecond},
+	}
+	for _, s := range segments {
+		var pkt []byte
+		if s.out {
+			pkt = ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 443, s.seq, s.ack, 100, 50, payload)
+		} else {
+			pkt = ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, s.seq, s.ack, 51, 100, nil)
+		}
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{Timestamp: start.Add(s.at)}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if flow.Sampled != 1 || flow.Last != uint64(10*time.Millisecond) {
+		t.Fatalf("Expected only the segment sent once to be sampled, got %d samples, last %v", flow.Sampled, time.Duration(flow.Last))
+	}
+}
+
+func TestSnifferReordering(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// two gaps in the data received: the first filled right away, reordered,
+	// the second well past the (default) reorder window, retransmitted. Then
+	// the remote end asks for more with four duplicate ACKs.
+	payload := make([]byte, 100)
+	start := time.Now()
+	segments := []struct {
+		seq     uint32
+		payload []byte
+		at      time.Duration
+	}{
+		{1, payload, 0},
+		{201, payload, time.Millisecond},
+		{101, payload, 2 * time.Millisecond},
+		{301, payload, 3 * time.Millisecond},
+		{501, payload, 4 * time.Millisecond},
+		{401, payload, 50 * time.Millisecond},
+		{601, nil, 60 * time.Millisecond},
+		{601, nil, 61 * time.Millisecond},
+		{601, nil, 62 * time.Millisecond},
+		{601, nil, 63 * time.Millisecond},
+	}
+	for _, s := range segments {
+		pkt := ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, s.seq, 1000, 51, 100, s.payload)
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{Timestamp: start.Add(s.at)}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if flow.Rcvd.Segments != 6 || flow.Rcvd.OutOfOrder != 1 || flow.Rcvd.Retransmits != 1 {
+		t.Fatalf("Unexpected received segments: %+v", flow.Rcvd)
+	}
+	if flow.DupAcks.Count != 4 || flow.DupAcks.Bursts != 1 || flow.RcvdDupAcks.Count != 0 {
+		t.Fatalf("Unexpected duplicate ACKs: %+v, %+v", flow.DupAcks, flow.RcvdDupAcks)
+	}
+}
+
+func TestSnifferWindows(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// after the handshake (no window scaling) we fill the remote end's 1024
+	// byte window, it then closes it until its application catches up, while
+	// we probe it.
+	start := time.Now()
+	segments := []struct {
+		local   bool
+		flags   byte
+		seq     uint32
+		ack     uint32
+		window  uint16
+		payload []byte
+	}{
+		{true, 0x02, 0, 0, 1024, nil},
+		{false, 0x12, 0, 1, 1024, nil},
+		{true, 0x10, 1, 1, 1024, nil},
+		{true, 0x10, 1, 1, 1024, make([]byte, 1024)},
+		{false, 0x10, 1, 1025, 0, nil},
+		{false, 0x10, 1, 1025, 0, nil},
+		{true, 0x10, 1025, 1, 1024, make([]byte, 1)},
+		{false, 0x10, 1, 1025, 0, nil},
+		{false, 0x10, 1, 1025, 1024, nil},
+		{true, 0x10, 1025, 1, 1024, make([]byte, 512)},
+	}
+	for i, s := range segments {
+		var pkt []byte
+		if s.local {
+			pkt = ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 443, s.seq, s.ack, 50, 0, s.payload)
+		} else {
+			pkt = ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, s.seq, s.ack, 51, 50, s.payload)
+		}
+		pkt[14+40+13] = s.flags
+		pkt[14+40+14], pkt[14+40+15] = byte(s.window>>8), byte(s.window)
+		ts := start.Add(time.Duration(i) * time.Millisecond)
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{Timestamp: ts}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if flow.Wnd.Zero != 1 || flow.Wnd.Full != 1 {
+		t.Fatalf("Unexpected remote window events: %+v", flow.Wnd)
+	}
+	if flow.RcvdWnd.Zero != 0 || flow.RcvdWnd.Full != 0 {
+		t.Fatalf("Unexpected local window events: %+v", flow.RcvdWnd)
+	}
+}
+
+func TestSnifferCloses(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// one connection closed orderly, one reset by the remote end after our
+	// FIN, one refused.
+	start := time.Now()
+	segments := []struct {
+		local bool
+		sport layers.TCPPort
+		flags byte
+	}{
+		{true, 40000, 0x02},
+		{false, 40000, 0x12},
+		{true, 40000, 0x11},
+		{false, 40000, 0x11},
+		{true, 40000, 0x10},
+		{true, 40001, 0x02},
+		{false, 40001, 0x12},
+		{true, 40001, 0x11},
+		{false, 40001, 0x14},
+		{true, 40002, 0x02},
+		{false, 40002, 0x14},
+	}
+	for i, s := range segments {
+		var pkt []byte
+		if s.local {
+			pkt = ipv6Segment(t, "2001:db8::1", "2001:db8::2", s.sport, 443, 1, 1, 50, 0, nil)
+		} else {
+			pkt = ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, s.sport, 1, 1, 51, 50, nil)
+		}
+		pkt[14+40+13] = s.flags
+		ts := start.Add(time.Duration(i) * time.Millisecond)
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{Timestamp: ts}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+
+	for _, expected := range []struct {
+		key   string
+		close string
+		local bool
+	}{
+		{"[2001:db8::1]:40000-[2001:db8::2]:443", closeFIN, false},
+		{"[2001:db8::1]:40001-[2001:db8::2]:443", closeReset, false},
+		{"[2001:db8::1]:40002-[2001:db8::2]:443", "", false},
+	} {
+		flow, ok := d.flows.Get(expected.key)
+		if !ok {
+			t.Fatalf("Expected flow %s, got %v", expected.key, d.flows.Map)
+		}
+		if flow.Close != expected.close || flow.ResetLocal != expected.local {
+			t.Fatalf("Unexpected close of %s: %q (local reset: %v)", expected.key, flow.Close, flow.ResetLocal)
+		}
+	}
+}
+
+func TestSnifferECN(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// an ECN capable exchange: one of our segments gets CE marked on the way,
+	// the remote end echoes it and we reduce our window.
+	payload := make([]byte, 100)
+	start := time.Now()
+	segments := []struct {
+		local bool
+		ecn   byte
+		flags byte
+	}{
+		{true, ecnECT0, 0x10},
+		{true, ecnCE, 0x10},
+		{false, ecnNotECT, 0x50},
+		{true, ecnECT0, 0x90},
+		{false, ecnNotECT, 0x10},
+	}
+	for i, s := range segments {
+		var pkt []byte
+		if s.local {
+			pkt = ipv6Segment(t, "2001:db8::1", "2001:db8::2", 40000, 443, uint32(1+100*i), 1, 50, 0, payload)
+		} else {
+			pkt = ipv6Segment(t, "2001:db8::2", "2001:db8::1", 443, 40000, 1, uint32(1+100*i), 51, 50, nil)
+		}
+		// traffic class, past the IP version.
+		pkt[15] |= s.ecn << 4
+		pkt[14+40+13] = s.flags
+		ts := start.Add(time.Duration(i) * time.Millisecond)
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{Timestamp: ts}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if flow.ECN != (ecnMarks{ECT: 3, CE: 1, CWR: 1}) {
+		t.Fatalf("Unexpected ECN signals sent: %+v", flow.ECN)
+	}
+	if flow.RcvdECN != (ecnMarks{ECE: 1}) {
+		t.Fatalf("Unexpected ECN signals received: %+v", flow.RcvdECN)
+	}
+}
+
+func sackOption(blocks ...uint32) layers.TCPOption {
+	data := make([]byte, 4*len(blocks))
+	for i, b := range blocks {
+		binary.BigEndian.PutUint32(data[4*i:], b)
+	}
+	return layers.TCPOption{OptionType: layers.TCPOptionKindSACK, OptionLength: uint8(2 + len(data)), OptionData: data}
+}
+
+func TestSACKLoss(t *testing.T) {
+	var s sackLoss
+	for i, step := range []struct {
+		ack       uint32
+		opts      []layers.TCPOption
+		holes, sz uint64
+	}{
+		{1000, []layers.TCPOption{sackOption(2000, 3000)}, 1, 1000},
+		// most recent block first, revealing a second hole.
+		{1000, []layers.TCPOption{sackOption(5000, 6000, 2000, 4000)}, 2, 2000},
+		{4000, []layers.TCPOption{sackOption(5000, 6000)}, 2, 2000},
+		{6000, nil, 2, 2000},
+		// D-SACK, a duplicate rather than a hole.
+		{6000, []layers.TCPOption{sackOption(5000, 5500)}, 2, 2000},
+		{6000, []layers.TCPOption{sackOption(7000, 8000)}, 3, 3000},
+	} {
+		o := parseTCPOptions(&layers.TCP{Options: step.opts})
+		s.track(step.ack, &o)
+		if s.Holes != step.holes || s.HoleBytes != step.sz {
+			t.Fatalf("Step %d: expected %d holes, %d bytes, got %+v", i, step.holes, step.sz, s)
+		}
+	}
+	if s.Acks != 5 {
+		t.Fatalf("Expected 5 ACKs with SACK blocks, got %d", s.Acks)
+	}
+
+	o := parseTCPOptions(&layers.TCP{Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{5, 180}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+	}})
+	if o.MSS != 1460 || !o.SACKPermitted || !o.HasWScale || o.WScale != 7 || o.HasTS {
+		t.Fatalf("Unexpected SYN options: %+v", o)
+	}
+}
+
+func TestOneWaySplit(t *testing.T) {
+	var o owdSplit
+	ms := int64(time.Millisecond)
+	// Dst's clock ticks every ms, from an arbitrary origin.
+	base := time.Now().UnixNano()
+	tsval := func(at int64) uint32 { return uint32(5000 + (at-base)/ms) }
+	o.observe(tsval(base), base)
+	o.sample(base, base+20*ms, tsval(base+10*ms))
+	if o.Samples != 0 {
+		t.Fatalf("Expected no split before the clock rate is known")
+	}
+	o.observe(tsval(base+2000*ms), base+2000*ms)
+	if o.hz != 1000 {
+		t.Fatalf("Expected a 1000 Hz clock, got %v", o.hz)
+	}
+
+	sent := base + 3000*ms
+	o.sample(sent, sent+20*ms, tsval(sent+10*ms))
+	// the outbound leg degrades by 20 ms.
+	for i := 0; i < 30; i++ {
+		sent += 100 * ms
+		o.sample(sent, sent+40*ms, tsval(sent+30*ms))
+	}
+	if o.Out < float64(15*ms) || o.In > float64(ms) {
+		t.Fatalf("Expected the outbound leg to carry the added delay, got %.0f out, %.0f in", o.Out, o.In)
+	}
+}
+
+func TestSnifferNoTimestamps(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	// ACKs are matched to the end of the segments they acknowledge, a
+	// delayed ACK to the latest.
+	payload := make([]byte, 100)
+	start := time.Now()
+	segments := []struct {
+		out      bool
+		seq, ack uint32
+		at       time.Duration
+	}{
+		{true, 1000, 1, 0},
+		{false, 1, 1100, 30 * time.Millisecond},
+		{true, 1100, 1, 40 * time.Millisecond},
+		{true, 1200, 1, 50 * time.Millisecond},
+		{false, 1, 1300, 90 * time.Millisecond},
+	}
+	for _, s := range segments {
+		var pkt []byte
+		if s.out {
+			pkt = ipv6SegmentOpts(t, "2001:db8::1", "2001:db8::2", 40000, 443, s.seq, s.ack, nil, payload)
+		} else {
+			pkt = ipv6SegmentOpts(t, "2001:db8::2", "2001:db8::1", 443, 40000, s.seq, s.ack, nil, nil)
+		}
+		if err := d.handlePacket(pkt, &gopacket.CaptureInfo{Timestamp: start.Add(s.at)}); err != nil {
+			t.Fatalf("Unexpected error handling segment: %v", err)
+		}
+	}
+
+	flow, ok := d.flows.Get("[2001:db8::1]:40000-[2001:db8::2]:443")
+	if !ok {
+		t.Fatalf("Expected a flow, got %v", d.flows.Map)
+	}
+	if !flow.NoTS || flow.Sampled != 2 || flow.Min != uint64(30*time.Millisecond) || flow.Last != uint64(40*time.Millisecond) {
+		t.Fatalf("Expected 30 and 40 ms samples off a timestamp-less flow, got %d samples, min %v, last %v",
+			flow.Sampled, time.Duration(flow.Min), time.Duration(flow.Last))
+	}
+}
+
+func TestTimestampWraparound(t *testing.T) {
+	if !tsAfter(0x10, 0xfffffff0) || tsAfter(0xfffffff0, 0x10) || tsAfter(5, 5) {
+		t.Fatalf("Expected TSvals compared modulo wraparound")
+	}
+
+	flow := &TCPAccounting{Timed: make(map[TCPKey]int64)}
+	start := time.Now().UnixNano()
+	flow.sentTS(0xfffffff0, start)
+	flow.Timed[TCPKey{Seq: 1000, TS: 0xfffffff0}] = start
+	flow.sentTS(0xfffffff8, start+int64(time.Second))
+	flow.Timed[TCPKey{Seq: 1100, TS: 0xfffffff8}] = start + int64(time.Second)
+
+	// the ACK of the first segment was lost, the clock wraps.
+	at := start + int64(timedMaxAge+time.Second)
+	flow.sentTS(0x10, at)
+	flow.Timed[TCPKey{Seq: 1200, TS: 0x10}] = at
+	if flow.TSHigh != 0x10 || len(flow.Timed) != 2 {
+		t.Fatalf("Expected the oldest segment swept, got %v", flow.Timed)
+	}
+	if flow.staleSample(true, 0xfffffff8, time.Millisecond) {
+		t.Fatalf("Expected an echo of a TSval before the wrap to be fresh")
+	}
+	if !flow.staleSample(true, 0x20, time.Millisecond) || !flow.staleSample(false, 0, 2*timedMaxAge) {
+		t.Fatalf("Expected echoes ahead of the newest TSval, and old segments, to be stale")
+	}
+}
+
+func TestFlowMapCaps(t *testing.T) {
+	flow := &TCPAccounting{Seen: make(map[uint32]struct{}), Timed: make(map[TCPKey]int64)}
+	for i := uint32(0); i < maxTimedEntries+10; i++ {
+		flow.markSent(TCPKey{Seq: i}, int64(i))
+		flow.markSeen(i)
+	}
+	if len(flow.Timed) != maxTimedEntries || len(flow.Seen) != maxSeenEntries || flow.Evicted != 20 {
+		t.Fatalf("Expected capped maps, got %d timed, %d seen, %d evicted", len(flow.Timed), len(flow.Seen), flow.Evicted)
+	}
+	if _, ok := flow.Timed[TCPKey{Seq: 9}]; ok {
+		t.Fatalf("Expected the oldest segments evicted first")
+	}
+	if _, ok := flow.Timed[TCPKey{Seq: 10}]; !ok {
+		t.Fatalf("Expected newer segments kept")
+	}
+
+	// segments acknowledged as fast as they're sent don't pile up.
+	for i := uint32(0); i < 3*maxTimedEntries; i++ {
+		k := TCPKey{Seq: 1<<30 + i}
+		flow.markSent(k, int64(i))
+		delete(flow.Timed, k)
+	}
+	if len(flow.timedOrder) > 2*maxTimedEntries {
+		t.Fatalf("Expected the eviction order bounded, got %d", len(flow.timedOrder))
+	}
+}
+
+func TestFlowMapKeyIterator(t *testing.T) {
+	flows := NewFlowMap()
+	for _, k := range []string{"a", "b", "c"} {
+		flows.Add(k, &TCPAccounting{})
+	}
+	// the map may be written to while iterating.
+	done := make(chan bool)
+	go func() {
+		for k := range flows.FlowMapKeyIterator() {
+			flows.Delete(k)
+			flows.Get(k)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected iterating while deleting not to deadlock")
+	}
+	if len(flows.Keys()) != 0 {
+		t.Fatalf("Expected all flows deleted, got %v", flows.Keys())
+	}
+}
+
+func TestSnifferTruncatedHeaders(t *testing.T) {
+	policies, _ := newTrafficPolicies(nil)
+	d := &MetroSniffer{
+		IdleTTL:    300,
+		decoders:   make(map[layers.LinkType]*MetroDecoder),
+		hostIPs:    map[string]bool{"2001:db8::1": true},
+		whitelist:  make(map[string]bool),
+		nameLookup: NewLookupTable(),
+		flows:      NewFlowMap(),
+		policies:   policies,
+	}
+	d.decoder = d.decoderFor(layers.LinkTypeEthernet)
+
+	opts := []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{5, 160}},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+	}
+	out := ipv6SegmentOpts(t, "2001:db8::1", "2001:db8::2", 40000, 443, 1000, 0, opts, nil)
+	if len(out) > headersSnaplen(Config{}) {
+		t.Fatalf("Headers only snaplen %d too short for a %d byte segment.", headersSnaplen(Config{}), len(out))
+	}
+
+	// the options cut short.
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 14 + 40 + 24, Length: len(out)}
+	if err := d.handlePacket(out[:ci.CaptureLength], ci); err == nil {
+		t.Fatalf("Expected an error decoding a truncated segment.")
+	}
+	if d.truncated != 1 {
+		t.Fatalf("Expected the truncated segment to be counted, got %d.", d.truncated)
+	}
+}
+
+func TestPayloadAnalyses(t *testing.T) {
+	if got := payloadAnalyses(Config{}); len(got) != 1 {
+		t.Fatalf("Expected TLS handshake timing only, got %v.", got)
+	}
+	cfg := Config{Analyzers: []string{analyzerHTTP}, DNS: true, UDP: &UDPConfig{}}
+	if got := payloadAnalyses(cfg); len(got) != 4 {
+		t.Fatalf("Expected a warning for every payload analysis, got %v.", got)
+	}
+}
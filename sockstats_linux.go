@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sock_diag(7) - see linux/inet_diag.h
+const (
+	inetDiagInfo        = 2 // INET_DIAG_INFO
+	inetDiagSkMeminfo   = 4 // INET_DIAG_SKMEMINFO
+	skMeminfoDrops      = 8 // SK_MEMINFO_DROPS
+	sizeofInetDiagReq   = 56
+	sizeofInetDiagMsg   = 72
+	tcpStatesAll        = 0xfff
+	tcpStateEstablished = 1
+)
+
+// tcpSockets dumps the kernel's IPv4 and IPv6 TCP sockets along with their
+// tcp_info counters and drops.
+func tcpSockets() ([]SocketStat, error) {
+	var stats []SocketStat
+	for _, family := range []byte{unix.AF_INET, unix.AF_INET6} {
+		s, err := dumpTCPSockets(family)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s...)
+	}
+	return stats, nil
+}
+
+// dumpTCPSockets dumps the TCP sockets of an address family over a
+// NETLINK_SOCK_DIAG socket.
+func dumpTCPSockets(family byte) ([]SocketStat, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	req := make([]byte, unix.SizeofNlMsghdr+sizeofInetDiagReq)
+	*(*unix.NlMsghdr)(unsafe.Pointer(&req[0])) = unix.NlMsghdr{
+		Len:   uint32(len(req)),
+		Type:  unix.SOCK_DIAG_BY_FAMILY,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_DUMP,
+		Seq:   1,
+	}
+	diag := req[unix.SizeofNlMsghdr:]
+	diag[0] = family
+	diag[1] = unix.IPPROTO_TCP
+	diag[2] = 1<<(inetDiagInfo-1) | 1<<(inetDiagSkMeminfo-1)
+	binary.LittleEndian.PutUint32(diag[4:8], tcpStatesAll)
+
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var stats []SocketStat
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return stats, nil
+			case unix.NLMSG_ERROR:
+				return nil, unix.EINVAL
+			}
+			if s, ok := parseInetDiagMsg(m.Data); ok {
+				stats = append(stats, s)
+			}
+		}
+	}
+}
+
+func parseInetDiagMsg(data []byte) (SocketStat, bool) {
+	var s SocketStat
+	if len(data) < sizeofInetDiagMsg || data[1] != tcpStateEstablished {
+		return s, false
+	}
+	// inet_diag_sockid: ports and addresses in network byte order.
+	s.Sport = binary.BigEndian.Uint16(data[4:6])
+	s.Dport = binary.BigEndian.Uint16(data[6:8])
+	ipLen := net.IPv4len
+	if data[0] == unix.AF_INET6 {
+		ipLen = net.IPv6len
+	}
+	s.Src = net.IP(append([]byte(nil), data[8:8+ipLen]...))
+	s.Dst = net.IP(append([]byte(nil), data[24:24+ipLen]...))
+
+	// rtattrs follow the message, 4 byte aligned.
+	found := false
+	for off := sizeofInetDiagMsg; off+unix.SizeofRtAttr <= len(data); {
+		alen := int(binary.LittleEndian.Uint16(data[off : off+2]))
+		atype := binary.LittleEndian.Uint16(data[off+2 : off+4])
+		if alen < unix.SizeofRtAttr || off+alen > len(data) {
+			break
+		}
+		switch atype {
+		case inetDiagInfo:
+			// older kernels report a shorter tcp_info.
+			var info unix.TCPInfo
+			n := copy((*[unsafe.Sizeof(info)]byte)(unsafe.Pointer(&info))[:], data[off+unix.SizeofRtAttr:off+alen])
+			if uintptr(n) < unsafe.Offsetof(info.Bytes_received)+unsafe.Sizeof(info.Bytes_received) {
+				return s, false
+			}
+			s.BytesAcked = info.Bytes_acked
+			s.BytesReceived = info.Bytes_received
+			s.Retrans = info.Total_retrans
+			found = true
+		case inetDiagSkMeminfo:
+			// an array of u32, SK_MEMINFO_*.
+			if meminfo := data[off+unix.SizeofRtAttr : off+alen]; len(meminfo) >= 4*(skMeminfoDrops+1) {
+				s.Drops = binary.LittleEndian.Uint32(meminfo[4*skMeminfoDrops:])
+			}
+		}
+		off += (alen + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+	}
+	return s, found
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseInetDiagMsg(t *testing.T) {
+	msg := make([]byte, sizeofInetDiagMsg)
+	msg[0], msg[1] = unix.AF_INET, tcpStateEstablished
+	binary.BigEndian.PutUint16(msg[4:6], 40000)
+	binary.BigEndian.PutUint16(msg[6:8], 443)
+	copy(msg[8:], []byte{10, 0, 0, 1})
+	copy(msg[24:], []byte{10, 0, 0, 2})
+
+	attr := func(atype uint16, payload []byte) []byte {
+		a := make([]byte, unix.SizeofRtAttr, unix.SizeofRtAttr+len(payload))
+		binary.LittleEndian.PutUint16(a[0:2], uint16(unix.SizeofRtAttr+len(payload)))
+		binary.LittleEndian.PutUint16(a[2:4], atype)
+		return append(a, payload...)
+	}
+	info := unix.TCPInfo{Bytes_acked: 3000, Bytes_received: 600, Total_retrans: 3}
+	meminfo := make([]byte, 4*(skMeminfoDrops+1))
+	binary.LittleEndian.PutUint32(meminfo[4*skMeminfoDrops:], 7)
+	msg = append(msg, attr(inetDiagSkMeminfo, meminfo)...)
+	msg = append(msg, attr(inetDiagInfo, (*[unsafe.Sizeof(info)]byte)(unsafe.Pointer(&info))[:])...)
+
+	s, ok := parseInetDiagMsg(msg)
+	if !ok {
+		t.Fatalf("Expected the socket to be parsed")
+	}
+	if s.key() != "10.0.0.1:40000-10.0.0.2:443" || s.BytesAcked != 3000 || s.BytesReceived != 600 || s.Retrans != 3 || s.Drops != 7 {
+		t.Fatalf("Unexpected socket: %+v", s)
+	}
+
+	// no tcp_info, not a socket we can report.
+	if _, ok := parseInetDiagMsg(msg[:sizeofInetDiagMsg+unix.SizeofRtAttr+len(meminfo)]); ok {
+		t.Fatalf("Expected a socket without tcp_info to be skipped")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func tcpSockets() ([]SocketStat, error) {
+	return nil, errSocketStatsUnsupported
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocketStatsDeltas(t *testing.T) {
+	s := newSocketStats()
+	sock := SocketStat{
+		Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2"), Sport: 40000, Dport: 443,
+		BytesAcked: 1000, BytesReceived: 500, Retrans: 1,
+	}
+	if deltas := s.deltas([]SocketStat{sock}); len(deltas) != 0 {
+		t.Fatalf("Expected no deltas for new sockets, got %v", deltas)
+	}
+
+	sock.BytesAcked, sock.BytesReceived, sock.Retrans, sock.Drops = 3000, 600, 3, 2
+	deltas := s.deltas([]SocketStat{sock})
+	if len(deltas) != 1 || deltas[0].BytesAcked != 2000 || deltas[0].BytesReceived != 100 || deltas[0].Retrans != 2 || deltas[0].Drops != 2 {
+		t.Fatalf("Unexpected deltas: %+v", deltas)
+	}
+
+	// 4-tuple reused by a new connection.
+	sock.BytesAcked, sock.BytesReceived = 10, 10
+	if deltas := s.deltas([]SocketStat{sock}); len(deltas) != 0 {
+		t.Fatalf("Expected no deltas for reused socket, got %v", deltas)
+	}
+}
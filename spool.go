@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const defaultSpoolMaxSize = 100 // MB
+
+// SpoolConfig enables spilling the payloads the API and OTLP reporters fail
+// to submit to disk, instead of memory, replaying them - timestamps intact -
+// once the backend is back. The spool drops its oldest payloads past max_size.
+type SpoolConfig struct {
+	Path    string `yaml:"path"`     // directory, one sub-directory per instance
+	MaxSize int    `yaml:"max_size"` // MB
+}
+
+func (c *SpoolConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("Error parsing configuration - spool path is required.")
+	}
+	if c.MaxSize < 0 {
+		return errors.New("Error parsing configuration - spool max_size must be positive.")
+	}
+	return nil
+}
+
+// diskSpool is a bounded on-disk queue of request bodies, one file each,
+// named by the time they were queued so they sort oldest first.
+type diskSpool struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+}
+
+// newDiskSpool opens the spool of an instance, keeping what a previous run
+// left behind.
+func newDiskSpool(cfg *SpoolConfig, instance string) (*diskSpool, error) {
+	name := strings.NewReplacer("/", "_", ":", "_", "\\", "_").Replace(instance)
+	s := &diskSpool{
+		dir:     filepath.Join(cfg.Path, name),
+		maxSize: int64(cfg.MaxSize) * 1024 * 1024,
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultSpoolMaxSize * 1024 * 1024
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// files returns the spooled payloads, oldest first.
+func (s *diskSpool) files() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := infos[:0]
+	for _, fi := range infos {
+		if !fi.IsDir() && filepath.Ext(fi.Name()) == ".json" {
+			files = append(files, fi)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+// push queues a payload, dropping the oldest ones past the size bound.
+func (s *diskSpool) push(body []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	name := fmt.Sprintf("%020d.json", time.Now().UnixNano())
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, fi := range files {
+		size += fi.Size()
+	}
+	for _, fi := range files {
+		if size <= s.maxSize {
+			break
+		}
+		log.Warnf("Spool %s full, dropping %s.", s.dir, fi.Name())
+		os.Remove(filepath.Join(s.dir, fi.Name()))
+		size -= fi.Size()
+	}
+	return nil
+}
+
+// statusError is a submission the backend answered with an error status.
+type statusError struct {
+	what   string
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.what, e.status)
+}
+
+// rejected tells whether a submission failed for good: the backend refused
+// the payload itself (4xx), bar timeouts and rate limiting. Retrying it is
+// pointless.
+func rejected(err error) bool {
+	e, ok := err.(*statusError)
+	return ok && e.code >= 400 && e.code < 500 &&
+		e.code != http.StatusRequestTimeout && e.code != http.StatusTooManyRequests
+}
+
+// replay submits the spooled payloads oldest first, removing each once
+// submitted - or rejected, not to hold up the others. It stops at the first
+// other failure, to be retried later.
+func (s *diskSpool) replay(post func([]byte) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		path := filepath.Join(s.dir, fi.Name())
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := post(body); rejected(err) {
+			log.Errorf("Dropping spooled payload %s: %v", fi.Name(), err)
+			os.Remove(path)
+			continue
+		} else if err != nil {
+			return err
+		}
+		os.Remove(path)
+		log.Infof("Replayed spooled payload %s.", fi.Name())
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAPISpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metro-spool")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	up := false
+	var received []apiSeries
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p apiPayload
+		json.NewDecoder(req.Body).Decode(&p)
+		received = append(received, p.Series...)
+	}))
+	defer srv.Close()
+
+	spool, err := newDiskSpool(&SpoolConfig{Path: dir}, "dpdk:0")
+	if err != nil {
+		t.Fatalf("Unexpected error opening spool: %v", err)
+	}
+	a := NewAPIClient(srv.URL, "key")
+	a.spool = spool
+
+	// two intervals while the API is down.
+	a.Gauge("system.net.tcp.rtt", 1, nil, 100)
+	if err := a.Flush(); err == nil {
+		t.Fatalf("Expected the submission to fail")
+	}
+	a.Gauge("system.net.tcp.rtt", 2, nil, 130)
+	a.Flush()
+	if files, _ := spool.files(); len(files) != 2 || len(a.pending) != 0 {
+		t.Fatalf("Expected failed submissions to be spooled, got %d files, %d pending", len(files), len(a.pending))
+	}
+
+	up = true
+	a.Gauge("system.net.tcp.rtt", 3, nil, 160)
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Unexpected error submitting: %v", err)
+	}
+	if len(received) != 3 || received[1].Points[0] != [2]float64{100, 1} || received[2].Points[0] != [2]float64{130, 2} {
+		t.Fatalf("Expected spooled points to be replayed oldest first, got %+v", received)
+	}
+	if files, _ := spool.files(); len(files) != 0 {
+		t.Fatalf("Expected replayed payloads to be removed, %d left", len(files))
+	}
+
+	// bounded: only the latest payload fits.
+	spool.maxSize = 100
+	spool.push(make([]byte, 80))
+	spool.push(make([]byte, 60))
+	if files, _ := spool.files(); len(files) != 1 || files[0].Size() != 60 {
+		t.Fatalf("Expected the oldest payloads to be dropped, got %d files", len(files))
+	}
+
+	if err := (&SpoolConfig{}).validate(); err == nil {
+		t.Fatalf("Expected spool without a path to be rejected")
+	}
+}
+
+func TestSpoolReplayRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metro-spool")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(&SpoolConfig{Path: dir}, "dpdk:0")
+	if err != nil {
+		t.Fatalf("Unexpected error opening spool: %v", err)
+	}
+	for _, p := range []string{"a", "bad", "c"} {
+		spool.push([]byte(p))
+	}
+
+	var posted []string
+	err = spool.replay(func(body []byte) error {
+		if string(body) == "bad" {
+			return &statusError{"API submission", http.StatusRequestEntityTooLarge, "413 Request Entity Too Large"}
+		}
+		posted = append(posted, string(body))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error replaying: %v", err)
+	}
+	if len(posted) != 2 || posted[0] != "a" || posted[1] != "c" {
+		t.Fatalf("Expected a rejected payload not to hold up the others, got %v", posted)
+	}
+	if files, _ := spool.files(); len(files) != 0 {
+		t.Fatalf("Expected the rejected payload to be dropped, %d left", len(files))
+	}
+
+	// retryable failures keep the payload for later.
+	spool.push([]byte("d"))
+	err = spool.replay(func(body []byte) error {
+		return &statusError{"API submission", http.StatusTooManyRequests, "429 Too Many Requests"}
+	})
+	if files, _ := spool.files(); err == nil || len(files) != 1 {
+		t.Fatalf("Expected a rate limited payload to be kept, got %v, %d files", err, len(files))
+	}
+}
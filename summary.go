@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	summaryJSON = "json"
+	summaryCSV  = "csv"
+)
+
+// SummaryConfig enables a machine-readable per-flow report once done reading
+// a pcap file, written to path (stdout if empty or "-").
+type SummaryConfig struct {
+	Format string `yaml:"format"`
+	Path   string `yaml:"path"`
+}
+
+func (c *SummaryConfig) validate() error {
+	switch c.Format {
+	case "":
+		c.Format = summaryJSON
+	case summaryJSON, summaryCSV:
+	default:
+		return fmt.Errorf("Error parsing configuration - unknown summary format %q.", c.Format)
+	}
+	return nil
+}
+
+// FlowSummary is a flow's entry in the offline summary, times in ms.
+type FlowSummary struct {
+	Flow     string  `json:"flow"`
+	Src      string  `json:"src"`
+	Dst      string  `json:"dst"`
+	Sport    int     `json:"sport"`
+	Dport    int     `json:"dport"`
+	SRTT     float64 `json:"srtt"`
+	Jitter   float64 `json:"jitter"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Samples  uint64  `json:"samples"`
+	Bytes    uint64  `json:"bytes"`
+	Duration float64 `json:"duration"`
+}
+
+var summaryHeader = []string{"flow", "src", "dst", "sport", "dport", "srtt", "jitter", "min", "max", "samples", "bytes", "duration"}
+
+func nsToMs(ns uint64) float64 {
+	return float64(ns) * float64(time.Nanosecond) / float64(time.Millisecond)
+}
+
+// flowSummaries returns the summary of every sampled flow, sorted by key.
+func flowSummaries(flows *FlowMap) []FlowSummary {
+	flows.RLock()
+	defer flows.RUnlock()
+
+	summaries := make([]FlowSummary, 0, len(flows.Map))
+	for k, flow := range flows.Map {
+		flow.RLock()
+		if flow.Sampled > 0 {
+			summaries = append(summaries, FlowSummary{
+				Flow:     k,
+				Src:      flow.Src.String(),
+				Dst:      flow.Dst.String(),
+				Sport:    int(flow.Sport),
+				Dport:    int(flow.Dport),
+				SRTT:     nsToMs(flow.SRTT),
+				Jitter:   nsToMs(flow.Jitter),
+				Min:      nsToMs(flow.Min),
+				Max:      nsToMs(flow.Max),
+				Samples:  flow.Sampled,
+				Bytes:    flow.Bytes,
+				Duration: nsToMs(uint64(flow.LastSeen - flow.FirstSeen)),
+			})
+		}
+		flow.RUnlock()
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Flow < summaries[j].Flow })
+	return summaries
+}
+
+func encodeSummary(w io.Writer, format string, summaries []FlowSummary) error {
+	if format == summaryCSV {
+		cw := csv.NewWriter(w)
+		cw.Write(summaryHeader)
+		f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+		for _, s := range summaries {
+			cw.Write([]string{
+				s.Flow, s.Src, s.Dst, strconv.Itoa(s.Sport), strconv.Itoa(s.Dport),
+				f(s.SRTT), f(s.Jitter), f(s.Min), f(s.Max),
+				strconv.FormatUint(s.Samples, 10), strconv.FormatUint(s.Bytes, 10), f(s.Duration),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summaries)
+}
+
+// writeSummary writes the offline summary report as configured.
+func writeSummary(cfg *SummaryConfig, flows *FlowMap) error {
+	summaries := flowSummaries(flows)
+	if cfg.Path == "" || cfg.Path == "-" {
+		return encodeSummary(os.Stdout, cfg.Format, summaries)
+	}
+
+	f, err := os.Create(cfg.Path)
+	if err != nil {
+		return err
+	}
+	if err := encodeSummary(f, cfg.Format, summaries); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlowSummaries(t *testing.T) {
+	flows := NewFlowMap()
+	flows.Add("10.0.0.1:40000-10.0.0.2:443", &TCPAccounting{
+		Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2"), Sport: 40000, Dport: 443,
+		SRTT: uint64(2 * time.Millisecond), Jitter: uint64(500 * time.Microsecond),
+		Min: uint64(time.Millisecond), Max: uint64(4 * time.Millisecond),
+		Sampled: 10, Bytes: 1500, FirstSeen: 1e9, LastSeen: 3e9,
+	})
+	flows.Add("10.0.0.1:40001-10.0.0.2:443", &TCPAccounting{Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2")})
+
+	summaries := flowSummaries(flows)
+	if len(summaries) != 1 {
+		t.Fatalf("Expected only sampled flows in the summary, got %+v", summaries)
+	}
+	s := summaries[0]
+	if s.SRTT != 2 || s.Jitter != 0.5 || s.Min != 1 || s.Max != 4 || s.Samples != 10 || s.Bytes != 1500 || s.Duration != 2000 || s.Dport != 443 {
+		t.Fatalf("Unexpected flow summary: %+v", s)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeSummary(&buf, summaryCSV, summaries); err != nil {
+		t.Fatalf("Unexpected error encoding summary: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := "10.0.0.1:40000-10.0.0.2:443,10.0.0.1,10.0.0.2,40000,443,2.000,0.500,1.000,4.000,10,1500,2000.000"
+	if len(lines) != 2 || lines[1] != expected {
+		t.Fatalf("Unexpected CSV summary: %q", lines)
+	}
+
+	buf.Reset()
+	if err := encodeSummary(&buf, summaryJSON, summaries); err != nil {
+		t.Fatalf("Unexpected error encoding summary: %v", err)
+	}
+	var decoded []FlowSummary
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 1 || decoded[0] != s {
+		t.Fatalf("Unexpected JSON summary: %s (%v)", buf.String(), err)
+	}
+
+	if err := (&SummaryConfig{Format: "xml"}).validate(); err == nil {
+		t.Fatalf("Expected unknown summary format to be rejected")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	defaultSNMPWalk          = "snmpbulkwalk"
+	defaultSNMPCommunity     = "public"
+	defaultSwitchPortRefresh = 300 // seconds
+	snmpWalkTimeout          = 30 * time.Second
+
+	// BRIDGE-MIB and Q-BRIDGE-MIB forwarding tables, indexed by (FDB id and)
+	// MAC, to bridge port, then bridge port to ifIndex and IF-MIB ifName.
+	oidDot1dTpFdbPort       = ".1.3.6.1.2.1.17.4.3.1.2"
+	oidDot1qTpFdbPort       = ".1.3.6.1.2.1.17.7.1.2.2.1.2"
+	oidDot1dBasePortIfIndex = ".1.3.6.1.2.1.17.1.4.1.2"
+	oidIfName               = ".1.3.6.1.2.1.31.1.1.1.1"
+)
+
+// SwitchPortConfig enables tagging flows with the switch port their remote
+// end's MAC was learned on, off the forwarding tables of access switches
+// polled over SNMP (v2c, with net-snmp's snmpbulkwalk). Only meaningful for
+// hosts on our L2 segment, eg. captured off a mirror port.
+type SwitchPortConfig struct {
+	Walk     string         `yaml:"walk"`     // snmpbulkwalk binary
+	Interval int            `yaml:"interval"` // seconds between polls
+	Switches []SwitchConfig `yaml:"switches"`
+}
+
+type SwitchConfig struct {
+	Host      string `yaml:"host"`
+	Community string `yaml:"community"` // public by default
+	Name      string `yaml:"name"`      // tagged as, the host by default
+}
+
+func (c *SwitchPortConfig) validate() error {
+	if len(c.Switches) == 0 {
+		return errors.New("Error parsing configuration - switch_ports requires switches.")
+	}
+	for i := range c.Switches {
+		if c.Switches[i].Host == "" {
+			return errors.New("Error parsing configuration - switch_ports switches require a host.")
+		}
+		if c.Switches[i].Community == "" {
+			c.Switches[i].Community = defaultSNMPCommunity
+		}
+		if c.Switches[i].Name == "" {
+			c.Switches[i].Name = c.Switches[i].Host
+		}
+	}
+	if c.Walk == "" {
+		c.Walk = defaultSNMPWalk
+	}
+	if c.Interval < 0 {
+		return errors.New("Error parsing configuration - switch_ports interval must be positive.")
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultSwitchPortRefresh
+	}
+	return nil
+}
+
+// switchPort is where a MAC was learned.
+type switchPort struct {
+	Switch string
+	Port   string
+	macs   int // learned on the port, trunks learn many
+}
+
+// switchPorts maps MACs to the access port they were learned on.
+type switchPorts struct {
+	sync.RWMutex
+	cfg     SwitchPortConfig
+	ports   map[string]switchPort
+	polled  time.Time
+	polling bool
+	// walk returns the values under an OID of a switch, by OID suffix.
+	walk func(sw SwitchConfig, oid string) (map[string]string, error)
+}
+
+// newSwitchPorts returns the switch port mapping for a configuration, polled
+// in the background.
+func newSwitchPorts(cfg *SwitchPortConfig) (*switchPorts, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &switchPorts{cfg: *cfg, ports: make(map[string]switchPort)}
+	s.walk = s.snmpWalk
+	s.refresh()
+	return s, nil
+}
+
+// refresh polls the switches in the background if due.
+func (s *switchPorts) refresh() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.polling || time.Since(s.polled) < time.Duration(s.cfg.Interval)*time.Second {
+		return
+	}
+	s.polling = true
+	go func() {
+		ports := s.poll()
+		s.Lock()
+		s.ports, s.polled, s.polling = ports, time.Now(), false
+		s.Unlock()
+	}()
+}
+
+// poll walks the forwarding tables of every switch. A MAC learned on several
+// ports, eg. an access port and the uplinks of other switches, is mapped to
+// the port with the fewest MACs.
+func (s *switchPorts) poll() map[string]switchPort {
+	ports := make(map[string]switchPort)
+	for _, sw := range s.cfg.Switches {
+		learned, err := s.pollSwitch(sw)
+		if err != nil {
+			log.Warnf("Unable to poll switch %s for its forwarding table: %v", sw.Host, err)
+			continue
+		}
+		for mac, p := range learned {
+			if cur, ok := ports[mac]; !ok || p.macs < cur.macs {
+				ports[mac] = p
+			}
+		}
+	}
+	log.Debugf("Polled %d switches, %d MACs learned", len(s.cfg.Switches), len(ports))
+	return ports
+}
+
+func (s *switchPorts) pollSwitch(sw SwitchConfig) (map[string]switchPort, error) {
+	fdb, err := s.walk(sw, oidDot1qTpFdbPort)
+	if err != nil {
+		return nil, err
+	}
+	if len(fdb) == 0 {
+		// no VLAN-aware bridge.
+		if fdb, err = s.walk(sw, oidDot1dTpFdbPort); err != nil {
+			return nil, err
+		}
+	}
+	ifIndexes, err := s.walk(sw, oidDot1dBasePortIfIndex)
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.walk(sw, oidIfName)
+	if err != nil {
+		return nil, err
+	}
+
+	macs := make(map[string]string)
+	count := make(map[string]int)
+	for index, port := range fdb {
+		mac, ok := indexMAC(index)
+		if !ok || port == "0" {
+			continue
+		}
+		macs[mac] = port
+		count[port]++
+	}
+	learned := make(map[string]switchPort, len(macs))
+	for mac, port := range macs {
+		name := port
+		if ifIndex, ok := ifIndexes[port]; ok {
+			name = ifIndex
+			if n, ok := names[ifIndex]; ok && n != "" {
+				name = n
+			}
+		}
+		learned[mac] = switchPort{Switch: sw.Name, Port: name, macs: count[port]}
+	}
+	return learned, nil
+}
+
+// snmpWalk runs snmpbulkwalk, numeric OIDs and bare values.
+func (s *switchPorts) snmpWalk(sw SwitchConfig, oid string) (map[string]string, error) {
+	cmd := exec.Command(s.cfg.Walk, "-v2c", "-c", sw.Community, "-Onq", sw.Host, oid)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.cfg.Walk, err)
+		}
+	case <-time.After(snmpWalkTimeout):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("%s timed out", s.cfg.Walk)
+	}
+	return parseSNMPWalk(&out, oid), nil
+}
+
+// parseSNMPWalk reads `snmpbulkwalk -Onq` output, the values under oid by
+// the rest of their OID:
+//
+//	.1.3.6.1.2.1.31.1.1.1.1.10105 "Gi1/0/5"
+func parseSNMPWalk(r io.Reader, oid string) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], oid+".") {
+			continue
+		}
+		values[strings.TrimPrefix(fields[0], oid+".")] = strings.Trim(fields[1], `"`)
+	}
+	return values
+}
+
+// indexMAC returns the MAC address ending a forwarding table index.
+func indexMAC(index string) (string, bool) {
+	parts := strings.Split(index, ".")
+	if len(parts) < 6 {
+		return "", false
+	}
+	mac := make(net.HardwareAddr, 6)
+	for i, p := range parts[len(parts)-6:] {
+		b, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return "", false
+		}
+		mac[i] = byte(b)
+	}
+	return mac.String(), true
+}
+
+// lookup returns the port a MAC was learned on.
+func (s *switchPorts) lookup(mac string) (switchPort, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	p, ok := s.ports[mac]
+	return p, ok
+}
+
+// tags returns the switch port tags for a flow's remote end (Dst).
+func (s *switchPorts) tags(flow *TCPAccounting) []string {
+	if s == nil || flow.RemoteMAC == "" {
+		return nil
+	}
+	p, ok := s.lookup(flow.RemoteMAC)
+	if !ok {
+		return nil
+	}
+	return []string{"switch:" + p.Switch, "switch_port:" + p.Port}
+}
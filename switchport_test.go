@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSwitchPorts(t *testing.T) {
+	if err := (&SwitchPortConfig{}).validate(); err == nil {
+		t.Fatalf("Expected switch_ports without switches to be rejected")
+	}
+	cfg := SwitchPortConfig{Switches: []SwitchConfig{{Host: "10.0.0.2"}, {Host: "10.0.0.3", Name: "core"}}}
+	if err := cfg.validate(); err != nil || cfg.Walk != defaultSNMPWalk || cfg.Switches[0].Community != defaultSNMPCommunity || cfg.Switches[0].Name != "10.0.0.2" {
+		t.Fatalf("Unexpected switch_ports validation: %+v (%v)", cfg, err)
+	}
+
+	// the access switch learned one host per port, the core switch learned
+	// both on its uplink to it.
+	walks := map[string]string{
+		"10.0.0.2" + oidDot1qTpFdbPort: `.1.3.6.1.2.1.17.7.1.2.2.1.2.10.0.80.86.1.2.3 5
+.1.3.6.1.2.1.17.7.1.2.2.1.2.10.0.80.86.1.2.4 6`,
+		"10.0.0.2" + oidDot1dBasePortIfIndex: `.1.3.6.1.2.1.17.1.4.1.2.5 10105
+.1.3.6.1.2.1.17.1.4.1.2.6 10106`,
+		"10.0.0.2" + oidIfName: `.1.3.6.1.2.1.31.1.1.1.1.10105 "Gi1/0/5"
+.1.3.6.1.2.1.31.1.1.1.1.10106 "Gi1/0/6"`,
+		"10.0.0.3" + oidDot1dTpFdbPort: `.1.3.6.1.2.1.17.4.3.1.2.0.80.86.1.2.3 1
+.1.3.6.1.2.1.17.4.3.1.2.0.80.86.1.2.4 1`,
+	}
+	s := &switchPorts{cfg: cfg}
+	s.walk = func(sw SwitchConfig, oid string) (map[string]string, error) {
+		return parseSNMPWalk(strings.NewReader(walks[sw.Host+oid]), oid), nil
+	}
+	s.ports = s.poll()
+
+	expected := map[string]switchPort{
+		"00:50:56:01:02:03": {Switch: "10.0.0.2", Port: "Gi1/0/5", macs: 1},
+		"00:50:56:01:02:04": {Switch: "10.0.0.2", Port: "Gi1/0/6", macs: 1},
+	}
+	if !reflect.DeepEqual(s.ports, expected) {
+		t.Fatalf("Unexpected switch ports: %+v", s.ports)
+	}
+
+	flow := &TCPAccounting{Src: net.ParseIP("10.0.0.10"), Dst: net.ParseIP("10.0.0.11"), RemoteMAC: "00:50:56:01:02:04"}
+	if tags := s.tags(flow); !reflect.DeepEqual(tags, []string{"switch:10.0.0.2", "switch_port:Gi1/0/6"}) {
+		t.Fatalf("Unexpected switch port tags: %v", tags)
+	}
+	flow.RemoteMAC = "00:50:56:01:02:05"
+	if tags := s.tags(flow); tags != nil {
+		t.Fatalf("Expected no tags for an unknown MAC, got %v", tags)
+	}
+}
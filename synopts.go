@@ -0,0 +1,78 @@
+package main
+
+import "strconv"
+
+// synOptions are the MSS and window scale an end announced in its SYN.
+type synOptions struct {
+	mss    uint16 // 0 if none
+	shift  uint8
+	scales bool
+	seen   bool // the SYN was
+}
+
+// synOpts returns what Dst and Src announced. Call holding the flow lock.
+func (t *TCPAccounting) synOpts() (dst, src synOptions) {
+	dst = synOptions{mss: t.MSS, shift: t.Wnd.shift, scales: t.Wnd.scales, seen: t.Wnd.syn}
+	src = synOptions{mss: t.SrcMSS, shift: t.RcvdWnd.shift, scales: t.RcvdWnd.scales, seen: t.RcvdWnd.syn}
+	return dst, src
+}
+
+// synOptionTags tags a flow with what either end announced in its SYN, the
+// endpoints named as by tag_mode: <end>_mss: and <end>_wscale: - none if it
+// doesn't scale its window. A low MSS (eg. tunnels, PMTU black holes) or no
+// window scaling often explain what looks like high RTT.
+func (r *Client) synOptionTags(flow *TCPAccounting) []string {
+	a, _, aKey, bKey := r.endpoints(flow)
+	dst, src := flow.synOpts()
+	aOpts, bOpts := src, dst
+	if !a.Equal(flow.Src) {
+		aOpts, bOpts = dst, src
+	}
+	var tags []string
+	for _, end := range []struct {
+		key  string
+		opts synOptions
+	}{
+		{aKey, aOpts},
+		{bKey, bOpts},
+	} {
+		if !end.opts.seen {
+			continue
+		}
+		if end.opts.mss != 0 {
+			tags = append(tags, end.key+"_mss:"+strconv.Itoa(int(end.opts.mss)))
+		}
+		if end.opts.scales {
+			tags = append(tags, end.key+"_wscale:"+strconv.Itoa(int(end.opts.shift)))
+		} else {
+			tags = append(tags, end.key+"_wscale:none")
+		}
+	}
+	return tags
+}
+
+// reportSYNOptions submits the MSS and window scale the ends announced,
+// tagged direction:sent for Dst's - capping the segments Src sends and
+// scaling the window it sends into - and direction:received for Src's. Only
+// those of SYNs seen are reported. Call holding the flow lock.
+func (r *Client) reportSYNOptions(k string, flow *TCPAccounting, tags []string, ts int64) {
+	dst, src := flow.synOpts()
+	for _, dir := range []struct {
+		tag  string
+		opts synOptions
+	}{
+		{"direction:sent", dst},
+		{"direction:received", src},
+	} {
+		if !dir.opts.seen {
+			continue
+		}
+		dtags := append(append([]string(nil), tags...), dir.tag)
+		if dir.opts.mss != 0 {
+			r.submit(k, metricPrefix+"mss", float64(dir.opts.mss), dtags, false, ts)
+		}
+		if dir.opts.scales {
+			r.submit(k, metricPrefix+"window_scale", float64(dir.opts.shift), dtags, false, ts)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maxSACKBlocks is the most SACK blocks an option fits (RFC 2018).
+const maxSACKBlocks = 4
+
+// sackBlock is a block of data received past the acknowledgment number.
+type sackBlock struct {
+	left, right uint32
+}
+
+// tcpOptions are the options of a segment analyzers look at, parsed in a
+// single walk. SACK blocks are kept in place to spare an allocation per
+// segment.
+type tcpOptions struct {
+	TS, TSecr     uint32
+	HasTS         bool
+	MSS           uint16 // 0 if none
+	WScale        uint8
+	HasWScale     bool
+	SACKPermitted bool
+	SACK          [maxSACKBlocks]sackBlock
+	SACKs         int // blocks in SACK
+}
+
+// parseTCPOptions walks a segment's options. Malformed ones are skipped.
+func parseTCPOptions(tcp *layers.TCP) (o tcpOptions) {
+	for i := range tcp.Options {
+		data := tcp.Options[i].OptionData
+		switch tcp.Options[i].OptionType {
+		case layers.TCPOptionKindTimestamps:
+			if len(data) == 8 {
+				o.TS, o.TSecr, o.HasTS = binary.BigEndian.Uint32(data[:4]), binary.BigEndian.Uint32(data[4:]), true
+			}
+		case layers.TCPOptionKindMSS:
+			if len(data) == 2 {
+				o.MSS = binary.BigEndian.Uint16(data)
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(data) == 1 {
+				o.WScale, o.HasWScale = data[0], true
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			o.SACKPermitted = true
+		case layers.TCPOptionKindSACK:
+			for ; len(data) >= 8 && o.SACKs < maxSACKBlocks; data = data[8:] {
+				o.SACK[o.SACKs] = sackBlock{binary.BigEndian.Uint32(data[:4]), binary.BigEndian.Uint32(data[4:8])}
+				o.SACKs++
+			}
+		}
+	}
+	return o
+}
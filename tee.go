@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	defaultTeeMaxSize  = 100 // MB
+	defaultTeeMaxFiles = 5
+	pcapFileHeaderLen  = 24
+	pcapRecordLen      = 16
+)
+
+// TeeConfig enables writing captured packets (those matching the BPF filter)
+// to a rotating pcap file, for debugging.
+type TeeConfig struct {
+	Path     string `yaml:"path"`
+	MaxSize  int    `yaml:"max_size"` // MB
+	MaxFiles int    `yaml:"max_files"`
+}
+
+// pcapTee may be written by concurrent pcap file workers, the mutex guards
+// the file and its rotation.
+type pcapTee struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	snaplen  uint32
+	link     layers.LinkType
+	f        *os.File
+	w        *pcapgo.Writer
+	written  int64
+}
+
+func newPcapTee(cfg *TeeConfig, snaplen int, link layers.LinkType) (*pcapTee, error) {
+	t := &pcapTee{
+		path:     cfg.Path,
+		maxSize:  int64(cfg.MaxSize) * 1024 * 1024,
+		maxFiles: cfg.MaxFiles,
+		snaplen:  uint32(snaplen),
+		link:     link,
+	}
+	if t.maxSize <= 0 {
+		t.maxSize = defaultTeeMaxSize * 1024 * 1024
+	}
+	if t.maxFiles <= 0 {
+		t.maxFiles = defaultTeeMaxFiles
+	}
+	if t.snaplen == 0 {
+		t.snaplen = maxSnaplen
+	}
+
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *pcapTee) open() error {
+	f, err := os.Create(t.path)
+	if err != nil {
+		return err
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(t.snaplen, t.link); err != nil {
+		f.Close()
+		return err
+	}
+	t.f = f
+	t.w = w
+	t.written = pcapFileHeaderLen
+	return nil
+}
+
+// rotate shifts path -> path.1 -> path.2 ... dropping the oldest file, then
+// opens path anew. Files not rotated yet are skipped.
+func (t *pcapTee) rotate() error {
+	err := t.f.Close()
+	t.f = nil
+	if err != nil {
+		return err
+	}
+	for i := t.maxFiles - 1; i > 0; i-- {
+		src := t.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", t.path, i-1)
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", t.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return t.open()
+}
+
+// Write appends a packet, rotating first if it'd take the file over
+// max_size - unless it's the file's first.
+func (t *pcapTee) Write(data []byte, ci *gopacket.CaptureInfo) {
+	t.Lock()
+	defer t.Unlock()
+	if t.f == nil {
+		return
+	}
+	size := pcapRecordLen + int64(len(data))
+	if t.written > pcapFileHeaderLen && t.written+size > t.maxSize {
+		if err := t.rotate(); err != nil {
+			// closed, disabled.
+			log.Errorf("Unable to rotate pcap tee %q, disabling: %v", t.path, err)
+			return
+		}
+	}
+	if err := t.w.WritePacket(*ci, data); err != nil {
+		log.Errorf("Error writing to pcap tee %q: %v", t.path, err)
+		return
+	}
+	t.written += size
+}
+
+func (t *pcapTee) Close() {
+	t.Lock()
+	defer t.Unlock()
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPcapTeeRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tee.pcap")
+	tee, err := newPcapTee(&TeeConfig{Path: path, MaxFiles: 3}, 0, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("Unexpected error opening the tee: %v", err)
+	}
+	// two 100 byte packets a file.
+	tee.maxSize = pcapFileHeaderLen + 2*(pcapRecordLen+100)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				data := make([]byte, 100)
+				tee.Write(data, &gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)})
+			}
+		}()
+	}
+	wg.Wait()
+	tee.Close()
+
+	// 5 files written, the 2 oldest dropped.
+	for i, name := range []string{path, path + ".1", path + ".2"} {
+		st, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected rotated file %d: %v", i, err)
+		}
+		if st.Size() > tee.maxSize {
+			t.Errorf("Expected %s capped at %d bytes, got %d", name, tee.maxSize, st.Size())
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatalf("Expected a pcap header in %s: %v", name, err)
+		}
+		packets := 0
+		for {
+			if _, _, err := r.ReadPacketData(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Error reading %s: %v", name, err)
+			}
+			packets++
+		}
+		f.Close()
+		if packets != 2 {
+			t.Errorf("Expected 2 packets in %s, got %d", name, packets)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.3", path)); !os.IsNotExist(err) {
+		t.Errorf("Expected no more than 3 files, got %s.3", path)
+	}
+}
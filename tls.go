@@ -0,0 +1,67 @@
+package main
+
+import "encoding/binary"
+
+const tlsMetricPrefix = "system.net.tls."
+
+// TLS record content and handshake message types we look for.
+const (
+	tlsChangeCipherSpec = 20
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+
+	tlsClientHello = 1
+	tlsServerHello = 2
+)
+
+// trackTLS follows the TLS handshake of a flow, off the records starting TCP
+// segments: from the ClientHello to the ServerHello, then to the client's
+// Finished - encrypted, but the first record the client sends after its
+// ChangeCipherSpec (TLS 1.2, or 1.3 middlebox compatibility) or as application
+// data (1.3). fromSrc tells whether the segment comes from Src. Call holding
+// the flow lock.
+func (t *TCPAccounting) trackTLS(fromSrc bool, payload []byte, ts int64) {
+	for len(payload) >= 5 {
+		typ, major := payload[0], payload[1]
+		if typ < tlsChangeCipherSpec || typ > tlsApplicationData || major != 3 {
+			// not TLS, or not at a record boundary.
+			return
+		}
+		var msg byte
+		if typ == tlsHandshake && len(payload) > 5 {
+			msg = payload[5]
+		}
+
+		switch {
+		case t.TLSHello == 0:
+			if typ != tlsHandshake || msg != tlsClientHello {
+				return
+			}
+			t.TLSHello, t.TLSClient = ts, fromSrc
+		case t.TLSServerHello == 0:
+			if fromSrc != t.TLSClient && typ == tlsHandshake && msg == tlsServerHello {
+				t.TLSServerHello = ts
+			}
+		case fromSrc == t.TLSClient && (typ == tlsChangeCipherSpec || typ == tlsApplicationData):
+			t.TLSHandshake = uint64(ts - t.TLSHello)
+			return
+		}
+		n := 5 + int(binary.BigEndian.Uint16(payload[3:5]))
+		if n > len(payload) {
+			// continued in the next segments.
+			return
+		}
+		payload = payload[n:]
+	}
+}
+
+// reportTLS submits the handshake times of a flow, once. Call holding the
+// flow lock.
+func (r *Client) reportTLS(k string, flow *TCPAccounting, tags []string, ts int64) {
+	if flow.TLSHandshake == 0 || flow.TLSReported {
+		return
+	}
+	r.submit(k, tlsMetricPrefix+"handshake_time", nsToMs(flow.TLSHandshake), tags, false, ts)
+	r.submit(k, tlsMetricPrefix+"server_hello_time", nsToMs(uint64(flow.TLSServerHello-flow.TLSHello)), tags, false, ts)
+	flow.TLSReported = true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	otlpTracesPath          = "/v1/traces"
+	defaultTracingSample    = 0.001
+	pipelineMetric          = "go_metro.pipeline.duration"
+	otlpSpanKindInternal    = 1
+	maxPendingPipelineSpans = 10000
+)
+
+// Pipeline stages, as span names and stage: attributes.
+const (
+	stageCapture = "capture" // captured to handed to us, live captures
+	stageDecode  = "decode"
+	stageAccount = "account"
+	stageReport  = "report"
+)
+
+// TracingConfig enables tracing the instance's own packet pipeline - capture,
+// decode, flow accounting and reporting - with OpenTelemetry spans and stage
+// duration histograms exported over OTLP/HTTP, to diagnose the probe itself.
+type TracingConfig struct {
+	Endpoint   string            `yaml:"endpoint"`    // defaults to otlp_endpoint
+	Headers    map[string]string `yaml:"headers"`     // defaults to otlp_headers
+	SampleRate float64           `yaml:"sample_rate"` // fraction of packets traced
+}
+
+func (c *TracingConfig) validate() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return errors.New("Error parsing configuration - pipeline_tracing sample_rate must be between 0 and 1.")
+	}
+	return nil
+}
+
+// OTLP/HTTP JSON encoding of the trace data model.
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracePayload struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// pipelineTracer samples packets through the pipeline, keeping their spans
+// and the duration of each stage until flushed with the reports.
+type pipelineTracer struct {
+	sync.Mutex
+	url     string
+	headers map[string]string
+	client  *http.Client
+	metrics *OTLPClient
+	tags    []string
+	enabled bool // unless overridden by the pipeline_tracing feature flag
+	rate    float64
+	packets uint64 // seen, sampled every so many
+	spans   []otlpSpan
+	stages  map[string]*ExpHistogram // ms
+	since   int64                    // start of the stage histograms (unix seconds)
+	rand    *rand.Rand
+}
+
+// newPipelineTracer returns the tracer for a configuration, off if nil but
+// ready to be turned on at runtime.
+func newPipelineTracer(cfg *TracingConfig, instcfg InitConfig, tags []string) *pipelineTracer {
+	enabled := cfg != nil
+	if cfg == nil {
+		cfg = &TracingConfig{}
+	}
+	endpoint, headers := cfg.Endpoint, cfg.Headers
+	if endpoint == "" {
+		endpoint = instcfg.OTLPEndpoint
+	}
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+	if headers == nil {
+		headers = instcfg.OTLPHeaders
+	}
+	rate := cfg.SampleRate
+	if rate == 0 {
+		rate = defaultTracingSample
+	}
+	return &pipelineTracer{
+		url:     strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		headers: headers,
+		client:  &http.Client{Timeout: apiTimeout * time.Second},
+		metrics: NewOTLPClient(endpoint, headers),
+		tags:    tags,
+		enabled: enabled,
+		rate:    rate,
+		stages:  make(map[string]*ExpHistogram),
+		since:   time.Now().Unix(),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// sample tells whether to trace the packet at hand.
+func (p *pipelineTracer) sample() bool {
+	if !p.on() {
+		return false
+	}
+	every := uint64(1/features.rate(featureTracingRate, p.rate) + 0.5)
+	return atomic.AddUint64(&p.packets, 1)%every == 0
+}
+
+func (p *pipelineTracer) on() bool {
+	return p != nil && features.enabled(featureTracing, p.enabled)
+}
+
+func (p *pipelineTracer) id(n int) string {
+	b := make([]byte, n)
+	p.rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func spanTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// span records a span and its stage duration. Call holding the lock.
+func (p *pipelineTracer) span(trace, parent, name string, start, end time.Time) string {
+	id := p.id(8)
+	p.spans = append(p.spans, otlpSpan{
+		TraceID:           trace,
+		SpanID:            id,
+		ParentSpanID:      parent,
+		Name:              name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: spanTime(start),
+		EndTimeUnixNano:   spanTime(end),
+		Attributes:        otlpAttributes(p.tags),
+	})
+	if len(p.spans) > maxPendingPipelineSpans {
+		p.spans = p.spans[len(p.spans)-maxPendingPipelineSpans:]
+	}
+	if name != "packet" {
+		h, ok := p.stages[name]
+		if !ok {
+			h = NewExpHistogram()
+			p.stages[name] = h
+		}
+		h.Record(float64(end.Sub(start)) / float64(time.Millisecond))
+	}
+	return id
+}
+
+// packet traces a packet captured at captured, handed to us at start and
+// decoded at decoded, accounted for by end. The capture stage is left out
+// when the capture time isn't comparable, eg. reading files.
+func (p *pipelineTracer) packet(live bool, captured, start, decoded, end time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	trace := p.id(16)
+	first := start
+	if live && captured.Before(start) {
+		first = captured
+	}
+	root := p.span(trace, "", "packet", first, end)
+	if first != start {
+		p.span(trace, root, stageCapture, captured, start)
+	}
+	p.span(trace, root, stageDecode, start, decoded)
+	p.span(trace, root, stageAccount, decoded, end)
+}
+
+// report traces a reporting interval.
+func (p *pipelineTracer) report(start, end time.Time) {
+	if !p.on() {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.span(p.id(16), "", stageReport, start, end)
+}
+
+// Flush exports the spans and stage durations recorded since the last flush.
+// What fails to export is dropped, it's only a diagnostic.
+func (p *pipelineTracer) Flush() {
+	if p == nil {
+		return
+	}
+	now := time.Now().Unix()
+	p.Lock()
+	spans, stages, since := p.spans, p.stages, p.since
+	p.spans, p.stages, p.since = nil, make(map[string]*ExpHistogram), now
+	p.Unlock()
+
+	for stage, h := range stages {
+		p.metrics.Histogram(pipelineMetric, "ms", h, append([]string{"stage:" + stage}, p.tags...), since, now, nil)
+	}
+	if err := p.metrics.Flush(); err != nil {
+		log.Warnf("Error exporting pipeline metrics over OTLP: %v", err)
+		p.metrics.Lock()
+		p.metrics.pending = nil
+		p.metrics.Unlock()
+	}
+	if len(spans) == 0 {
+		return
+	}
+	if err := p.post(spans); err != nil {
+		log.Warnf("Error exporting %d pipeline spans over OTLP: %v", len(spans), err)
+	}
+}
+
+func (p *pipelineTracer) post(spans []otlpSpan) error {
+	payload := otlpTracePayload{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: "go-metro"}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "go-metro/pipeline"},
+			Spans: spans,
+		}},
+	}}}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP trace export failed: %s", resp.Status)
+	}
+	return nil
+}
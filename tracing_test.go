@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPipelineTracer(t *testing.T) {
+	var spans []otlpSpan
+	var metrics []otlpMetric
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case otlpTracesPath:
+			var p otlpTracePayload
+			json.NewDecoder(req.Body).Decode(&p)
+			for _, rs := range p.ResourceSpans {
+				for _, ss := range rs.ScopeSpans {
+					spans = append(spans, ss.Spans...)
+				}
+			}
+		case otlpMetricsPath:
+			var p otlpPayload
+			json.NewDecoder(req.Body).Decode(&p)
+			for _, rm := range p.ResourceMetrics {
+				for _, sm := range rm.ScopeMetrics {
+					metrics = append(metrics, sm.Metrics...)
+				}
+			}
+		}
+	}))
+	defer srv.Close()
+
+	var off *pipelineTracer
+	if off.sample() {
+		t.Fatalf("Expected no packets traced when off")
+	}
+	if err := (&TracingConfig{SampleRate: 2}).validate(); err == nil {
+		t.Fatalf("Expected bad sample rate to be rejected")
+	}
+
+	p := newPipelineTracer(&TracingConfig{Endpoint: srv.URL, SampleRate: 0.5}, InitConfig{}, []string{"iface:eth0"})
+	sampled := 0
+	for i := 0; i < 10; i++ {
+		if p.sample() {
+			sampled++
+		}
+	}
+	if sampled != 5 {
+		t.Fatalf("Expected every other packet to be traced, got %d of 10", sampled)
+	}
+
+	start := time.Now()
+	p.packet(true, start.Add(-time.Millisecond), start, start.Add(2*time.Millisecond), start.Add(5*time.Millisecond))
+	p.report(start, start.Add(time.Second))
+	p.Flush()
+
+	if len(spans) != 5 {
+		t.Fatalf("Expected packet, capture, decode, account and report spans, got %+v", spans)
+	}
+	root := spans[0]
+	if root.Name != "packet" || root.ParentSpanID != "" || len(root.TraceID) != 32 || len(root.SpanID) != 16 {
+		t.Fatalf("Unexpected packet span: %+v", root)
+	}
+	for _, s := range spans[1:4] {
+		if s.TraceID != root.TraceID || s.ParentSpanID != root.SpanID {
+			t.Fatalf("Expected %s span to be a child of the packet span: %+v", s.Name, s)
+		}
+	}
+	if spans[4].Name != stageReport || spans[4].TraceID == root.TraceID {
+		t.Fatalf("Unexpected report span: %+v", spans[4])
+	}
+
+	if len(metrics) != 4 {
+		t.Fatalf("Expected a histogram per stage, got %+v", metrics)
+	}
+	for _, m := range metrics {
+		if m.Name != pipelineMetric || m.Unit != "ms" || m.ExponentialHistogram == nil {
+			t.Fatalf("Unexpected pipeline metric: %+v", m)
+		}
+	}
+
+	// nothing recorded, nothing sent.
+	spans, metrics = nil, nil
+	p.Flush()
+	if len(spans) != 0 || len(metrics) != 0 {
+		t.Fatalf("Expected nothing exported without new samples")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tunnelFilter captures the encapsulations we decode - VXLAN, Geneve, GRE and
+// IP-in-IP (IPIP, SIT) - on top of the instance filter.
+const tunnelFilter = "udp port 4789 or udp port 6081 or ip proto 47 or ip6 proto 47 or ip proto 4 or ip proto 41"
+
+var (
+	errGRETooShort    = errors.New("GRE header too short.")
+	errGRERouting     = errors.New("GRE source routing unsupported.")
+	errGeneveTooShort = errors.New("Geneve header too short.")
+)
+
+// greLayer decodes the GRE header, keeping the key if any. Unlike
+// layers.GRE it checks the header fits the packet.
+type greLayer struct {
+	layers.BaseLayer
+	KeyPresent bool
+	Key        uint32
+	Protocol   layers.EthernetType
+}
+
+func (g *greLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeGRE
+}
+
+func (g *greLayer) NextLayerType() gopacket.LayerType {
+	return g.Protocol.LayerType()
+}
+
+func (g *greLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errGRETooShort
+	}
+	if data[0]&0x40 != 0 {
+		return errGRERouting
+	}
+	checksum, seq := data[0]&0x80 != 0, data[0]&0x10 != 0
+	g.KeyPresent = data[0]&0x20 != 0
+	g.Protocol = layers.EthernetType(binary.BigEndian.Uint16(data[2:4]))
+
+	n := 4
+	if checksum {
+		n += 4
+	}
+	if g.KeyPresent {
+		n += 4
+	}
+	if seq {
+		n += 4
+	}
+	if len(data) < n {
+		df.SetTruncated()
+		return errGRETooShort
+	}
+	if g.KeyPresent {
+		off := 4
+		if checksum {
+			off += 4
+		}
+		g.Key = binary.BigEndian.Uint32(data[off : off+4])
+	}
+	g.BaseLayer = layers.BaseLayer{Contents: data[:n], Payload: data[n:]}
+	return nil
+}
+
+// geneveLayer decodes the Geneve header, skipping its options.
+type geneveLayer struct {
+	layers.BaseLayer
+	VNI      uint32
+	Protocol layers.EthernetType
+}
+
+func (g *geneveLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeGeneve
+}
+
+func (g *geneveLayer) NextLayerType() gopacket.LayerType {
+	return g.Protocol.LayerType()
+}
+
+func (g *geneveLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errGeneveTooShort
+	}
+	n := 8 + int(data[0]&0x3f)*4
+	if len(data) < n {
+		df.SetTruncated()
+		return errGeneveTooShort
+	}
+	g.Protocol = layers.EthernetType(binary.BigEndian.Uint16(data[2:4]))
+	g.VNI = uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6])
+	g.BaseLayer = layers.BaseLayer{Contents: data[:n], Payload: data[n:]}
+	return nil
+}
+
+// tunnelTag returns the tag identifying the tunnel of a decoded encapsulation
+// layer: the VNI of VXLAN and Geneve, the GRE key. Encapsulated flows are
+// tagged, and keyed, by it - addresses often overlap between overlays.
+func (d *MetroDecoder) tunnelTag(typ gopacket.LayerType) string {
+	switch typ {
+	case layers.LayerTypeVXLAN:
+		return "vni:" + strconv.FormatUint(uint64(d.vxlan.VNI), 10)
+	case layers.LayerTypeGeneve:
+		return "vni:" + strconv.FormatUint(uint64(d.geneve.VNI), 10)
+	case layers.LayerTypeGRE:
+		if d.gre.KeyPresent {
+			return "gre_key:" + strconv.FormatUint(uint64(d.gre.Key), 10)
+		}
+		return "tunnel:gre"
+	}
+	return ""
+}
+
+// ipTunnelTag returns the tag of an IP-in-IP tunnel, given the outer source
+// address and the inner IP layer type.
+func ipTunnelTag(outer net.IP, inner gopacket.LayerType) string {
+	if outer.To4() != nil && inner == layers.LayerTypeIPv6 {
+		return "tunnel:sit"
+	}
+	return "tunnel:ipip"
+}
+
+// encrypted tells whether decoding stopped at an ESP header: IPsec traffic
+// can't be measured, it's only counted.
+func encrypted(err error) bool {
+	u, ok := err.(gopacket.UnsupportedLayerType)
+	return ok && gopacket.LayerType(u) == layers.LayerTypeIPSecESP
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const udpMetricPrefix = "system.net.udp."
+
+// defaultUDPRequestPorts are the request/response protocols we know: DNS and
+// NTP.
+var defaultUDPRequestPorts = []int{53, 123}
+
+// UDPConfig enables the accounting of UDP flows. Flows to or from one of the
+// request ports are request/response exchanges, their unanswered requests are
+// reported too.
+type UDPConfig struct {
+	RequestPorts []int `yaml:"request_ports"` // DNS and NTP by default
+	QUICPorts    []int `yaml:"quic_ports"`    // 443 by default
+}
+
+func (c *UDPConfig) validate() error {
+	for _, p := range c.RequestPorts {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("Error parsing configuration - bad udp request port %d.", p)
+		}
+	}
+	if len(c.RequestPorts) == 0 {
+		c.RequestPorts = defaultUDPRequestPorts
+	}
+	if err := validateQUICPorts(c.QUICPorts); err != nil {
+		return err
+	}
+	if len(c.QUICPorts) == 0 {
+		c.QUICPorts = defaultQUICPorts
+	}
+	return nil
+}
+
+// UDPAccounting keeps the counters of a UDP flow. As for TCP, Src is our end.
+type UDPAccounting struct {
+	Src, Dst     net.IP
+	Sport, Dport layers.UDPPort
+	Service      layers.UDPPort // request port either end is on, 0 if none
+	QUIC         bool
+	External     bool
+	Tunnel       string
+	Packets      uint64
+	Bytes        uint64 // UDP payload, either direction
+	Requests     uint64 // to the service port
+	Responses    uint64 // from the service port
+	LastSeen     int64  // capture timestamp of the last packet
+	RepPackets   uint64 // counters at the last report
+	RepBytes     uint64
+	RepRequests  uint64
+	RepResponses uint64
+	Spin         bool   // QUIC spin bit of our last short header packet
+	SpinEdge     int64  // capture timestamp of its last flip, -1 until one's seen
+	SpinSRTT     uint64 // ns
+	SpinLast     uint64
+	SpinSampled  uint64
+	RepSpin      uint64
+}
+
+// udpService returns the request port of a flow, if any.
+func (d *MetroSniffer) udpService(sport, dport layers.UDPPort) layers.UDPPort {
+	if d.config.UDP == nil {
+		return 0
+	}
+	for _, p := range d.config.UDP.RequestPorts {
+		if int(dport) == p {
+			return dport
+		} else if int(sport) == p {
+			return sport
+		}
+	}
+	return 0
+}
+
+// handleUDP accounts a decoded UDP datagram to its flow.
+func (d *MetroSniffer) handleUDP(srcIP, dstIP net.IP, meta *packetMeta) {
+	udp := &d.decoder.udp
+	ourIP := d.isLocal(srcIP, layers.TCPPort(udp.SrcPort), layers.TCPPort(udp.DstPort))
+	if meta.Tunnel != "" {
+		ourIP = udp.SrcPort > udp.DstPort
+	}
+	src, dst := net.JoinHostPort(srcIP.String(), strconv.Itoa(int(udp.SrcPort))), net.JoinHostPort(dstIP.String(), strconv.Itoa(int(udp.DstPort)))
+	if !ourIP {
+		src, dst = dst, src
+	}
+	flowkey := src + "-" + dst
+	if meta.Tunnel != "" {
+		flowkey = meta.Tunnel + "/" + flowkey
+	}
+
+	size := uint64(len(udp.Payload))
+	if udp.Length >= 8 {
+		// the payload may have been cut short by the snaplen.
+		size = uint64(udp.Length) - 8
+	}
+
+	d.flows.Lock()
+	defer d.flows.Unlock()
+	flow, ok := d.flows.UDP[flowkey]
+	if !ok {
+		remote := srcIP
+		if ourIP {
+			remote = dstIP
+		}
+		external := d.policies.external(remote)
+		if !d.policies.sampled(flowkey, external) {
+			return
+		}
+		flow = &UDPAccounting{Src: srcIP, Dst: dstIP, Sport: udp.SrcPort, Dport: udp.DstPort}
+		if !ourIP {
+			flow.Src, flow.Dst, flow.Sport, flow.Dport = dstIP, srcIP, udp.DstPort, udp.SrcPort
+		}
+		flow.Service = d.udpService(udp.SrcPort, udp.DstPort)
+		flow.QUIC = d.quicPort(udp.SrcPort, udp.DstPort)
+		flow.External = external
+		flow.Tunnel = meta.Tunnel
+		d.flows.UDP[flowkey] = flow
+	}
+
+	flow.Packets++
+	flow.Bytes += size
+	flow.LastSeen = meta.ci.Timestamp.UnixNano()
+	if flow.QUIC && ourIP && len(udp.Payload) > 0 {
+		flow.spin(udp.Payload[0], flow.LastSeen, d.Soften)
+	}
+	if flow.Service != 0 {
+		// symmetric ports (NTP) - we're the one asking.
+		if udp.DstPort == flow.Service && (udp.SrcPort != flow.Service || ourIP) {
+			flow.Requests++
+		} else {
+			flow.Responses++
+		}
+	}
+}
+
+// unneededPayload tells whether decoding only stopped at a payload we don't
+// decode as a layer: of TCP segments (eg. TLS, on port 443) and UDP datagrams
+// (eg. DNS), of ICMPv6 messages other than echoes.
+func unneededPayload(err error, decoded []gopacket.LayerType) bool {
+	if _, ok := err.(gopacket.UnsupportedLayerType); !ok || len(decoded) == 0 {
+		return false
+	}
+	last := decoded[len(decoded)-1]
+	return last == layers.LayerTypeTCP || last == layers.LayerTypeUDP || last == layers.LayerTypeICMPv6
+}
+
+// reportUDP submits the per second packet and byte rates of UDP flows active
+// over the interval, and the ratio of requests left unanswered, then forgets
+// the idle ones.
+func (r *Client) reportUDP(now int64) {
+	secs := float64(now - r.lastReport)
+	if r.lastReport == 0 || secs <= 0 {
+		secs = float64(r.sleep)
+	}
+
+	r.flows.Lock()
+	defer r.flows.Unlock()
+	for k, flow := range r.flows.UDP {
+		packets := flow.Packets - flow.RepPackets
+		if packets > 0 && r.policies.reported(flow.External) {
+			ts := flow.LastSeen / int64(time.Second)
+			tags := []string{"src:" + r.hostname(flow.Src), "dst:" + r.hostname(flow.Dst)}
+			if flow.Service != 0 {
+				tags = append(tags, "service_port:"+strconv.Itoa(int(flow.Service)))
+			}
+			if flow.Tunnel != "" {
+				tags = append(tags, flow.Tunnel)
+			}
+			tags = append(tags, r.tags...)
+
+			r.submit(k, udpMetricPrefix+"packets", float64(packets)/secs, tags, false, ts)
+			r.submit(k, udpMetricPrefix+"bytes", float64(flow.Bytes-flow.RepBytes)/secs, tags, false, ts)
+			if requests := flow.Requests - flow.RepRequests; requests > 0 {
+				// late responses may answer requests of the previous interval.
+				unanswered := 1 - float64(flow.Responses-flow.RepResponses)/float64(requests)
+				if unanswered < 0 {
+					unanswered = 0
+				}
+				r.submit(k, udpMetricPrefix+"unanswered", unanswered, tags, false, ts)
+			}
+			if flow.SpinSampled > flow.RepSpin {
+				r.submit(k, quicMetricPrefix+"rtt.avg", nsToMs(flow.SpinSRTT), tags, false, ts)
+				r.submit(k, quicMetricPrefix+"rtt", nsToMs(flow.SpinLast), tags, false, ts)
+			}
+		}
+		flow.RepPackets, flow.RepBytes = flow.Packets, flow.Bytes
+		flow.RepRequests, flow.RepResponses = flow.Requests, flow.Responses
+		flow.RepSpin = flow.SpinSampled
+
+		if packets == 0 && time.Duration(now*int64(time.Second)-flow.LastSeen) > r.idleTTL {
+			delete(r.flows.UDP, k)
+			log.Infof("UDP flow expired: [%s]", k)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ethernetTypeQinQLegacy is the pre-802.1ad EtherType some switches still
+// use for outer (service) tags.
+const ethernetTypeQinQLegacy layers.EthernetType = 0x9100
+
+var errVLANTooShort = errors.New("VLAN tag too short.")
+
+func init() {
+	// gopacket only knows 802.1Q and 802.1ad tags, decode the legacy QinQ type
+	// alike.
+	layers.EthernetTypeMetadata[ethernetTypeQinQLegacy] = layers.EthernetTypeMetadata[layers.EthernetTypeQinQ]
+}
+
+func isVLANType(t layers.EthernetType) bool {
+	return t == layers.EthernetTypeDot1Q || t == layers.EthernetTypeQinQ || t == ethernetTypeQinQLegacy
+}
+
+// vlanStack decodes any number of stacked VLAN tags (QinQ, provider
+// bridging...) as a single layer, keeping their IDs - outermost first.
+type vlanStack struct {
+	layers.BaseLayer
+	IDs  []uint16
+	next layers.EthernetType
+}
+
+func (v *vlanStack) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeDot1Q
+}
+
+func (v *vlanStack) NextLayerType() gopacket.LayerType {
+	return v.next.LayerType()
+}
+
+func (v *vlanStack) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	v.IDs = v.IDs[:0]
+	off := 0
+	for {
+		if len(data) < off+4 {
+			df.SetTruncated()
+			return errVLANTooShort
+		}
+		v.IDs = append(v.IDs, binary.BigEndian.Uint16(data[off:off+2])&0x0fff)
+		v.next = layers.EthernetType(binary.BigEndian.Uint16(data[off+2 : off+4]))
+		off += 4
+		if !isVLANType(v.next) {
+			break
+		}
+	}
+	v.BaseLayer = layers.BaseLayer{Contents: data[:off], Payload: data[off:]}
+	return nil
+}
+
+// vlanTags returns the tags for a flow's VLANs: the innermost (customer) VLAN,
+// and the outermost (service) one if stacked.
+func vlanTags(ids []uint16) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	tags := []string{"vlan:" + strconv.Itoa(int(ids[len(ids)-1]))}
+	if len(ids) > 1 {
+		tags = append(tags, "outer_vlan:"+strconv.Itoa(int(ids[0])))
+	}
+	return tags
+}
@@ -0,0 +1,109 @@
+package main
+
+import "github.com/google/gopacket/layers"
+
+// rwnd follows the receive window one end of a flow advertises: how
+// often it closes it (zero window, its application isn't draining the socket
+// buffer), and how often the other end's data fills it (window-full stalls).
+type rwnd struct {
+	syn    bool   // the end's SYN was seen...
+	shift  uint8  // ...with this window scale...
+	scales bool   // ...if it had the option
+	known  bool   // edge is valid, the window scale being known
+	edge   uint32 // right edge: acknowledged + window
+	closed bool   // advertising a zero window
+	filled bool   // edge reached, until it moves
+	Zero   uint64 // zero window advertisements, counted as the window closes
+	Full   uint64 // times the other end's data reached the edge
+}
+
+// synWScale returns the window scale option of a SYN.
+func synWScale(tcp *layers.TCP) (uint8, bool) {
+	o := parseTCPOptions(tcp)
+	return o.WScale, o.HasWScale
+}
+
+// advertise accounts for a window advertisement. The window is scaled as
+// negotiated by the handshake, with peer the other end's window: scaling is
+// on if both SYNs carried the option. Without the handshake only zero windows
+// are told apart.
+func (w *rwnd) advertise(ack uint32, window uint16, peer *rwnd) {
+	if window == 0 {
+		if !w.closed {
+			w.Zero++
+		}
+		w.closed = true
+	} else {
+		w.closed = false
+	}
+	if !w.syn || !peer.syn {
+		return
+	}
+	edge := ack + uint32(window)
+	if w.scales && peer.scales {
+		edge = ack + uint32(window)<<w.shift
+	}
+	if !w.known || edge != w.edge {
+		w.filled = false
+	}
+	w.known, w.edge = true, edge
+}
+
+// sent accounts for the other end's data up to end: a stall if it reaches
+// the edge of an open window. Zero window probes don't count.
+func (w *rwnd) sent(end uint32) {
+	if !w.known || w.closed || w.filled || int32(end-w.edge) < 0 {
+		return
+	}
+	w.Full++
+	w.filled = true
+}
+
+// trackWindow accounts for the windows advertised and the data sent into
+// them by a segment, from Src or Dst. Call holding the flow lock.
+func (t *TCPAccounting) trackWindow(fromSrc bool, tcp *layers.TCP, payload uint32) {
+	own, into := &t.RcvdWnd, &t.Wnd
+	if !fromSrc {
+		own, into = &t.Wnd, &t.RcvdWnd
+	}
+	if tcp.RST {
+		return
+	}
+	if tcp.SYN {
+		own.syn = true
+		own.shift, own.scales = synWScale(tcp)
+		if tcp.ACK && into.syn {
+			// SYN windows are never scaled.
+			own.known, own.edge, own.filled = true, tcp.Ack+uint32(tcp.Window), false
+		}
+		return
+	}
+	if tcp.ACK {
+		own.advertise(tcp.Ack, tcp.Window, into)
+	}
+	if payload > 0 {
+		into.sent(tcp.Seq + payload)
+	}
+}
+
+// reportWindows submits the zero window advertisements and window-full stalls
+// of the interval, tagged direction:sent for the data Src sends (into Dst's
+// window) and direction:received for Dst's (into ours). Call holding the
+// flow lock.
+func (r *Client) reportWindows(k string, flow *TCPAccounting, tags []string, ts int64) {
+	for _, dir := range []struct {
+		tag      string
+		cur, rep rwnd
+	}{
+		{"direction:sent", flow.Wnd, flow.RepWnd},
+		{"direction:received", flow.RcvdWnd, flow.RepRcvdWnd},
+	} {
+		zero, full := dir.cur.Zero-dir.rep.Zero, dir.cur.Full-dir.rep.Full
+		if zero == 0 && full == 0 {
+			continue
+		}
+		dtags := append(append([]string(nil), tags...), dir.tag)
+		r.submit(k, metricPrefix+"zero_window", float64(zero), dtags, false, ts)
+		r.submit(k, metricPrefix+"window_full", float64(full), dtags, false, ts)
+	}
+}